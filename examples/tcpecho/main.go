@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+const ECHO_PORT = 7
+
+var (
+	serverAddr = netip.MustParseAddr("10.0.0.2")
+	clientAddr = netip.MustParseAddr("10.0.0.1")
+)
+
+// TCPのエコーサーバー（RFC 862）
+// 既定ではNewPipePairでつないだ2つのStackの間でサーバーとクライアントを動かし、
+// 送ったデータがそのまま返ってくることを確かめる。権限やTUNデバイスは不要
+// -tun を付けると tun0 の先にいる10.0.0.2としてサーバーだけを動かす
+// （make tuntap の後、nc 10.0.0.2 7 などで接続する）
+func main() {
+	tun := flag.Bool("tun", false, "serve on tun0 as 10.0.0.2")
+	flag.Parse()
+
+	if *tun {
+		dev, err := network.NewTun(network.WithLogger(network.NewStdLogger(nil)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		dev.Bind()
+		stack, err := network.NewStack(dev, serverAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l, err := stack.ListenTCP(ECHO_PORT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Fatal(serve(l))
+	}
+
+	if err := runPipe(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+// 接続してきたコネクションごとに、受け取ったデータをそのまま送り返す
+func serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// パイプでつないだStackの間でエコーを確かめる
+func runPipe() error {
+	a, b := network.NewPipePair()
+	a.Bind()
+	b.Bind()
+
+	// Stackを閉じるとデバイスも閉じる
+	server, err := network.NewStack(b, serverAddr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	client, err := network.NewStack(a, clientAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	l, err := server.ListenTCP(ECHO_PORT)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go serve(l)
+
+	conn, err := client.DialTCPTimeout(netip.AddrPortFrom(serverAddr, ECHO_PORT), 3*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// 複数のセグメントに分かれる大きさのデータを送る
+	data := bytes.Repeat([]byte("hello, tcp-ip-go! "), 4096)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return fmt.Errorf("read error: %s", err.Error())
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("echo mismatch: sent %d bytes", len(data))
+	}
+	fmt.Printf("echoed %d bytes from %s\n", len(got), conn.RemoteAddr())
+	return nil
+}
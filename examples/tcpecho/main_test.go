@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// パイプでつないだStackの間で、送ったデータがそのまま返ってくること
+func TestEcho(t *testing.T) {
+	a, b := network.NewPipePair()
+	a.Bind()
+	b.Bind()
+	server, err := network.NewStack(b, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := network.NewStack(a, clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	l, err := server.ListenTCP(ECHO_PORT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l)
+
+	conn, err := client.DialTCPTimeout(netip.AddrPortFrom(serverAddr, ECHO_PORT), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	for _, data := range [][]byte{[]byte("ping"), bytes.Repeat([]byte("0123456789"), 1000)} {
+		go conn.Write(data)
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("echo mismatch: sent %d bytes", len(data))
+		}
+	}
+}
+
+// mainの既定の動作が成功すること
+func TestRunPipe(t *testing.T) {
+	if err := runPipe(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+const ECHO_PORT = 7
+
+var (
+	serverAddr = netip.MustParseAddr("10.0.0.2")
+	clientAddr = netip.MustParseAddr("10.0.0.1")
+)
+
+// UDPのエコーサーバー（RFC 862）
+// 既定ではNewPipePairでつないだ2つのStackの間でサーバーとクライアントを動かし、
+// 送ったデータグラムがそのまま返ってくることを確かめる。権限やTUNデバイスは不要
+// -tun を付けると tun0 の先にいる10.0.0.2としてサーバーだけを動かす
+// （make tuntap の後、nc -u 10.0.0.2 7 などで送る）
+func main() {
+	tun := flag.Bool("tun", false, "serve on tun0 as 10.0.0.2")
+	flag.Parse()
+
+	if *tun {
+		dev, err := network.NewTun(network.WithLogger(network.NewStdLogger(nil)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		dev.Bind()
+		stack, err := network.NewStack(dev, serverAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn, err := stack.ListenUDP(ECHO_PORT)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Fatal(serve(conn))
+	}
+
+	if err := runPipe(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+// 受け取ったデータグラムを送信元に送り返す
+func serve(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.WriteTo(buf[:n], from); err != nil {
+			return err
+		}
+	}
+}
+
+// パイプでつないだStackの間でエコーを確かめる
+func runPipe() error {
+	a, b := network.NewPipePair()
+	a.Bind()
+	b.Bind()
+
+	// Stackを閉じるとデバイスも閉じる
+	server, err := network.NewStack(b, serverAddr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	client, err := network.NewStack(a, clientAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sconn, err := server.ListenUDP(ECHO_PORT)
+	if err != nil {
+		return err
+	}
+	defer sconn.Close()
+	go serve(sconn)
+
+	conn, err := client.ListenUDP(0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: net.IP(serverAddr.AsSlice()), Port: ECHO_PORT}
+	buf := make([]byte, 65535)
+	// MTUを超えてフラグメントに分かれるデータグラムも含める
+	for _, size := range []int{1, 512, 1472, 4000} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		if _, err := conn.WriteTo(data, dst); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("read error: %s", err.Error())
+		}
+		if !bytes.Equal(buf[:n], data) {
+			return fmt.Errorf("echo mismatch: sent %d bytes, received %d bytes", size, n)
+		}
+		fmt.Printf("echoed %d bytes from %s\n", n, from)
+	}
+	return nil
+}
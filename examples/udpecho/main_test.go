@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// パイプでつないだStackの間で、送ったデータグラムがそのまま送信元に返ってくること
+func TestEcho(t *testing.T) {
+	a, b := network.NewPipePair()
+	a.Bind()
+	b.Bind()
+	server, err := network.NewStack(b, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := network.NewStack(a, clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sconn, err := server.ListenUDP(ECHO_PORT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	go serve(sconn)
+
+	conn, err := client.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: net.IP(serverAddr.AsSlice()), Port: ECHO_PORT}
+	buf := make([]byte, 65535)
+	data := []byte("hello, udp echo")
+	if _, err := conn.WriteTo(data, dst); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatalf("echo %q, want %q", buf[:n], data)
+	}
+	if from.String() != dst.String() {
+		t.Fatalf("echo from %s, want %s", from, dst)
+	}
+}
+
+// mainの既定の動作が成功すること
+func TestRunPipe(t *testing.T) {
+	if err := runPipe(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスやMACアドレスの表現
+	"sync"            // 排他制御
+)
+
+const (
+	ARP_PACKET_LEN  = 28
+	ARP_HTYPE_ETHER = 1
+	ARP_OP_REQUEST  = 1
+	ARP_OP_REPLY    = 2
+)
+
+// EthernetとIPv4のARPパケット
+type ARPPacket struct {
+	HardwareType uint16
+	ProtocolType uint16
+	HardwareLen  uint8
+	ProtocolLen  uint8
+	Op           uint16
+	SenderHW     net.HardwareAddr
+	SenderIP     net.IP
+	TargetHW     net.HardwareAddr
+	TargetIP     net.IP
+}
+
+// ARPパケットを解析する（Ethernetヘッダは含まない）
+func ParseARP(b []byte) (*ARPPacket, error) {
+	if len(b) < ARP_PACKET_LEN {
+		return nil, fmt.Errorf("invalid arp packet: too short (%d bytes)", len(b))
+	}
+	p := &ARPPacket{
+		HardwareType: binary.BigEndian.Uint16(b[0:2]),
+		ProtocolType: binary.BigEndian.Uint16(b[2:4]),
+		HardwareLen:  b[4],
+		ProtocolLen:  b[5],
+		Op:           binary.BigEndian.Uint16(b[6:8]),
+	}
+	if p.HardwareType != ARP_HTYPE_ETHER || p.ProtocolType != ETHERTYPE_IPV4 || p.HardwareLen != 6 || p.ProtocolLen != 4 {
+		return nil, fmt.Errorf("invalid arp packet: unsupported htype %d ptype 0x%04x", p.HardwareType, p.ProtocolType)
+	}
+	p.SenderHW = net.HardwareAddr(b[8:14])
+	p.SenderIP = net.IP(b[14:18])
+	p.TargetHW = net.HardwareAddr(b[18:24])
+	p.TargetIP = net.IP(b[24:28])
+	return p, nil
+}
+
+// ARPパケットをバイト列に変換する
+func (p *ARPPacket) Marshal() ([]byte, error) {
+	if len(p.SenderHW) != 6 || len(p.TargetHW) != 6 || p.SenderIP.To4() == nil || p.TargetIP.To4() == nil {
+		return nil, fmt.Errorf("invalid arp packet: sender %s/%s, target %s/%s", p.SenderHW, p.SenderIP, p.TargetHW, p.TargetIP)
+	}
+	b := make([]byte, ARP_PACKET_LEN)
+	binary.BigEndian.PutUint16(b[0:2], ARP_HTYPE_ETHER)
+	binary.BigEndian.PutUint16(b[2:4], ETHERTYPE_IPV4)
+	b[4] = 6
+	b[5] = 4
+	binary.BigEndian.PutUint16(b[6:8], p.Op)
+	copy(b[8:14], p.SenderHW)
+	copy(b[14:18], p.SenderIP.To4())
+	copy(b[18:24], p.TargetHW)
+	copy(b[24:28], p.TargetIP.To4())
+	return b, nil
+}
+
+// ARP要求に対する応答のEthernetフレームを作成する
+func BuildARPReply(req *ARPPacket, mac net.HardwareAddr) (Packet, error) {
+	if req.Op != ARP_OP_REQUEST {
+		return Packet{}, fmt.Errorf("not an arp request: op %d", req.Op)
+	}
+	reply := ARPPacket{
+		Op:       ARP_OP_REPLY,
+		SenderHW: mac,
+		SenderIP: req.TargetIP,
+		TargetHW: req.SenderHW,
+		TargetIP: req.SenderIP,
+	}
+	payload, err := reply.Marshal()
+	if err != nil {
+		return Packet{}, err
+	}
+	eth := EthernetHeader{Dst: req.SenderHW, Src: mac, EtherType: ETHERTYPE_ARP}
+	b, err := eth.MarshalWithPayload(payload)
+	if err != nil {
+		return Packet{}, err
+	}
+	return bytesPacket(b), nil
+}
+
+// 自身のIPアドレスに対するARP要求に応答する（TAPモード用）
+type ARPResponder struct {
+	mu  sync.RWMutex
+	ip  net.IP
+	mac net.HardwareAddr
+}
+
+// ipに対する要求にmacで応答するARPResponderを作成する
+func NewARPResponder(ip net.IP, mac net.HardwareAddr) *ARPResponder {
+	return &ARPResponder{ip: ip.To4(), mac: mac}
+}
+
+// TAPデバイスのMACアドレスで、ipに対する要求に応答するARPResponderを作成する
+// デバイスのSetHardwareAddrでアドレスを変えると、応答に使うアドレスも変わる
+func (t *NetDevice) NewARPResponder(ip net.IP) (*ARPResponder, error) {
+	mac, err := t.HardwareAddr()
+	if err != nil {
+		return nil, err
+	}
+	r := NewARPResponder(ip, mac)
+	t.arpMu.Lock()
+	defer t.arpMu.Unlock()
+	t.arpResponders = append(t.arpResponders, r)
+	return r, nil
+}
+
+func (t *NetDevice) updateARPResponders(mac net.HardwareAddr) {
+	t.arpMu.Lock()
+	defer t.arpMu.Unlock()
+	for _, r := range t.arpResponders {
+		r.SetHardwareAddr(append(net.HardwareAddr(nil), mac...))
+	}
+}
+
+// 応答に使うMACアドレスを設定する
+func (r *ARPResponder) SetHardwareAddr(mac net.HardwareAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mac = mac
+}
+
+// 応答に使うMACアドレスを返す
+func (r *ARPResponder) HardwareAddr() net.HardwareAddr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mac
+}
+
+// Ethernetフレームを処理し、自身宛てのARP要求であれば応答を返す
+// 他のIPアドレスへの要求やARP以外のフレームではfalseを返す
+func (r *ARPResponder) Handle(frame []byte) (Packet, bool) {
+	eth, payload, err := ParseEthernet(frame)
+	if err != nil || eth.EtherType != ETHERTYPE_ARP {
+		return Packet{}, false
+	}
+	req, err := ParseARP(payload)
+	if err != nil || req.Op != ARP_OP_REQUEST || !req.TargetIP.Equal(r.ip) {
+		return Packet{}, false
+	}
+	reply, err := BuildARPReply(req, r.HardwareAddr())
+	if err != nil {
+		return Packet{}, false
+	}
+	return reply, true
+}
+
+// ARP要求のEthernetフレームを作成する（ブロードキャスト宛て）
+func BuildARPRequest(srcIP net.IP, srcMAC net.HardwareAddr, target net.IP) (Packet, error) {
+	req := ARPPacket{
+		Op:       ARP_OP_REQUEST,
+		SenderHW: srcMAC,
+		SenderIP: srcIP,
+		TargetHW: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		TargetIP: target,
+	}
+	payload, err := req.Marshal()
+	if err != nil {
+		return Packet{}, err
+	}
+	eth := EthernetHeader{Dst: BroadcastHardwareAddr, Src: srcMAC, EtherType: ETHERTYPE_ARP}
+	b, err := eth.MarshalWithPayload(payload)
+	if err != nil {
+		return Packet{}, err
+	}
+	return bytesPacket(b), nil
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"fmt"  // 文字列の生成や出力、スキャン
+	"net"  // IPアドレスやMACアドレスの表現
+	"os"   // タイムアウトのエラー
+	"sync" // 排他制御
+	"time" // 有効期限の管理
+)
+
+const (
+	ARP_CACHE_TTL             = 5 * time.Minute
+	ARP_CACHE_EXPIRE_INTERVAL = 10 * time.Second
+)
+
+type arpEntry struct {
+	mac     net.HardwareAddr
+	expires time.Time
+}
+
+// IPアドレスからMACアドレスへの対応を保持するキャッシュ
+// 期限切れのエントリはバックグラウンドで削除される
+type ARPCache struct {
+	mu      sync.RWMutex
+	entries map[[4]byte]arpEntry
+	waiters map[[4]byte][]chan net.HardwareAddr
+	// キャッシュに無いアドレスを解決する際にARP要求を送信する
+	request func(ip net.IP) error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// ARPCacheを作成する
+// requestはResolveでキャッシュに無い場合に呼ばれ、ARP要求をデバイスに書き込む
+func NewARPCache(request func(ip net.IP) error) *ARPCache {
+	c := &ARPCache{
+		entries: make(map[[4]byte]arpEntry),
+		waiters: make(map[[4]byte][]chan net.HardwareAddr),
+		request: request,
+		done:    make(chan struct{}),
+	}
+	go c.expireLoop(ARP_CACHE_EXPIRE_INTERVAL)
+	return c
+}
+
+func arpKey(ip net.IP) ([4]byte, bool) {
+	var k [4]byte
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return k, false
+	}
+	copy(k[:], ip4)
+	return k, true
+}
+
+// キャッシュからMACアドレスを探す
+// マルチキャストのアドレスはキャッシュを使わず、対応するMACアドレスを返す
+func (c *ARPCache) Lookup(ip net.IP) (net.HardwareAddr, bool) {
+	k, ok := arpKey(ip)
+	if !ok {
+		return nil, false
+	}
+	if mac, err := MulticastHardwareAddr(ip); err == nil {
+		return mac, true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.entries[k]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.mac, true
+}
+
+// 対応を追加し、解決を待っているResolveに通知する
+// ttlが0以下の場合はARP_CACHE_TTLを使う
+func (c *ARPCache) Add(ip net.IP, mac net.HardwareAddr, ttl time.Duration) {
+	k, ok := arpKey(ip)
+	if !ok {
+		return
+	}
+	if ttl <= 0 {
+		ttl = ARP_CACHE_TTL
+	}
+	mac = append(net.HardwareAddr(nil), mac...)
+
+	c.mu.Lock()
+	c.entries[k] = arpEntry{mac: mac, expires: time.Now().Add(ttl)}
+	waiters := c.waiters[k]
+	delete(c.waiters, k)
+	c.mu.Unlock()
+
+	for _, w := range waiters {
+		w <- mac
+	}
+}
+
+// ARPフレームを処理し、送信元の対応をキャッシュに登録する
+func (c *ARPCache) Handle(frame []byte) {
+	eth, payload, err := ParseEthernet(frame)
+	if err != nil || eth.EtherType != ETHERTYPE_ARP {
+		return
+	}
+	p, err := ParseARP(payload)
+	if err != nil {
+		return
+	}
+	c.Add(p.SenderIP, p.SenderHW, 0)
+}
+
+// MACアドレスを解決する
+// キャッシュに無い場合はARP要求を送信し、timeoutまで応答を待つ
+func (c *ARPCache) Resolve(ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	if mac, ok := c.Lookup(ip); ok {
+		return mac, nil
+	}
+	k, ok := arpKey(ip)
+	if !ok {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", ip)
+	}
+
+	w := make(chan net.HardwareAddr, 1)
+	c.mu.Lock()
+	c.waiters[k] = append(c.waiters[k], w)
+	c.mu.Unlock()
+	defer c.removeWaiter(k, w)
+
+	if c.request != nil {
+		if err := c.request(ip); err != nil {
+			return nil, err
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case mac := <-w:
+		return mac, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("arp resolve %s: %w", ip, os.ErrDeadlineExceeded)
+	case <-c.done:
+		return nil, fmt.Errorf("arp cache closed")
+	}
+}
+
+func (c *ARPCache) removeWaiter(k [4]byte, w chan net.HardwareAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ws := c.waiters[k]
+	for i := range ws {
+		if ws[i] == w {
+			c.waiters[k] = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[k]) == 0 {
+		delete(c.waiters, k)
+	}
+}
+
+// 期限切れのエントリを削除する
+func (c *ARPCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *ARPCache) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+	}
+}
+
+// バックグラウンドの削除を停止する
+func (c *ARPCache) Close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
@@ -0,0 +1,115 @@
+package network
+
+import (
+	"bytes"  // MACアドレスの比較
+	"errors" // エラーの判定
+	"net"    // IPアドレスやMACアドレスの表現
+	"os"     // タイムアウトのエラー
+	"testing"
+	"time" // 有効期限
+)
+
+// 追加した対応が見つかり、他のアドレスは見つからないこと
+func TestARPCacheLookup(t *testing.T) {
+	c := NewARPCache(nil)
+	defer c.Close()
+	c.Add(net.IPv4(10, 0, 0, 1), arpPeerMAC, 0)
+	mac, ok := c.Lookup(net.IPv4(10, 0, 0, 1))
+	if !ok || !bytes.Equal(mac, arpPeerMAC) {
+		t.Fatalf("lookup %s %v, want %s", mac, ok, arpPeerMAC)
+	}
+	if _, ok := c.Lookup(net.IPv4(10, 0, 0, 2)); ok {
+		t.Fatal("found an address never added")
+	}
+	// マルチキャストはキャッシュを使わない
+	mac, ok = c.Lookup(net.IPv4(224, 0, 0, 251))
+	if want, _ := MulticastHardwareAddr(net.IPv4(224, 0, 0, 251)); !ok || !bytes.Equal(mac, want) {
+		t.Fatalf("multicast lookup %s %v, want %s", mac, ok, want)
+	}
+}
+
+// キャッシュに無いアドレスはARP要求を送り、応答のフレームで解決すること
+func TestARPCacheResolve(t *testing.T) {
+	responder := NewARPResponder(net.IPv4(10, 0, 0, 1), arpPeerMAC)
+	var c *ARPCache
+	requests := 0
+	c = NewARPCache(func(ip net.IP) error {
+		requests++
+		req, err := BuildARPRequest(net.IPv4(10, 0, 0, 2), arpLocalMAC, ip)
+		if err != nil {
+			return err
+		}
+		// 応答するホストがいなければ何も届かない
+		reply, ok := responder.Handle(req.Buf[:req.Len()])
+		if !ok {
+			return nil
+		}
+		// 応答は別のゴルーチンで届く
+		go c.Handle(reply.Buf[:reply.Len()])
+		return nil
+	})
+	defer c.Close()
+
+	mac, err := c.Resolve(net.IPv4(10, 0, 0, 1), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mac, arpPeerMAC) {
+		t.Fatalf("resolved %s, want %s", mac, arpPeerMAC)
+	}
+	// 2回目はキャッシュから返す
+	if _, err := c.Resolve(net.IPv4(10, 0, 0, 1), time.Second); err != nil || requests != 1 {
+		t.Fatalf("second resolve: %v, %d requests", err, requests)
+	}
+
+	// 応答が無ければタイムアウトする
+	start := time.Now()
+	if _, err := c.Resolve(net.IPv4(10, 0, 0, 9), 50*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("returned after %s", d)
+	}
+}
+
+// Closeすると解決を待っているResolveが戻ること
+func TestARPCacheResolveClose(t *testing.T) {
+	c := NewARPCache(nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Resolve(net.IPv4(10, 0, 0, 1), time.Minute)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("resolved after close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("resolve blocked after close")
+	}
+}
+
+// 期限の切れた対応は見つからず、削除で取り除かれること
+func TestARPCacheExpiry(t *testing.T) {
+	c := NewARPCache(nil)
+	defer c.Close()
+	c.Add(net.IPv4(10, 0, 0, 1), arpPeerMAC, 20*time.Millisecond)
+	c.Add(net.IPv4(10, 0, 0, 2), arpLocalMAC, time.Minute)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Lookup(net.IPv4(10, 0, 0, 1)); ok {
+		t.Fatal("expired entry found")
+	}
+	if _, ok := c.Lookup(net.IPv4(10, 0, 0, 2)); !ok {
+		t.Fatal("live entry missing")
+	}
+	c.expire(time.Now())
+	c.mu.RLock()
+	n := len(c.entries)
+	c.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("%d entries after expire, want 1", n)
+	}
+}
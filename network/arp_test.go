@@ -0,0 +1,106 @@
+package network
+
+import (
+	"bytes"        // バイト列の比較
+	"encoding/hex" // 取得したフレームの読み込み
+	"net"          // IPアドレスやMACアドレスの表現
+	"testing"
+)
+
+var (
+	arpLocalMAC = net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}
+	arpPeerMAC  = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+)
+
+// 10.0.0.1（52:54:00:12:34:56）から10.0.0.2へのwho-hasのフレーム
+const arpRequestFrame = "ffffffffffff525400123456" + "0806" +
+	"0001" + "0800" + "06" + "04" + "0001" +
+	"525400123456" + "0a000001" +
+	"000000000000" + "0a000002"
+
+func arpFrame(t *testing.T) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(arpRequestFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 自身のIPアドレスへのARP要求に、設定したMACアドレスで応答すること
+func TestARPResponderReply(t *testing.T) {
+	r := NewARPResponder(net.IPv4(10, 0, 0, 2), arpLocalMAC)
+	reply, ok := r.Handle(arpFrame(t))
+	if !ok {
+		t.Fatal("no reply to who-has")
+	}
+	eth, payload, err := ParseEthernet(reply.Buf[:reply.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(eth.Dst, arpPeerMAC) || !bytes.Equal(eth.Src, arpLocalMAC) || eth.EtherType != ETHERTYPE_ARP {
+		t.Fatalf("ethernet %s -> %s type 0x%04x", eth.Src, eth.Dst, eth.EtherType)
+	}
+	p, err := ParseARP(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Op != ARP_OP_REPLY {
+		t.Fatalf("op %d, want reply", p.Op)
+	}
+	if !bytes.Equal(p.SenderHW, arpLocalMAC) || !p.SenderIP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("sender %s/%s", p.SenderHW, p.SenderIP)
+	}
+	if !bytes.Equal(p.TargetHW, arpPeerMAC) || !p.TargetIP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("target %s/%s", p.TargetHW, p.TargetIP)
+	}
+
+	// MACアドレスを変えると応答も変わる
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	r.SetHardwareAddr(mac)
+	reply, ok = r.Handle(arpFrame(t))
+	if !ok {
+		t.Fatal("no reply after SetHardwareAddr")
+	}
+	_, payload, err = ParseEthernet(reply.Buf[:reply.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ParseARP(payload); err != nil || !bytes.Equal(p.SenderHW, mac) {
+		t.Fatalf("reply sender %v (%v), want %s", p, err, mac)
+	}
+}
+
+// 他のIPアドレスへの要求や、応答、ARP以外のフレームには応答しないこと
+func TestARPResponderIgnores(t *testing.T) {
+	r := NewARPResponder(net.IPv4(10, 0, 0, 3), arpLocalMAC)
+	if _, ok := r.Handle(arpFrame(t)); ok {
+		t.Fatal("replied to a request for another ip")
+	}
+
+	r = NewARPResponder(net.IPv4(10, 0, 0, 2), arpLocalMAC)
+	b := arpFrame(t)
+	b[ETHERNET_HEADER_LEN+7] = ARP_OP_REPLY
+	if _, ok := r.Handle(b); ok {
+		t.Fatal("replied to an arp reply")
+	}
+	b = arpFrame(t)
+	b[12], b[13] = 0x08, 0x00
+	if _, ok := r.Handle(b); ok {
+		t.Fatal("replied to an ipv4 frame")
+	}
+	if _, ok := r.Handle(arpFrame(t)[:ETHERNET_HEADER_LEN+ARP_PACKET_LEN-1]); ok {
+		t.Fatal("replied to a truncated request")
+	}
+}
+
+// BuildARPRequestのフレームが取得したフレームと一致すること
+func TestBuildARPRequest(t *testing.T) {
+	req, err := BuildARPRequest(net.IPv4(10, 0, 0, 1), arpPeerMAC, net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Buf[:req.Len()]; !bytes.Equal(got, arpFrame(t)) {
+		t.Fatalf("request\n got %x\nwant %x", got, arpFrame(t))
+	}
+}
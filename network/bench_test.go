@@ -0,0 +1,138 @@
+package network
+
+import (
+	"fmt"     // サブベンチマークの名前
+	"net"     // IPアドレスの表現
+	"testing" // ベンチマーク
+	"time"    // 経過時間
+)
+
+// src:srcPortから10.0.0.1:53へのpayloadバイトのUDPパケットを組み立てる
+func udpPacket(tb testing.TB, srcPort uint16, payload int) []byte {
+	tb.Helper()
+	src, dst := net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 1).To4()
+	udp := UDPHeader{SrcPort: srcPort, DstPort: 53}
+	seg, err := udp.MarshalWithPayload(make([]byte, payload), src, dst)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_UDP, Src: src, Dst: dst}
+	b, err := ip.MarshalWithPayload(seg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// 1秒あたりのパケット数を報告する
+func reportPPS(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "pkts/s")
+}
+
+// 読み込みのゴルーチンから受信キューを経てReadPacketで受け取るまで
+// Releaseで返却するとバッファを再利用し、読み込みのたびの割り当てが無くなる
+func BenchmarkReadLoop(b *testing.B) {
+	pkt := udpPacket(b, 1000, 64)
+	for _, tc := range []struct {
+		name    string
+		release bool
+	}{
+		{"Release", true},
+		{"NoRelease", false},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			dev, peer := NewPipePair()
+			defer peer.Close()
+			defer dev.Close()
+			dev.Bind()
+			// 対向のWriteはコピーを割り当てるため、パイプに直接渡して読み込み側の割り当てだけを数える
+			tx := peer.conn.(*pipeEnd).tx
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case tx <- pkt:
+					case <-done:
+						return
+					}
+				}
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				p, err := dev.ReadPacket()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if tc.release {
+					p.Release()
+				}
+			}
+			reportPPS(b, start)
+		})
+	}
+}
+
+// WritePacketで送信キューに入れてから、送信のゴルーチンが書き込むまで
+// 送信のゴルーチンはキューに溜まった分をまとめて書き込む。WriteBatchは1回の呼び出しでbatch個を入れる
+// パイプのWriteはパケットをコピーするため、1パケットあたり1回の割り当てはパイプによるもの
+func BenchmarkWritePackets(b *testing.B) {
+	pkt := udpPacket(b, 1000, 64)
+	for _, batch := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			dev, peer := NewPipePair()
+			defer peer.Close()
+			defer dev.Close()
+			dev.Bind()
+			rx := dev.conn.(*pipeEnd).tx
+			received := make(chan struct{})
+			go func() {
+				for i := 0; i < b.N; i++ {
+					<-rx
+				}
+				close(received)
+			}()
+			pkts := make([]Packet, batch)
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i += batch {
+				n := batch
+				if b.N-i < n {
+					n = b.N - i
+				}
+				for j := 0; j < n; j++ {
+					// プールのバッファは送信後にデバイスが返却する
+					ref := dev.buffers.get()
+					pkts[j] = Packet{Buf: ref.b[:copy(ref.b, pkt)], pool: dev.buffers, ref: ref, gen: ref.gen.Load()}
+					pkts[j].normalize()
+				}
+				if err := dev.WriteBatch(pkts[:n]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-received
+			reportPPS(b, start)
+		})
+	}
+}
+
+// PacketViewでIPv4とUDPのヘッダを解析し、各層の内容を取り出すまで。割り当ては起きない
+func BenchmarkPacketViewParse(b *testing.B) {
+	pkt := Packet{Buf: udpPacket(b, 1000, 64)}
+	pkt.normalize()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v, err := NewPacketView(pkt, ModeTUN)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if v.Protocol() != PROTOCOL_UDP || v.DstPort() != 53 || len(v.Payload()) != 64 {
+			b.Fatal("unexpected view")
+		}
+		v.Release()
+	}
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"bufio"           // 書き込みのバッファリング
+	"encoding/binary" // pcapのヘッダの書き込み
+	"errors"          // エラーの生成
+	"fmt"             // 文字列の生成や出力、スキャン
+	"io"              // 出力先
+	"sync"            // 排他制御
+	"time"            // タイムスタンプ
+)
+
+// pcapのファイル形式（https://www.tcpdump.org/manpages/pcap-savefile.5.html）
+const (
+	PCAP_MAGIC         = 0xa1b2c3d4 // マイクロ秒精度
+	PCAP_VERSION_MAJOR = 2
+	PCAP_VERSION_MINOR = 4
+	PCAP_HEADER_LEN    = 24
+	PCAP_RECORD_LEN    = 16
+
+	LINKTYPE_ETHERNET = 1
+	LINKTYPE_RAW      = 101
+
+	// 書き込みを待つパケットの上限。超えた分は記録しない
+	CAPTURE_QUEUE_SIZE = 1024
+)
+
+var ErrCaptureRunning = errors.New("capture already running")
+
+// キャプチャ中のパケット
+type captureRecord struct {
+	at   time.Time
+	data []byte
+	size int // 元のパケット長
+}
+
+// 送受信の経路から受け取ったパケットを別のゴルーチンでpcap形式に書き出す
+type pcapWriter struct {
+	mu      sync.Mutex
+	closed  bool
+	records chan captureRecord
+	w       *bufio.Writer
+	snaplen int
+	done    chan struct{}
+	err     error
+}
+
+// キャプチャを開始し、送受信したすべてのパケットをwにpcap形式で書き出す
+// TUNではLINKTYPE_RAW、TAPではLINKTYPE_ETHERNETとして記録する
+// 書き込みは送受信と非同期に行い、書き込みが追いつかない間のパケットは記録しない
+func (t *NetDevice) StartCapture(w io.Writer) error {
+	t.captureMu.Lock()
+	defer t.captureMu.Unlock()
+	if t.capture.Load() != nil {
+		return ErrCaptureRunning
+	}
+	linktype := uint32(LINKTYPE_RAW)
+	if t.mode == ModeTAP {
+		linktype = LINKTYPE_ETHERNET
+	}
+	p := &pcapWriter{
+		records: make(chan captureRecord, CAPTURE_QUEUE_SIZE),
+		w:       bufio.NewWriter(w),
+		snaplen: t.packetSize,
+		done:    make(chan struct{}),
+	}
+	hdr := make([]byte, PCAP_HEADER_LEN)
+	binary.LittleEndian.PutUint32(hdr[0:4], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(hdr[4:6], PCAP_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(hdr[6:8], PCAP_VERSION_MINOR)
+	// thiszone, sigfigsは0
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(p.snaplen))
+	binary.LittleEndian.PutUint32(hdr[20:24], linktype)
+	if _, err := p.w.Write(hdr); err != nil {
+		return fmt.Errorf("capture error: %s", err.Error())
+	}
+	go p.run()
+	t.capture.Store(p)
+	return nil
+}
+
+// キャプチャを停止し、書き出していないパケットをすべて書き出す
+// キャプチャしていない場合は何もしない
+func (t *NetDevice) StopCapture() error {
+	t.captureMu.Lock()
+	defer t.captureMu.Unlock()
+	p := t.capture.Swap(nil)
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	p.closed = true
+	close(p.records)
+	p.mu.Unlock()
+	<-p.done
+	if p.err != nil {
+		return fmt.Errorf("capture error: %s", p.err.Error())
+	}
+	return nil
+}
+
+// キャプチャ中であればパケットを記録する
+func (t *NetDevice) captured(b []byte) {
+	if p := t.capture.Load(); p != nil {
+		p.tap(b)
+	}
+}
+
+// パケットをコピーして書き込み待ちに入れる。待ちが溢れている場合は記録しない
+func (p *pcapWriter) tap(b []byte) {
+	size := len(b)
+	if len(b) > p.snaplen {
+		b = b[:p.snaplen]
+	}
+	rec := captureRecord{at: time.Now(), data: append([]byte(nil), b...), size: size}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.records <- rec:
+	default:
+	}
+}
+
+func (p *pcapWriter) run() {
+	defer close(p.done)
+	hdr := make([]byte, PCAP_RECORD_LEN)
+	for rec := range p.records {
+		if p.err != nil {
+			continue
+		}
+		binary.LittleEndian.PutUint32(hdr[0:4], uint32(rec.at.Unix()))
+		binary.LittleEndian.PutUint32(hdr[4:8], uint32(rec.at.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(rec.data)))
+		binary.LittleEndian.PutUint32(hdr[12:16], uint32(rec.size))
+		if _, err := p.w.Write(hdr); err != nil {
+			p.err = err
+			continue
+		}
+		if _, err := p.w.Write(rec.data); err != nil {
+			p.err = err
+			continue
+		}
+		// 溜まっている分が無くなったら書き出す
+		if len(p.records) == 0 {
+			if err := p.w.Flush(); err != nil {
+				p.err = err
+			}
+		}
+	}
+	if p.err == nil {
+		p.err = p.w.Flush()
+	}
+}
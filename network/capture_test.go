@@ -0,0 +1,146 @@
+package network
+
+import (
+	"bytes"           // キャプチャの出力先
+	"encoding/binary" // pcapのヘッダの読み取り
+	"errors"          // エラーの判定
+	"testing"
+)
+
+// pcapのレコード
+type pcapRecord struct {
+	caplen, size int
+	data         []byte
+}
+
+// pcapのバイト列を解析し、リンクタイプとレコードを返す
+func parsePcap(t *testing.T, b []byte) (uint32, int, []pcapRecord) {
+	t.Helper()
+	if len(b) < PCAP_HEADER_LEN {
+		t.Fatalf("pcap of %d bytes", len(b))
+	}
+	if m := binary.LittleEndian.Uint32(b[0:4]); m != PCAP_MAGIC {
+		t.Fatalf("magic %#x", m)
+	}
+	if major, minor := binary.LittleEndian.Uint16(b[4:6]), binary.LittleEndian.Uint16(b[6:8]); major != 2 || minor != 4 {
+		t.Fatalf("version %d.%d, want 2.4", major, minor)
+	}
+	snaplen := int(binary.LittleEndian.Uint32(b[16:20]))
+	linktype := binary.LittleEndian.Uint32(b[20:24])
+	var recs []pcapRecord
+	for off := PCAP_HEADER_LEN; off < len(b); {
+		if len(b)-off < PCAP_RECORD_LEN {
+			t.Fatalf("truncated record header at %d", off)
+		}
+		h := b[off : off+PCAP_RECORD_LEN]
+		if usec := binary.LittleEndian.Uint32(h[4:8]); usec >= 1000000 {
+			t.Fatalf("timestamp usec %d", usec)
+		}
+		caplen := int(binary.LittleEndian.Uint32(h[8:12]))
+		size := int(binary.LittleEndian.Uint32(h[12:16]))
+		off += PCAP_RECORD_LEN
+		if caplen > snaplen || caplen > size || len(b)-off < caplen {
+			t.Fatalf("record caplen %d size %d snaplen %d, %d bytes left", caplen, size, snaplen, len(b)-off)
+		}
+		recs = append(recs, pcapRecord{caplen: caplen, size: size, data: b[off : off+caplen]})
+		off += caplen
+	}
+	return linktype, snaplen, recs
+}
+
+// 送受信したパケットをLINKTYPE_RAWのpcapとして記録し、停止後は記録しないこと
+func TestCapture(t *testing.T) {
+	a, b := forwardPair(t)
+	var out bytes.Buffer
+	if err := a.StartCapture(&out); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StartCapture(&out); !errors.Is(err, ErrCaptureRunning) {
+		t.Fatalf("second start: got %v, want ErrCaptureRunning", err)
+	}
+	sent := natUDP(t, testLocal, testRemote, 1, 53, "query")
+	recv := natUDP(t, testRemote, testLocal, 53, 1, "answer")
+	if err := a.WriteBytes(sent); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, b)
+	pkt.Release()
+	if err := b.WriteBytes(recv); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, a)
+	pkt.Release()
+	if err := a.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.StopCapture(); err != nil {
+		t.Fatalf("second stop: %s", err)
+	}
+	n := out.Len()
+	if err := a.WriteBytes(sent); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, b)
+	pkt.Release()
+	if out.Len() != n {
+		t.Fatal("packet recorded after StopCapture")
+	}
+
+	linktype, snaplen, recs := parsePcap(t, out.Bytes())
+	if linktype != LINKTYPE_RAW || snaplen != a.packetSize {
+		t.Fatalf("linktype %d snaplen %d", linktype, snaplen)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("%d records, want 2", len(recs))
+	}
+	for i, want := range [][]byte{sent, recv} {
+		if !bytes.Equal(recs[i].data, want) || recs[i].size != len(want) {
+			t.Fatalf("record %d: %x (%d bytes), want %x", i, recs[i].data, recs[i].size, want)
+		}
+	}
+}
+
+// snaplenを超えるパケットは切り詰め、元の長さを記録すること
+func TestCaptureSnaplen(t *testing.T) {
+	a, _ := forwardPair(t)
+	var out bytes.Buffer
+	if err := a.StartCapture(&out); err != nil {
+		t.Fatal(err)
+	}
+	p := a.capture.Load()
+	big := make([]byte, p.snaplen+100)
+	p.tap(big)
+	if err := a.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	_, snaplen, recs := parsePcap(t, out.Bytes())
+	if len(recs) != 1 || recs[0].caplen != snaplen || recs[0].size != len(big) {
+		t.Fatalf("records %+v, want caplen %d size %d", recs, snaplen, len(big))
+	}
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return len(b), nil
+}
+
+// 書き込みの失敗は送受信を止めず、StopCaptureで返すこと
+func TestCaptureWriteError(t *testing.T) {
+	a, b := forwardPair(t)
+	if err := a.StartCapture(&failingWriter{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteBytes(natUDP(t, testLocal, testRemote, 1, 53, "x")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, b)
+	pkt.Release()
+	if err := a.StopCapture(); err == nil {
+		t.Fatal("write error not reported")
+	}
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"net" // IPアドレスの表現
+)
+
+// インターネットチェックサム（RFC 1071）を計算する
+// 16ビット単位の1の補数和の1の補数を返す。奇数長の場合は末尾を0で埋めて計算する
+func InternetChecksum(b []byte) uint16 {
+	return ^foldChecksum(sumChecksum(0, b))
+}
+
+// 16ビット単位の和を加算する
+func sumChecksum(sum uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n%2 == 1 {
+		sum += uint32(b[n-1]) << 8
+	}
+	return sum
+}
+
+// 桁上がりを下位16ビットに折り返す
+func foldChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
+
+// TCP/UDPのチェックサムに使う疑似ヘッダの和を計算する
+func pseudoHeaderSum(src, dst net.IP, proto uint8, length int) uint32 {
+	var sum uint32
+	sum = sumChecksum(sum, src.To4())
+	sum = sumChecksum(sum, dst.To4())
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// 疑似ヘッダを含めたチェックサムを計算する
+func transportChecksum(src, dst net.IP, proto uint8, b []byte) uint16 {
+	return ^foldChecksum(sumChecksum(pseudoHeaderSum(src, dst, proto, len(b)), b))
+}
+
+// IPv6の上位層のチェックサムに使う疑似ヘッダの和を計算する（RFC 8200）
+func pseudoHeaderSum6(src, dst net.IP, proto uint8, length int) uint32 {
+	var sum uint32
+	sum = sumChecksum(sum, src.To16())
+	sum = sumChecksum(sum, dst.To16())
+	sum += uint32(length>>16) + uint32(length&0xffff)
+	sum += uint32(proto)
+	return sum
+}
+
+// IPv6の疑似ヘッダを含めたチェックサムを計算する
+func transportChecksum6(src, dst net.IP, proto uint8, b []byte) uint16 {
+	return ^foldChecksum(sumChecksum(pseudoHeaderSum6(src, dst, proto, len(b)), b))
+}
+
+// ヘッダの16ビットのフィールドがoldFieldからnewFieldに変わったときのチェックサムを差分で更新する
+// RFC 1624 式3：HC' = ~(~HC + ~m + m')。TTLの減算やNATのアドレス・ポートの書き換えで、
+// ヘッダ全体を計算し直さずに済む。32ビットのアドレスは上位と下位の16ビットごとに呼ぶ
+func UpdateChecksum(old uint16, oldField, newField uint16) uint16 {
+	sum := uint32(^old) + uint32(^oldField) + uint32(newField)
+	return ^foldChecksum(sum)
+}
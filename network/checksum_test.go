@@ -0,0 +1,378 @@
+package network
+
+import (
+	"context"         // Deviceの実装
+	"encoding/binary" // ヘッダの読み書き
+	"encoding/hex"    // 取得したヘッダの読み込み
+	"errors"          // エラーの判定
+	"math/rand"       // ランダムなヘッダ
+	"net"             // IPアドレスの表現
+	"net/netip"       // NATのアドレス
+	"testing"
+)
+
+// bのoffの16ビットのワードをvに書き換え、UpdateChecksumで差分を更新したチェックサムと、
+// 全体を計算し直したチェックサムが一致すること。差分の結果でヘッダの検証も通ること
+// チェックサムのフィールドはcsumにある
+func checkUpdate(t *testing.T, b []byte, csum, off int, v uint16) {
+	t.Helper()
+	old := binary.BigEndian.Uint16(b[off:])
+	binary.BigEndian.PutUint16(b[off:], v)
+	got := UpdateChecksum(binary.BigEndian.Uint16(b[csum:]), old, v)
+	binary.BigEndian.PutUint16(b[csum:], 0)
+	want := InternetChecksum(b)
+	binary.BigEndian.PutUint16(b[csum:], got)
+	if got != want {
+		t.Fatalf("word %d %#04x -> %#04x: incremental %#04x, recomputed %#04x", off/2, old, v, got, want)
+	}
+	if InternetChecksum(b) != 0 {
+		t.Fatalf("word %d %#04x -> %#04x: header does not verify with %#04x", off/2, old, v, got)
+	}
+}
+
+// 20バイトのヘッダのワードを並べ、チェックサムのフィールド（ワード5）を計算する
+func checksumHeader(words ...uint16) []byte {
+	b := make([]byte, IPV4_MIN_HEADER_LEN)
+	for i, w := range words {
+		binary.BigEndian.PutUint16(b[i*2:], w)
+	}
+	binary.BigEndian.PutUint16(b[10:], InternetChecksum(b))
+	return b
+}
+
+// チェックサムや書き換えるフィールドが0x0000と0xffffになる場合
+// 全て0のデータの和（+0）は差分では-0と区別できないため（RFC 1624 3章）、
+// IPv4ヘッダと同じく先頭のワードにバージョンを置く
+func TestUpdateChecksumEdgeCases(t *testing.T) {
+	tests := []struct {
+		name  string
+		words []uint16
+		off   int
+		v     uint16
+	}{
+		// 和が0xffffでチェックサムが0x0000のヘッダ
+		{"checksum 0x0000 field to 0x0000", []uint16{0x4500, 0xbaff}, 2, 0x0000},
+		{"checksum 0x0000 field to 0xffff", []uint16{0x4500, 0xbaff}, 2, 0xffff},
+		{"checksum stays 0x0000", []uint16{0x4500, 0xbaff, 0x0000}, 4, 0xffff},
+		// 和が0xffffになるよう書き換えて、チェックサムが0x0000になる
+		{"to checksum 0x0000", []uint16{0x4500, 0x0054}, 2, 0xbaff},
+		{"field 0xffff to 0x0000", []uint16{0x4500, 0xffff, 0x1234}, 2, 0x0000},
+		{"field 0x0000 to 0xffff", []uint16{0x4500, 0x0000, 0x1234}, 2, 0xffff},
+		{"unchanged", []uint16{0x4500, 0x0054}, 2, 0x0054},
+		{"sum wraps", []uint16{0x4500, 0x8000, 0x8000, 0xffff}, 6, 0xfffe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkUpdate(t, checksumHeader(tt.words...), 10, tt.off, tt.v)
+		})
+	}
+}
+
+// ランダムなヘッダのランダムなワードを書き換える
+func TestUpdateChecksumRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, IPV4_MIN_HEADER_LEN)
+	for i := 0; i < 100000; i++ {
+		r.Read(b)
+		// 0x0000と0xffffのワードを多めに混ぜる
+		for j := 0; j < len(b); j += 2 {
+			switch r.Intn(8) {
+			case 0:
+				binary.BigEndian.PutUint16(b[j:], 0x0000)
+			case 1:
+				binary.BigEndian.PutUint16(b[j:], 0xffff)
+			}
+		}
+		b[0] = 0x45 // バージョンとIHL
+		binary.BigEndian.PutUint16(b[10:], 0)
+		binary.BigEndian.PutUint16(b[10:], InternetChecksum(b))
+		off := r.Intn(IPV4_MIN_HEADER_LEN/2) * 2
+		if off == 0 || off == 10 {
+			continue
+		}
+		v := uint16(r.Uint32())
+		switch r.Intn(4) {
+		case 0:
+			v = 0x0000
+		case 1:
+			v = 0xffff
+		}
+		checkUpdate(t, b, 10, off, v)
+	}
+}
+
+// 実際に取得したIPv4ヘッダ（チェックサムのフィールドを0にしたもの）と、RFC 1071の例
+var checksumTests = []struct {
+	name string
+	hex  string
+	want uint16
+}{
+	{"udp header", "450000730000400040110000c0a80001c0a800c7", 0xb861},
+	{"tcp header", "4500003c1c46400040060000ac100a63ac100a0c", 0xb1e6},
+	{"rfc 1071", "0001f203f4f5f6f7", 0x220d},
+	// 奇数長の場合は末尾を0で埋める
+	{"odd length", "0001f2", 0x0dfe},
+	{"single byte", "ff", 0x00ff},
+	{"empty", "", 0xffff},
+}
+
+func TestInternetChecksum(t *testing.T) {
+	for _, tt := range checksumTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := InternetChecksum(b); got != tt.want {
+				t.Fatalf("checksum %#04x, want %#04x", got, tt.want)
+			}
+			// 偶数長のデータはチェックサムを埋めると和が0になる
+			if len(b)%2 == 0 && len(b) > 0 {
+				b = append(b, byte(tt.want>>8), byte(tt.want))
+				if got := InternetChecksum(b); got != 0 {
+					t.Fatalf("checksum with field filled %#04x, want 0", got)
+				}
+			}
+		})
+	}
+}
+
+// ParseIPv4がヘッダのチェックサムを検証し、一致しない場合はErrBadChecksumを返すこと
+func TestParseIPv4Checksum(t *testing.T) {
+	b, err := hex.DecodeString("45000073000040004011b861c0a80001c0a800c7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, make([]byte, 0x73-len(b))...)
+	if _, _, err := ParseIPv4(b); err != nil {
+		t.Fatalf("captured header rejected: %s", err)
+	}
+	// ヘッダの外のペイロードは検証しない
+	b[len(b)-1] ^= 0xff
+	if _, _, err := ParseIPv4(b); err != nil {
+		t.Fatalf("payload corruption rejected: %s", err)
+	}
+	for _, off := range []int{1, 8, 10, 19} {
+		c := append([]byte(nil), b...)
+		c[off] ^= 0x01
+		if _, _, err := ParseIPv4(c); !errors.Is(err, ErrBadChecksum) {
+			t.Fatalf("byte %d flipped: got %v, want ErrBadChecksum", off, err)
+		}
+	}
+}
+
+var (
+	testLocal  = net.IPv4(192, 168, 0, 2).To4()
+	testRemote = net.IPv4(198, 51, 100, 1).To4()
+)
+
+// srcからdstへのTCPセグメントを含むIPv4パケットを組み立てる
+func tcpPacket(t testing.TB, src, dst net.IP, tcp TCPHeader, payload []byte) []byte {
+	t.Helper()
+	seg, err := tcp.MarshalWithPayload(payload, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := IPv4Header{ID: 0xffff, TTL: 64, Protocol: PROTOCOL_TCP, Src: src, Dst: dst}
+	b, err := ip.MarshalWithPayload(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// IPv4ヘッダとTCP/UDPのチェックサムを検証し、ヘッダを返す
+func verifyPacket(t *testing.T, b []byte) (*IPv4Header, uint16, uint16) {
+	t.Helper()
+	ip, payload, err := ParseIPv4(b)
+	if err != nil {
+		t.Fatalf("ipv4: %s", err)
+	}
+	switch ip.Protocol {
+	case PROTOCOL_TCP:
+		h, _, err := ParseTCP(payload, ip)
+		if err != nil {
+			t.Fatalf("tcp: %s", err)
+		}
+		return ip, h.SrcPort, h.DstPort
+	case PROTOCOL_UDP:
+		h, _, err := ParseUDP(payload, ip)
+		if err != nil {
+			t.Fatalf("udp: %s", err)
+		}
+		return ip, h.SrcPort, h.DstPort
+	}
+	t.Fatalf("unexpected protocol %d", ip.Protocol)
+	return nil, 0, 0
+}
+
+// 書き込まれたパケットを記録するDevice
+type recordDevice struct {
+	written [][]byte
+	// 0の場合はDEFAULT_MTU
+	mtu int
+}
+
+func (d *recordDevice) Bind()                                       {}
+func (d *recordDevice) Close() error                                { return nil }
+func (d *recordDevice) ReadPacket() (Packet, error)                 { return Packet{}, ErrDeviceClosed }
+func (d *recordDevice) ReadContext(context.Context) (Packet, error) { return Packet{}, ErrDeviceClosed }
+func (d *recordDevice) GetMTU() (int, error) {
+	if d.mtu == 0 {
+		return DEFAULT_MTU, nil
+	}
+	return d.mtu, nil
+}
+func (d *recordDevice) SetMTU(int) error { return nil }
+func (d *recordDevice) WritePacket(pkt Packet) error {
+	d.written = append(d.written, append([]byte(nil), pkt.Buf[:pkt.Len()]...))
+	pkt.Release()
+	return nil
+}
+
+// 転送でTTLを減らした後もIPv4ヘッダのチェックサムが正しいこと
+// TTLとプロトコル番号のワードが0x0000と0xffffをまたぐ場合を含める
+func TestForwardTTLChecksum(t *testing.T) {
+	dev, peer := NewPipePair()
+	defer peer.Close()
+	defer dev.Close()
+	for _, ttl := range []uint8{2, 64, 255} {
+		for _, proto := range []uint8{0x00, PROTOCOL_UDP, 0xff} {
+			ip := IPv4Header{ID: 0xffff, TTL: ttl, Protocol: proto, Src: testLocal, Dst: testRemote}
+			b, err := ip.MarshalWithPayload(make([]byte, 8))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := &recordDevice{}
+			if err := dev.Forward(bytesPacket(b), out); err != nil {
+				t.Fatalf("ttl %d proto %d: %s", ttl, proto, err)
+			}
+			got, _, err := ParseIPv4(out.written[0])
+			if err != nil {
+				t.Fatalf("ttl %d proto %d: %s", ttl, proto, err)
+			}
+			if got.TTL != ttl-1 {
+				t.Fatalf("ttl %d: forwarded with ttl %d", ttl, got.TTL)
+			}
+			want := *got
+			want.Checksum = 0
+			fresh, err := want.MarshalWithPayload(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum := binary.BigEndian.Uint16(fresh[10:12]); sum != got.Checksum {
+				t.Fatalf("ttl %d proto %d: incremental %#04x, recomputed %#04x", ttl, proto, got.Checksum, sum)
+			}
+		}
+	}
+}
+
+// NATで送信元・宛先を書き換えた後も、IPv4ヘッダとTCP/UDPのチェックサムが正しいこと
+func TestNATChecksum(t *testing.T) {
+	ext := netip.MustParseAddr("203.0.113.1")
+	nat, err := NewNAT(ext, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nat.Close()
+
+	udp := func(src, dst net.IP, sport, dport uint16) []byte {
+		h := UDPHeader{SrcPort: sport, DstPort: dport}
+		seg, err := h.MarshalWithPayload([]byte("hello"), src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_UDP, Src: src, Dst: dst}
+		b, err := ip.MarshalWithPayload(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tcp := func(src, dst net.IP, sport, dport uint16) []byte {
+		return tcpPacket(t, src, dst, TCPHeader{SrcPort: sport, DstPort: dport, Seq: 1, Flags: TCP_FLAG_SYN, Window: 0xffff}, nil)
+	}
+	for _, tc := range []struct {
+		name  string
+		build func(src, dst net.IP, sport, dport uint16) []byte
+	}{
+		{"udp", udp},
+		{"tcp", tcp},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// 0x0000と0xffffに近いポートも書き換える
+			for _, sport := range []uint16{1, 40000, 0xffff} {
+				b := tc.build(testLocal, testRemote, sport, 80)
+				if err := nat.Egress(b); err != nil {
+					t.Fatal(err)
+				}
+				ip, extPort, _ := verifyPacket(t, b)
+				if !ip.Src.Equal(net.IP(ext.AsSlice())) {
+					t.Fatalf("egress: src %s, want %s", ip.Src, ext)
+				}
+
+				reply := tc.build(testRemote, net.IP(ext.AsSlice()), 80, extPort)
+				ok, err := nat.Ingress(reply)
+				if err != nil || !ok {
+					t.Fatalf("ingress: %v %v", ok, err)
+				}
+				ip, _, dport := verifyPacket(t, reply)
+				if !ip.Dst.Equal(testLocal) || dport != sport {
+					t.Fatalf("ingress: dst %s:%d, want %s:%d", ip.Dst, dport, testLocal, sport)
+				}
+			}
+		})
+	}
+}
+
+// MSSを書き換えた後もTCPのチェックサムが正しいこと
+// MSSオプションが16ビットの境界に揃っていない場合を含める
+func TestClampMSSChecksum(t *testing.T) {
+	aligned := tcpPacket(t, testLocal, testRemote, TCPHeader{
+		SrcPort: 40000, DstPort: 80, Seq: 1, Flags: TCP_FLAG_SYN, Window: 0xffff,
+		Options: TCPOptions{MSS: 1460, HasWindowScale: true, WindowScale: 7, SACKPermitted: true, HasTimestamps: true, TSVal: 1},
+	}, nil)
+
+	// NOP, MSS, NOP, NOP, NOPの順で、MSSの値が奇数のオフセットにある
+	ip := IPv4Header{Src: testLocal, Dst: testRemote}
+	seg := make([]byte, TCP_MIN_HEADER_LEN+8)
+	binary.BigEndian.PutUint16(seg[0:2], 40000)
+	binary.BigEndian.PutUint16(seg[2:4], 80)
+	seg[12] = byte(len(seg)/4) << 4
+	seg[13] = TCP_FLAG_SYN
+	copy(seg[TCP_MIN_HEADER_LEN:], []byte{TCP_OPT_NOP, TCP_OPT_MSS, 4, 0xff, 0xff, TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_NOP})
+	binary.BigEndian.PutUint16(seg[16:18], transportChecksum(ip.Src, ip.Dst, PROTOCOL_TCP, seg))
+	ip.TTL, ip.Protocol = 64, PROTOCOL_TCP
+	unaligned, err := ip.MarshalWithPayload(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		b    []byte
+	}{
+		{"aligned", aligned},
+		{"unaligned", unaligned},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, mss := range []uint16{1360, 0x00ff, 0x0100, 1} {
+				b := append([]byte(nil), tc.b...)
+				if !ClampMSS(b, mss) {
+					t.Fatalf("mss %d: not clamped", mss)
+				}
+				ip, payload, err := ParseIPv4(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				h, _, err := ParseTCP(payload, ip)
+				if err != nil {
+					t.Fatalf("mss %d: %s", mss, err)
+				}
+				if h.Options.MSS != mss {
+					t.Fatalf("mss %d: got %d", mss, h.Options.MSS)
+				}
+			}
+		})
+	}
+}
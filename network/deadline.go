@@ -0,0 +1,71 @@
+package network
+
+import (
+	"sync" // 排他制御
+	"time" // 時刻とタイマー
+)
+
+// 読み書きの期限を管理する
+// 期限が過ぎるとwaitが返すチャネルが閉じられる
+// 期限を再設定すると、待機中の処理にも新しい期限が反映される
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// 期限を設定する。ゼロ値の場合は期限を解除する
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// タイマーが既に発火している場合はチャネルが閉じるのを待つ
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// 過去の時刻が指定された場合は即座に期限切れにする
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// 期限が過ぎると閉じられるチャネルを返す
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"fmt"     // 文字列の生成や出力、スキャン
+	"net"     // IPアドレスの表現
+	"strings" // 要約の組み立て
+)
+
+// Decodeで解析した各層のヘッダ
+// 含まれない層のフィールドはnilになる
+type Layers struct {
+	Ethernet *EthernetHeader
+	ARP      *ARPPacket
+	IPv4     *IPv4Header
+	IPv6     *IPv6Header
+	// ICMPv4とICMPv6のどちらも格納する。どちらかはIPv4/IPv6のどちらがあるかで判断する
+	ICMP *ICMPMessage
+	TCP  *TCPHeader
+	UDP  *UDPHeader
+	// 解析した最も上の層のペイロード
+	// トランスポートを解析しなかった場合（フラグメントや未対応のプロトコル）はIPのペイロード
+	Payload []byte
+}
+
+// TUNから読み込んだIPパケットを層ごとに解析する
+// 表示やデバッグ用のため、IPv4ヘッダ以外のチェックサムは検証しない
+// フラグメントと未対応のプロトコルはIPの層までを返す
+func Decode(pkt Packet) (Layers, error) {
+	var l Layers
+	err := l.decodeIP(pkt.Buf[:pkt.Len()])
+	return l, err
+}
+
+// TAPから読み込んだEthernetフレームを層ごとに解析する
+func DecodeEthernet(pkt Packet) (Layers, error) {
+	var l Layers
+	eth, payload, err := ParseEthernet(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		return l, err
+	}
+	l.Ethernet = eth
+	switch eth.EtherType {
+	case ETHERTYPE_ARP:
+		l.ARP, err = ParseARP(payload)
+	case ETHERTYPE_IPV4, ETHERTYPE_IPV6:
+		err = l.decodeIP(payload)
+	default:
+		l.Payload = payload
+	}
+	return l, err
+}
+
+func (l *Layers) decodeIP(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("invalid ip header: empty packet")
+	}
+	var (
+		proto   uint8
+		payload []byte
+		err     error
+	)
+	switch b[0] >> 4 {
+	case IPV4_VERSION:
+		if l.IPv4, payload, err = ParseIPv4(b); err != nil {
+			return err
+		}
+		proto = l.IPv4.Protocol
+		l.Payload = payload
+		if l.IPv4.FragOffset != 0 || l.IPv4.Flags&IPV4_FLAG_MF != 0 {
+			return nil
+		}
+	case IPV6_VERSION:
+		if l.IPv6, payload, err = ParseIPv6(b); err != nil {
+			return err
+		}
+		proto = l.IPv6.Protocol
+		l.Payload = payload
+	default:
+		return fmt.Errorf("invalid ip header: version %d", b[0]>>4)
+	}
+
+	switch proto {
+	case PROTOCOL_TCP:
+		l.TCP, l.Payload, err = parseTCP(payload, nil, false)
+	case PROTOCOL_UDP:
+		l.UDP, l.Payload, err = parseUDP(payload, nil, false)
+	case PROTOCOL_ICMP, PROTOCOL_ICMPV6:
+		if l.ICMP, err = parseICMP(payload, false); err == nil {
+			l.Payload = l.ICMP.Data
+		}
+	}
+	if err != nil {
+		l.Payload = payload
+	}
+	return err
+}
+
+// tcpdumpに似た1行の要約を返す
+// 例: IP 10.0.0.1.1234 > 10.0.0.2.80: TCP SYN seq 1 win 65535
+func (l Layers) String() string {
+	var sb strings.Builder
+	if l.Ethernet != nil {
+		fmt.Fprintf(&sb, "%s > %s, ethertype 0x%04x: ", l.Ethernet.Src, l.Ethernet.Dst, l.Ethernet.EtherType)
+	}
+
+	var (
+		family   string
+		src, dst net.IP
+		proto    uint8
+	)
+	switch {
+	case l.ARP != nil:
+		if l.ARP.Op == ARP_OP_REQUEST {
+			fmt.Fprintf(&sb, "ARP who-has %s tell %s", l.ARP.TargetIP, l.ARP.SenderIP)
+		} else {
+			fmt.Fprintf(&sb, "ARP reply %s is-at %s", l.ARP.SenderIP, l.ARP.SenderHW)
+		}
+		return sb.String()
+	case l.IPv4 != nil:
+		family, src, dst, proto = "IP", l.IPv4.Src, l.IPv4.Dst, l.IPv4.Protocol
+	case l.IPv6 != nil:
+		family, src, dst, proto = "IP6", l.IPv6.Src, l.IPv6.Dst, l.IPv6.Protocol
+	default:
+		fmt.Fprintf(&sb, "length %d", len(l.Payload))
+		return sb.String()
+	}
+
+	switch {
+	case l.TCP != nil:
+		h := l.TCP
+		fmt.Fprintf(&sb, "%s %s.%d > %s.%d: TCP %s seq %d", family, src, h.SrcPort, dst, h.DstPort, TCPFlagsString(h.Flags), h.Seq)
+		if h.Has(TCP_FLAG_ACK) {
+			fmt.Fprintf(&sb, " ack %d", h.Ack)
+		}
+		fmt.Fprintf(&sb, " win %d", h.Window)
+		if len(l.Payload) > 0 {
+			fmt.Fprintf(&sb, " length %d", len(l.Payload))
+		}
+	case l.UDP != nil:
+		fmt.Fprintf(&sb, "%s %s.%d > %s.%d: UDP length %d", family, src, l.UDP.SrcPort, dst, l.UDP.DstPort, len(l.Payload))
+	case l.ICMP != nil:
+		fmt.Fprintf(&sb, "%s %s > %s: %s", family, src, dst, icmpSummary(l.ICMP, l.IPv6 != nil))
+	case l.IPv4 != nil && (l.IPv4.FragOffset != 0 || l.IPv4.Flags&IPV4_FLAG_MF != 0):
+		fmt.Fprintf(&sb, "%s %s > %s: frag id %d offset %d proto %d length %d", family, src, dst, l.IPv4.ID, int(l.IPv4.FragOffset)*8, proto, len(l.Payload))
+	default:
+		fmt.Fprintf(&sb, "%s %s > %s: proto %d length %d", family, src, dst, proto, len(l.Payload))
+	}
+	return sb.String()
+}
+
+// ICMP/ICMPv6メッセージの要約を返す
+func icmpSummary(m *ICMPMessage, v6 bool) string {
+	name := "ICMP"
+	if v6 {
+		name = "ICMP6"
+	}
+	echo := ""
+	switch {
+	case !v6 && m.Type == ICMP_TYPE_ECHO_REQUEST, v6 && m.Type == ICMPV6_TYPE_ECHO_REQUEST:
+		echo = "echo request"
+	case !v6 && m.Type == ICMP_TYPE_ECHO_REPLY, v6 && m.Type == ICMPV6_TYPE_ECHO_REPLY:
+		echo = "echo reply"
+	}
+	if echo != "" {
+		return fmt.Sprintf("%s %s id %d seq %d length %d", name, echo, m.ID, m.Seq, len(m.Data))
+	}
+	return fmt.Sprintf("%s type %d code %d length %d", name, m.Type, m.Code, len(m.Data))
+}
@@ -0,0 +1,129 @@
+package network
+
+import "testing"
+
+// IPv4ヘッダを付けたパケットを作る
+func ipPacket(t *testing.T, h IPv4Header, payload []byte) []byte {
+	t.Helper()
+	if h.TTL == 0 {
+		h.TTL = 64
+	}
+	b, err := h.MarshalWithPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 取得したパケットごとに層を解析し、tcpdumpに似た要約を返すこと
+func TestDecodeSummary(t *testing.T) {
+	echo := ICMPMessage{Type: ICMP_TYPE_ECHO_REQUEST, ID: 1, Seq: 2, Data: []byte("ping")}
+	udp := natUDP(t, testRemote, testLocal, 40000, 9, "closed port")
+	h, payload, err := ParseIPv4(udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable, err := BuildDestUnreachable(h, payload, ICMP_CODE_PORT_UNREACHABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{
+			"tcp syn",
+			tcpPacket(t, testLocal, testRemote, TCPHeader{SrcPort: 1234, DstPort: 80, Seq: 1, Flags: TCP_FLAG_SYN, Window: 65535}, nil),
+			"IP 192.168.0.2.1234 > 198.51.100.1.80: TCP SYN seq 1 win 65535",
+		},
+		{
+			"tcp data",
+			tcpPacket(t, testRemote, testLocal, TCPHeader{SrcPort: 80, DstPort: 1234, Seq: 100, Ack: 200, Flags: TCP_FLAG_PSH | TCP_FLAG_ACK, Window: 512}, []byte("hello")),
+			"IP 198.51.100.1.80 > 192.168.0.2.1234: TCP PSH|ACK seq 100 ack 200 win 512 length 5",
+		},
+		{
+			"udp",
+			natUDP(t, testLocal, testRemote, 40000, 53, "query"),
+			"IP 192.168.0.2.40000 > 198.51.100.1.53: UDP length 5",
+		},
+		{
+			"icmp echo",
+			ipPacket(t, IPv4Header{Protocol: PROTOCOL_ICMP, Src: testRemote, Dst: testLocal}, echo.Marshal()),
+			"IP 198.51.100.1 > 192.168.0.2: ICMP echo request id 1 seq 2 length 4",
+		},
+		{
+			"icmp unreachable",
+			unreachable.Buf[:unreachable.Len()],
+			"IP 192.168.0.2 > 198.51.100.1: ICMP type 3 code 3 length 28",
+		},
+		{
+			"icmpv6 echo",
+			decodeHex(t, ipv6EchoRequest),
+			"IP6 fe80::1 > fe80::2: ICMP6 echo request id 7211 seq 1 length 4",
+		},
+		{
+			"later fragment",
+			ipPacket(t, IPv4Header{ID: 7, FragOffset: 2, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote}, make([]byte, 16)),
+			"IP 192.168.0.2 > 198.51.100.1: frag id 7 offset 16 proto 17 length 16",
+		},
+		{
+			"unknown protocol",
+			ipPacket(t, IPv4Header{Protocol: 47, Src: testLocal, Dst: testRemote}, []byte("gre")),
+			"IP 192.168.0.2 > 198.51.100.1: proto 47 length 3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := Decode(bytesPacket(tc.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.String(); got != tc.want {
+				t.Fatalf("got  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// 先頭のフラグメントはトランスポートを解析せず、IPのペイロードを返すこと
+func TestDecodeFirstFragment(t *testing.T) {
+	seg := natUDP(t, testLocal, testRemote, 40000, 53, "first fragment")[IPV4_MIN_HEADER_LEN:]
+	b := ipPacket(t, IPv4Header{ID: 8, Flags: IPV4_FLAG_MF, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote}, seg)
+	l, err := Decode(bytesPacket(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.IPv4 == nil || l.UDP != nil || len(l.Payload) != len(seg) {
+		t.Fatalf("decoded %+v", l)
+	}
+}
+
+// TAPのフレームはEthernetの層から解析すること
+func TestDecodeEthernet(t *testing.T) {
+	l, err := DecodeEthernet(bytesPacket(arpFrame(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "52:54:00:12:34:56 > ff:ff:ff:ff:ff:ff, ethertype 0x0806: ARP who-has 10.0.0.2 tell 10.0.0.1"
+	if got := l.String(); got != want {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+
+	frame := append([]byte{0x02, 0, 0x5e, 0x10, 0, 1, 0x52, 0x54, 0, 0x12, 0x34, 0x56, 0x08, 0x00}, natUDP(t, testLocal, testRemote, 1, 53, "x")...)
+	l, err = DecodeEthernet(bytesPacket(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Ethernet == nil || l.IPv4 == nil || l.UDP == nil || l.UDP.DstPort != 53 {
+		t.Fatalf("decoded %+v", l)
+	}
+}
+
+// 空のパケットや未知のバージョンはエラーにすること
+func TestDecodeInvalid(t *testing.T) {
+	for _, b := range [][]byte{{}, {0x50, 0, 0, 0}} {
+		if _, err := Decode(bytesPacket(b)); err == nil {
+			t.Errorf("decoded %x", b)
+		}
+	}
+}
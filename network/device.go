@@ -0,0 +1,76 @@
+package network
+
+import (
+	"context" // 読み込みのキャンセル
+)
+
+// プロトコルスタックが使うデバイスの操作
+// NetDeviceとNewPipePairのデバイスが満たし、テストでは偽のデバイスに差し替えられる
+type Device interface {
+	// 読み書きのゴルーチンを開始する
+	Bind()
+	Close() error
+	// 受信したパケットを1つ読み込む。使い終わったパケットはReleaseする
+	ReadPacket() (Packet, error)
+	ReadContext(ctx context.Context) (Packet, error)
+	WritePacket(pkt Packet) error
+	// MTUを取得・設定できない場合はエラーを返す
+	GetMTU() (int, error)
+	SetMTU(mtu int) error
+}
+
+var _ Device = (*NetDevice)(nil)
+
+// 上位層の書き込み期限を扱えるデバイス
+type cancelWriter interface {
+	writePacket(pkt Packet, cancel <-chan struct{}) error
+}
+
+// 送受信のエラーを出力するロガーを持つデバイス
+type loggerDevice interface {
+	deviceLogger() Logger
+}
+
+// オフロードを設定できるデバイス
+type offloadDevice interface {
+	Offloads() OffloadFlags
+}
+
+// パケットを書き込む
+// cancelを扱えないデバイスではcancelを無視してWritePacketを呼び出す
+func writeDevice(dev Device, pkt Packet, cancel <-chan struct{}) error {
+	if w, ok := dev.(cancelWriter); ok {
+		return w.writePacket(pkt, cancel)
+	}
+	return dev.WritePacket(pkt)
+}
+
+// 組み立てたパケットのバイト列をデバイスに書き込む。bの所有権はデバイスに移る
+func writeBytes(dev Device, b []byte, cancel <-chan struct{}) error {
+	return writeDevice(dev, bytesPacket(b), cancel)
+}
+
+// バイト列全体を長さとするPacketを作る
+func bytesPacket(b []byte) Packet {
+	return Packet{Buf: b, N: uintptr(len(b))}
+}
+
+// デバイスのロガーを返す。ロガーを持たないデバイスでは何も出力しない
+func loggerOf(dev Device) Logger {
+	if d, ok := dev.(loggerDevice); ok {
+		return d.deviceLogger()
+	}
+	return nopLogger{}
+}
+
+// デバイスがTCP/UDPのチェックサムを計算しないまま渡してくるかを返す
+func checksumOffloaded(dev Device) bool {
+	if d, ok := dev.(offloadDevice); ok {
+		return d.Offloads()&TUN_F_CSUM != 0
+	}
+	return false
+}
+
+func (t *NetDevice) deviceLogger() Logger {
+	return t.logger
+}
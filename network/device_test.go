@@ -0,0 +1,645 @@
+package network
+
+import (
+	"bytes"   // パケットの比較
+	"context" // 読み込みの期限
+	"errors"  // エラーの判定
+	"os"      // 期限切れのエラー
+	"runtime" // ゴルーチンの数
+	"sync"    // 一度だけ閉じる
+	"testing"
+	"time" // 待ち時間
+)
+
+// パイプでつないだ2つのデバイスを作成する。Bindは呼ばない
+func pipePair(t *testing.T) (*NetDevice, *NetDevice) {
+	t.Helper()
+	a, b := NewPipePair()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// 読み込みの結果を順番に返すconn。使い切ると閉じられるまでブロックする
+// 書き込んだパケットはwrittenに送り、受け取る相手がいなければブロックする
+type scriptConn struct {
+	reads   chan scriptRead
+	written chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+type scriptRead struct {
+	b   []byte
+	err error
+}
+
+// writeBufは書き込みを受け取らずに溜めておける数
+func newScriptConn(writeBuf int) *scriptConn {
+	return &scriptConn{
+		reads:   make(chan scriptRead, 64),
+		written: make(chan []byte, writeBuf),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *scriptConn) Read(buf []byte) (int, error) {
+	select {
+	case r := <-c.reads:
+		if r.err != nil {
+			return 0, r.err
+		}
+		return copy(buf, r.b), nil
+	case <-c.done:
+		return 0, os.ErrClosed
+	}
+}
+
+func (c *scriptConn) Write(buf []byte) (int, error) {
+	select {
+	case c.written <- append([]byte(nil), buf...):
+		return len(buf), nil
+	case <-c.done:
+		return 0, os.ErrClosed
+	}
+}
+
+func (c *scriptConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// connを読み書きするTUNのデバイスを作成する
+func scriptDevice(t *testing.T, conn *scriptConn, opts ...Option) *NetDevice {
+	t.Helper()
+	cfg, err := newConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := newNetDevice(conn, "script0", ModeTUN, cfg)
+	t.Cleanup(func() { dev.Close() })
+	return dev
+}
+
+// 期限付きでパケットを1つ読み込む
+func readPacket(t *testing.T, dev *NetDevice) Packet {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	pkt, err := dev.ReadContext(ctx)
+	if err != nil {
+		t.Fatalf("no packet: %s", err)
+	}
+	return pkt
+}
+
+// 2回目のBindはゴルーチンを増やさず、パケットは1度だけ届くこと
+func TestBindTwice(t *testing.T) {
+	a, b := pipePair(t)
+	b.Bind()
+	a.Bind()
+	before := runtime.NumGoroutine()
+	a.Bind()
+	if after := runtime.NumGoroutine(); after != before {
+		t.Fatalf("second Bind started %d goroutines", after-before)
+	}
+	if err := b.WriteBytes(udpPacket(t, 1000, 10)); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, a)
+	pkt.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if pkt, err := a.ReadContext(ctx); err == nil {
+		t.Fatalf("packet of %d bytes delivered twice", pkt.Len())
+	}
+}
+
+// ReadContextはctxのキャンセルでctx.Err()を、CloseでErrDeviceClosedを返すこと
+func TestReadContextCancel(t *testing.T) {
+	a, _ := pipePair(t)
+	a.Bind()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := a.ReadContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	// キャンセルの後もデバイスは使える
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.ReadContext(context.Background())
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	a.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDeviceClosed) {
+			t.Fatalf("got %v, want ErrDeviceClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadContext did not return after Close")
+	}
+}
+
+// Bindする前の読み書きとCloseがパニックせず、書き込んだパケットはBindの後に送られること
+func TestDeviceBeforeBind(t *testing.T) {
+	a, b := pipePair(t)
+	b.Bind()
+	if _, err := a.Write(udpPacket(t, 1000, 10)); err != nil {
+		t.Fatalf("write before bind: %s", err)
+	}
+	if err := a.WritePacket(bytesPacket(udpPacket(t, 1001, 10))); err != nil {
+		t.Fatalf("write packet before bind: %s", err)
+	}
+	if _, out := a.QueueDepths(); out != 2 {
+		t.Fatalf("outgoing queue %d, want 2", out)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.ReadContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read before bind got %v, want context.DeadlineExceeded", err)
+	}
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := a.Read(make([]byte, 100)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read before bind got %v, want os.ErrDeadlineExceeded", err)
+	}
+	a.SetReadDeadline(time.Time{})
+
+	a.Bind()
+	for _, port := range []uint16{1000, 1001} {
+		pkt := readPacket(t, b)
+		if _, src, _ := verifyPacket(t, pkt.Buf[:pkt.Len()]); src != port {
+			t.Fatalf("source port %d, want %d", src, port)
+		}
+		pkt.Release()
+	}
+}
+
+// Bindせずに閉じたデバイスの読み書きはErrDeviceClosedを返すこと
+func TestCloseBeforeBind(t *testing.T) {
+	a, _ := pipePair(t)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write([]byte{1}); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("write got %v, want ErrDeviceClosed", err)
+	}
+	if _, err := a.ReadPacket(); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("read got %v, want ErrDeviceClosed", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("second close: %s", err)
+	}
+	// 閉じた後のBindも何もしない
+	a.Bind()
+	if _, err := a.ReadPacket(); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("read after bind got %v, want ErrDeviceClosed", err)
+	}
+}
+
+// 読み込みに失敗した回はパケットをキューに入れず、RxDropsに数えること
+func TestReadErrorNotEnqueued(t *testing.T) {
+	conn := newScriptConn(0)
+	dev := scriptDevice(t, conn)
+	injected := errors.New("injected")
+	for i := 0; i < 3; i++ {
+		conn.reads <- scriptRead{err: injected}
+	}
+	want := udpPacket(t, 1000, 10)
+	conn.reads <- scriptRead{b: want}
+	dev.Bind()
+	pkt := readPacket(t, dev)
+	if pkt.Len() != len(want) {
+		t.Fatalf("first packet %d bytes, want the %d byte packet", pkt.Len(), len(want))
+	}
+	pkt.Release()
+	if s := dev.Stats(); s.RxDrops != 3 || s.RxPackets != 1 {
+		t.Fatalf("rx drops %d packets %d, want 3 1", s.RxDrops, s.RxPackets)
+	}
+	if in, _ := dev.QueueDepths(); in != 0 {
+		t.Fatalf("%d packets left in the incoming queue", in)
+	}
+}
+
+// 連続して失敗した回数が上限に達した場合だけデバイスを止めること
+func TestMaxReadErrors(t *testing.T) {
+	conn := newScriptConn(0)
+	dev := scriptDevice(t, conn, WithMaxReadErrors(3))
+	injected := errors.New("injected")
+	// 成功した読み込みで数え直す
+	conn.reads <- scriptRead{err: injected}
+	conn.reads <- scriptRead{err: injected}
+	conn.reads <- scriptRead{b: udpPacket(t, 1000, 10)}
+	dev.Bind()
+	pkt := readPacket(t, dev)
+	pkt.Release()
+	if dev.Err() != nil {
+		t.Fatalf("stopped after non-consecutive errors: %s", dev.Err())
+	}
+	for i := 0; i < 3; i++ {
+		conn.reads <- scriptRead{err: injected}
+	}
+	select {
+	case <-dev.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("device not stopped after 3 consecutive errors")
+	}
+	if err := dev.Err(); !errors.Is(err, injected) {
+		t.Fatalf("got %v, want the injected error", err)
+	}
+}
+
+// パイプの一方のデバイスから、もう一方のスタックへのpingが往復すること
+func TestPipePairPing(t *testing.T) {
+	_, dev := rawPeer(t)
+	p, err := NewPinger(dev, rawPeerIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtts, err := p.Ping(rawStackIP, 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rtts) != 3 {
+		t.Fatalf("%d replies, want 3", len(rtts))
+	}
+}
+
+// パイプの一方を閉じると、もう一方への書き込みは届かず、閉じた側はErrDeviceClosedを返すこと
+func TestPipePairClose(t *testing.T) {
+	a, b := pipePair(t)
+	a.Bind()
+	b.Bind()
+	if err := a.WriteBytes(udpPacket(t, 1000, 10)); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, b)
+	pkt.Release()
+	b.Close()
+	if err := b.WriteBytes(udpPacket(t, 1000, 10)); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("write on the closed end got %v, want ErrDeviceClosed", err)
+	}
+	if _, err := b.ReadPacket(); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("read on the closed end got %v, want ErrDeviceClosed", err)
+	}
+	// 対向が閉じた後の書き込みは失敗しない（送った先で破棄される）
+	if err := a.WriteBytes(udpPacket(t, 1000, 10)); err != nil {
+		t.Fatalf("write to a closed peer: %s", err)
+	}
+}
+
+// CloseWithFlushは送信キューに残ったパケットを書き出してから閉じること
+func TestCloseWithFlush(t *testing.T) {
+	a, b := pipePair(t)
+	b.Bind()
+	// Bindしていないため、パケットは送信キューに溜まる
+	for i := 0; i < 5; i++ {
+		if err := a.WriteBytes(udpPacket(t, uint16(1000+i), 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.CloseWithFlush(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		pkt := readPacket(t, b)
+		if _, src, _ := verifyPacket(t, pkt.Buf[:pkt.Len()]); src != uint16(1000+i) {
+			t.Fatalf("packet %d from port %d, want %d", i, src, 1000+i)
+		}
+		pkt.Release()
+	}
+	if got := a.Stats().TxPackets; got != 5 {
+		t.Fatalf("tx packets %d, want 5", got)
+	}
+	if err := a.WriteBytes(udpPacket(t, 1000, 10)); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("write after flush got %v, want ErrDeviceClosed", err)
+	}
+}
+
+// 期限までに書き出せなかったパケットは破棄してTxDropsに数え、期限切れのエラーを返すこと
+func TestCloseWithFlushTimeout(t *testing.T) {
+	// 書き込みを受け取る相手がいないため、最初のまとめ書きでブロックする
+	conn := newScriptConn(0)
+	dev := scriptDevice(t, conn, WithQueueSize(2*MAX_BATCH_SIZE))
+	for i := 0; i < 2*MAX_BATCH_SIZE; i++ {
+		if err := dev.WriteBytes(udpPacket(t, 1000, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	err := dev.CloseWithFlush(50 * time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("flush returned after %s", elapsed)
+	}
+	if drops := dev.Stats().TxDrops; drops != MAX_BATCH_SIZE {
+		t.Fatalf("tx drops %d, want the %d packets left in the queue", drops, MAX_BATCH_SIZE)
+	}
+}
+
+// 受信キューが一杯の場合のそれぞれの方針で、キューに残るパケットと破棄した数
+func TestOverflowPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy OverflowPolicy
+		kept   []uint16
+		drops  uint64
+	}{
+		{"drop newest", DropNewest, []uint16{1000, 1001}, 3},
+		{"drop oldest", DropOldest, []uint16{1003, 1004}, 3},
+		{"block", Block, []uint16{1000, 1001, 1002, 1003, 1004}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newScriptConn(0)
+			dev := scriptDevice(t, conn, WithQueueSize(2), WithOverflowPolicy(tc.policy))
+			for i := 0; i < 5; i++ {
+				conn.reads <- scriptRead{b: udpPacket(t, uint16(1000+i), 10)}
+			}
+			dev.Bind()
+			// Blockでは3つ目を入れようとして読み込みが止まる
+			received := uint64(5)
+			if tc.policy == Block {
+				received = 3
+			}
+			waitFor(t, "reads", func() bool { return dev.Stats().RxPackets == received })
+			waitFor(t, "full queue", func() bool {
+				in, _ := dev.QueueDepths()
+				return in == 2
+			})
+			for _, want := range tc.kept {
+				pkt := readPacket(t, dev)
+				if _, src, _ := verifyPacket(t, pkt.Buf[:pkt.Len()]); src != want {
+					t.Fatalf("got port %d, want %d", src, want)
+				}
+				pkt.Release()
+			}
+			if got := dev.Stats().RxDrops; got != tc.drops {
+				t.Fatalf("rx drops %d, want %d", got, tc.drops)
+			}
+		})
+	}
+}
+
+// TUNではIPv4ヘッダ、TAPではEthernetヘッダより短い読み込みを破棄してRxRuntに数えること
+func TestRuntPacketsDropped(t *testing.T) {
+	for _, tc := range []struct {
+		mode Mode
+		min  int
+	}{
+		{ModeTUN, IPV4_MIN_HEADER_LEN},
+		{ModeTAP, ETHERNET_HEADER_LEN},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			conn := newScriptConn(0)
+			cfg := defaultConfig()
+			dev := newNetDevice(conn, "script0", tc.mode, cfg)
+			defer dev.Close()
+			for _, n := range []int{5, tc.min - 1, tc.min} {
+				conn.reads <- scriptRead{b: make([]byte, n)}
+			}
+			dev.Bind()
+			pkt := readPacket(t, dev)
+			if pkt.Len() != tc.min {
+				t.Fatalf("delivered %d bytes, want only the %d byte packet", pkt.Len(), tc.min)
+			}
+			pkt.Release()
+			if s := dev.Stats(); s.RxRunt != 2 || s.RxPackets != 1 {
+				t.Fatalf("runts %d packets %d, want 2 1", s.RxRunt, s.RxPackets)
+			}
+		})
+	}
+}
+
+// 送受信のゴルーチンが止まった原因をErrで返し、Doneを閉じること
+func TestDeviceErrAndDone(t *testing.T) {
+	t.Run("persistent read error", func(t *testing.T) {
+		conn := newScriptConn(0)
+		dev := scriptDevice(t, conn)
+		injected := errors.New("injected")
+		for i := 0; i < MAX_READ_ERRORS; i++ {
+			conn.reads <- scriptRead{err: injected}
+		}
+		if dev.Err() != nil {
+			t.Fatalf("err %v before bind", dev.Err())
+		}
+		dev.Bind()
+		select {
+		case <-dev.Done():
+		case <-time.After(2 * time.Second):
+			t.Fatal("Done not closed")
+		}
+		if err := dev.Err(); !errors.Is(err, injected) {
+			t.Fatalf("got %v, want the injected error", err)
+		}
+		if _, err := dev.ReadPacket(); !errors.Is(err, ErrDeviceClosed) {
+			t.Fatalf("read got %v, want ErrDeviceClosed", err)
+		}
+	})
+	t.Run("closed externally", func(t *testing.T) {
+		conn := newScriptConn(0)
+		dev := scriptDevice(t, conn)
+		dev.Bind()
+		// Closeを経ずにconnを閉じる
+		conn.Close()
+		select {
+		case <-dev.Done():
+		case <-time.After(2 * time.Second):
+			t.Fatal("Done not closed")
+		}
+		if err := dev.Err(); !errors.Is(err, os.ErrClosed) {
+			t.Fatalf("got %v, want os.ErrClosed", err)
+		}
+	})
+	t.Run("close", func(t *testing.T) {
+		dev := scriptDevice(t, newScriptConn(0))
+		dev.Bind()
+		dev.Close()
+		<-dev.Done()
+		if err := dev.Err(); !errors.Is(err, ErrDeviceClosed) {
+			t.Fatalf("got %v, want ErrDeviceClosed", err)
+		}
+	})
+}
+
+// 多数のゴルーチンが書き込んでいる間にCloseしてもパニックせず、閉じた後の書き込みはErrDeviceClosedを返すこと
+func TestWriteDuringClose(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		a, b := NewPipePair()
+		a.Bind()
+		b.Bind()
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make(chan error, 16)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for {
+					_, err := a.Write(make([]byte, IPV4_MIN_HEADER_LEN))
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		close(start)
+		time.Sleep(time.Millisecond)
+		a.Close()
+		wg.Wait()
+		b.Close()
+		close(errs)
+		for err := range errs {
+			if !errors.Is(err, ErrDeviceClosed) {
+				t.Fatalf("write during close got %v, want ErrDeviceClosed", err)
+			}
+		}
+	}
+}
+
+// QueueDepthsが溜まっているパケット数を返し、送受信したバイト数を数えること
+func TestQueueDepthsAndByteCounters(t *testing.T) {
+	a, b := pipePair(t)
+	// Bindしていないため書き込みは送信キューに溜まる
+	for i := 0; i < QUEUE_SIZE; i++ {
+		if err := a.WriteBytes(udpPacket(t, 1000, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if in, out := a.QueueDepths(); in != 0 || out != QUEUE_SIZE {
+		t.Fatalf("depths %d %d, want 0 %d", in, out, QUEUE_SIZE)
+	}
+	a.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := a.WriteBytes(udpPacket(t, 1000, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write to a full queue got %v, want os.ErrDeadlineExceeded", err)
+	}
+	a.SetWriteDeadline(time.Time{})
+
+	// bはBindしているが誰も読まないため、受信キューに溜まる
+	b.Bind()
+	a.Bind()
+	waitFor(t, "incoming queue", func() bool {
+		in, _ := b.QueueDepths()
+		return in == QUEUE_SIZE
+	})
+	if _, out := a.QueueDepths(); out != 0 {
+		t.Fatalf("outgoing depth %d after the writer drained it", out)
+	}
+	want := uint64(QUEUE_SIZE * len(udpPacket(t, 1000, 10)))
+	if got := a.Stats().TxBytes; got != want {
+		t.Fatalf("tx bytes %d, want %d", got, want)
+	}
+	if got := b.Stats().RxBytes; got != want {
+		t.Fatalf("rx bytes %d, want %d", got, want)
+	}
+	pkt := readPacket(t, b)
+	pkt.Release()
+	if in, _ := b.QueueDepths(); in != QUEUE_SIZE-1 {
+		t.Fatalf("incoming depth %d after one read, want %d", in, QUEUE_SIZE-1)
+	}
+}
+
+// WriteBytesとWriteが同じバイト列を書き込み、閉じた後はどちらもErrDeviceClosedを返すこと
+func TestWriteBytesMatchesWrite(t *testing.T) {
+	conn := newScriptConn(2)
+	dev := scriptDevice(t, conn)
+	dev.Bind()
+	want := udpPacket(t, 1000, 100)
+	if _, err := dev.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WriteBytes(append([]byte(nil), want...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, how := range []string{"Write", "WriteBytes"} {
+		select {
+		case got := <-conn.written:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s wrote %x, want %x", how, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s wrote nothing", how)
+		}
+	}
+	dev.Close()
+	if _, err := dev.Write(want); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("Write got %v, want ErrDeviceClosed", err)
+	}
+	if err := dev.WriteBytes(want); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("WriteBytes got %v, want ErrDeviceClosed", err)
+	}
+}
+
+// ReadIntoは呼び出し側のバッファにパケットを読み込み、Closeで中断され、Bindの後はエラーを返すこと
+func TestReadInto(t *testing.T) {
+	conn := newScriptConn(0)
+	dev := scriptDevice(t, conn)
+	want := udpPacket(t, 1000, 100)
+	conn.reads <- scriptRead{b: make([]byte, 5)}
+	conn.reads <- scriptRead{b: want}
+	buf := make([]byte, PACKET_SIZE)
+	n, err := dev.ReadInto(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Fatalf("read %x, want %x", buf[:n], want)
+	}
+	if s := dev.Stats(); s.RxRunt != 1 || s.RxPackets != 1 || s.RxBytes != uint64(len(want)) {
+		t.Fatalf("stats %+v, want 1 runt and 1 packet of %d bytes", s, len(want))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := dev.ReadInto(buf)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	dev.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDeviceClosed) {
+			t.Fatalf("got %v, want ErrDeviceClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadInto not interrupted by Close")
+	}
+}
+
+// BindしたデバイスではReadIntoを使えないこと
+func TestReadIntoAfterBind(t *testing.T) {
+	dev := scriptDevice(t, newScriptConn(0))
+	dev.Bind()
+	if _, err := dev.ReadInto(make([]byte, PACKET_SIZE)); err == nil {
+		t.Fatal("ReadInto succeeded after Bind")
+	}
+}
+
+// 受信時刻を取得できないデバイスでも、読み込んだ時刻を単調に増える順で設定すること
+func TestPacketTimestampFallback(t *testing.T) {
+	a, b := forwardPair(t)
+	before := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := a.WriteBytes(natUDP(t, testLocal, testRemote, 1, uint16(1000+i), "stamped")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var prev time.Time
+	for i := 0; i < 5; i++ {
+		pkt := readPacket(t, b)
+		if pkt.Timestamp.IsZero() || pkt.Timestamp.Before(before) || pkt.Timestamp.Before(prev) {
+			t.Fatalf("packet %d: timestamp %s, previous %s, sent after %s", i, pkt.Timestamp, prev, before)
+		}
+		if pkt.Timestamp.After(time.Now()) {
+			t.Fatalf("packet %d: timestamp %s is in the future", i, pkt.Timestamp)
+		}
+		prev = pkt.Timestamp
+		pkt.Release()
+	}
+}
@@ -0,0 +1,302 @@
+package network
+
+import (
+	"crypto/rand"     // クエリIDの生成
+	"encoding/binary" // DNSメッセージの読み書き
+	"errors"          // エラーの生成
+	"fmt"             // 文字列の生成や出力、スキャン
+	"io"              // TCPでの読み込み
+	"net/netip"       // アドレスの表現
+	"os"              // タイムアウトのエラー
+	"strings"         // ドメイン名の分割
+	"time"            // タイムアウトの指定
+)
+
+const (
+	DNS_PORT       = 53
+	DNS_HEADER_LEN = 12
+	// UDPで受け取るDNSメッセージの上限（RFC 1035）
+	DNS_UDP_SIZE = 512
+
+	DNS_TYPE_A    = 1
+	DNS_TYPE_AAAA = 28
+	DNS_CLASS_IN  = 1
+
+	DNS_FLAG_QR = 0x8000 // 応答
+	DNS_FLAG_TC = 0x0200 // 切り詰め
+	DNS_FLAG_RD = 0x0100 // 再帰要求
+
+	DNS_RCODE_NXDOMAIN = 3
+
+	DNS_DEFAULT_TIMEOUT = 2 * time.Second
+	DNS_DEFAULT_RETRIES = 2
+)
+
+var (
+	ErrNoSuchHost = errors.New("no such host")
+	ErrDNSFormat  = errors.New("malformed dns message")
+)
+
+// Stackを使って上流のDNSサーバーに問い合わせる最小限のリゾルバ
+type Resolver struct {
+	stack  *Stack
+	server netip.AddrPort
+	// 1回の問い合わせの待ち時間
+	Timeout time.Duration
+	// タイムアウトした場合に送り直す回数
+	Retries int
+	// 切り詰められた（TC）応答を受け取った場合にTCPで問い合わせ直す
+	UseTCPOnTruncate bool
+}
+
+// serverに問い合わせるResolverを作成する。ポートが0の場合は53を使う
+func NewResolver(stack *Stack, server netip.AddrPort) *Resolver {
+	if server.Port() == 0 {
+		server = netip.AddrPortFrom(server.Addr(), DNS_PORT)
+	}
+	return &Resolver{
+		stack:            stack,
+		server:           server,
+		Timeout:          DNS_DEFAULT_TIMEOUT,
+		Retries:          DNS_DEFAULT_RETRIES,
+		UseTCPOnTruncate: true,
+	}
+}
+
+// nameのAレコードとAAAAレコードを問い合わせ、アドレスを返す
+// どちらの問い合わせでもアドレスが得られなかった場合はエラーを返す
+func (r *Resolver) LookupHost(name string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	var firstErr error
+	for _, qtype := range []uint16{DNS_TYPE_A, DNS_TYPE_AAAA} {
+		got, err := r.lookup(name, qtype)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		addrs = append(addrs, got...)
+	}
+	if len(addrs) == 0 {
+		if firstErr == nil {
+			firstErr = ErrNoSuchHost
+		}
+		return nil, fmt.Errorf("lookup %s: %w", name, firstErr)
+	}
+	return addrs, nil
+}
+
+// 1種類のレコードを問い合わせる
+func (r *Resolver) lookup(name string, qtype uint16) ([]netip.Addr, error) {
+	id, err := newDNSID()
+	if err != nil {
+		return nil, err
+	}
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.exchangeUDP(id, query)
+	if err != nil {
+		return nil, err
+	}
+	if resp.flags&DNS_FLAG_TC != 0 && r.UseTCPOnTruncate {
+		if resp, err = r.exchangeTCP(id, query); err != nil {
+			return nil, err
+		}
+	}
+	if rcode := resp.flags & 0x000f; rcode == DNS_RCODE_NXDOMAIN {
+		return nil, ErrNoSuchHost
+	} else if rcode != 0 {
+		return nil, fmt.Errorf("dns error: rcode %d", rcode)
+	}
+	var addrs []netip.Addr
+	for _, rr := range resp.answers {
+		if rr.class != DNS_CLASS_IN || rr.typ != qtype {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(rr.data); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// UDPで問い合わせ、IDが一致する応答を待つ。タイムアウトした場合はRetries回まで送り直す
+func (r *Resolver) exchangeUDP(id uint16, query []byte) (*dnsMessage, error) {
+	conn, err := r.stack.ListenUDP(0)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+		if err := conn.WriteToAddrPort(query, r.server); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(r.Timeout))
+		for {
+			b, from, err := conn.ReadFromAddrPort()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			// 別の送信元や古い問い合わせへの応答は読み捨てる
+			if from != r.server {
+				continue
+			}
+			resp, err := parseDNSMessage(b)
+			if err != nil || resp.id != id || resp.flags&DNS_FLAG_QR == 0 {
+				continue
+			}
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("dns error: %w", os.ErrDeadlineExceeded)
+}
+
+// TCPで問い合わせる。メッセージの前には2バイトの長さが付く（RFC 1035 4.2.2）
+func (r *Resolver) exchangeTCP(id uint16, query []byte) (*dnsMessage, error) {
+	conn, err := r.stack.DialTCPTimeout(r.server, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg[0:2], uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	resp, err := parseDNSMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	if resp.id != id {
+		return nil, fmt.Errorf("dns error: id mismatch %d != %d", resp.id, id)
+	}
+	return resp, nil
+}
+
+func newDNSID() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[:]), nil
+}
+
+// 再帰要求付きの問い合わせを作る
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, DNS_HEADER_LEN, DNS_HEADER_LEN+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	binary.BigEndian.PutUint16(b[2:4], DNS_FLAG_RD)
+	binary.BigEndian.PutUint16(b[4:6], 1) // QDCOUNT
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return nil, fmt.Errorf("invalid dns name: %q", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid dns name: %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, DNS_CLASS_IN)
+	return b, nil
+}
+
+// DNSメッセージのうちリゾルバが使う部分
+type dnsMessage struct {
+	id      uint16
+	flags   uint16
+	answers []dnsRR
+}
+
+type dnsRR struct {
+	typ   uint16
+	class uint16
+	data  []byte
+}
+
+func parseDNSMessage(b []byte) (*dnsMessage, error) {
+	if len(b) < DNS_HEADER_LEN {
+		return nil, ErrDNSFormat
+	}
+	m := &dnsMessage{
+		id:    binary.BigEndian.Uint16(b[0:2]),
+		flags: binary.BigEndian.Uint16(b[2:4]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:6]))
+	an := int(binary.BigEndian.Uint16(b[6:8]))
+	off := DNS_HEADER_LEN
+	for i := 0; i < qd; i++ {
+		var err error
+		if off, err = skipDNSName(b, off); err != nil {
+			return nil, err
+		}
+		off += 4 // QTYPE, QCLASS
+	}
+	for i := 0; i < an; i++ {
+		var err error
+		if off, err = skipDNSName(b, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(b) {
+			return nil, ErrDNSFormat
+		}
+		rr := dnsRR{
+			typ:   binary.BigEndian.Uint16(b[off : off+2]),
+			class: binary.BigEndian.Uint16(b[off+2 : off+4]),
+		}
+		rdlen := int(binary.BigEndian.Uint16(b[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(b) {
+			return nil, ErrDNSFormat
+		}
+		rr.data = b[off : off+rdlen]
+		off += rdlen
+		m.answers = append(m.answers, rr)
+	}
+	return m, nil
+}
+
+// 名前を読み飛ばし、次の位置を返す
+// 圧縮ポインタ（上位2ビットが11）は2バイトで名前が終わる
+func skipDNSName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return 0, ErrDNSFormat
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(b) {
+				return 0, ErrDNSFormat
+			}
+			return off + 2, nil
+		case l&0xc0 != 0:
+			return 0, ErrDNSFormat
+		default:
+			off += 1 + l
+		}
+	}
+}
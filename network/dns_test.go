@@ -0,0 +1,229 @@
+package network
+
+import (
+	"encoding/binary" // DNSメッセージの読み書き
+	"errors"          // エラーの判定
+	"io"              // TCPでの読み込み
+	"net/netip"       // アドレスの表現
+	"os"              // タイムアウトのエラー
+	"sort"            // 結果の並べ替え
+	"sync/atomic"     // 問い合わせの回数
+	"testing"
+	"time" // タイムアウトの指定
+)
+
+// queryへの応答を作る。answersは4バイトならA、16バイトならAAAAのレコードにする
+func dnsReply(query []byte, id uint16, flags uint16, answers ...[]byte) []byte {
+	b := make([]byte, DNS_HEADER_LEN)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	binary.BigEndian.PutUint16(b[2:4], DNS_FLAG_QR|DNS_FLAG_RD|flags)
+	binary.BigEndian.PutUint16(b[4:6], 1)
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(answers)))
+	b = append(b, query[DNS_HEADER_LEN:]...)
+	for _, a := range answers {
+		typ := uint16(DNS_TYPE_A)
+		if len(a) == 16 {
+			typ = DNS_TYPE_AAAA
+		}
+		// 名前は質問の名前への圧縮ポインタ
+		b = append(b, 0xc0, DNS_HEADER_LEN)
+		b = binary.BigEndian.AppendUint16(b, typ)
+		b = binary.BigEndian.AppendUint16(b, DNS_CLASS_IN)
+		b = binary.BigEndian.AppendUint32(b, 300)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a)))
+		b = append(b, a...)
+	}
+	return b
+}
+
+// 問い合わせのIDと種類
+func dnsQuestion(query []byte) (id, qtype uint16) {
+	return binary.BigEndian.Uint16(query[0:2]), binary.BigEndian.Uint16(query[len(query)-4:])
+}
+
+// sbの53番ポートでUDPの問い合わせを受け、handlerが返した応答を全て送り返す
+// handlerには何番目の問い合わせか（0から）を渡す
+func serveDNS(t *testing.T, sb *Stack, handler func(n int, query []byte) [][]byte) *atomic.Int32 {
+	t.Helper()
+	conn, err := sb.ListenUDP(DNS_PORT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var count atomic.Int32
+	go func() {
+		for {
+			query, from, err := conn.ReadFromAddrPort()
+			if err != nil {
+				return
+			}
+			n := int(count.Add(1)) - 1
+			for _, reply := range handler(n, query) {
+				// 送れなかった応答はリゾルバ側のタイムアウトとして現れる
+				conn.WriteToAddrPort(reply, from)
+			}
+		}
+	}()
+	return &count
+}
+
+// sbに問い合わせる、待ち時間を短くしたリゾルバ
+func testResolver(sa *Stack) *Resolver {
+	r := NewResolver(sa, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), 0))
+	r.Timeout = 200 * time.Millisecond
+	return r
+}
+
+// AとAAAAの両方を問い合わせ、IDの異なる応答は読み捨てて一致する応答を使うこと
+func TestResolverLookupHost(t *testing.T) {
+	sa, sb := stackPair(t)
+	v4 := netip.MustParseAddr("192.0.2.10")
+	v6 := netip.MustParseAddr("2001:db8::10")
+	serveDNS(t, sb, func(_ int, query []byte) [][]byte {
+		id, qtype := dnsQuestion(query)
+		answer := v4.AsSlice()
+		if qtype == DNS_TYPE_AAAA {
+			answer = v6.AsSlice()
+		}
+		// 先に古い問い合わせへの応答を装ったものを送る
+		stale := dnsReply(query, id+1, 0, netip.MustParseAddr("203.0.113.66").AsSlice())
+		return [][]byte{stale, dnsReply(query, id, 0, answer)}
+	})
+
+	got, err := testResolver(sa).LookupHost("www.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Less(got[j]) })
+	if len(got) != 2 || got[0] != v4 || got[1] != v6 {
+		t.Fatalf("got %v, want [%s %s]", got, v4, v6)
+	}
+}
+
+// 応答がなければTimeoutごとに送り直し、Retries回を超えたらタイムアウトのエラーにすること
+func TestResolverRetry(t *testing.T) {
+	sa, sb := stackPair(t)
+	v4 := netip.MustParseAddr("192.0.2.20")
+	count := serveDNS(t, sb, func(n int, query []byte) [][]byte {
+		// 最初の問い合わせは失われたものとする
+		if n == 0 {
+			return nil
+		}
+		id, _ := dnsQuestion(query)
+		return [][]byte{dnsReply(query, id, 0, v4.AsSlice())}
+	})
+	r := testResolver(sa)
+	got, err := r.lookup("retry.example", DNS_TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != v4 || count.Load() != 2 {
+		t.Fatalf("got %v after %d queries, want [%s] after 2", got, count.Load(), v4)
+	}
+
+	// 応答しないサーバーには1+Retries回送って諦める
+	sa2, sb2 := stackPair(t)
+	silent := serveDNS(t, sb2, func(int, []byte) [][]byte { return nil })
+	r = testResolver(sa2)
+	r.Timeout = 50 * time.Millisecond
+	r.Retries = 2
+	if _, err := r.lookup("silent.example", DNS_TYPE_A); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if got := silent.Load(); got != 3 {
+		t.Fatalf("sent %d queries, want 3", got)
+	}
+}
+
+// NXDOMAINはErrNoSuchHostに、その他のRCODEはエラーにすること
+func TestResolverRcode(t *testing.T) {
+	sa, sb := stackPair(t)
+	var rcode atomic.Int32
+	serveDNS(t, sb, func(_ int, query []byte) [][]byte {
+		id, _ := dnsQuestion(query)
+		return [][]byte{dnsReply(query, id, uint16(rcode.Load()))}
+	})
+	r := testResolver(sa)
+	rcode.Store(DNS_RCODE_NXDOMAIN)
+	if _, err := r.LookupHost("missing.example"); !errors.Is(err, ErrNoSuchHost) {
+		t.Fatalf("nxdomain: got %v, want ErrNoSuchHost", err)
+	}
+	rcode.Store(2) // SERVFAIL
+	if _, err := r.LookupHost("broken.example"); err == nil || errors.Is(err, ErrNoSuchHost) {
+		t.Fatalf("servfail: got %v", err)
+	}
+}
+
+// 切り詰められた応答を受け取るとTCPで問い合わせ直すこと
+func TestResolverTruncatedFallsBackToTCP(t *testing.T) {
+	sa, sb := stackPair(t)
+	v4 := netip.MustParseAddr("192.0.2.30")
+	serveDNS(t, sb, func(_ int, query []byte) [][]byte {
+		id, _ := dnsQuestion(query)
+		return [][]byte{dnsReply(query, id, DNS_FLAG_TC)}
+	})
+	l, err := sb.ListenTCP(DNS_PORT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		var n [2]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			t.Error(err)
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(c, query); err != nil {
+			t.Error(err)
+			return
+		}
+		id, _ := dnsQuestion(query)
+		reply := dnsReply(query, id, 0, v4.AsSlice())
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	r := testResolver(sa)
+	r.Timeout = 2 * time.Second
+	got, err := r.lookup("big.example", DNS_TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != v4 {
+		t.Fatalf("got %v, want [%s]", got, v4)
+	}
+}
+
+// 不正な名前の問い合わせは作らず、壊れたメッセージはErrDNSFormatにすること
+func TestDNSMessageFormat(t *testing.T) {
+	for _, name := range []string{"", ".", "a..b", string(make([]byte, 64)) + ".example"} {
+		if _, err := buildDNSQuery(1, name, DNS_TYPE_A); err == nil {
+			t.Errorf("built a query for %q", name)
+		}
+	}
+	query, err := buildDNSQuery(0x1234, "www.example.com", DNS_TYPE_A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := dnsReply(query, 0x1234, 0, []byte{192, 0, 2, 1})
+	m, err := parseDNSMessage(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.id != 0x1234 || len(m.answers) != 1 || m.answers[0].typ != DNS_TYPE_A {
+		t.Fatalf("parsed %+v", m)
+	}
+	for _, n := range []int{DNS_HEADER_LEN - 1, len(query), len(reply) - 1} {
+		if _, err := parseDNSMessage(reply[:n]); !errors.Is(err, ErrDNSFormat) {
+			t.Errorf("%d bytes: got %v, want ErrDNSFormat", n, err)
+		}
+	}
+}
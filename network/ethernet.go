@@ -0,0 +1,86 @@
+package network
+
+import (
+	"crypto/rand"     // MACアドレスの生成
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // MACアドレスの表現
+)
+
+const ETHERNET_HEADER_LEN = 14
+
+// EtherType
+const (
+	ETHERTYPE_IPV4 = 0x0800
+	ETHERTYPE_ARP  = 0x0806
+	ETHERTYPE_IPV6 = 0x86dd
+)
+
+var BroadcastHardwareAddr = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// ローカル管理（U/Lビット）のユニキャストのMACアドレスを乱数で生成する
+// 既存の機器のアドレスと衝突しないため、TAPデバイスに設定するアドレスとして使える
+func GenerateHardwareAddr() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return nil, fmt.Errorf("generate hardware address error: %s", err.Error())
+	}
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac, nil
+}
+
+// インターフェースに設定できるMACアドレスか調べる
+// 6バイトのユニキャストで全て0でないこと。ローカル管理のビットは、実在する機器のアドレスを引き継ぐ場合もあるため求めない
+func validHardwareAddr(mac net.HardwareAddr) error {
+	if len(mac) != 6 {
+		return fmt.Errorf("invalid hardware address: %s (must be 6 bytes)", mac)
+	}
+	if mac[0]&0x01 != 0 {
+		return fmt.Errorf("invalid hardware address: %s is multicast", mac)
+	}
+	if mac[0]|mac[1]|mac[2]|mac[3]|mac[4]|mac[5] == 0 {
+		return fmt.Errorf("invalid hardware address: %s", mac)
+	}
+	return nil
+}
+
+// IPv4のマルチキャストアドレスに対応するMACアドレスを返す
+// 01:00:5e に続けてアドレスの下位23ビットを入れる（RFC 1112 6.4）。ARPでは解決しない
+func MulticastHardwareAddr(ip net.IP) (net.HardwareAddr, error) {
+	ip4 := ip.To4()
+	if ip4 == nil || !ip4.IsMulticast() {
+		return nil, fmt.Errorf("invalid multicast address: %s", ip)
+	}
+	return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}, nil
+}
+
+// Ethernetヘッダ
+type EthernetHeader struct {
+	Dst       net.HardwareAddr
+	Src       net.HardwareAddr
+	EtherType uint16
+}
+
+// Ethernetヘッダを解析し、ヘッダとペイロードを返す
+func ParseEthernet(b []byte) (*EthernetHeader, []byte, error) {
+	if len(b) < ETHERNET_HEADER_LEN {
+		return nil, nil, fmt.Errorf("invalid ethernet header: too short (%d bytes)", len(b))
+	}
+	return &EthernetHeader{
+		Dst:       net.HardwareAddr(b[0:6]),
+		Src:       net.HardwareAddr(b[6:12]),
+		EtherType: binary.BigEndian.Uint16(b[12:14]),
+	}, b[ETHERNET_HEADER_LEN:], nil
+}
+
+// Ethernetヘッダにペイロードを続けたフレームのバイト列を返す
+func (h *EthernetHeader) MarshalWithPayload(payload []byte) ([]byte, error) {
+	if len(h.Dst) != 6 || len(h.Src) != 6 {
+		return nil, fmt.Errorf("invalid ethernet address: dst %s, src %s", h.Dst, h.Src)
+	}
+	b := make([]byte, ETHERNET_HEADER_LEN, ETHERNET_HEADER_LEN+len(payload))
+	copy(b[0:6], h.Dst)
+	copy(b[6:12], h.Src)
+	binary.BigEndian.PutUint16(b[12:14], h.EtherType)
+	return append(b, payload...), nil
+}
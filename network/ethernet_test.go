@@ -0,0 +1,110 @@
+package network
+
+import (
+	"bytes"     // MACアドレスの比較
+	"errors"    // エラーの生成
+	"net"       // IPアドレスやMACアドレスの表現
+	"net/netip" // アドレスとポートの表現
+	"testing"
+	"time" // 解決の期限
+)
+
+// インターフェースに設定できるのは6バイトのユニキャストで全て0でないアドレスだけであること
+func TestValidHardwareAddr(t *testing.T) {
+	for _, tc := range []struct {
+		mac net.HardwareAddr
+		ok  bool
+	}{
+		{arpLocalMAC, true},
+		// 実在する機器のアドレス（グローバル）も設定できる
+		{arpPeerMAC, true},
+		{net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}, false},
+		{net.HardwareAddr{0, 0, 0, 0, 0, 0}, false},
+		{net.HardwareAddr{0x02, 0, 0, 0, 1}, false},
+		{net.HardwareAddr{0x02, 0, 0, 0, 0, 0, 0, 1}, false},
+	} {
+		if err := validHardwareAddr(tc.mac); (err == nil) != tc.ok {
+			t.Fatalf("%s: got %v, want ok %v", tc.mac, err, tc.ok)
+		}
+	}
+	// 生成するアドレスはローカル管理のユニキャスト
+	for i := 0; i < 16; i++ {
+		mac, err := GenerateHardwareAddr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mac[0]&0x02 == 0 || validHardwareAddr(mac) != nil {
+			t.Fatalf("generated %s", mac)
+		}
+	}
+}
+
+// マルチキャストのアドレスの下位23ビットを01:00:5eに続けたMACアドレスにすること（RFC 1112 6.4）
+func TestMulticastHardwareAddr(t *testing.T) {
+	for _, tc := range []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.IPv4(224, 0, 0, 251), "01:00:5e:00:00:fb"},
+		{net.IPv4(239, 1, 2, 3), "01:00:5e:01:02:03"},
+		// 上位の1ビットは捨てられる
+		{net.IPv4(239, 129, 2, 3), "01:00:5e:01:02:03"},
+		{net.IPv4(239, 255, 255, 250), "01:00:5e:7f:ff:fa"},
+	} {
+		mac, err := MulticastHardwareAddr(tc.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mac.String() != tc.want {
+			t.Fatalf("%s: got %s, want %s", tc.ip, mac, tc.want)
+		}
+	}
+	for _, ip := range []net.IP{net.IPv4(10, 0, 0, 1), net.ParseIP("ff02::fb"), nil} {
+		if _, err := MulticastHardwareAddr(ip); err == nil {
+			t.Fatalf("%s: accepted a non-ipv4-multicast address", ip)
+		}
+	}
+}
+
+// マルチキャストの送信は設定したTTLで送り、TAPのフレームの宛先はARPを使わずに決まること
+func TestMulticastSendFrame(t *testing.T) {
+	s, peer := rawPeer(t)
+	c, err := s.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetMulticastTTL(8)
+	group := netip.MustParseAddrPort("239.255.255.250:1900")
+	if err := c.WriteToAddrPort([]byte("M-SEARCH"), group); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, peer)
+	defer pkt.Release()
+	ip, _, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.TTL != 8 || !ip.Dst.Equal(net.IP(group.Addr().AsSlice())) {
+		t.Fatalf("sent to %s with ttl %d, want %s ttl 8", ip.Dst, ip.TTL, group.Addr())
+	}
+
+	cache := NewARPCache(func(ip net.IP) error { return errors.New("arp request for a multicast address") })
+	defer cache.Close()
+	dst, err := cache.Resolve(ip.Dst, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth := EthernetHeader{Dst: dst, Src: arpLocalMAC, EtherType: ETHERTYPE_IPV4}
+	frame, err := eth.MarshalWithPayload(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := ParseEthernet(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (net.HardwareAddr{0x01, 0x00, 0x5e, 0x7f, 0xff, 0xfa}); !bytes.Equal(got.Dst, want) {
+		t.Fatalf("frame to %s, want %s", got.Dst, want)
+	}
+}
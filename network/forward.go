@@ -0,0 +1,85 @@
+package network
+
+import (
+	"encoding/binary" // ヘッダの書き換え
+	"errors"          // エラーの生成
+)
+
+var ErrTTLExceeded = errors.New("ttl exceeded")
+
+// t で受信したIPv4パケットを out に転送する
+// TTLを1減らし、ヘッダのチェックサムはRFC 1624の差分更新で書き換える
+// SetMSSClampを設定した場合は、TCPのSYNとSYN-ACKのMSSオプションも書き換える
+// TTLが尽きた場合は転送せずに t へICMP時間超過を返し（SetICMPRateLimitの上限まで）、ErrTTLExceededを返す
+// out のMTUを超えるパケットはフラグメントに分割する。DFが立っている場合は分割せずに破棄し、
+// t へ次ホップのMTUを載せたICMPフラグメント化要求を返して（RFC 1191）、ErrFragmentationNeededを返す
+// pktのバッファはその場で書き換えて out に渡すため、呼び出し後は pkt を使ってはならない
+// （プールのバッファは送信後に返却される）
+func (t *NetDevice) Forward(pkt Packet, out Device) error {
+	b := pkt.Buf[:pkt.Len()]
+	ip, payload, err := ParseIPv4(b)
+	if err != nil {
+		pkt.Release()
+		return err
+	}
+	if ip.TTL <= 1 {
+		return t.forwardError(pkt, ip, payload, ICMPMessage{Type: ICMP_TYPE_TIME_EXCEEDED, Code: ICMP_CODE_TTL_EXCEEDED}, ErrTTLExceeded)
+	}
+	if mss := t.mssClamp.Load(); mss != 0 {
+		// ipとpayloadはbを参照しているため、フラグメントに分割する場合も書き換えた内容が使われる
+		ClampMSS(b, uint16(mss))
+	}
+	mtu, err := out.GetMTU()
+	if err != nil || mtu < MIN_MTU {
+		mtu = DEFAULT_MTU
+	}
+	if len(b) > mtu {
+		if ip.Flags&IPV4_FLAG_DF != 0 {
+			msg := ICMPMessage{Type: ICMP_TYPE_DEST_UNREACHABLE, Code: ICMP_CODE_FRAGMENTATION_NEEDED, Seq: uint16(mtu)}
+			return t.forwardError(pkt, ip, payload, msg, ErrFragmentationNeeded)
+		}
+		// 元のヘッダはチェックサムを含めて作り直すため、TTLだけを減らしておく
+		ip.TTL--
+		frags, err := FragmentIPv4(ip, payload, mtu)
+		pkt.Release()
+		if err != nil {
+			return err
+		}
+		for _, f := range frags {
+			if err := out.WritePacket(bytesPacket(f)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// TTLとプロトコル番号は同じ16ビットのワードに含まれる
+	old := binary.BigEndian.Uint16(b[8:10])
+	b[8]--
+	sum := UpdateChecksum(binary.BigEndian.Uint16(b[10:12]), old, binary.BigEndian.Uint16(b[8:10]))
+	binary.BigEndian.PutUint16(b[10:12], sum)
+	return out.WritePacket(pkt)
+}
+
+// 転送できなかったパケットを破棄し、t へICMPエラーを返してerrを返す
+// SetICMPRateLimitの上限を超えた場合はICMPエラーを送らない
+func (t *NetDevice) forwardError(pkt Packet, ip *IPv4Header, payload []byte, msg ICMPMessage, err error) error {
+	if !t.icmpLimit.allow() {
+		pkt.Release()
+		return err
+	}
+	reply, buildErr := buildICMPError(msg, ip, payload)
+	pkt.Release()
+	if buildErr != nil {
+		return buildErr
+	}
+	if writeErr := t.WritePacket(reply); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// Forwardが返すICMP時間超過とフラグメント化要求の1秒あたりの上限を設定する。既定はICMP_RATE_LIMIT
+// 0以下の場合は制限しない
+func (t *NetDevice) SetICMPRateLimit(perSecond int) {
+	t.icmpLimit.setRate(perSecond)
+}
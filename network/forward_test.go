@@ -0,0 +1,155 @@
+package network
+
+import (
+	"context" // 読み込みの期限
+	"errors"  // エラーの判定
+	"testing"
+	"time" // 読み込みの期限
+)
+
+// 受信側のデバイスとその先のピアを作成する
+func forwardPair(t *testing.T) (*NetDevice, *NetDevice) {
+	t.Helper()
+	in, peer := NewPipePair()
+	in.Bind()
+	peer.Bind()
+	t.Cleanup(func() {
+		in.Close()
+		peer.Close()
+	})
+	return in, peer
+}
+
+// ピアに届いたICMPメッセージを読み込む
+func readICMP(t *testing.T, peer *NetDevice) (*IPv4Header, *ICMPMessage) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	pkt, err := peer.ReadContext(ctx)
+	if err != nil {
+		t.Fatalf("no icmp reply: %s", err)
+	}
+	defer pkt.Release()
+	ip, payload, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Protocol != PROTOCOL_ICMP {
+		t.Fatalf("reply protocol %d, want icmp", ip.Protocol)
+	}
+	msg, err := ParseICMP(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip, msg
+}
+
+// DFが立っていて次ホップのMTUを超えるデータグラムは分割せずに破棄し、
+// 受信したデバイスへ次ホップのMTUを載せたICMPフラグメント化要求を返すこと
+func TestForwardFragmentationNeeded(t *testing.T) {
+	in, peer := forwardPair(t)
+	const nextHop = 1000
+	out := &recordDevice{mtu: nextHop}
+	ip := IPv4Header{ID: 1, Flags: IPV4_FLAG_DF, TTL: 64, Protocol: PROTOCOL_UDP, Src: testRemote, Dst: testLocal}
+	b, err := ip.MarshalWithPayload(make([]byte, 1200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Forward(bytesPacket(b), out); !errors.Is(err, ErrFragmentationNeeded) {
+		t.Fatalf("got %v, want ErrFragmentationNeeded", err)
+	}
+	if len(out.written) != 0 {
+		t.Fatalf("forwarded %d packets", len(out.written))
+	}
+	reply, msg := readICMP(t, peer)
+	if msg.Type != ICMP_TYPE_DEST_UNREACHABLE || msg.Code != ICMP_CODE_FRAGMENTATION_NEEDED {
+		t.Fatalf("icmp type %d code %d, want 3/4", msg.Type, msg.Code)
+	}
+	// RFC 1191：残り4バイトの下位16ビットが次ホップのMTU
+	if msg.Seq != nextHop {
+		t.Fatalf("next-hop mtu %d, want %d", msg.Seq, nextHop)
+	}
+	if !reply.Dst.Equal(testRemote) {
+		t.Fatalf("reply sent to %s, want %s", reply.Dst, testRemote)
+	}
+	orig, _, err := ParseICMPErrorOrigin(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig.ID != ip.ID || !orig.Dst.Equal(testLocal) {
+		t.Fatalf("icmp quotes %+v", orig)
+	}
+
+	// DFが無ければ分割して転送する
+	ip.Flags = 0
+	b, err = ip.MarshalWithPayload(make([]byte, 1200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Forward(bytesPacket(b), out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.written) < 2 {
+		t.Fatalf("forwarded %d packets, want fragments", len(out.written))
+	}
+	for _, f := range out.written {
+		if len(f) > nextHop {
+			t.Fatalf("fragment of %d bytes exceeds mtu %d", len(f), nextHop)
+		}
+	}
+}
+
+// 2つのデバイスの間でパケットを転送し、TTLが1つ減って届くこと
+// TTLが尽きるパケットは転送せず、受信したデバイスへICMP時間超過を返すこと
+func TestForwardBetweenDevices(t *testing.T) {
+	in, src := forwardPair(t)
+	out, dst := forwardPair(t)
+	send := func(ttl uint8) {
+		t.Helper()
+		ip := IPv4Header{ID: uint16(ttl), TTL: ttl, Protocol: PROTOCOL_UDP, Src: testRemote, Dst: testLocal}
+		b, err := ip.MarshalWithPayload([]byte("forwarded"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.WriteBytes(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(64)
+	pkt := readPacket(t, in)
+	if err := in.Forward(pkt, out); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, dst)
+	ip, payload, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		t.Fatalf("forwarded packet: %s", err)
+	}
+	if ip.TTL != 63 || ip.ID != 64 || string(payload) != "forwarded" {
+		t.Fatalf("forwarded ttl %d id %d payload %q, want 63 64 forwarded", ip.TTL, ip.ID, payload)
+	}
+	pkt.Release()
+
+	send(1)
+	pkt = readPacket(t, in)
+	if err := in.Forward(pkt, out); !errors.Is(err, ErrTTLExceeded) {
+		t.Fatalf("got %v, want ErrTTLExceeded", err)
+	}
+	_, msg := readICMP(t, src)
+	if msg.Type != ICMP_TYPE_TIME_EXCEEDED || msg.Code != ICMP_CODE_TTL_EXCEEDED {
+		t.Fatalf("icmp type %d code %d, want 11/0", msg.Type, msg.Code)
+	}
+	orig, _, err := ParseICMPErrorOrigin(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig.ID != 1 {
+		t.Fatalf("icmp quotes id %d, want 1", orig.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := dst.ReadContext(ctx); err == nil {
+		t.Fatal("expired packet was forwarded")
+	}
+}
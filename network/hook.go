@@ -0,0 +1,98 @@
+package network
+
+import (
+	"fmt" // 文字列の生成や出力、スキャン
+)
+
+// フックの判定
+type HookAction int
+
+const (
+	HookAccept HookAction = iota // そのまま通す
+	HookDrop                     // 破棄する
+	HookModify                   // フックが返したパケットに置き換える
+)
+
+func (a HookAction) String() string {
+	switch a {
+	case HookAccept:
+		return "accept"
+	case HookDrop:
+		return "drop"
+	case HookModify:
+		return "modify"
+	default:
+		return fmt.Sprintf("HookAction(%d)", int(a))
+	}
+}
+
+// パケットを検査するフック
+// 返したパケットはHookModifyの場合にのみ使われる
+// 受信したパケットのBufをその場で書き換えて返す場合は、引数のパケットをそのまま
+// （Buf/Nだけを変えて）返す。新しいパケットを返した場合、元のバッファはプールに返却される
+type Hook func(pkt Packet) (HookAction, Packet)
+
+// 受信のフックを設定する。nilで解除する
+// 読み込みのゴルーチンが受信キューに入れる前に呼び出す
+func (t *NetDevice) SetIngressHook(h Hook) {
+	if h == nil {
+		t.ingressHook.Store(nil)
+		return
+	}
+	t.ingressHook.Store(&h)
+}
+
+// 送信のフックを設定する。nilで解除する
+// WritePacket/Writeが送信キューに入れる前に呼び出す
+func (t *NetDevice) SetEgressHook(h Hook) {
+	if h == nil {
+		t.egressHook.Store(nil)
+		return
+	}
+	t.egressHook.Store(&h)
+}
+
+// 受信のフックを適用する。破棄する場合はfalseを返す
+func (t *NetDevice) ingress(pkt Packet) (Packet, bool) {
+	h := t.ingressHook.Load()
+	if h == nil {
+		return pkt, true
+	}
+	action, repl := (*h)(pkt)
+	switch action {
+	case HookDrop:
+		t.stats.rxFiltered.Add(1)
+		pkt.Release()
+		return Packet{}, false
+	case HookModify:
+		if repl.ref != pkt.ref {
+			pkt.Release()
+		}
+		repl.normalize()
+		return repl, true
+	default:
+		return pkt, true
+	}
+}
+
+// 送信のフックを適用する。破棄する場合はfalseを返す
+func (t *NetDevice) egress(pkt Packet) (Packet, bool) {
+	h := t.egressHook.Load()
+	if h == nil {
+		return pkt, true
+	}
+	action, repl := (*h)(pkt)
+	switch action {
+	case HookDrop:
+		t.stats.txFiltered.Add(1)
+		pkt.Release()
+		return Packet{}, false
+	case HookModify:
+		if repl.ref != pkt.ref {
+			pkt.Release()
+		}
+		return repl, true
+	default:
+		return pkt, true
+	}
+}
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"bytes"       // データの比較
+	"context"     // 読み込みの期限
+	"sync/atomic" // フックの判定の切り替え
+	"testing"
+	"time" // 読み込みの期限
+)
+
+// devから期限までに何も読み込めないこと
+func expectNoPacket(t *testing.T, dev *NetDevice) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if pkt, err := dev.ReadContext(ctx); err == nil {
+		t.Fatalf("unexpected packet %x", pkt.Buf[:pkt.Len()])
+	}
+}
+
+// 受信のフックがDropしたパケットは受信キューに入らず、Accept・Modifyはそれぞれ届くこと
+func TestIngressHook(t *testing.T) {
+	a, b := forwardPair(t)
+	var action atomic.Int32
+	hooked := natUDP(t, testLocal, testRemote, 1, 53, "hooked")
+	b.SetIngressHook(func(pkt Packet) (HookAction, Packet) {
+		act := HookAction(action.Load())
+		if act == HookModify {
+			// 受信バッファをその場で書き換え、長さを縮める
+			pkt.N = uintptr(copy(pkt.Buf, hooked))
+		}
+		return act, pkt
+	})
+	send := func(payload string) []byte {
+		t.Helper()
+		p := natUDP(t, testLocal, testRemote, 1, 53, payload)
+		if err := a.WriteBytes(p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	action.Store(int32(HookDrop))
+	send("dropped")
+	expectNoPacket(t, b)
+	if got := b.Stats().RxFiltered; got != 1 {
+		t.Fatalf("rx filtered %d, want 1", got)
+	}
+
+	action.Store(int32(HookAccept))
+	want := send("accepted")
+	pkt := readPacket(t, b)
+	if !bytes.Equal(pkt.Buf[:pkt.Len()], want) {
+		t.Fatalf("got %x, want %x", pkt.Buf[:pkt.Len()], want)
+	}
+	pkt.Release()
+
+	action.Store(int32(HookModify))
+	send("a longer original payload")
+	pkt = readPacket(t, b)
+	if !bytes.Equal(pkt.Buf[:pkt.Len()], hooked) || len(pkt.Buf) != len(hooked) {
+		t.Fatalf("got %x (%d bytes buffer), want %x", pkt.Buf[:pkt.Len()], len(pkt.Buf), hooked)
+	}
+	pkt.Release()
+
+	// 解除すると全て届く
+	b.SetIngressHook(nil)
+	action.Store(int32(HookDrop))
+	send("after")
+	pkt = readPacket(t, b)
+	pkt.Release()
+	if got := b.Stats().RxFiltered; got != 1 {
+		t.Fatalf("rx filtered %d after clearing the hook, want 1", got)
+	}
+}
+
+// 送信のフックがDropしたパケットは書き込まず、Modifyは置き換えたパケットを書き込むこと
+func TestEgressHook(t *testing.T) {
+	a, b := forwardPair(t)
+	drop := natUDP(t, testLocal, testRemote, 1, 53, "drop")
+	replace := natUDP(t, testLocal, testRemote, 1, 53, "replace")
+	replaced := natUDP(t, testLocal, testRemote, 1, 53, "replaced")
+	keep := natUDP(t, testLocal, testRemote, 1, 53, "keep")
+	a.SetEgressHook(func(pkt Packet) (HookAction, Packet) {
+		switch buf := pkt.Buf[:pkt.Len()]; {
+		case bytes.Equal(buf, drop):
+			return HookDrop, pkt
+		case bytes.Equal(buf, replace):
+			return HookModify, bytesPacket(replaced)
+		}
+		return HookAccept, pkt
+	})
+	for _, p := range [][]byte{drop, replace, keep} {
+		if err := a.WriteBytes(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range [][]byte{replaced, keep} {
+		pkt := readPacket(t, b)
+		if got := pkt.Buf[:pkt.Len()]; !bytes.Equal(got, want) {
+			t.Fatalf("got %x, want %x", got, want)
+		}
+		pkt.Release()
+	}
+	expectNoPacket(t, b)
+	s := a.Stats()
+	if s.TxFiltered != 1 || s.TxPackets != 2 {
+		t.Fatalf("tx filtered %d packets %d, want 1 2", s.TxFiltered, s.TxPackets)
+	}
+}
+
+// 未定義の判定も数値で表示すること
+func TestHookActionString(t *testing.T) {
+	for a, want := range map[HookAction]string{HookAccept: "accept", HookDrop: "drop", HookModify: "modify", 7: "HookAction(7)"} {
+		if got := a.String(); got != want {
+			t.Fatalf("%d: got %q, want %q", int(a), got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+)
+
+const ICMP_HEADER_LEN = 8
+
+// ICMPのタイプ
+const (
+	ICMP_TYPE_ECHO_REPLY       = 0
+	ICMP_TYPE_DEST_UNREACHABLE = 3
+	ICMP_TYPE_ECHO_REQUEST     = 8
+	ICMP_TYPE_TIME_EXCEEDED    = 11
+)
+
+// ICMP到達不能のコード
+const (
+	ICMP_CODE_NET_UNREACHABLE      = 0
+	ICMP_CODE_HOST_UNREACHABLE     = 1
+	ICMP_CODE_PROTOCOL_UNREACHABLE = 2
+	ICMP_CODE_PORT_UNREACHABLE     = 3
+	ICMP_CODE_FRAGMENTATION_NEEDED = 4
+)
+
+// ICMP時間超過のコード
+const (
+	ICMP_CODE_TTL_EXCEEDED        = 0
+	ICMP_CODE_REASSEMBLY_EXCEEDED = 1
+)
+
+// ICMPメッセージ
+type ICMPMessage struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	// ヘッダの残り4バイト。エコー要求/応答では識別子とシーケンス番号
+	ID   uint16
+	Seq  uint16
+	Data []byte
+}
+
+// ICMPメッセージを解析する
+func ParseICMP(b []byte) (*ICMPMessage, error) {
+	return parseICMP(b, true)
+}
+
+// verifyがfalseの場合はチェックサムを検証しない（Decodeでの表示用）
+func parseICMP(b []byte, verify bool) (*ICMPMessage, error) {
+	if len(b) < ICMP_HEADER_LEN {
+		return nil, fmt.Errorf("invalid icmp message: too short (%d bytes)", len(b))
+	}
+	if verify && InternetChecksum(b) != 0 {
+		return nil, fmt.Errorf("invalid icmp message: %w", ErrBadChecksum)
+	}
+	return &ICMPMessage{
+		Type:     b[0],
+		Code:     b[1],
+		Checksum: binary.BigEndian.Uint16(b[2:4]),
+		ID:       binary.BigEndian.Uint16(b[4:6]),
+		Seq:      binary.BigEndian.Uint16(b[6:8]),
+		Data:     b[ICMP_HEADER_LEN:],
+	}, nil
+}
+
+// ICMPメッセージをバイト列に変換する
+// チェックサムは再計算してChecksumフィールドにも反映する
+func (m *ICMPMessage) Marshal() []byte {
+	b := make([]byte, ICMP_HEADER_LEN+len(m.Data))
+	b[0] = m.Type
+	b[1] = m.Code
+	binary.BigEndian.PutUint16(b[4:6], m.ID)
+	binary.BigEndian.PutUint16(b[6:8], m.Seq)
+	copy(b[ICMP_HEADER_LEN:], m.Data)
+
+	m.Checksum = InternetChecksum(b)
+	binary.BigEndian.PutUint16(b[2:4], m.Checksum)
+	return b
+}
+
+// エコー要求に対するエコー応答のパケットを作成する
+// 送信元と宛先を入れ替え、ICMPとIPのチェックサムを再計算する
+func BuildEchoReply(req ICMPMessage, ip *IPv4Header) (Packet, error) {
+	if req.Type != ICMP_TYPE_ECHO_REQUEST {
+		return Packet{}, fmt.Errorf("not an echo request: type %d", req.Type)
+	}
+	reply := ICMPMessage{
+		Type: ICMP_TYPE_ECHO_REPLY,
+		Code: 0,
+		ID:   req.ID,
+		Seq:  req.Seq,
+		Data: req.Data,
+	}
+	hdr := &IPv4Header{
+		TOS:      ip.TOS,
+		ID:       ip.ID,
+		TTL:      64,
+		Protocol: PROTOCOL_ICMP,
+		Src:      ip.Dst,
+		Dst:      ip.Src,
+	}
+	b, err := hdr.MarshalWithPayload(reply.Marshal())
+	if err != nil {
+		return Packet{}, err
+	}
+	return bytesPacket(b), nil
+}
+
+// 受信したパケットに対する到達不能メッセージを作成する
+// codeはICMP_CODE_PORT_UNREACHABLEなど。フラグメント化が必要な場合はBuildFragmentationNeededを使う
+func BuildDestUnreachable(orig *IPv4Header, origPayload []byte, code uint8) (Packet, error) {
+	return buildICMPError(ICMPMessage{Type: ICMP_TYPE_DEST_UNREACHABLE, Code: code}, orig, origPayload)
+}
+
+// フラグメント化が必要だがDFが立っていることを知らせる到達不能メッセージを作成する
+// ヘッダの残り4バイトの下位16ビットに次ホップのMTUを入れる（RFC 1191）
+func BuildFragmentationNeeded(orig *IPv4Header, origPayload []byte, mtu uint16) (Packet, error) {
+	return buildICMPError(ICMPMessage{Type: ICMP_TYPE_DEST_UNREACHABLE, Code: ICMP_CODE_FRAGMENTATION_NEEDED, Seq: mtu}, orig, origPayload)
+}
+
+// ICMPエラーメッセージを返してはならないパケットか（RFC 1122 3.2.2）
+// ICMPエラーメッセージ自身と、先頭以外のフラグメントには返さない
+func suppressICMPError(orig *IPv4Header, origPayload []byte) bool {
+	if orig.FragOffset != 0 {
+		return true
+	}
+	if orig.Protocol == PROTOCOL_ICMP && len(origPayload) > 0 {
+		switch origPayload[0] {
+		case ICMP_TYPE_ECHO_REPLY, ICMP_TYPE_ECHO_REQUEST:
+			return false
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// 受信したパケットに対するICMPエラーメッセージを作成する
+// msgのType/Code/ID/Seqを使い、元のIPヘッダとペイロードの先頭8バイトを含める（RFC 792）
+func buildICMPError(msg ICMPMessage, orig *IPv4Header, origPayload []byte) (Packet, error) {
+	if suppressICMPError(orig, origPayload) {
+		return Packet{}, fmt.Errorf("icmp error suppressed for protocol %d fragment offset %d", orig.Protocol, orig.FragOffset)
+	}
+	origHeader, err := orig.Marshal()
+	if err != nil {
+		return Packet{}, err
+	}
+	if len(origPayload) > 8 {
+		origPayload = origPayload[:8]
+	}
+	msg.Data = append(origHeader, origPayload...)
+	hdr := &IPv4Header{
+		TTL:      64,
+		Protocol: PROTOCOL_ICMP,
+		Src:      orig.Dst,
+		Dst:      orig.Src,
+	}
+	b, err := hdr.MarshalWithPayload(msg.Marshal())
+	if err != nil {
+		return Packet{}, err
+	}
+	return bytesPacket(b), nil
+}
+
+// ICMPエラーメッセージに含まれる元のIPヘッダとペイロードの先頭を取り出す
+// 元のパケットは切り詰められているため、TotalLengthとの整合性は検査しない
+func ParseICMPErrorOrigin(data []byte) (*IPv4Header, []byte, error) {
+	if len(data) < IPV4_MIN_HEADER_LEN {
+		return nil, nil, fmt.Errorf("invalid icmp error payload: too short (%d bytes)", len(data))
+	}
+	hlen := int(data[0]&0x0f) * 4
+	if data[0]>>4 != IPV4_VERSION || hlen < IPV4_MIN_HEADER_LEN || len(data) < hlen {
+		return nil, nil, fmt.Errorf("invalid icmp error payload: bad ipv4 header")
+	}
+	h := &IPv4Header{
+		Version:     IPV4_VERSION,
+		IHL:         data[0] & 0x0f,
+		TOS:         data[1],
+		TotalLength: binary.BigEndian.Uint16(data[2:4]),
+		ID:          binary.BigEndian.Uint16(data[4:6]),
+		Flags:       data[6] >> 5,
+		FragOffset:  binary.BigEndian.Uint16(data[6:8]) & 0x1fff,
+		TTL:         data[8],
+		Protocol:    data[9],
+		Checksum:    binary.BigEndian.Uint16(data[10:12]),
+		Src:         net.IPv4(data[12], data[13], data[14], data[15]).To4(),
+		Dst:         net.IPv4(data[16], data[17], data[18], data[19]).To4(),
+	}
+	if hlen > IPV4_MIN_HEADER_LEN {
+		h.Options = data[IPV4_MIN_HEADER_LEN:hlen]
+	}
+	return h, data[hlen:], nil
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"bytes" // データの比較
+	"testing"
+)
+
+// ICMPエラーのパケットを解析する。チェックサムの検証も兼ねる
+func parseICMPError(t *testing.T, pkt Packet) (*IPv4Header, *ICMPMessage) {
+	t.Helper()
+	ip, payload, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Protocol != PROTOCOL_ICMP {
+		t.Fatalf("protocol %d, want icmp", ip.Protocol)
+	}
+	msg, err := ParseICMP(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip, msg
+}
+
+// 元のIPヘッダとペイロードの先頭8バイトを含む到達不能メッセージを、送信元へ返すこと（RFC 792）
+func TestBuildDestUnreachable(t *testing.T) {
+	b := natUDP(t, testRemote, testLocal, 40000, 9, "a payload longer than eight bytes")
+	h, payload, err := ParseIPv4(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []uint8{ICMP_CODE_NET_UNREACHABLE, ICMP_CODE_HOST_UNREACHABLE, ICMP_CODE_PORT_UNREACHABLE} {
+		pkt, err := BuildDestUnreachable(h, payload, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, msg := parseICMPError(t, pkt)
+		if !ip.Src.Equal(testLocal) || !ip.Dst.Equal(testRemote) {
+			t.Fatalf("reply %s -> %s", ip.Src, ip.Dst)
+		}
+		if msg.Type != ICMP_TYPE_DEST_UNREACHABLE || msg.Code != code || msg.ID != 0 || msg.Seq != 0 {
+			t.Fatalf("icmp %+v", msg)
+		}
+		// 元のヘッダ（20バイト）とUDPヘッダ（8バイト）
+		if want := b[:IPV4_MIN_HEADER_LEN+8]; !bytes.Equal(msg.Data, want) {
+			t.Fatalf("quoted %x, want %x", msg.Data, want)
+		}
+	}
+
+	pkt, err := BuildFragmentationNeeded(h, payload, 1280)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := parseICMPError(t, pkt); msg.Code != ICMP_CODE_FRAGMENTATION_NEEDED || msg.Seq != 1280 {
+		t.Fatalf("fragmentation needed code %d mtu %d", msg.Code, msg.Seq)
+	}
+
+	// 8バイトに満たないペイロードはそのまま含める
+	pkt, err = BuildDestUnreachable(h, payload[:3], ICMP_CODE_PORT_UNREACHABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg := parseICMPError(t, pkt); len(msg.Data) != IPV4_MIN_HEADER_LEN+3 {
+		t.Fatalf("quoted %d bytes, want %d", len(msg.Data), IPV4_MIN_HEADER_LEN+3)
+	}
+}
+
+// ICMPエラーと先頭以外のフラグメントにはエラーを返さず、エコーには返すこと（RFC 1122 3.2.2）
+func TestBuildDestUnreachableSuppressed(t *testing.T) {
+	icmp := &IPv4Header{TTL: 64, Protocol: PROTOCOL_ICMP, Src: testRemote, Dst: testLocal}
+	for _, tc := range []struct {
+		name     string
+		h        *IPv4Header
+		payload  []byte
+		suppress bool
+	}{
+		{"icmp error", icmp, []byte{ICMP_TYPE_DEST_UNREACHABLE, 3, 0, 0, 0, 0, 0, 0}, true},
+		{"time exceeded", icmp, []byte{ICMP_TYPE_TIME_EXCEEDED, 0, 0, 0, 0, 0, 0, 0}, true},
+		{"echo request", icmp, []byte{ICMP_TYPE_ECHO_REQUEST, 0, 0, 0, 0, 1, 0, 1}, false},
+		{"later fragment", &IPv4Header{FragOffset: 185, TTL: 64, Protocol: PROTOCOL_UDP, Src: testRemote, Dst: testLocal}, make([]byte, 8), true},
+		{"first fragment", &IPv4Header{Flags: IPV4_FLAG_MF, TTL: 64, Protocol: PROTOCOL_UDP, Src: testRemote, Dst: testLocal}, make([]byte, 8), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := BuildDestUnreachable(tc.h, tc.payload, ICMP_CODE_PORT_UNREACHABLE)
+			if (err != nil) != tc.suppress {
+				t.Fatalf("err %v, want suppressed %v", err, tc.suppress)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+)
+
+// ICMPv6のタイプ
+const (
+	ICMPV6_TYPE_DEST_UNREACHABLE = 1
+	ICMPV6_TYPE_PACKET_TOO_BIG   = 2
+	ICMPV6_TYPE_TIME_EXCEEDED    = 3
+	ICMPV6_TYPE_ECHO_REQUEST     = 128
+	ICMPV6_TYPE_ECHO_REPLY       = 129
+)
+
+// ICMPv6メッセージを解析する
+// ヘッダの形式はICMPと同じだが、チェックサムにIPv6の疑似ヘッダを含める（RFC 4443）
+func ParseICMPv6(b []byte, ip *IPv6Header) (*ICMPMessage, error) {
+	if len(b) < ICMP_HEADER_LEN {
+		return nil, fmt.Errorf("invalid icmpv6 message: too short (%d bytes)", len(b))
+	}
+	if transportChecksum6(ip.Src, ip.Dst, PROTOCOL_ICMPV6, b) != 0 {
+		return nil, fmt.Errorf("invalid icmpv6 message: %w", ErrBadChecksum)
+	}
+	return &ICMPMessage{
+		Type:     b[0],
+		Code:     b[1],
+		Checksum: binary.BigEndian.Uint16(b[2:4]),
+		ID:       binary.BigEndian.Uint16(b[4:6]),
+		Seq:      binary.BigEndian.Uint16(b[6:8]),
+		Data:     b[ICMP_HEADER_LEN:],
+	}, nil
+}
+
+// ICMPv6メッセージをバイト列に変換する
+// チェックサムは疑似ヘッダを含めて再計算し、Checksumフィールドにも反映する
+func (m *ICMPMessage) MarshalV6(src, dst []byte) []byte {
+	b := make([]byte, ICMP_HEADER_LEN+len(m.Data))
+	b[0] = m.Type
+	b[1] = m.Code
+	binary.BigEndian.PutUint16(b[4:6], m.ID)
+	binary.BigEndian.PutUint16(b[6:8], m.Seq)
+	copy(b[ICMP_HEADER_LEN:], m.Data)
+
+	m.Checksum = transportChecksum6(src, dst, PROTOCOL_ICMPV6, b)
+	binary.BigEndian.PutUint16(b[2:4], m.Checksum)
+	return b
+}
+
+// ICMPv6のエコー要求に対するエコー応答のパケットを作成する
+func BuildEchoReplyV6(req ICMPMessage, ip *IPv6Header) (Packet, error) {
+	if req.Type != ICMPV6_TYPE_ECHO_REQUEST {
+		return Packet{}, fmt.Errorf("not an icmpv6 echo request: type %d", req.Type)
+	}
+	reply := ICMPMessage{
+		Type: ICMPV6_TYPE_ECHO_REPLY,
+		Code: 0,
+		ID:   req.ID,
+		Seq:  req.Seq,
+		Data: req.Data,
+	}
+	hdr := &IPv6Header{
+		TrafficClass: ip.TrafficClass,
+		HopLimit:     64,
+		Protocol:     PROTOCOL_ICMPV6,
+		Src:          ip.Dst,
+		Dst:          ip.Src,
+	}
+	b, err := hdr.MarshalWithPayload(reply.MarshalV6(hdr.Src, hdr.Dst))
+	if err != nil {
+		return Packet{}, err
+	}
+	return bytesPacket(b), nil
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"fmt"     // 文字列の生成や出力、スキャン
+	"net"     // IPアドレスやネットマスクの表現
+	"syscall" // ファイル操作やプロセス管理、ネットワーク操作
+	"unsafe"  // 低レベルなメモリ操作を行う
+)
+
+const (
+	SIOCSIFFLAGS = 0x80206910
+	SIOCGIFFLAGS = 0xc0206911
+	SIOCAIFADDR  = 0x8040691a
+	SIOCGIFMTU   = 0xc0206933
+	SIOCSIFMTU   = 0x80206934
+)
+
+// アドレスを追加するためのifaliasreq
+type ifaliasreq struct {
+	ifraName      [IFNAMSIZ]byte
+	ifraAddr      syscall.RawSockaddrInet4
+	ifraBroadaddr syscall.RawSockaddrInet4
+	ifraMask      syscall.RawSockaddrInet4
+}
+
+// MTUを設定するためのifreq
+type ifreqMTU struct {
+	ifrName [IFNAMSIZ]byte
+	ifrMTU  int32
+	_       [12]byte
+}
+
+// インターフェースを起動し、IPv4アドレスとネットマスクを設定する
+// ifconfig <name> <addr> <addr> netmask <mask> up に相当する
+// utunはポイントツーポイントのため、対向のアドレスにも自身のアドレスを設定する。
+// Linuxと違いサブネットへの経路は作られないため、route add -net で追加する
+func (t *NetDevice) ConfigureIPv4(addr net.IP, mask net.IPMask) error {
+	if t == nil || t.file == nil || t.name == "" {
+		return fmt.Errorf("device not created")
+	}
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return fmt.Errorf("invalid ipv4 address: %s", addr)
+	}
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if len(mask) != net.IPv4len {
+		return fmt.Errorf("invalid ipv4 mask: %s", mask)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket error: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	req := ifaliasreq{}
+	copy(req.ifraName[:IFNAMSIZ-1], []byte(t.name))
+	for _, sa := range []struct {
+		dst *syscall.RawSockaddrInet4
+		ip  net.IP
+	}{{&req.ifraAddr, ip4}, {&req.ifraBroadaddr, ip4}, {&req.ifraMask, net.IP(mask)}} {
+		sa.dst.Len = syscall.SizeofSockaddrInet4
+		sa.dst.Family = syscall.AF_INET
+		copy(sa.dst.Addr[:], sa.ip)
+	}
+	if err := ioctl(uintptr(fd), SIOCAIFADDR, uintptr(unsafe.Pointer(&req))); err != nil {
+		return err
+	}
+
+	ifr := ifreq{}
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(t.name))
+	if err := ioctl(uintptr(fd), SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); err != nil {
+		return err
+	}
+	ifr.ifrFlags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	return ioctl(uintptr(fd), SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+}
+
+// インターフェースのMTUを設定する
+func (t *NetDevice) SetMTU(mtu int) error {
+	if mtu < MIN_MTU || mtu > MAX_MTU {
+		return fmt.Errorf("invalid mtu: %d (must be %d..%d)", mtu, MIN_MTU, MAX_MTU)
+	}
+	ifr := ifreqMTU{ifrMTU: int32(mtu)}
+	return t.ifMTU(SIOCSIFMTU, &ifr)
+}
+
+// インターフェースのMTUを取得する
+func (t *NetDevice) GetMTU() (int, error) {
+	ifr := ifreqMTU{}
+	if err := t.ifMTU(SIOCGIFMTU, &ifr); err != nil {
+		return 0, err
+	}
+	return int(ifr.ifrMTU), nil
+}
+
+func (t *NetDevice) ifMTU(req uintptr, ifr *ifreqMTU) error {
+	if t == nil || t.file == nil || t.name == "" {
+		return fmt.Errorf("device not created")
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket error: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(t.name))
+	return ioctl(uintptr(fd), req, uintptr(unsafe.Pointer(ifr)))
+}
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"fmt"     // 文字列の生成や出力、スキャン
+	"net"     // IPアドレスやネットマスクの表現
+	"syscall" // ファイル操作やプロセス管理、ネットワーク操作
+	"unsafe"  // 低レベルなメモリ操作を行う
+)
+
+const (
+	SIOCGIFFLAGS   = 0x8913
+	SIOCSIFFLAGS   = 0x8914
+	SIOCSIFADDR    = 0x8916
+	SIOCSIFNETMASK = 0x891c
+	SIOCGIFMTU     = 0x8921
+	SIOCSIFMTU     = 0x8922
+	SIOCSIFHWADDR  = 0x8924
+	SIOCGIFHWADDR  = 0x8927
+)
+
+// アドレスを設定するためのifreq
+type ifreqAddr struct {
+	ifrName [IFNAMSIZ]byte
+	ifrAddr syscall.RawSockaddrInet4
+	_       [8]byte
+}
+
+// MTUを設定するためのifreq
+type ifreqMTU struct {
+	ifrName [IFNAMSIZ]byte
+	ifrMTU  int32
+	_       [20]byte
+}
+
+// MACアドレスを設定するためのifreq
+type ifreqHWAddr struct {
+	ifrName   [IFNAMSIZ]byte
+	ifrFamily uint16 // ARPHRD_ETHER
+	ifrData   [14]byte
+	_         [8]byte
+}
+
+// インターフェースを起動し、IPv4アドレスとネットマスクを設定する
+// ip link set <name> up と ip addr add <addr>/<mask> dev <name> に相当する
+func (t *NetDevice) ConfigureIPv4(addr net.IP, mask net.IPMask) error {
+	if t == nil || t.file == nil || t.name == "" {
+		return fmt.Errorf("device not created")
+	}
+	ip4 := addr.To4()
+	if ip4 == nil {
+		return fmt.Errorf("invalid ipv4 address: %s", addr)
+	}
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if len(mask) != net.IPv4len {
+		return fmt.Errorf("invalid ipv4 mask: %s", mask)
+	}
+
+	// インターフェースの設定にはAF_INETのソケットに対してioctlを呼び出す
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket error: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	if err := t.setIfAddr(fd, SIOCSIFADDR, ip4); err != nil {
+		return err
+	}
+	if err := t.setIfAddr(fd, SIOCSIFNETMASK, net.IP(mask)); err != nil {
+		return err
+	}
+
+	// 現在のフラグを取得し、IFF_UPとIFF_RUNNINGを加える
+	ifr := ifreq{}
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(t.name))
+	if err := ioctl(uintptr(fd), SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); err != nil {
+		return err
+	}
+	ifr.ifrFlags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	return ioctl(uintptr(fd), SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+}
+
+func (t *NetDevice) setIfAddr(fd int, req uintptr, ip net.IP) error {
+	ifr := ifreqAddr{}
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(t.name))
+	ifr.ifrAddr.Family = syscall.AF_INET
+	copy(ifr.ifrAddr.Addr[:], ip.To4())
+	return ioctl(uintptr(fd), req, uintptr(unsafe.Pointer(&ifr)))
+}
+
+// インターフェースのMTUを設定する
+func (t *NetDevice) SetMTU(mtu int) error {
+	if mtu < MIN_MTU || mtu > MAX_MTU {
+		return fmt.Errorf("invalid mtu: %d (must be %d..%d)", mtu, MIN_MTU, MAX_MTU)
+	}
+	ifr := ifreqMTU{ifrMTU: int32(mtu)}
+	return t.ifMTU(SIOCSIFMTU, &ifr)
+}
+
+// インターフェースのMTUを取得する
+func (t *NetDevice) GetMTU() (int, error) {
+	ifr := ifreqMTU{}
+	if err := t.ifMTU(SIOCGIFMTU, &ifr); err != nil {
+		return 0, err
+	}
+	return int(ifr.ifrMTU), nil
+}
+
+func (t *NetDevice) ifMTU(req uintptr, ifr *ifreqMTU) error {
+	if t == nil || t.file == nil || t.name == "" {
+		return fmt.Errorf("device not created")
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket error: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(t.name))
+	return ioctl(uintptr(fd), req, uintptr(unsafe.Pointer(ifr)))
+}
+
+// TAPデバイスのMACアドレスを設定する
+// ip link set <name> address <mac> に相当する。NewARPResponderで作った応答器も新しいアドレスで応答する
+func (t *NetDevice) SetHardwareAddr(mac net.HardwareAddr) error {
+	if err := validHardwareAddr(mac); err != nil {
+		return err
+	}
+	ifr := ifreqHWAddr{ifrFamily: syscall.ARPHRD_ETHER}
+	copy(ifr.ifrData[:], mac)
+	if err := t.ifHWAddr(SIOCSIFHWADDR, &ifr); err != nil {
+		return err
+	}
+	t.updateARPResponders(mac)
+	return nil
+}
+
+// TAPデバイスのMACアドレスを取得する
+func (t *NetDevice) HardwareAddr() (net.HardwareAddr, error) {
+	ifr := ifreqHWAddr{}
+	if err := t.ifHWAddr(SIOCGIFHWADDR, &ifr); err != nil {
+		return nil, err
+	}
+	return append(net.HardwareAddr(nil), ifr.ifrData[:6]...), nil
+}
+
+func (t *NetDevice) ifHWAddr(req uintptr, ifr *ifreqHWAddr) error {
+	if t == nil || t.file == nil || t.name == "" {
+		return fmt.Errorf("device not created")
+	}
+	if t.mode != ModeTAP {
+		return fmt.Errorf("hardware address error: %s is not a tap device", t.name)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket error: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(t.name))
+	return ioctl(uintptr(fd), req, uintptr(unsafe.Pointer(ifr)))
+}
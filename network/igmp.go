@@ -0,0 +1,264 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+	"net/netip"       // グループアドレスの表現
+	"sync"            // 排他制御
+	"time"            // 報告の遅延
+)
+
+const (
+	PROTOCOL_IGMP   = 2
+	IGMP_HEADER_LEN = 8
+	// 参加時の報告を繰り返すまでの最大の遅延（RFC 2236 8.10）
+	IGMP_UNSOLICITED_REPORT_INTERVAL = 10 * time.Second
+	// IGMPv1の問い合わせ（最大応答時間が0）に応答するまでの最大の遅延
+	IGMP_V1_MAX_RESPONSE_TIME = 10 * time.Second
+)
+
+// IGMPのタイプ
+const (
+	IGMP_TYPE_MEMBERSHIP_QUERY     = 0x11
+	IGMP_TYPE_V1_MEMBERSHIP_REPORT = 0x12
+	IGMP_TYPE_V2_MEMBERSHIP_REPORT = 0x16
+	IGMP_TYPE_LEAVE_GROUP          = 0x17
+)
+
+var (
+	// 全てのホストが常に参加しているグループ。報告は送らない
+	IGMPAllHosts = netip.AddrFrom4([4]byte{224, 0, 0, 1})
+	// 離脱の通知の宛先
+	IGMPAllRouters = netip.AddrFrom4([4]byte{224, 0, 0, 2})
+)
+
+// IPv4のRouter Alertオプション（RFC 2113）。IGMPv2のメッセージに付ける
+var ipv4RouterAlert = []byte{IPV4_OPT_ROUTER_ALERT, 4, 0, 0}
+
+// IGMPv2のメッセージ（RFC 2236）
+type IGMPMessage struct {
+	Type        uint8
+	MaxRespTime uint8 // 問い合わせの最大応答時間（1/10秒単位）
+	Checksum    uint16
+	Group       net.IP
+}
+
+// IGMPメッセージを解析する
+func ParseIGMP(b []byte) (*IGMPMessage, error) {
+	if len(b) < IGMP_HEADER_LEN {
+		return nil, fmt.Errorf("invalid igmp message: too short (%d bytes)", len(b))
+	}
+	if InternetChecksum(b) != 0 {
+		return nil, fmt.Errorf("invalid igmp message: %w", ErrBadChecksum)
+	}
+	return &IGMPMessage{
+		Type:        b[0],
+		MaxRespTime: b[1],
+		Checksum:    binary.BigEndian.Uint16(b[2:4]),
+		Group:       net.IPv4(b[4], b[5], b[6], b[7]).To4(),
+	}, nil
+}
+
+// IGMPメッセージをバイト列に変換する
+// チェックサムは再計算してChecksumフィールドにも反映する
+func (m *IGMPMessage) Marshal() ([]byte, error) {
+	group := m.Group.To4()
+	if group == nil {
+		return nil, fmt.Errorf("invalid igmp group: %s", m.Group)
+	}
+	b := make([]byte, IGMP_HEADER_LEN)
+	b[0] = m.Type
+	b[1] = m.MaxRespTime
+	copy(b[4:8], group)
+
+	m.Checksum = InternetChecksum(b)
+	binary.BigEndian.PutUint16(b[2:4], m.Checksum)
+	return b, nil
+}
+
+// 参加しているグループと、保留している報告のタイマー
+type igmpGroups struct {
+	mu     sync.Mutex
+	groups map[netip.Addr]*igmpGroup
+}
+
+type igmpGroup struct {
+	timer    *time.Timer // 保留している報告。無ければnil
+	deadline time.Time
+}
+
+func newIGMPGroups() *igmpGroups {
+	return &igmpGroups{groups: make(map[netip.Addr]*igmpGroup)}
+}
+
+// 宛先のグループに参加しているか
+func (g *igmpGroups) isMember(group netip.Addr) bool {
+	if group == IGMPAllHosts {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.groups[group]
+	return ok
+}
+
+// 保留している報告のタイマーを全て止める
+func (g *igmpGroups) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr, m := range g.groups {
+		if m.timer != nil {
+			m.timer.Stop()
+		}
+		delete(g.groups, addr)
+	}
+}
+
+// マルチキャストのグループに参加し、IGMPv2の参加報告を送る
+// 報告が失われた場合に備えて、IGMP_UNSOLICITED_REPORT_INTERVAL以内にもう一度送る
+// 参加した後はグループ宛てのUDPデータグラムを受け取る。224.0.0.1には常に参加している
+func (s *Stack) JoinGroup(ip net.IP) error {
+	group, err := multicastGroup(ip)
+	if err != nil {
+		return err
+	}
+	if group == IGMPAllHosts {
+		return nil
+	}
+	g := s.igmp
+	g.mu.Lock()
+	if _, ok := g.groups[group]; ok {
+		g.mu.Unlock()
+		return nil
+	}
+	g.groups[group] = &igmpGroup{}
+	g.mu.Unlock()
+
+	if err := s.sendIGMP(IGMP_TYPE_V2_MEMBERSHIP_REPORT, group, group); err != nil {
+		g.mu.Lock()
+		delete(g.groups, group)
+		g.mu.Unlock()
+		return err
+	}
+	g.mu.Lock()
+	s.scheduleReport(group, IGMP_UNSOLICITED_REPORT_INTERVAL)
+	g.mu.Unlock()
+	return nil
+}
+
+// マルチキャストのグループから離脱し、ルーターに離脱を通知する
+func (s *Stack) LeaveGroup(ip net.IP) error {
+	group, err := multicastGroup(ip)
+	if err != nil {
+		return err
+	}
+	if group == IGMPAllHosts {
+		return fmt.Errorf("invalid multicast group: cannot leave %s", group)
+	}
+	g := s.igmp
+	g.mu.Lock()
+	m, ok := g.groups[group]
+	if !ok {
+		g.mu.Unlock()
+		return fmt.Errorf("invalid multicast group: %s is not joined", group)
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	delete(g.groups, group)
+	g.mu.Unlock()
+	return s.sendIGMP(IGMP_TYPE_LEAVE_GROUP, IGMPAllRouters, group)
+}
+
+func multicastGroup(ip net.IP) (netip.Addr, error) {
+	group, ok := netip.AddrFromSlice(ip.To4())
+	if !ok || !group.IsMulticast() {
+		return netip.Addr{}, fmt.Errorf("invalid multicast address: %s", ip)
+	}
+	return group, nil
+}
+
+// IGMPメッセージをTTL 1、Router Alert付きでdstに送る
+func (s *Stack) sendIGMP(typ uint8, dst, group netip.Addr) error {
+	msg := IGMPMessage{Type: typ, Group: net.IP(group.AsSlice())}
+	b, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	ip := IPv4Header{
+		TTL:      1,
+		Protocol: PROTOCOL_IGMP,
+		Src:      net.IP(s.addr.AsSlice()),
+		Dst:      net.IP(dst.AsSlice()),
+		Options:  ipv4RouterAlert,
+	}
+	return s.ip.send(&ip, b, nil)
+}
+
+// maxDelayまでのランダムな遅延の後に参加報告を送る（s.igmp.muを保持して呼ぶ）
+// 既にそれより早く送る報告を保留している場合は何もしない（RFC 2236 3）
+func (s *Stack) scheduleReport(group netip.Addr, maxDelay time.Duration) {
+	m, ok := s.igmp.groups[group]
+	if !ok {
+		return
+	}
+	delay := time.Duration(0)
+	if ms := uint32(maxDelay / time.Millisecond); ms > 0 {
+		delay = time.Duration(randomUint32()%ms) * time.Millisecond
+	}
+	deadline := time.Now().Add(delay)
+	if m.timer != nil {
+		if m.deadline.Before(deadline) {
+			return
+		}
+		m.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		s.igmp.mu.Lock()
+		// 停止や再設定の後に発火したタイマーは無視する
+		if cur, ok := s.igmp.groups[group]; !ok || cur.timer != timer {
+			s.igmp.mu.Unlock()
+			return
+		}
+		m.timer = nil
+		s.igmp.mu.Unlock()
+		s.sendIGMP(IGMP_TYPE_V2_MEMBERSHIP_REPORT, group, group)
+	})
+	m.timer = timer
+	m.deadline = deadline
+}
+
+// 問い合わせには参加しているグループの報告を遅延させて返し、
+// 他のホストの報告を受け取った場合は同じグループの保留している報告を取りやめる
+func (s *Stack) handleIGMP(payload []byte) {
+	msg, err := ParseIGMP(payload)
+	if err != nil {
+		return
+	}
+	group, _ := netip.AddrFromSlice(msg.Group.To4())
+	g := s.igmp
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch msg.Type {
+	case IGMP_TYPE_MEMBERSHIP_QUERY:
+		maxDelay := time.Duration(msg.MaxRespTime) * 100 * time.Millisecond
+		if msg.MaxRespTime == 0 {
+			maxDelay = IGMP_V1_MAX_RESPONSE_TIME
+		}
+		if group.IsUnspecified() {
+			// 一般の問い合わせ
+			for addr := range g.groups {
+				s.scheduleReport(addr, maxDelay)
+			}
+			return
+		}
+		s.scheduleReport(group, maxDelay)
+	case IGMP_TYPE_V1_MEMBERSHIP_REPORT, IGMP_TYPE_V2_MEMBERSHIP_REPORT:
+		if m, ok := g.groups[group]; ok && m.timer != nil {
+			m.timer.Stop()
+			m.timer = nil
+		}
+	}
+}
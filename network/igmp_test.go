@@ -0,0 +1,195 @@
+package network
+
+import (
+	"bytes"     // オプションの比較
+	"errors"    // エラーの判定
+	"net"       // IPアドレスの表現
+	"net/netip" // アドレスとポートの表現
+	"os"        // タイムアウトのエラー
+	"testing"
+	"time" // 読み込みの期限
+)
+
+var testGroup = net.IPv4(239, 1, 2, 3).To4()
+
+// peerに届いたIGMPメッセージを読み込み、TTL 1とRouter Alertが付いていることを確かめる
+func readIGMP(t *testing.T, peer *NetDevice) (*IPv4Header, *IGMPMessage) {
+	t.Helper()
+	pkt := readPacket(t, peer)
+	defer pkt.Release()
+	ip, payload, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Protocol != PROTOCOL_IGMP || ip.TTL != 1 || !bytes.Equal(ip.Options, ipv4RouterAlert) {
+		t.Fatalf("protocol %d ttl %d options %x", ip.Protocol, ip.TTL, ip.Options)
+	}
+	msg, err := ParseIGMP(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip, msg
+}
+
+// peerからスタックへIGMPメッセージを送る
+func sendIGMP(t *testing.T, peer *NetDevice, msg IGMPMessage, dst net.IP) {
+	t.Helper()
+	b, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := IPv4Header{TTL: 1, Protocol: PROTOCOL_IGMP, Src: rawPeerIP, Dst: dst, Options: ipv4RouterAlert}
+	pkt, err := ip.MarshalWithPayload(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.WriteBytes(pkt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testGroupに参加して参加報告を読み捨てる
+// 他のホストの報告を装って、繰り返しの報告が途中で届かないように取りやめさせる
+func joinQuiet(t *testing.T, s *Stack, peer *NetDevice) {
+	t.Helper()
+	if err := s.JoinGroup(testGroup); err != nil {
+		t.Fatal(err)
+	}
+	readIGMP(t, peer)
+	sendIGMP(t, peer, IGMPMessage{Type: IGMP_TYPE_V2_MEMBERSHIP_REPORT, Group: testGroup}, testGroup)
+}
+
+// 参加するとグループ宛てに参加報告を送り、離脱すると全ルーター宛てに離脱を通知すること
+func TestJoinLeaveGroup(t *testing.T) {
+	s, peer := rawPeer(t)
+	if err := s.JoinGroup(testGroup); err != nil {
+		t.Fatal(err)
+	}
+	ip, msg := readIGMP(t, peer)
+	if msg.Type != IGMP_TYPE_V2_MEMBERSHIP_REPORT || !msg.Group.Equal(testGroup) || !ip.Dst.Equal(testGroup) {
+		t.Fatalf("report type %#x group %s to %s", msg.Type, msg.Group, ip.Dst)
+	}
+
+	if err := s.LeaveGroup(testGroup); err != nil {
+		t.Fatal(err)
+	}
+	ip, msg = readIGMP(t, peer)
+	if msg.Type != IGMP_TYPE_LEAVE_GROUP || !msg.Group.Equal(testGroup) || !ip.Dst.Equal(net.IP(IGMPAllRouters.AsSlice())) {
+		t.Fatalf("leave type %#x group %s to %s", msg.Type, msg.Group, ip.Dst)
+	}
+
+	if err := s.LeaveGroup(testGroup); err == nil {
+		t.Fatal("left a group not joined")
+	}
+	if err := s.LeaveGroup(net.IP(IGMPAllHosts.AsSlice())); err == nil {
+		t.Fatal("left the all-hosts group")
+	}
+	if err := s.JoinGroup(net.IPv4(10, 0, 0, 9)); err == nil {
+		t.Fatal("joined a unicast address")
+	}
+}
+
+// 参加していないグループ宛てのデータグラムは受け取らず、ポート到達不能も返さないこと
+func TestMulticastFiltering(t *testing.T) {
+	s, peer := rawPeer(t)
+	c, err := s.ListenUDP(5353)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	send := func(payload string) {
+		t.Helper()
+		if err := peer.WriteBytes(natUDP(t, rawPeerIP, testGroup, 5353, 5353, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("not joined")
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if b, _, err := c.ReadFromAddrPort(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("received %q before joining", b)
+	}
+	expectNoPacket(t, peer)
+
+	joinQuiet(t, s, peer)
+	send("joined")
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, from, err := c.ReadFromAddrPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "joined" || from != netip.MustParseAddrPort("10.0.0.1:5353") {
+		t.Fatalf("received %q from %s", b, from)
+	}
+}
+
+// 問い合わせには最大応答時間以内に報告を返し、他のホストの報告を受け取れば取りやめること
+func TestIGMPQuery(t *testing.T) {
+	s, peer := rawPeer(t)
+	joinQuiet(t, s, peer)
+
+	// 一般の問い合わせ（最大応答時間0.1秒）
+	sendIGMP(t, peer, IGMPMessage{Type: IGMP_TYPE_MEMBERSHIP_QUERY, MaxRespTime: 1, Group: net.IPv4zero.To4()}, net.IP(IGMPAllHosts.AsSlice()))
+	if _, msg := readIGMP(t, peer); msg.Type != IGMP_TYPE_V2_MEMBERSHIP_REPORT || !msg.Group.Equal(testGroup) {
+		t.Fatalf("query answered with type %#x group %s", msg.Type, msg.Group)
+	}
+
+	// グループを指定した問い合わせ（最大応答時間0.3秒）の後に他のホストが報告する
+	sendIGMP(t, peer, IGMPMessage{Type: IGMP_TYPE_MEMBERSHIP_QUERY, MaxRespTime: 3, Group: testGroup}, testGroup)
+	sendIGMP(t, peer, IGMPMessage{Type: IGMP_TYPE_V2_MEMBERSHIP_REPORT, Group: testGroup}, testGroup)
+	time.Sleep(400 * time.Millisecond)
+	expectNoPacket(t, peer)
+}
+
+// 参加しているグループ宛ては自身にも折り返し、TTL 0では送らず、折り返しを無効にすれば送るだけになること
+func TestMulticastLoopbackAndTTL(t *testing.T) {
+	s, peer := rawPeer(t)
+	joinQuiet(t, s, peer)
+	recv, err := s.ListenUDP(5353)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	sender, err := s.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	group := netip.AddrPortFrom(netip.AddrFrom4([4]byte(testGroup)), 5353)
+
+	for _, tc := range []struct {
+		name   string
+		ttl    uint8
+		loop   bool
+		looped bool
+		sent   bool
+	}{
+		{"default", UDP_DEFAULT_MULTICAST_TTL, true, true, true},
+		{"ttl 0", 0, true, true, false},
+		{"no loopback", 4, false, false, true},
+	} {
+		sender.SetMulticastTTL(tc.ttl)
+		sender.SetMulticastLoopback(tc.loop)
+		if err := sender.WriteToAddrPort([]byte(tc.name), group); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		recv.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		b, _, err := recv.ReadFromAddrPort()
+		if looped := err == nil; looped != tc.looped || (looped && string(b) != tc.name) {
+			t.Fatalf("%s: looped back %q (%v), want %v", tc.name, b, err, tc.looped)
+		}
+		if !tc.sent {
+			expectNoPacket(t, peer)
+			continue
+		}
+		pkt := readPacket(t, peer)
+		ip, _, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Dst.Equal(testGroup) || ip.TTL != tc.ttl {
+			t.Fatalf("%s: sent to %s with ttl %d, want ttl %d", tc.name, ip.Dst, ip.TTL, tc.ttl)
+		}
+		pkt.Release()
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin
+
+package network
+
+import (
+	"errors"  // エラーの判定
+	"fmt"     // 文字列の生成や出力、スキャン
+	"io/fs"   // ファイルが無い・権限が無いエラーの判定
+	"syscall" // システムコールの呼び出し
+)
+
+// ioctlシステムコールを呼び出す
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	_, _, sysErr := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if sysErr != 0 {
+		return fmt.Errorf("ioctl error: %w", sysErr)
+	}
+	return nil
+}
+
+// デバイスを開く際のエラーを原因ごとのエラー（ErrTunNotAvailable/ErrPermissionDenied）で包み、
+// プラットフォームごとの対処のヒントを付ける。どちらでもない場合は元のエラーをそのまま包む
+func openError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("open error: %w: %w (%s)", ErrPermissionDenied, err, permissionHint)
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO):
+		return fmt.Errorf("open error: %w: %w (%s)", ErrTunNotAvailable, err, unavailableHint)
+	default:
+		return fmt.Errorf("open error: %w", err)
+	}
+}
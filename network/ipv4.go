@@ -0,0 +1,163 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"errors"          // エラーの生成
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+)
+
+const (
+	IPV4_VERSION        = 4
+	IPV4_MIN_HEADER_LEN = 20
+	IPV4_MAX_HEADER_LEN = 60
+)
+
+// IPプロトコル番号
+const (
+	PROTOCOL_ICMP = 1
+	PROTOCOL_TCP  = 6
+	PROTOCOL_UDP  = 17
+)
+
+// IPv4のフラグ
+const (
+	IPV4_FLAG_MF = 0x1 // More Fragments
+	IPV4_FLAG_DF = 0x2 // Don't Fragment
+)
+
+var ErrBadChecksum = errors.New("bad checksum")
+
+// IPv4ヘッダ
+type IPv4Header struct {
+	Version     uint8
+	IHL         uint8 // ヘッダ長（4バイト単位）
+	TOS         uint8
+	TotalLength uint16
+	ID          uint16
+	Flags       uint8
+	FragOffset  uint16 // フラグメントオフセット（8バイト単位）
+	TTL         uint8
+	Protocol    uint8
+	Checksum    uint16
+	Src         net.IP
+	Dst         net.IP
+	// オプションのバイト列。Marshalはこちらを使う
+	Options []byte
+	// ParseIPv4がOptionsを解析した結果
+	ParsedOptions []IPv4Option
+	// Optionsを解析できなかった場合のエラー。ParsedOptionsは空になる
+	// ヘッダ長と全長が正しければデータグラムは受け取るため、破棄するかは呼び出し側が決める
+	OptionsErr error
+}
+
+// IPv4ヘッダを解析し、ヘッダとペイロードを返す
+// ペイロードはTotalLengthまでに切り詰められる
+// エラーを返すのはIHLや全長、チェックサムが正しくない場合で、オプションの誤りはOptionsErrに記録する
+func ParseIPv4(b []byte) (*IPv4Header, []byte, error) {
+	if len(b) < IPV4_MIN_HEADER_LEN {
+		return nil, nil, fmt.Errorf("invalid ipv4 header: too short (%d bytes)", len(b))
+	}
+	h := &IPv4Header{
+		Version:     b[0] >> 4,
+		IHL:         b[0] & 0x0f,
+		TOS:         b[1],
+		TotalLength: binary.BigEndian.Uint16(b[2:4]),
+		ID:          binary.BigEndian.Uint16(b[4:6]),
+		Flags:       b[6] >> 5,
+		FragOffset:  binary.BigEndian.Uint16(b[6:8]) & 0x1fff,
+		TTL:         b[8],
+		Protocol:    b[9],
+		Checksum:    binary.BigEndian.Uint16(b[10:12]),
+		Src:         net.IPv4(b[12], b[13], b[14], b[15]).To4(),
+		Dst:         net.IPv4(b[16], b[17], b[18], b[19]).To4(),
+	}
+	if h.Version != IPV4_VERSION {
+		return nil, nil, fmt.Errorf("invalid ipv4 header: version %d", h.Version)
+	}
+	if h.IHL < 5 {
+		return nil, nil, fmt.Errorf("invalid ipv4 header: ihl %d", h.IHL)
+	}
+	hlen := int(h.IHL) * 4
+	if len(b) < hlen {
+		return nil, nil, fmt.Errorf("invalid ipv4 header: ihl %d exceeds %d bytes", h.IHL, len(b))
+	}
+	if int(h.TotalLength) < hlen || len(b) < int(h.TotalLength) {
+		return nil, nil, fmt.Errorf("invalid ipv4 header: total length %d (header %d, packet %d bytes)", h.TotalLength, hlen, len(b))
+	}
+	// チェックサムを含めたヘッダ全体の和が0になれば正しい
+	if InternetChecksum(b[:hlen]) != 0 {
+		return nil, nil, fmt.Errorf("invalid ipv4 header: %w", ErrBadChecksum)
+	}
+	if hlen > IPV4_MIN_HEADER_LEN {
+		h.Options = b[IPV4_MIN_HEADER_LEN:hlen]
+		h.ParsedOptions, h.OptionsErr = ParseIPv4Options(h.Options)
+	}
+
+	return h, b[hlen:h.TotalLength], nil
+}
+
+// ヘッダ長をバイト単位で返す
+func (h *IPv4Header) HeaderLen() int {
+	return int(h.IHL) * 4
+}
+
+// IPv4ヘッダをバイト列に変換する
+// VersionとIHLは未設定（0）なら補完し、TotalLengthが0ならヘッダ長とする
+// チェックサムは再計算してChecksumフィールドにも反映する
+func (h *IPv4Header) Marshal() ([]byte, error) {
+	return h.MarshalWithPayload(nil)
+}
+
+// IPv4ヘッダにペイロードを続けたパケットのバイト列を返す
+// TotalLengthが0の場合はヘッダ長とペイロード長の和を設定する
+func (h *IPv4Header) MarshalWithPayload(payload []byte) ([]byte, error) {
+	src, dst := h.Src.To4(), h.Dst.To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: src %s, dst %s", h.Src, h.Dst)
+	}
+	if len(h.Options)%4 != 0 {
+		return nil, fmt.Errorf("invalid ipv4 header: options length %d is not a multiple of 4", len(h.Options))
+	}
+	if IPV4_MIN_HEADER_LEN+len(h.Options) > IPV4_MAX_HEADER_LEN {
+		return nil, fmt.Errorf("invalid ipv4 header: options length %d too long", len(h.Options))
+	}
+	if h.Version == 0 {
+		h.Version = IPV4_VERSION
+	}
+	if h.Version != IPV4_VERSION {
+		return nil, fmt.Errorf("invalid ipv4 header: version %d", h.Version)
+	}
+	if h.IHL == 0 {
+		h.IHL = uint8((IPV4_MIN_HEADER_LEN + len(h.Options)) / 4)
+	}
+	hlen := h.HeaderLen()
+	if hlen < IPV4_MIN_HEADER_LEN || hlen != IPV4_MIN_HEADER_LEN+len(h.Options) {
+		return nil, fmt.Errorf("invalid ipv4 header: ihl %d with %d bytes options", h.IHL, len(h.Options))
+	}
+	if h.TotalLength == 0 {
+		if hlen+len(payload) > 0xffff {
+			return nil, fmt.Errorf("invalid ipv4 header: payload too long (%d bytes)", len(payload))
+		}
+		h.TotalLength = uint16(hlen + len(payload))
+	}
+	if int(h.TotalLength) != hlen+len(payload) && payload != nil {
+		return nil, fmt.Errorf("invalid ipv4 header: total length %d (header %d, payload %d bytes)", h.TotalLength, hlen, len(payload))
+	}
+
+	b := make([]byte, hlen, hlen+len(payload))
+	b[0] = h.Version<<4 | h.IHL
+	b[1] = h.TOS
+	binary.BigEndian.PutUint16(b[2:4], h.TotalLength)
+	binary.BigEndian.PutUint16(b[4:6], h.ID)
+	binary.BigEndian.PutUint16(b[6:8], uint16(h.Flags)<<13|h.FragOffset&0x1fff)
+	b[8] = h.TTL
+	b[9] = h.Protocol
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	copy(b[IPV4_MIN_HEADER_LEN:], h.Options)
+
+	h.Checksum = InternetChecksum(b)
+	binary.BigEndian.PutUint16(b[10:12], h.Checksum)
+	return append(b, payload...), nil
+}
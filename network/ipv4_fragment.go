@@ -0,0 +1,88 @@
+package network
+
+import (
+	"errors" // エラーの生成
+	"fmt"    // 文字列の生成や出力、スキャン
+)
+
+var ErrFragmentationNeeded = errors.New("fragmentation needed but don't fragment set")
+
+// IPv4パケットをmtuに収まるフラグメントに分割する
+// 各フラグメントは同じIDを持ち、オフセットは8バイト単位、最後以外はMFフラグを立てる
+// DFフラグが立っていてmtuを超える場合はErrFragmentationNeededを返す
+func FragmentIPv4(h *IPv4Header, payload []byte, mtu int) ([][]byte, error) {
+	hlen := IPV4_MIN_HEADER_LEN + len(h.Options)
+	if hlen+len(payload) <= mtu {
+		hdr := *h
+		hdr.TotalLength = 0
+		b, err := hdr.MarshalWithPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{b}, nil
+	}
+	if h.Flags&IPV4_FLAG_DF != 0 {
+		return nil, ErrFragmentationNeeded
+	}
+
+	var frags [][]byte
+	for off := 0; off < len(payload); {
+		hdr := *h
+		hdr.IHL = 0
+		hdr.TotalLength = 0
+		if off > 0 {
+			// 2つ目以降のフラグメントにはコピーフラグが立ったオプションだけを含める
+			hdr.Options = copiedIPv4Options(h.Options)
+		}
+		// フラグメントのデータ長は最後を除き8の倍数でなければならない
+		max := (mtu - IPV4_MIN_HEADER_LEN - len(hdr.Options)) &^ 7
+		if max <= 0 {
+			return nil, fmt.Errorf("mtu %d too small to fragment", mtu)
+		}
+		end := off + max
+		last := end >= len(payload)
+		if last {
+			end = len(payload)
+		}
+		hdr.FragOffset = h.FragOffset + uint16(off/8)
+		hdr.Flags = h.Flags &^ IPV4_FLAG_MF
+		// 元のパケット自体がフラグメントの場合、最後のフラグメントはMFを引き継ぐ
+		if !last || h.Flags&IPV4_FLAG_MF != 0 {
+			hdr.Flags |= IPV4_FLAG_MF
+		}
+		b, err := hdr.MarshalWithPayload(payload[off:end])
+		if err != nil {
+			return nil, err
+		}
+		frags = append(frags, b)
+		off = end
+	}
+	return frags, nil
+}
+
+// コピーフラグ（最上位ビット）が立ったオプションだけを取り出し、4バイト境界まで埋める
+func copiedIPv4Options(opts []byte) []byte {
+	var out []byte
+	for i := 0; i < len(opts); {
+		kind := opts[i]
+		if kind == IPV4_OPT_EOL {
+			break
+		}
+		if kind == IPV4_OPT_NOP {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			break
+		}
+		length := int(opts[i+1])
+		if kind&0x80 != 0 {
+			out = append(out, opts[i:i+length]...)
+		}
+		i += length
+	}
+	for len(out)%4 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"bytes"     // データの比較
+	"errors"    // エラーの判定
+	"net/netip" // アドレスとポートの表現
+	"testing"
+	"time" // 読み込みの期限
+)
+
+// フラグメントのヘッダを解析する。チェックサムの検証も兼ねる
+func parseFragments(t *testing.T, frags [][]byte) ([]*IPv4Header, [][]byte) {
+	t.Helper()
+	var hs []*IPv4Header
+	var ps [][]byte
+	for i, b := range frags {
+		h, p, err := ParseIPv4(b)
+		if err != nil {
+			t.Fatalf("fragment %d: %s", i, err)
+		}
+		hs = append(hs, h)
+		ps = append(ps, p)
+	}
+	return hs, ps
+}
+
+// 4000バイトのペイロードを1500のMTUで分割し、再構築すると元に戻ること
+func TestFragmentIPv4(t *testing.T) {
+	payload := make([]byte, 4000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	ip := IPv4Header{ID: 0x1234, TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote}
+	frags, err := FragmentIPv4(&ip, payload, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, ps := parseFragments(t, frags)
+	if len(hs) != 3 {
+		t.Fatalf("%d fragments, want 3", len(hs))
+	}
+	// 1480バイト（8の倍数）ずつ分割する
+	for i, want := range []struct {
+		off  uint16
+		mf   bool
+		size int
+	}{{0, true, 1480}, {185, true, 1480}, {370, false, 1040}} {
+		h := hs[i]
+		if h.FragOffset != want.off || (h.Flags&IPV4_FLAG_MF != 0) != want.mf || len(ps[i]) != want.size {
+			t.Fatalf("fragment %d: offset %d flags %d size %d, want %+v", i, h.FragOffset, h.Flags, len(ps[i]), want)
+		}
+		if h.ID != ip.ID || h.Protocol != PROTOCOL_UDP || len(frags[i]) > 1500 {
+			t.Fatalf("fragment %d: id %#x protocol %d length %d", i, h.ID, h.Protocol, len(frags[i]))
+		}
+	}
+
+	r := NewIPv4Reassembler(time.Second, nil)
+	defer r.Close()
+	var got []byte
+	for i := range hs {
+		h, p, ok := r.Add(hs[i], ps[i])
+		if ok != (i == len(hs)-1) {
+			t.Fatalf("fragment %d: complete %v", i, ok)
+		}
+		if ok {
+			if h.Flags&IPV4_FLAG_MF != 0 || h.FragOffset != 0 || int(h.TotalLength) != IPV4_MIN_HEADER_LEN+len(payload) {
+				t.Fatalf("reassembled header %+v", h)
+			}
+			got = p
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("reassembled payload differs")
+	}
+
+	// MTUに収まる場合は分割しない
+	frags, err = FragmentIPv4(&ip, payload[:100], 1500)
+	if err != nil || len(frags) != 1 {
+		t.Fatalf("%d fragments (%v), want 1", len(frags), err)
+	}
+}
+
+// DFが立っていれば分割せずにErrFragmentationNeededを返すこと
+func TestFragmentIPv4DontFragment(t *testing.T) {
+	ip := IPv4Header{Flags: IPV4_FLAG_DF, TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote}
+	if _, err := FragmentIPv4(&ip, make([]byte, 4000), 1500); !errors.Is(err, ErrFragmentationNeeded) {
+		t.Fatalf("got %v, want ErrFragmentationNeeded", err)
+	}
+	if _, err := FragmentIPv4(&ip, make([]byte, 1480), 1500); err != nil {
+		t.Fatalf("packet within mtu: %s", err)
+	}
+}
+
+// 2つ目以降のフラグメントにはコピーフラグが立ったオプションだけを含めること
+func TestFragmentIPv4Options(t *testing.T) {
+	opts := []byte{
+		IPV4_OPT_ROUTER_ALERT, 4, 0, 0,
+		IPV4_OPT_RECORD_ROUTE, 7, 4, 0, 0, 0, 0, IPV4_OPT_EOL,
+	}
+	ip := IPv4Header{ID: 7, TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote, Options: opts}
+	frags, err := FragmentIPv4(&ip, make([]byte, 2000), 576)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, ps := parseFragments(t, frags)
+	if !bytes.Equal(hs[0].Options, opts) {
+		t.Fatalf("first fragment options %x", hs[0].Options)
+	}
+	total := len(ps[0])
+	for i, h := range hs[1:] {
+		if !bytes.Equal(h.Options, opts[:4]) {
+			t.Fatalf("fragment %d options %x, want router alert only", i+1, h.Options)
+		}
+		if int(h.FragOffset)*8 != total {
+			t.Fatalf("fragment %d offset %d, want %d", i+1, int(h.FragOffset)*8, total)
+		}
+		total += len(ps[i+1])
+	}
+	if total != 2000 {
+		t.Fatalf("fragments carry %d bytes, want 2000", total)
+	}
+}
+
+// MTUを超えるUDPのデータグラムを送信側で分割し、受信側で再構築して届けること
+func TestUDPFragmentedDatagram(t *testing.T) {
+	sa, sb := stackPair(t)
+	a, err := sa.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := sb.ListenUDP(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data := bytes.Repeat([]byte("fragment"), 500)
+	if err := a.WriteToAddrPort(data, netip.MustParseAddrPort("10.0.0.2:5000")); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := b.ReadFromAddrPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data))
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+)
+
+// IPv4オプションの種類（コピーフラグとクラスを含めた値）
+const (
+	IPV4_OPT_EOL          = 0
+	IPV4_OPT_NOP          = 1
+	IPV4_OPT_RECORD_ROUTE = 7   // RFC 791
+	IPV4_OPT_TIMESTAMP    = 68  // RFC 791
+	IPV4_OPT_ROUTER_ALERT = 148 // RFC 2113
+)
+
+// Timestampオプションのフラグ
+const (
+	IPV4_TS_ONLY    = 0 // タイムスタンプだけを記録する
+	IPV4_TS_ADDR    = 1 // アドレスとタイムスタンプを記録する
+	IPV4_TS_PRESPEC = 3 // 指定されたアドレスのルーターだけが記録する
+)
+
+const (
+	IPV4_RR_MIN_PTR   = 4 // Record Routeのポインタの最小値
+	IPV4_TS_MIN_PTR   = 5 // Timestampのポインタの最小値
+	IPV4_OPT_ADDR_LEN = 4
+)
+
+// 解析したIPv4オプション
+// EOLとNOPは含めない。未対応の種類はTypeとDataだけを設定する
+type IPv4Option struct {
+	Type uint8
+	Data []byte // タイプと長さを除いた内容
+	// Record RouteとTimestampの次に記録する位置（オプションの先頭を1とするオフセット）
+	Pointer uint8
+	// Record Routeで記録済みのアドレス。Timestampではフラグが1か3の場合のタイムスタンプと対になるアドレス
+	Addrs []net.IP
+	// Timestampで記録済みのタイムスタンプ（UTCの0時からのミリ秒）
+	Timestamps []uint32
+	Overflow   uint8  // Timestampを記録できなかったルーターの数
+	Flag       uint8  // Timestampのフラグ
+	Value      uint16 // Router Alertの値。0は全てのルーターが調べる
+}
+
+// IPv4ヘッダのオプション部分を解析する
+// 1バイトのEOL/NOP以外は長さのバイトに従って読み飛ばし、EOLで終わる
+func ParseIPv4Options(b []byte) ([]IPv4Option, error) {
+	var opts []IPv4Option
+	for i := 0; i < len(b); {
+		typ := b[i]
+		if typ == IPV4_OPT_EOL {
+			break
+		}
+		if typ == IPV4_OPT_NOP {
+			i++
+			continue
+		}
+		if i+1 >= len(b) {
+			return nil, fmt.Errorf("invalid ipv4 options: option %d truncated", typ)
+		}
+		length := int(b[i+1])
+		if length < 2 || i+length > len(b) {
+			return nil, fmt.Errorf("invalid ipv4 options: option %d length %d (%d bytes left)", typ, length, len(b)-i)
+		}
+		opt := IPv4Option{Type: typ, Data: b[i+2 : i+length]}
+		if err := opt.parse(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+		i += length
+	}
+	return opts, nil
+}
+
+// 種類ごとの内容を解析する
+// ポインタが内容を超えている場合（記録する場所が残っていない）は内容の全てを記録済みとみなす
+func (o *IPv4Option) parse() error {
+	switch o.Type {
+	case IPV4_OPT_RECORD_ROUTE:
+		if len(o.Data) < 1 {
+			return fmt.Errorf("invalid ipv4 options: record route too short")
+		}
+		o.Pointer = o.Data[0]
+		for _, entry := range recordedEntries(o.Data[1:], o.Pointer, IPV4_RR_MIN_PTR, IPV4_OPT_ADDR_LEN) {
+			o.Addrs = append(o.Addrs, net.IPv4(entry[0], entry[1], entry[2], entry[3]).To4())
+		}
+	case IPV4_OPT_TIMESTAMP:
+		if len(o.Data) < 2 {
+			return fmt.Errorf("invalid ipv4 options: timestamp too short")
+		}
+		o.Pointer = o.Data[0]
+		o.Overflow = o.Data[1] >> 4
+		o.Flag = o.Data[1] & 0x0f
+		size := 4
+		if o.Flag == IPV4_TS_ADDR || o.Flag == IPV4_TS_PRESPEC {
+			size += IPV4_OPT_ADDR_LEN
+		}
+		for _, entry := range recordedEntries(o.Data[2:], o.Pointer, IPV4_TS_MIN_PTR, size) {
+			if size > 4 {
+				o.Addrs = append(o.Addrs, net.IPv4(entry[0], entry[1], entry[2], entry[3]).To4())
+				entry = entry[IPV4_OPT_ADDR_LEN:]
+			}
+			o.Timestamps = append(o.Timestamps, binary.BigEndian.Uint32(entry))
+		}
+	case IPV4_OPT_ROUTER_ALERT:
+		if len(o.Data) != 2 {
+			return fmt.Errorf("invalid ipv4 options: router alert length %d", len(o.Data)+2)
+		}
+		o.Value = binary.BigEndian.Uint16(o.Data)
+	}
+	return nil
+}
+
+// ポインタの手前までに記録された、sizeバイトずつの項目を返す
+func recordedEntries(b []byte, ptr uint8, minPtr, size int) [][]byte {
+	n := len(b)
+	if filled := int(ptr) - minPtr; filled < 0 {
+		n = 0
+	} else if filled < n {
+		n = filled
+	}
+	var entries [][]byte
+	for off := 0; off+size <= n; off += size {
+		entries = append(entries, b[off:off+size])
+	}
+	return entries
+}
+
+// 指定した種類のオプションを返す
+func (h *IPv4Header) Option(typ uint8) (*IPv4Option, bool) {
+	for i := range h.ParsedOptions {
+		if h.ParsedOptions[i].Type == typ {
+			return &h.ParsedOptions[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"sync/atomic" // IDの採番
+)
+
+const (
+	IPV4_DEFAULT_TTL = 64
+	DEFAULT_MTU      = 1500
+	MIN_MTU          = 68
+	MAX_MTU          = 65535
+)
+
+// IPv4パケットを組み立ててデバイスに書き込む
+// MTUを超えるパケットはフラグメントに分割する
+type ipv4Output struct {
+	dev Device
+	mtu atomic.Int32
+	id  atomic.Uint32
+}
+
+func newIPv4Output(dev Device) *ipv4Output {
+	o := &ipv4Output{dev: dev}
+	mtu, err := dev.GetMTU()
+	if err != nil || mtu < MIN_MTU {
+		mtu = DEFAULT_MTU
+	}
+	o.mtu.Store(int32(mtu))
+	o.id.Store(randomUint32())
+	return o
+}
+
+// hの送信元・宛先・プロトコルで payload を送信する
+// IDとTTLが0の場合は補完する。cancelが閉じられると書き込みを諦める
+// hにDFを立てた場合はMTUを超えても分割せず、何も書き込まずにErrFragmentationNeededを返す。
+// 呼び出し側はMTUに収まる大きさに分けて送り直す
+func (o *ipv4Output) send(h *IPv4Header, payload []byte, cancel <-chan struct{}) error {
+	if h.ID == 0 {
+		h.ID = uint16(o.id.Add(1))
+	}
+	if h.TTL == 0 {
+		h.TTL = IPV4_DEFAULT_TTL
+	}
+	frags, err := FragmentIPv4(h, payload, int(o.mtu.Load()))
+	if err != nil {
+		return err
+	}
+	for _, b := range frags {
+		if err := writeBytes(o.dev, b, cancel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
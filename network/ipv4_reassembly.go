@@ -0,0 +1,183 @@
+package network
+
+import (
+	"net/netip" // IPアドレスの型
+	"sync"      // 排他制御
+	"time"      // タイムアウトの計測
+)
+
+const (
+	// 再構築を諦めるまでの時間（RFC 791の推奨上限は15秒、Linuxの既定は30秒）
+	IPV4_REASSEMBLY_TIMEOUT = 30 * time.Second
+	// 同時に再構築するデータグラムの上限
+	IPV4_REASSEMBLY_MAX_DATAGRAMS = 64
+	IPV4_MAX_DATAGRAM_LEN         = 65535
+)
+
+// フラグメントを束ねるキー（RFC 791）
+type fragKey struct {
+	src, dst netip.Addr
+	id       uint16
+	proto    uint8
+}
+
+// 受信済みの範囲 [start, end)
+type fragRange struct {
+	start, end int
+}
+
+// 再構築中のデータグラム
+type fragBuffer struct {
+	first   *IPv4Header // オフセット0のフラグメントのヘッダ
+	firstP  []byte      // オフセット0のフラグメントのペイロード（ICMPエラー用）
+	data    []byte
+	ranges  []fragRange
+	total   int  // データグラム全体の長さ。最後のフラグメントを受信するまでは-1
+	invalid bool // 重複したフラグメントを受信したため破棄する
+	timer   *time.Timer
+}
+
+// IPv4のフラグメントを再構築する
+//
+// 重複の扱い: 同じ範囲の再送は無視し、それ以外の重なり（RFC 5722）を
+// 検出したデータグラムはタイムアウトまで以降のフラグメントも含めて破棄する
+type IPv4Reassembler struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	bufs    map[fragKey]*fragBuffer
+	// タイムアウトで破棄したデータグラムのうち、先頭のフラグメントを受信していたものについて呼ばれる
+	onTimeout func(first *IPv4Header, payload []byte)
+}
+
+// timeoutで再構築を諦めるIPv4Reassemblerを作成する。onTimeoutはnilでもよい
+func NewIPv4Reassembler(timeout time.Duration, onTimeout func(first *IPv4Header, payload []byte)) *IPv4Reassembler {
+	return &IPv4Reassembler{
+		timeout:   timeout,
+		bufs:      make(map[fragKey]*fragBuffer),
+		onTimeout: onTimeout,
+	}
+}
+
+// フラグメントを追加する
+// データグラムが揃った場合はフラグメント化されていないヘッダとペイロードを返す
+func (r *IPv4Reassembler) Add(h *IPv4Header, payload []byte) (*IPv4Header, []byte, bool) {
+	src, _ := netip.AddrFromSlice(h.Src.To4())
+	dst, _ := netip.AddrFromSlice(h.Dst.To4())
+	key := fragKey{src: src, dst: dst, id: h.ID, proto: h.Protocol}
+	start := int(h.FragOffset) * 8
+	end := start + len(payload)
+	more := h.Flags&IPV4_FLAG_MF != 0
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buf, ok := r.bufs[key]
+	if !ok {
+		if len(r.bufs) >= IPV4_REASSEMBLY_MAX_DATAGRAMS {
+			return nil, nil, false
+		}
+		buf = &fragBuffer{total: -1}
+		buf.timer = time.AfterFunc(r.timeout, func() { r.expire(key, buf) })
+		r.bufs[key] = buf
+	}
+	if buf.invalid {
+		return nil, nil, false
+	}
+	// 最後以外のフラグメントの長さは8の倍数でなければならない
+	if end > IPV4_MAX_DATAGRAM_LEN-IPV4_MIN_HEADER_LEN || (more && len(payload)%8 != 0) || (more && len(payload) == 0) {
+		buf.invalid = true
+		return nil, nil, false
+	}
+	if !more {
+		if buf.total >= 0 && buf.total != end {
+			buf.invalid = true
+			return nil, nil, false
+		}
+		buf.total = end
+	}
+	if buf.total >= 0 && end > buf.total {
+		buf.invalid = true
+		return nil, nil, false
+	}
+	for _, rg := range buf.ranges {
+		if rg.start == start && rg.end == end {
+			// 同じフラグメントの再送
+			return nil, nil, false
+		}
+		if start < rg.end && rg.start < end {
+			buf.invalid = true
+			return nil, nil, false
+		}
+	}
+
+	if len(buf.data) < end {
+		grown := make([]byte, end)
+		copy(grown, buf.data)
+		buf.data = grown
+	}
+	copy(buf.data[start:end], payload)
+	buf.ranges = append(buf.ranges, fragRange{start, end})
+	if start == 0 {
+		// Optionsは受信バッファを参照しているためコピーする
+		first := *h
+		first.Options = append([]byte(nil), h.Options...)
+		buf.first = &first
+		buf.firstP = buf.data[:end]
+	}
+
+	if buf.first == nil || buf.total < 0 || !buf.complete() {
+		return nil, nil, false
+	}
+	buf.timer.Stop()
+	delete(r.bufs, key)
+
+	hdr := *buf.first
+	hdr.Flags &^= IPV4_FLAG_MF
+	hdr.FragOffset = 0
+	hdr.TotalLength = uint16(hdr.HeaderLen() + buf.total)
+	return &hdr, buf.data[:buf.total], true
+}
+
+// 受信済みの範囲が [0, total) を隙間なく覆っているか
+func (b *fragBuffer) complete() bool {
+	covered := 0
+	for covered < b.total {
+		next := covered
+		for _, rg := range b.ranges {
+			if rg.start == covered {
+				next = rg.end
+				break
+			}
+		}
+		if next == covered {
+			return false
+		}
+		covered = next
+	}
+	return true
+}
+
+// 揃わなかったデータグラムを破棄する
+func (r *IPv4Reassembler) expire(key fragKey, buf *fragBuffer) {
+	r.mu.Lock()
+	if r.bufs[key] != buf {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.bufs, key)
+	r.mu.Unlock()
+
+	if r.onTimeout != nil && buf.first != nil && !buf.invalid {
+		r.onTimeout(buf.first, buf.firstP)
+	}
+}
+
+// 再構築中のデータグラムをすべて破棄する
+func (r *IPv4Reassembler) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, buf := range r.bufs {
+		buf.timer.Stop()
+		delete(r.bufs, key)
+	}
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"bytes" // データの比較
+	"testing"
+	"time" // 再構築のタイムアウト
+)
+
+// 24バイトのペイロードを8バイトずつに分けたフラグメント
+func testFragments(t *testing.T, id uint16) ([]*IPv4Header, [][]byte, []byte) {
+	t.Helper()
+	payload := []byte("abcdefghijklmnopqrstuvwx")
+	ip := IPv4Header{ID: id, TTL: 64, Protocol: PROTOCOL_UDP, Src: testRemote, Dst: testLocal}
+	frags, err := FragmentIPv4(&ip, payload, IPV4_MIN_HEADER_LEN+8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, ps := parseFragments(t, frags)
+	if len(hs) != 3 {
+		t.Fatalf("%d fragments, want 3", len(hs))
+	}
+	return hs, ps, payload
+}
+
+// 受信した順序に関わらず、揃った時点でデータグラムを返すこと
+func TestReassemblyOrders(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		order []int
+	}{
+		{"in order", []int{0, 1, 2}},
+		{"reversed", []int{2, 1, 0}},
+		{"last first", []int{2, 0, 1}},
+		{"first last", []int{1, 2, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewIPv4Reassembler(time.Second, nil)
+			defer r.Close()
+			hs, ps, payload := testFragments(t, 1)
+			for n, i := range tc.order {
+				h, got, ok := r.Add(hs[i], ps[i])
+				if ok != (n == len(tc.order)-1) {
+					t.Fatalf("fragment %d: complete %v", i, ok)
+				}
+				if ok && (!bytes.Equal(got, payload) || h.FragOffset != 0 || h.Flags&IPV4_FLAG_MF != 0) {
+					t.Fatalf("reassembled %q offset %d flags %d", got, h.FragOffset, h.Flags)
+				}
+			}
+		})
+	}
+}
+
+// 同じ範囲の再送は無視し、別のIDのフラグメントとは混ざらないこと
+func TestReassemblyDuplicateAndKeys(t *testing.T) {
+	r := NewIPv4Reassembler(time.Second, nil)
+	defer r.Close()
+	hs, ps, payload := testFragments(t, 1)
+	other, ops, _ := testFragments(t, 2)
+	r.Add(hs[0], ps[0])
+	if _, _, ok := r.Add(hs[0], ps[0]); ok {
+		t.Fatal("duplicate completed the datagram")
+	}
+	r.Add(other[1], ops[1])
+	r.Add(other[2], ops[2])
+	r.Add(hs[1], ps[1])
+	h, got, ok := r.Add(hs[2], ps[2])
+	if !ok || h.ID != 1 || !bytes.Equal(got, payload) {
+		t.Fatalf("complete %v id %d payload %q", ok, h.ID, got)
+	}
+}
+
+// 重なるフラグメントを受け取ったデータグラムは、以降のフラグメントも含めて破棄すること（RFC 5722）
+func TestReassemblyOverlapDiscards(t *testing.T) {
+	r := NewIPv4Reassembler(time.Second, nil)
+	defer r.Close()
+	hs, ps, _ := testFragments(t, 1)
+	r.Add(hs[0], ps[0])
+	r.Add(hs[1], ps[1])
+	// 先頭から16バイト（受信済みの2つに重なる）
+	overlap := *hs[0]
+	if _, _, ok := r.Add(&overlap, bytes.Repeat([]byte{'X'}, 16)); ok {
+		t.Fatal("overlap completed the datagram")
+	}
+	for i := 1; i < len(hs); i++ {
+		if _, _, ok := r.Add(hs[i], ps[i]); ok {
+			t.Fatalf("fragment %d completed a discarded datagram", i)
+		}
+	}
+}
+
+// 長さが矛盾する最後のフラグメントや、8の倍数でない途中のフラグメントは破棄すること
+func TestReassemblyInvalidLengths(t *testing.T) {
+	r := NewIPv4Reassembler(time.Second, nil)
+	defer r.Close()
+	hs, ps, _ := testFragments(t, 1)
+	odd := *hs[0]
+	if _, _, ok := r.Add(&odd, ps[0][:7]); ok {
+		t.Fatal("accepted odd-length middle fragment")
+	}
+	for i := range hs {
+		if _, _, ok := r.Add(hs[i], ps[i]); ok {
+			t.Fatal("completed after an invalid fragment")
+		}
+	}
+
+	hs, ps, _ = testFragments(t, 2)
+	r.Add(hs[2], ps[2])
+	short := *hs[2]
+	if _, _, ok := r.Add(&short, ps[2][:4]); ok {
+		t.Fatal("accepted a second last fragment with another length")
+	}
+	r.Add(hs[0], ps[0])
+	if _, _, ok := r.Add(hs[1], ps[1]); ok {
+		t.Fatal("completed after conflicting last fragments")
+	}
+}
+
+// 欠けたフラグメントがあればタイムアウトで破棄し、先頭を受け取っていればonTimeoutを呼ぶこと
+func TestReassemblyTimeout(t *testing.T) {
+	timeouts := make(chan *IPv4Header, 2)
+	r := NewIPv4Reassembler(20*time.Millisecond, func(first *IPv4Header, payload []byte) {
+		if len(payload) != 8 {
+			t.Errorf("timeout payload %d bytes, want 8", len(payload))
+		}
+		timeouts <- first
+	})
+	defer r.Close()
+	hs, ps, _ := testFragments(t, 1)
+	r.Add(hs[0], ps[0])
+	r.Add(hs[2], ps[2])
+	// 先頭のフラグメントが無ければICMPを返せない
+	noFirst, nps, _ := testFragments(t, 2)
+	r.Add(noFirst[1], nps[1])
+
+	select {
+	case first := <-timeouts:
+		if first.ID != 1 || first.FragOffset != 0 {
+			t.Fatalf("timeout for id %d offset %d", first.ID, first.FragOffset)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("incomplete datagram did not time out")
+	}
+	select {
+	case first := <-timeouts:
+		t.Fatalf("timeout reported for id %d without a first fragment", first.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// 破棄した後に残りが届いても揃わない
+	if _, _, ok := r.Add(hs[1], ps[1]); ok {
+		t.Fatal("completed after the timeout")
+	}
+}
+
+// 同時に再構築するデータグラムの数を制限すること
+func TestReassemblyMaxDatagrams(t *testing.T) {
+	r := NewIPv4Reassembler(time.Second, nil)
+	defer r.Close()
+	for id := 0; id < IPV4_REASSEMBLY_MAX_DATAGRAMS; id++ {
+		hs, ps, _ := testFragments(t, uint16(id))
+		r.Add(hs[0], ps[0])
+	}
+	hs, ps, _ := testFragments(t, IPV4_REASSEMBLY_MAX_DATAGRAMS)
+	for i := range hs {
+		if _, _, ok := r.Add(hs[i], ps[i]); ok {
+			t.Fatal("datagram beyond the limit reassembled")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"bytes"        // バイト列の比較
+	"encoding/hex" // 取得したヘッダの読み込み
+	"net"          // IPアドレスの表現
+	"testing"
+)
+
+// オプションを解析できなくても、ヘッダ長と全長が正しければデータグラムを受け取ること
+func TestParseIPv4MalformedOptions(t *testing.T) {
+	// 長さが3のRouter Alert（正しくは4）
+	opts := []byte{IPV4_OPT_ROUTER_ALERT, 3, 0, 0}
+	ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote, Options: opts}
+	b, err := ip.MarshalWithPayload([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, payload, err := ParseIPv4(b)
+	if err != nil {
+		t.Fatalf("malformed options rejected the datagram: %s", err)
+	}
+	if h.OptionsErr == nil || h.ParsedOptions != nil {
+		t.Fatalf("OptionsErr %v, ParsedOptions %v", h.OptionsErr, h.ParsedOptions)
+	}
+	if !bytes.Equal(h.Options, opts) || string(payload) != "payload" {
+		t.Fatalf("options %x, payload %q", h.Options, payload)
+	}
+
+	// IHLがパケットを超える場合はエラーにする
+	b[0] = IPV4_VERSION<<4 | 15
+	if _, _, err := ParseIPv4(b); err == nil {
+		t.Fatal("accepted ihl beyond the packet")
+	}
+}
+
+// 正しいパケットを解析してから組み立て直すと、元と同じバイト列になること
+func TestIPv4MarshalRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		hex  string
+	}{
+		{"udp", "4500002000004000401100000a0000020a000001" + "0035003500000000" + "74657374"},
+		{"df and tos", "45b8001c1c4640004006000aac100a63ac100a0c" + "0102030405060708"},
+		{"fragment", "45000018abcd200540010000c0a80001c0a800c7" + "00000000"},
+		{"router alert", "4600001c0000000001020000c0a80001e0000016" + "94040000" + "1100eeff"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.hex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// チェックサムを埋めて正しいパケットにする
+			hlen := int(b[0]&0x0f) * 4
+			b[10], b[11] = 0, 0
+			csum := InternetChecksum(b[:hlen])
+			b[10], b[11] = byte(csum>>8), byte(csum)
+
+			h, payload, err := ParseIPv4(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := h.MarshalWithPayload(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Fatalf("round trip\n got %x\nwant %x", got, b)
+			}
+			hdr, err := h.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(hdr, b[:hlen]) {
+				t.Fatalf("header\n got %x\nwant %x", hdr, b[:hlen])
+			}
+		})
+	}
+}
+
+// VersionとIHL、TotalLengthを補完し、矛盾する組み合わせは拒否すること
+func TestIPv4MarshalValidation(t *testing.T) {
+	ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote, Options: []byte{IPV4_OPT_ROUTER_ALERT, 4, 0, 0}}
+	b, err := ip.MarshalWithPayload([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != IPV4_VERSION<<4|6 || ip.IHL != 6 || ip.TotalLength != 27 || len(b) != 27 {
+		t.Fatalf("version/ihl %#x, ihl %d, total length %d, %d bytes", b[0], ip.IHL, ip.TotalLength, len(b))
+	}
+	if InternetChecksum(b[:24]) != 0 || ip.Checksum != uint16(b[10])<<8|uint16(b[11]) {
+		t.Fatalf("checksum %#04x not filled", ip.Checksum)
+	}
+
+	for _, tt := range []struct {
+		name string
+		h    IPv4Header
+	}{
+		{"ihl below 5", IPv4Header{IHL: 4}},
+		{"ihl without options", IPv4Header{IHL: 6}},
+		{"options not a multiple of 4", IPv4Header{Options: []byte{IPV4_OPT_NOP, IPV4_OPT_NOP, IPV4_OPT_NOP}}},
+		{"options too long", IPv4Header{Options: make([]byte, 44)}},
+		{"version 6", IPv4Header{Version: 6}},
+		{"total length mismatch", IPv4Header{TotalLength: 100}},
+		{"no source", IPv4Header{Src: net.IP{}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.h
+			if h.Src == nil {
+				h.Src = testLocal
+			}
+			h.Dst = testRemote
+			if _, err := h.MarshalWithPayload([]byte("abc")); err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
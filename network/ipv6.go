@@ -0,0 +1,133 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+)
+
+const (
+	IPV6_VERSION    = 6
+	IPV6_HEADER_LEN = 40
+)
+
+// IPv6の拡張ヘッダ・上位層のプロトコル番号
+const (
+	PROTOCOL_IPV6_HOPOPTS  = 0
+	PROTOCOL_IPV6_ROUTE    = 43
+	PROTOCOL_IPV6_FRAGMENT = 44
+	PROTOCOL_ESP           = 50
+	PROTOCOL_AH            = 51
+	PROTOCOL_ICMPV6        = 58
+	PROTOCOL_IPV6_NONXT    = 59
+	PROTOCOL_IPV6_DSTOPTS  = 60
+)
+
+// IPv6ヘッダ
+type IPv6Header struct {
+	Version       uint8
+	TrafficClass  uint8
+	FlowLabel     uint32
+	PayloadLength uint16
+	NextHeader    uint8 // 固定ヘッダの次ヘッダ
+	HopLimit      uint8
+	Src           net.IP
+	Dst           net.IP
+	// 拡張ヘッダをたどった先の上位層のプロトコル番号
+	Protocol uint8
+	// 固定ヘッダと上位層の間にある拡張ヘッダ
+	Extensions []byte
+}
+
+// IPv6ヘッダを解析し、ヘッダと上位層のペイロードを返す
+// 拡張ヘッダはたどってExtensionsに格納し、上位層のプロトコル番号をProtocolに設定する
+// ESPの先は暗号化されているため、ESPを上位層として扱う
+func ParseIPv6(b []byte) (*IPv6Header, []byte, error) {
+	if len(b) < IPV6_HEADER_LEN {
+		return nil, nil, fmt.Errorf("invalid ipv6 header: too short (%d bytes)", len(b))
+	}
+	h := &IPv6Header{
+		Version:       b[0] >> 4,
+		TrafficClass:  b[0]<<4 | b[1]>>4,
+		FlowLabel:     binary.BigEndian.Uint32(b[0:4]) & 0x000fffff,
+		PayloadLength: binary.BigEndian.Uint16(b[4:6]),
+		NextHeader:    b[6],
+		HopLimit:      b[7],
+		Src:           net.IP(append([]byte(nil), b[8:24]...)),
+		Dst:           net.IP(append([]byte(nil), b[24:40]...)),
+	}
+	if h.Version != IPV6_VERSION {
+		return nil, nil, fmt.Errorf("invalid ipv6 header: version %d", h.Version)
+	}
+	end := IPV6_HEADER_LEN + int(h.PayloadLength)
+	if len(b) < end {
+		return nil, nil, fmt.Errorf("invalid ipv6 header: payload length %d exceeds %d bytes", h.PayloadLength, len(b)-IPV6_HEADER_LEN)
+	}
+	payload := b[IPV6_HEADER_LEN:end]
+
+	next := h.NextHeader
+	off := 0
+	for isIPv6Extension(next) {
+		if len(payload)-off < 8 {
+			return nil, nil, fmt.Errorf("invalid ipv6 extension header %d: too short", next)
+		}
+		var length int
+		switch next {
+		case PROTOCOL_IPV6_FRAGMENT:
+			length = 8
+		case PROTOCOL_AH:
+			// AHの長さは4バイト単位で、先頭8バイトを含まない
+			length = (int(payload[off+1]) + 2) * 4
+		default:
+			length = (int(payload[off+1]) + 1) * 8
+		}
+		if len(payload)-off < length {
+			return nil, nil, fmt.Errorf("invalid ipv6 extension header %d: length %d exceeds payload", next, length)
+		}
+		next = payload[off]
+		off += length
+	}
+	h.Protocol = next
+	if off > 0 {
+		h.Extensions = payload[:off]
+	}
+	return h, payload[off:], nil
+}
+
+// 拡張ヘッダのプロトコル番号か
+func isIPv6Extension(proto uint8) bool {
+	switch proto {
+	case PROTOCOL_IPV6_HOPOPTS, PROTOCOL_IPV6_ROUTE, PROTOCOL_IPV6_FRAGMENT, PROTOCOL_AH, PROTOCOL_IPV6_DSTOPTS:
+		return true
+	}
+	return false
+}
+
+// IPv6ヘッダにペイロードを付けたバイト列に変換する
+// 拡張ヘッダは付けず、NextHeaderが0ならProtocolを、PayloadLengthはペイロード長を設定する
+func (h *IPv6Header) MarshalWithPayload(payload []byte) ([]byte, error) {
+	if len(payload) > 0xffff {
+		return nil, fmt.Errorf("invalid ipv6 payload: too long (%d bytes)", len(payload))
+	}
+	src, dst := h.Src.To16(), h.Dst.To16()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid ipv6 address: src %v, dst %v", h.Src, h.Dst)
+	}
+	if h.Version == 0 {
+		h.Version = IPV6_VERSION
+	}
+	if h.NextHeader == 0 {
+		h.NextHeader = h.Protocol
+	}
+	h.PayloadLength = uint16(len(payload))
+
+	b := make([]byte, IPV6_HEADER_LEN+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(h.Version)<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0x000fffff)
+	binary.BigEndian.PutUint16(b[4:6], h.PayloadLength)
+	b[6] = h.NextHeader
+	b[7] = h.HopLimit
+	copy(b[8:24], src)
+	copy(b[24:40], dst)
+	copy(b[IPV6_HEADER_LEN:], payload)
+	return b, nil
+}
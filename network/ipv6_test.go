@@ -0,0 +1,153 @@
+package network
+
+import (
+	"context"      // 読み込みの期限
+	"encoding/hex" // 取得したパケットの読み込み
+	"net"          // IPアドレスの表現
+	"net/netip"    // アドレスの表現
+	"testing"
+	"time" // 読み込みの期限
+)
+
+// fe80::1からfe80::2へのエコー要求（フローラベル0x12345、ホップ制限64）
+const ipv6EchoRequest = "60012345000c3a40" +
+	"fe800000000000000000000000000001" +
+	"fe800000000000000000000000000002" +
+	"8000a1c11c2b000161626364"
+
+// 同じエコー要求の前にHop-by-HopとDestination Optionsの拡張ヘッダ（PadN）を置いたもの
+const ipv6EchoRequestExt = "6b800000001c00ff" +
+	"fe800000000000000000000000000001" +
+	"fe800000000000000000000000000002" +
+	"3c00010400000000" + "3a00010400000000" +
+	"8000a1c11c2b000161626364"
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 固定ヘッダの各フィールドを解析し、拡張ヘッダをたどって上位層を見つけること
+func TestParseIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		hex     string
+		tc      uint8
+		flow    uint32
+		next    uint8
+		hop     uint8
+		extLen  int
+		payload int
+	}{
+		{"echo request", ipv6EchoRequest, 0, 0x12345, PROTOCOL_ICMPV6, 64, 0, 12},
+		{"extension headers", ipv6EchoRequestExt, 0xb8, 0, PROTOCOL_IPV6_HOPOPTS, 255, 16, 28},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, payload, err := ParseIPv6(decodeHex(t, tc.hex))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Version != IPV6_VERSION || h.TrafficClass != tc.tc || h.FlowLabel != tc.flow || h.NextHeader != tc.next || h.HopLimit != tc.hop {
+				t.Fatalf("header %+v", h)
+			}
+			if int(h.PayloadLength) != tc.payload || len(h.Extensions) != tc.extLen || h.Protocol != PROTOCOL_ICMPV6 {
+				t.Fatalf("payload length %d, %d bytes extensions, protocol %d", h.PayloadLength, len(h.Extensions), h.Protocol)
+			}
+			if !h.Src.Equal(net.ParseIP("fe80::1")) || !h.Dst.Equal(net.ParseIP("fe80::2")) {
+				t.Fatalf("%s -> %s", h.Src, h.Dst)
+			}
+			msg, err := ParseICMPv6(payload, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != ICMPV6_TYPE_ECHO_REQUEST || msg.ID != 0x1c2b || msg.Seq != 1 || string(msg.Data) != "abcd" {
+				t.Fatalf("icmpv6 %+v", msg)
+			}
+		})
+	}
+}
+
+// 壊れたパケットを拒否すること
+func TestParseIPv6Invalid(t *testing.T) {
+	b := decodeHex(t, ipv6EchoRequest)
+	if _, _, err := ParseIPv6(b[:IPV6_HEADER_LEN-1]); err == nil {
+		t.Fatal("accepted a short header")
+	}
+	if _, _, err := ParseIPv6(b[:len(b)-1]); err == nil {
+		t.Fatal("accepted payload length beyond the packet")
+	}
+	v4 := append([]byte(nil), b...)
+	v4[0] = 0x45
+	if _, _, err := ParseIPv6(v4); err == nil {
+		t.Fatal("accepted version 4")
+	}
+	// 拡張ヘッダの長さがペイロードを超える
+	ext := decodeHex(t, ipv6EchoRequestExt)
+	ext[IPV6_HEADER_LEN+1] = 8
+	if _, _, err := ParseIPv6(ext); err == nil {
+		t.Fatal("accepted an extension header beyond the payload")
+	}
+	// チェックサムは疑似ヘッダを含めて検証する
+	h, payload, err := ParseIPv6(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Dst = net.ParseIP("fe80::3")
+	if _, err := ParseICMPv6(payload, h); err == nil {
+		t.Fatal("accepted a wrong pseudo-header")
+	}
+}
+
+// 解析してから組み立て直すと元と同じバイト列になること
+func TestIPv6MarshalRoundTrip(t *testing.T) {
+	b := decodeHex(t, ipv6EchoRequest)
+	h, payload, err := ParseIPv6(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.MarshalWithPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(got) != ipv6EchoRequest {
+		t.Fatalf("round trip\n got %x\nwant %s", got, ipv6EchoRequest)
+	}
+}
+
+// スタックがバージョンで振り分け、自身のIPv6アドレスへのエコー要求に応答すること
+func TestStackEchoV6(t *testing.T) {
+	s, peer := rawPeer(t)
+	if err := s.SetIPv6Addr(netip.MustParseAddr("fe80::2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []string{ipv6EchoRequest, ipv6EchoRequestExt} {
+		if err := peer.WriteBytes(decodeHex(t, req)); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		pkt, err := peer.ReadContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("no echo reply: %s", err)
+		}
+		h, payload, err := ParseIPv6(pkt.Buf[:pkt.Len()])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Src.Equal(net.ParseIP("fe80::2")) || !h.Dst.Equal(net.ParseIP("fe80::1")) {
+			t.Fatalf("reply %s -> %s", h.Src, h.Dst)
+		}
+		msg, err := ParseICMPv6(payload, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != ICMPV6_TYPE_ECHO_REPLY || msg.ID != 0x1c2b || msg.Seq != 1 || string(msg.Data) != "abcd" {
+			t.Fatalf("reply %+v", msg)
+		}
+		pkt.Release()
+	}
+}
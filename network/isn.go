@@ -0,0 +1,51 @@
+package network
+
+import (
+	"crypto/rand"     // 秘密鍵と乱数の生成
+	"crypto/sha256"   // 4つ組のハッシュ
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net/netip"       // アドレスとポートの表現
+	"time"            // ISNのタイマー
+)
+
+// 暗号論的な乱数を返す
+func randomUint32() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("rand error: %s", err.Error()))
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// RFC 6528の初期シーケンス番号の生成器
+// ISN = M + F(localip, localport, remoteip, remoteport, secretkey)
+// Mは4マイクロ秒ごとに1増えるタイマー、Fは秘密鍵と4つ組を連結したSHA-256の先頭32ビット
+// 同じ4つ組では時間とともに増えるため、TIME_WAITの間に作り直したコネクションの
+// セグメントが前のコネクションのものと混ざりにくく、4つ組が違えば推測できない
+type isnGenerator struct {
+	secret [16]byte
+	start  time.Time
+}
+
+func newISNGenerator() *isnGenerator {
+	g := &isnGenerator{start: time.Now()}
+	if _, err := rand.Read(g.secret[:]); err != nil {
+		panic(fmt.Sprintf("rand error: %s", err.Error()))
+	}
+	return g
+}
+
+func (g *isnGenerator) generate(local, remote netip.AddrPort) uint32 {
+	h := sha256.New()
+	h.Write(g.secret[:])
+	for _, ap := range []netip.AddrPort{local, remote} {
+		addr := ap.Addr().As16()
+		h.Write(addr[:])
+		h.Write([]byte{byte(ap.Port() >> 8), byte(ap.Port())})
+	}
+	var sum [sha256.Size]byte
+	f := binary.BigEndian.Uint32(h.Sum(sum[:0]))
+	m := uint32(time.Since(g.start) / (4 * time.Microsecond))
+	return m + f
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"net/netip" // アドレスとポートの表現
+	"testing"
+	"time" // ISNのタイマー
+)
+
+// 同じ4つ組では時間とともに増え、4つ組や秘密鍵が違えば異なる値になること（RFC 6528）
+func TestISNGenerator(t *testing.T) {
+	g := newISNGenerator()
+	local := netip.MustParseAddrPort("10.0.0.1:40000")
+	remote := netip.MustParseAddrPort("10.0.0.2:80")
+
+	first := g.generate(local, remote)
+	time.Sleep(2 * time.Millisecond)
+	second := g.generate(local, remote)
+	// 4マイクロ秒ごとに1増えるため、2ミリ秒で500以上進む
+	if !seqGT(second, first) || second-first < 500 {
+		t.Fatalf("isn %d then %d, want an increase of at least 500", first, second)
+	}
+
+	seen := map[uint32]bool{}
+	for _, tuple := range [][2]netip.AddrPort{
+		{local, remote},
+		{netip.MustParseAddrPort("10.0.0.1:40001"), remote},
+		{local, netip.MustParseAddrPort("10.0.0.3:80")},
+		{remote, local},
+	} {
+		isn := g.generate(tuple[0], tuple[1])
+		if seen[isn] {
+			t.Fatalf("%s -> %s: isn %d repeats another tuple", tuple[0], tuple[1], isn)
+		}
+		seen[isn] = true
+	}
+	// 秘密鍵が違えば同じ4つ組でも推測できない
+	other := newISNGenerator()
+	other.start = g.start
+	if g.generate(local, remote) == other.generate(local, remote) {
+		t.Fatal("two generators produced the same isn")
+	}
+}
+
+// 設定した生成関数のISNがSYNに載り、nilで既定の生成器に戻ること
+func TestSetISNGenerator(t *testing.T) {
+	s, dev := rawPeer(t)
+	dial := func() *TCPHeader {
+		t.Helper()
+		go s.DialTCPTimeout(netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), 80), 100*time.Millisecond)
+		h, _ := readTCP(t, dev)
+		if h.Flags != TCP_FLAG_SYN {
+			t.Fatalf("flags %s, want SYN", TCPFlagsString(h.Flags))
+		}
+		return h
+	}
+
+	s.SetISNGenerator(func() uint32 { return 0xdeadbeef })
+	if h := dial(); h.Seq != 0xdeadbeef {
+		t.Fatalf("syn seq %#x, want 0xdeadbeef", h.Seq)
+	}
+	s.SetISNGenerator(nil)
+	if h := dial(); h.Seq == 0xdeadbeef {
+		t.Fatal("fixed isn used after reset")
+	}
+}
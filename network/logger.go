@@ -0,0 +1,38 @@
+package network
+
+import (
+	"log" // 標準ライブラリのロガーへの橋渡し
+)
+
+// デバイスとプロトコル層が使うロガー
+// 既定では何も出力しない。WithLoggerで利用者のロガーに差し替える
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// 何も出力しないロガー
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Infof(string, ...any)  {}
+func (nopLogger) Errorf(string, ...any) {}
+
+// 標準ライブラリのlog.Loggerに出力するロガー
+// レベルは先頭に付けて区別する
+type stdLogger struct {
+	l *log.Logger
+}
+
+// log.Loggerに出力するLoggerを返す。lがnilの場合はlog.Default()を使う
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l: l}
+}
+
+func (s stdLogger) Debugf(format string, args ...any) { s.l.Printf("DEBUG "+format, args...) }
+func (s stdLogger) Infof(format string, args ...any)  { s.l.Printf("INFO "+format, args...) }
+func (s stdLogger) Errorf(format string, args ...any) { s.l.Printf("ERROR "+format, args...) }
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"expvar"   // 統計の公開
+	"fmt"      // 文字列の生成や出力、スキャン
+	"io"       // 出力先
+	"net/http" // メトリクスの配信
+)
+
+// 統計をexpvarにprefixという名前で公開する
+// 値は参照のたびにStatsを呼び出して取得するため、登録後に更新する必要はない
+func (t *NetDevice) RegisterExpvar(prefix string) error {
+	if prefix == "" {
+		prefix = t.name
+	}
+	if expvar.Get(prefix) != nil {
+		return fmt.Errorf("expvar %q already registered", prefix)
+	}
+	expvar.Publish(prefix, expvar.Func(func() any {
+		m := t.Stats().expvarMap()
+		in, out := t.QueueDepths()
+		m["queue_depth"] = map[string]any{"incoming": in, "outgoing": out}
+		return m
+	}))
+	return nil
+}
+
+func (s Stats) expvarMap() map[string]any {
+	return map[string]any{
+		"rx_packets":   s.RxPackets,
+		"tx_packets":   s.TxPackets,
+		"rx_bytes":     s.RxBytes,
+		"tx_bytes":     s.TxBytes,
+		"rx_drops":     s.RxDrops,
+		"tx_drops":     s.TxDrops,
+		"rx_filtered":  s.RxFiltered,
+		"tx_filtered":  s.TxFiltered,
+		"rx_truncated": s.RxTruncated,
+		"rx_runt":      s.RxRunt,
+		"rx_protocols": s.RxProtocols.expvarMap(),
+		"tx_protocols": s.TxProtocols.expvarMap(),
+	}
+}
+
+func (p ProtocolStats) expvarMap() map[string]any {
+	return map[string]any{
+		"icmp":  p.ICMP,
+		"tcp":   p.TCP,
+		"udp":   p.UDP,
+		"other": p.Other,
+	}
+}
+
+// 統計をPrometheusのテキスト形式で書き出す
+// client_golangに依存せずにスクレイプできるようにするためのもので、メトリクス名は
+// prometheusビルドタグ付きのPrometheusCollectorと同じ
+func (t *NetDevice) WritePrometheus(w io.Writer) error {
+	s := t.Stats()
+	dev := t.name
+	metrics := []struct {
+		name, help string
+		rx, tx     uint64
+	}{
+		{"tcpip_packets_total", "Packets read from or written to the device.", s.RxPackets, s.TxPackets},
+		{"tcpip_bytes_total", "Bytes read from or written to the device.", s.RxBytes, s.TxBytes},
+		{"tcpip_drops_total", "Packets dropped on read or write.", s.RxDrops, s.TxDrops},
+		{"tcpip_filtered_total", "Packets dropped by a hook.", s.RxFiltered, s.TxFiltered},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s{device=%q,direction=\"rx\"} %d\n%s{device=%q,direction=\"tx\"} %d\n", m.name, dev, m.rx, m.name, dev, m.tx); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "# HELP tcpip_rx_truncated_total Packets truncated on read.\n# TYPE tcpip_rx_truncated_total counter\ntcpip_rx_truncated_total{device=%q} %d\n", dev, s.RxTruncated); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "# HELP tcpip_rx_runt_total Packets shorter than the minimum header dropped on read.\n# TYPE tcpip_rx_runt_total counter\ntcpip_rx_runt_total{device=%q} %d\n", dev, s.RxRunt); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprint(w, "# HELP tcpip_protocol_packets_total Packets by direction and IP protocol.\n# TYPE tcpip_protocol_packets_total counter\n"); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		dir string
+		p   ProtocolStats
+	}{{"rx", s.RxProtocols}, {"tx", s.TxProtocols}} {
+		for _, v := range []struct {
+			proto string
+			value uint64
+		}{{"icmp", d.p.ICMP}, {"tcp", d.p.TCP}, {"udp", d.p.UDP}, {"other", d.p.Other}} {
+			if _, err := fmt.Fprintf(w, "tcpip_protocol_packets_total{device=%q,direction=%q,protocol=%q} %d\n", dev, d.dir, v.proto, v.value); err != nil {
+				return err
+			}
+		}
+	}
+	in, out := t.QueueDepths()
+	if _, err := fmt.Fprintf(w, "# HELP tcpip_queue_depth Packets waiting in the incoming or outgoing queue.\n# TYPE tcpip_queue_depth gauge\ntcpip_queue_depth{device=%q,queue=\"incoming\"} %d\ntcpip_queue_depth{device=%q,queue=\"outgoing\"} %d\n", dev, in, dev, out); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 統計をPrometheusのテキスト形式で返すhttp.Handler
+func (t *NetDevice) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		t.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,71 @@
+//go:build prometheus
+
+// client_golangへの依存を任意にするため、prometheusビルドタグを付けた場合のみビルドする
+//
+//	go get github.com/prometheus/client_golang/prometheus
+//	go build -tags prometheus ./...
+
+package network
+
+import (
+	"github.com/prometheus/client_golang/prometheus" // Collectorの実装
+)
+
+var (
+	promPacketsDesc = prometheus.NewDesc("tcpip_packets_total", "Packets read from or written to the device.", []string{"device", "direction"}, nil)
+	promBytesDesc   = prometheus.NewDesc("tcpip_bytes_total", "Bytes read from or written to the device.", []string{"device", "direction"}, nil)
+	promDropsDesc   = prometheus.NewDesc("tcpip_drops_total", "Packets dropped on read or write.", []string{"device", "direction"}, nil)
+	promFilterDesc  = prometheus.NewDesc("tcpip_filtered_total", "Packets dropped by a hook.", []string{"device", "direction"}, nil)
+	promTruncDesc   = prometheus.NewDesc("tcpip_rx_truncated_total", "Packets truncated on read.", []string{"device"}, nil)
+	promRuntDesc    = prometheus.NewDesc("tcpip_rx_runt_total", "Packets shorter than the minimum header dropped on read.", []string{"device"}, nil)
+	promProtoDesc   = prometheus.NewDesc("tcpip_protocol_packets_total", "Packets by direction and IP protocol.", []string{"device", "direction", "protocol"}, nil)
+	promQueueDesc   = prometheus.NewDesc("tcpip_queue_depth", "Packets waiting in the incoming or outgoing queue.", []string{"device", "queue"}, nil)
+)
+
+// デバイスの統計を公開するprometheus.Collector
+type statsCollector struct {
+	dev *NetDevice
+}
+
+// デバイスの統計を公開するprometheus.Collectorを返す
+func (t *NetDevice) PrometheusCollector() prometheus.Collector {
+	return statsCollector{dev: t}
+}
+
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promPacketsDesc
+	ch <- promBytesDesc
+	ch <- promDropsDesc
+	ch <- promFilterDesc
+	ch <- promTruncDesc
+	ch <- promRuntDesc
+	ch <- promProtoDesc
+	ch <- promQueueDesc
+}
+
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.dev.Stats()
+	dev := c.dev.name
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	counter(promPacketsDesc, s.RxPackets, dev, "rx")
+	counter(promPacketsDesc, s.TxPackets, dev, "tx")
+	counter(promBytesDesc, s.RxBytes, dev, "rx")
+	counter(promBytesDesc, s.TxBytes, dev, "tx")
+	counter(promDropsDesc, s.RxDrops, dev, "rx")
+	counter(promDropsDesc, s.TxDrops, dev, "tx")
+	counter(promFilterDesc, s.RxFiltered, dev, "rx")
+	counter(promFilterDesc, s.TxFiltered, dev, "tx")
+	counter(promTruncDesc, s.RxTruncated, dev)
+	counter(promRuntDesc, s.RxRunt, dev)
+	for dir, p := range map[string]ProtocolStats{"rx": s.RxProtocols, "tx": s.TxProtocols} {
+		counter(promProtoDesc, p.ICMP, dev, dir, "icmp")
+		counter(promProtoDesc, p.TCP, dev, dir, "tcp")
+		counter(promProtoDesc, p.UDP, dev, dir, "udp")
+		counter(promProtoDesc, p.Other, dev, dir, "other")
+	}
+	in, out := c.dev.QueueDepths()
+	ch <- prometheus.MustNewConstMetric(promQueueDesc, prometheus.GaugeValue, float64(in), dev, "incoming")
+	ch <- prometheus.MustNewConstMetric(promQueueDesc, prometheus.GaugeValue, float64(out), dev, "outgoing")
+}
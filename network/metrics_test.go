@@ -0,0 +1,93 @@
+package network
+
+import (
+	"encoding/json"     // expvarの値の解析
+	"expvar"            // 公開した統計の参照
+	"fmt"               // 公開する名前の生成
+	"net/http/httptest" // ハンドラの呼び出し
+	"strings"           // 出力の検索
+	"testing"
+)
+
+// expvarの名前はプロセスで一意のため、-countで繰り返しても重ならないようにする
+var expvarRuns int
+
+// expvarに公開した統計に期待するキーがあり、送信したパケットが反映されること
+func TestRegisterExpvar(t *testing.T) {
+	a, b := forwardPair(t)
+	expvarRuns++
+	name := fmt.Sprintf("tcpip_test_expvar_%d", expvarRuns)
+	if err := a.RegisterExpvar(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RegisterExpvar(name); err == nil {
+		t.Fatal("registered the same name twice")
+	}
+	if err := a.WriteBytes(natUDP(t, testLocal, testRemote, 1, 53, "x")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, b)
+	pkt.Release()
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("not published")
+	}
+	var m map[string]any
+	if err := json.Unmarshal([]byte(v.String()), &m); err != nil {
+		t.Fatalf("%s: %s", err, v.String())
+	}
+	for _, k := range []string{
+		"rx_packets", "tx_packets", "rx_bytes", "tx_bytes", "rx_drops", "tx_drops",
+		"rx_filtered", "tx_filtered", "rx_truncated", "rx_runt", "rx_protocols", "tx_protocols", "queue_depth",
+	} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("key %q missing", k)
+		}
+	}
+	if m["tx_packets"] != float64(1) {
+		t.Fatalf("tx_packets %v, want 1", m["tx_packets"])
+	}
+	protos, _ := m["tx_protocols"].(map[string]any)
+	for _, k := range []string{"icmp", "tcp", "udp", "other"} {
+		if _, ok := protos[k]; !ok {
+			t.Errorf("tx_protocols key %q missing", k)
+		}
+	}
+	if protos["udp"] != float64(1) {
+		t.Fatalf("tx_protocols.udp %v, want 1", protos["udp"])
+	}
+	depth, _ := m["queue_depth"].(map[string]any)
+	if _, ok := depth["incoming"]; !ok {
+		t.Fatalf("queue_depth %v", m["queue_depth"])
+	}
+}
+
+// Prometheusのテキスト形式で方向ごとのカウンタを返すこと
+func TestMetricsHandler(t *testing.T) {
+	a, b := forwardPair(t)
+	if err := a.WriteBytes(natUDP(t, testLocal, testRemote, 1, 53, "x")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, b)
+	pkt.Release()
+
+	rec := httptest.NewRecorder()
+	a.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE tcpip_packets_total counter\n",
+		`tcpip_packets_total{device="` + a.name + `",direction="tx"} 1` + "\n",
+		`tcpip_packets_total{device="` + a.name + `",direction="rx"} 0` + "\n",
+		`tcpip_protocol_packets_total{device="` + a.name + `",direction="tx",protocol="udp"} 1` + "\n",
+		"# TYPE tcpip_queue_depth gauge\n",
+		"tcpip_rx_runt_total{",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package network
+
+import (
+	"errors" // エラーの判定
+	"os"     // 閉じたファイルのエラー
+)
+
+// バッファプールからパケットを読み込む
+// recvmmsgが使える場合はreadBatch個までまとめて読み込み、使えない場合は1個ずつreadする
+// TUN/TAPのfdはソケットではないためrecvmmsgはENOTSOCKとなり、以降はreadに切り替わる
+func (t *NetDevice) readPackets() ([]Packet, error) {
+	if t.readBatch > 1 && t.raw != nil && !t.noRecvmmsg.Load() {
+		pkts, err := t.recvmmsg(t.readBatch)
+		if !mmsgUnsupported(err) {
+			return pkts, err
+		}
+		t.noRecvmmsg.Store(true)
+	}
+	ref := t.buffers.get()
+	n, err := t.read(ref.b)
+	if err != nil {
+		t.buffers.putUnused(ref)
+		return nil, err
+	}
+	pkt, err := t.makePacket(ref, n)
+	if err != nil {
+		t.buffers.putUnused(ref)
+		return nil, err
+	}
+	return []Packet{pkt}, nil
+}
+
+// パケットを順番に書き込む
+// sendmmsgが使える場合はまとめて書き込み、使えない場合は1個ずつwriteする
+// 書き込みに失敗したパケットはログに記録して読み飛ばす
+func (t *NetDevice) writePackets(pkts []Packet) {
+	if len(pkts) > 1 && SYS_SENDMMSG != 0 && t.raw != nil && !t.noSendmmsg.Load() {
+		err := t.sendmmsg(pkts)
+		if err == nil {
+			for i := range pkts {
+				pkts[i].Release()
+			}
+			return
+		}
+		t.noSendmmsg.Store(true)
+	}
+	for _, pkt := range pkts {
+		if _, err := t.write(t.frame(pkt)); err != nil {
+			t.logger.Errorf("write error: %s", err.Error())
+			t.stats.txDrops.Add(1)
+			// Closeを経ずにファイルが閉じられた場合は送受信を止める
+			if errors.Is(err, os.ErrClosed) && t.ctx.Err() == nil {
+				t.fail(err)
+			}
+		} else {
+			t.stats.sent(pkt.Buf[:pkt.Len()], t.mode)
+			t.captured(pkt.Buf[:pkt.Len()])
+		}
+		pkt.Release()
+	}
+}
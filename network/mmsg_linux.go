@@ -0,0 +1,177 @@
+package network
+
+import (
+	"errors"  // エラーの判定
+	"fmt"     // 文字列の生成や出力、スキャン
+	"os"      // 閉じたファイルのエラー
+	"syscall" // システムコールの呼び出し
+	"time"    // 受信時刻
+	"unsafe"  // 構造体のポインタ渡し
+)
+
+// カーネルのstruct mmsghdr
+// 末尾の詰め物はGoがMsghdrの境界に揃えて付けるため、64ビットでは64バイト、32ビットでは32バイトとなりカーネルと一致する
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// recvmmsg/sendmmsgが使えないことを示すエラーか
+func mmsgUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSOCK) || errors.Is(err, syscall.ENOSYS)
+}
+
+// 受信時刻の制御メッセージの大きさ
+var timestampSpace = syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{})))
+
+// ソケットでSO_TIMESTAMPNSを有効にする。最初のrecvmmsgで一度だけ試す
+func (t *NetDevice) enableTimestamps() bool {
+	t.timestampOnce.Do(func() {
+		err := t.control(func(fd uintptr) error {
+			return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+		})
+		if err == nil {
+			t.timestamps.Store(true)
+		}
+	})
+	return t.timestamps.Load()
+}
+
+// 制御メッセージからSO_TIMESTAMPNSの受信時刻を取り出す
+func parseTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_TIMESTAMPNS &&
+			len(m.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+			ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Unix()), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// recvmmsgで最大max個のパケットを読み込む
+// MSG_WAITFORONEを指定し、1個届いた時点で読み込めている分だけを返す
+// SO_TIMESTAMPNSを使える場合はカーネルの受信時刻をTimestampに設定する
+func (t *NetDevice) recvmmsg(max int) ([]Packet, error) {
+	refs := make([]*poolBuf, max)
+	iovs := make([]syscall.Iovec, max)
+	msgs := make([]mmsghdr, max)
+	var oob []byte
+	if t.enableTimestamps() {
+		oob = make([]byte, max*timestampSpace)
+	}
+	for i := range refs {
+		refs[i] = t.buffers.get()
+		iovs[i].Base = &refs[i].b[0]
+		iovs[i].SetLen(len(refs[i].b))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+		if oob != nil {
+			msgs[i].hdr.Control = &oob[i*timestampSpace]
+			msgs[i].hdr.SetControllen(timestampSpace)
+		}
+	}
+	release := func(from int) {
+		for _, ref := range refs[from:] {
+			t.buffers.putUnused(ref)
+		}
+	}
+	var n uintptr
+	var sysErr syscall.Errno
+	// EAGAINの間はfalseを返し、ポーラーで読み込めるようになるまで待つ
+	err := t.raw.Read(func(fd uintptr) bool {
+		for {
+			n, _, sysErr = syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(max), syscall.MSG_WAITFORONE, 0, 0)
+			if sysErr != syscall.EINTR {
+				return sysErr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		// RawConnのエラーはfdが閉じられたことを表すが、os.ErrClosedには変換されない
+		err = os.ErrClosed
+	} else if sysErr != 0 {
+		err = sysErr
+	}
+	if err != nil {
+		release(0)
+		return nil, fmt.Errorf("recvmmsg error: %w", err)
+	}
+	pkts := make([]Packet, 0, n)
+	for i := 0; i < int(n); i++ {
+		pkt, err := t.makePacket(refs[i], uintptr(msgs[i].len))
+		if err != nil {
+			t.logger.Errorf("%s", err.Error())
+			t.stats.rxDrops.Add(1)
+			t.buffers.putUnused(refs[i])
+			continue
+		}
+		if oob != nil {
+			cmsg := oob[i*timestampSpace : i*timestampSpace+int(msgs[i].hdr.Controllen)]
+			if ts, ok := parseTimestamp(cmsg); ok {
+				pkt.Timestamp = ts
+			}
+		}
+		pkts = append(pkts, pkt)
+	}
+	release(int(n))
+	return pkts, nil
+}
+
+// sendmmsgでパケットをまとめて書き込む
+// 一部だけが送信された場合は残りを続けて送信する
+// sendmmsgが使えない場合にのみエラーを返す
+func (t *NetDevice) sendmmsg(pkts []Packet) error {
+	iovs := make([]syscall.Iovec, len(pkts))
+	msgs := make([]mmsghdr, len(pkts))
+	for i, pkt := range pkts {
+		b := t.frame(pkt)
+		if len(b) > 0 {
+			iovs[i].Base = &b[0]
+		}
+		iovs[i].SetLen(len(b))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+	}
+	for sent := 0; sent < len(msgs); {
+		var n uintptr
+		var sysErr syscall.Errno
+		err := t.raw.Write(func(fd uintptr) bool {
+			for {
+				n, _, sysErr = syscall.Syscall6(SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+				if sysErr != syscall.EINTR {
+					return sysErr != syscall.EAGAIN
+				}
+			}
+		})
+		if err != nil {
+			// fdが閉じられた場合は残りを破棄する
+			t.logger.Errorf("write error: sendmmsg error: %s", err.Error())
+			t.stats.txDrops.Add(uint64(len(msgs) - sent))
+			if t.ctx.Err() == nil {
+				t.fail(fmt.Errorf("sendmmsg error: %w", os.ErrClosed))
+			}
+			return nil
+		}
+		if sysErr == syscall.ENOTSOCK || sysErr == syscall.ENOSYS {
+			return fmt.Errorf("sendmmsg error: %w", sysErr)
+		}
+		if sysErr != 0 {
+			// 先頭のパケットで失敗した場合は読み飛ばして残りを送る
+			t.logger.Errorf("write error: sendmmsg error: %s", sysErr.Error())
+			t.stats.txDrops.Add(1)
+			sent++
+			continue
+		}
+		for _, pkt := range pkts[sent : sent+int(n)] {
+			t.stats.sent(pkt.Buf[:pkt.Len()], t.mode)
+			t.captured(pkt.Buf[:pkt.Len()])
+		}
+		sent += int(n)
+	}
+	return nil
+}
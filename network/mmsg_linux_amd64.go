@@ -0,0 +1,4 @@
+package network
+
+// sendmmsgのシステムコール番号（syscallパッケージには定義されていない）
+const SYS_SENDMMSG = 307
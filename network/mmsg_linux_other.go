@@ -0,0 +1,6 @@
+//go:build linux && !amd64 && !arm64
+
+package network
+
+// システムコール番号が分からないアーキテクチャではsendmmsgを使わずwriteする
+const SYS_SENDMMSG = 0
@@ -0,0 +1,288 @@
+package network
+
+import (
+	"bytes"   // パケットの比較
+	"fmt"     // サブベンチマークの名前
+	"syscall" // ソケットペアの作成
+	"testing" // ベンチマーク
+	"time"    // 経過時間
+	"unsafe"  // 構造体の大きさ
+)
+
+// /dev/net/tunの代わりにUNIXドメインのデータグラムソケットペアの片側を開くdeviceSys
+// TUNデバイスや特権が無くても、openDeviceからrecvmmsg/sendmmsgまでの実際の経路を通せる
+// 対向のfdはpeersに追加する
+func socketPairSys(tb testing.TB, peers *[]int) *deviceSys {
+	return &deviceSys{
+		path: "socketpair",
+		open: func(path string, mode int, perm uint32) (int, error) {
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+			if err != nil {
+				return -1, err
+			}
+			*peers = append(*peers, fds[1])
+			tb.Cleanup(func() { syscall.Close(fds[1]) })
+			return fds[0], nil
+		},
+		ioctl: func(fd, req, arg uintptr) error { return nil },
+	}
+}
+
+func withSys(sys *deviceSys) Option {
+	return func(c *config) error {
+		c.sys = sys
+		return nil
+	}
+}
+
+// 対向のfdにpktを書き込み続ける。doneを閉じると止まる
+func feed(fd int, pkt []byte, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := syscall.Write(fd, pkt); err != nil {
+			return
+		}
+	}
+}
+
+// mmsghdrの大きさがカーネルのstruct mmsghdrと一致すること
+// 一致しないと2つ目以降のエントリがずれ、カーネルが別の場所に書き込む
+func TestMmsghdrLayout(t *testing.T) {
+	want := uintptr(32)
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		want = 64
+	}
+	if got := unsafe.Sizeof(mmsghdr{}); got != want {
+		t.Fatalf("sizeof(mmsghdr) = %d, want %d", got, want)
+	}
+}
+
+// 長さの異なるパケット
+func batchPackets(t *testing.T, n int) [][]byte {
+	pkts := make([][]byte, n)
+	for i := range pkts {
+		pkts[i] = udpPacket(t, uint16(1000+i), 1+i*37)
+	}
+	return pkts
+}
+
+// recvmmsgの1回の呼び出しで、届いていた全てのパケットを順番どおり正しい長さで読み込むこと
+func TestRecvmmsgBatch(t *testing.T) {
+	var peers []int
+	dev, err := newDevice(ModeTUN, []Option{withSys(socketPairSys(t, &peers))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	want := batchPackets(t, 20)
+	for _, p := range want {
+		if _, err := syscall.Write(peers[0], p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := dev.recvmmsg(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d packets in one call, want %d", len(got), len(want))
+	}
+	for i, p := range got {
+		if !bytes.Equal(p.Buf[:p.Len()], want[i]) {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, p.Len(), len(want[i]))
+		}
+		p.Release()
+	}
+}
+
+// sendmmsgでまとめて書き込んだパケットが、順番どおり正しい内容で届くこと
+func TestSendmmsgBatch(t *testing.T) {
+	if SYS_SENDMMSG == 0 {
+		t.Skip("sendmmsg is not available on this architecture")
+	}
+	var peers []int
+	dev, err := newDevice(ModeTUN, []Option{withSys(socketPairSys(t, &peers))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	want := batchPackets(t, 20)
+	pkts := make([]Packet, len(want))
+	for i, p := range want {
+		pkts[i] = bytesPacket(p)
+	}
+	if err := dev.sendmmsg(pkts); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	for i, p := range want {
+		n, err := syscall.Read(peers[0], buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, n, len(p))
+		}
+	}
+	if got := dev.Stats().TxPackets; got != uint64(len(want)) {
+		t.Fatalf("tx packets %d, want %d", got, len(want))
+	}
+}
+
+// recvmmsgで1回に読み込むパケット数ごとの受信の性能
+// batch=1はパケットごとにreadを呼ぶ場合に当たる
+func BenchmarkReadBatch(b *testing.B) {
+	pkt := udpPacket(b, 1000, 64)
+	for _, batch := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			var peers []int
+			dev, err := newDevice(ModeTUN, []Option{withSys(socketPairSys(b, &peers)), WithReadBatchSize(batch)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dev.Close()
+			if batch == 1 {
+				dev.noRecvmmsg.Store(true)
+			}
+			dev.Bind()
+			done := make(chan struct{})
+			defer close(done)
+			for i := 0; i < 4; i++ {
+				go feed(peers[0], pkt, done)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				p, err := dev.ReadPacket()
+				if err != nil {
+					b.Fatal(err)
+				}
+				p.Release()
+			}
+			reportPPS(b, start)
+		})
+	}
+}
+
+// 送信のゴルーチンがキューに溜まった分をsendmmsgでまとめて書き込む場合と、1個ずつwriteする場合の比較
+func BenchmarkWriteBatch(b *testing.B) {
+	if SYS_SENDMMSG == 0 {
+		b.Skip("sendmmsg is not available on this architecture")
+	}
+	pkt := udpPacket(b, 1000, 64)
+	for _, tc := range []struct {
+		name     string
+		sendmmsg bool
+	}{
+		{"sendmmsg", true},
+		{"write", false},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			var peers []int
+			dev, err := newDevice(ModeTUN, []Option{withSys(socketPairSys(b, &peers))})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dev.Close()
+			dev.noSendmmsg.Store(!tc.sendmmsg)
+			dev.Bind()
+			received := make(chan struct{})
+			go func() {
+				defer close(received)
+				buf := make([]byte, len(pkt))
+				for i := 0; i < b.N; i++ {
+					if _, err := syscall.Read(peers[0], buf); err != nil {
+						return
+					}
+				}
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				ref := dev.buffers.get()
+				p := Packet{Buf: ref.b[:copy(ref.b, pkt)], pool: dev.buffers, ref: ref, gen: ref.gen.Load()}
+				p.normalize()
+				if err := dev.WritePacket(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-received
+			reportPPS(b, start)
+		})
+	}
+}
+
+// マルチキューのデバイスで、キューごとの読み込みのゴルーチンから集めた受信の性能
+func BenchmarkMultiQueueRead(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("queues=%d", n), func(b *testing.B) {
+			var peers []int
+			dev, err := newMultiQueueDevice(ModeTUN, n, []Option{withSys(socketPairSys(b, &peers))})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dev.Close()
+			dev.Bind()
+			done := make(chan struct{})
+			defer close(done)
+			for i, fd := range peers {
+				go feed(fd, udpPacket(b, uint16(1000+i), 64), done)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				p, err := dev.ReadPacket()
+				if err != nil {
+					b.Fatal(err)
+				}
+				p.Release()
+			}
+			reportPPS(b, start)
+		})
+	}
+}
+
+// SO_TIMESTAMPNSを使えるソケットでは、カーネルの受信時刻を書き込んだ順に設定すること
+func TestRecvmmsgTimestamps(t *testing.T) {
+	var peers []int
+	dev, err := newDevice(ModeTUN, []Option{withSys(socketPairSys(t, &peers))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	// 有効にする前に届いたパケットには受信時刻が付かず、読み込んだ時刻になる
+	if !dev.enableTimestamps() {
+		t.Skip("SO_TIMESTAMPNS is not available on this socket")
+	}
+	want := batchPackets(t, 5)
+	before := time.Now()
+	for _, p := range want {
+		if _, err := syscall.Write(peers[0], p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := time.Now()
+	got, err := dev.recvmmsg(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d packets, want %d", len(got), len(want))
+	}
+	var prev time.Time
+	for i, p := range got {
+		// 受信時刻は書き込みの間にあり、後から読み込んだ時刻ではない
+		if p.Timestamp.Before(before) || p.Timestamp.After(after) || p.Timestamp.Before(prev) {
+			t.Fatalf("packet %d: timestamp %s outside [%s, %s] or before %s", i, p.Timestamp, before, after, prev)
+		}
+		prev = p.Timestamp
+		p.Release()
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors" // エラーの生成
+)
+
+// recvmmsg/sendmmsgはLinuxにしか無いため、常にread/writeを使う
+const SYS_SENDMMSG = 0
+
+var errNoMmsg = errors.New("recvmmsg/sendmmsg not supported")
+
+func mmsgUnsupported(err error) bool {
+	return true
+}
+
+func (t *NetDevice) recvmmsg(max int) ([]Packet, error) {
+	return nil, errNoMmsg
+}
+
+func (t *NetDevice) sendmmsg(pkts []Packet) error {
+	return errNoMmsg
+}
@@ -0,0 +1,66 @@
+package network
+
+import (
+	"encoding/binary" // ヘッダの書き換え
+)
+
+// IPv4パケットbがSYNを含むTCPセグメントで、MSSオプションがmssより大きい場合はmssに書き換える
+// TCPのチェックサムはUpdateChecksumで差分を更新する。書き換えた場合はtrueを返す
+// MTUの小さいリンクへ転送・NATする経路でPMTUDが働かない（ICMPが届かない）場合に、
+// 大きなセグメントが破棄され続けてコネクションが止まるのを防ぐ
+// フラグメントや解析できないパケットは書き換えない
+func ClampMSS(b []byte, mss uint16) bool {
+	ip, seg, err := ParseIPv4(b)
+	if err != nil || ip.Protocol != PROTOCOL_TCP || ip.FragOffset != 0 || ip.Flags&IPV4_FLAG_MF != 0 {
+		return false
+	}
+	if len(seg) < TCP_MIN_HEADER_LEN || seg[13]&TCP_FLAG_SYN == 0 {
+		return false
+	}
+	hlen := int(seg[12]>>4) * 4
+	if hlen < TCP_MIN_HEADER_LEN || hlen > len(seg) {
+		return false
+	}
+	for i := TCP_MIN_HEADER_LEN; i < hlen; {
+		kind := seg[i]
+		if kind == TCP_OPT_EOL {
+			return false
+		}
+		if kind == TCP_OPT_NOP {
+			i++
+			continue
+		}
+		if i+1 >= hlen || seg[i+1] < 2 || i+int(seg[i+1]) > hlen {
+			return false
+		}
+		if kind == TCP_OPT_MSS && seg[i+1] == 4 {
+			if binary.BigEndian.Uint16(seg[i+2:i+4]) <= mss {
+				return false
+			}
+			rewriteTCPHeader(seg, i+2, []byte{byte(mss >> 8), byte(mss)})
+			return true
+		}
+		i += int(seg[i+1])
+	}
+	return false
+}
+
+// TCPヘッダのoffからの内容をvに書き換え、チェックサムを差分で更新する
+// オプションは16ビットの境界に揃っているとは限らないため、書き換えた範囲を含むワードごとに更新する
+// TCPヘッダの長さは4の倍数のため、揃えた範囲もヘッダに収まる
+func rewriteTCPHeader(seg []byte, off int, v []byte) {
+	start, end := off&^1, (off+len(v)+1)&^1
+	old := append([]byte(nil), seg[start:end]...)
+	copy(seg[off:], v)
+	sum := binary.BigEndian.Uint16(seg[16:18])
+	for i := 0; i < len(old); i += 2 {
+		sum = UpdateChecksum(sum, binary.BigEndian.Uint16(old[i:]), binary.BigEndian.Uint16(seg[start+i:]))
+	}
+	binary.BigEndian.PutUint16(seg[16:18], sum)
+}
+
+// Forwardで転送するTCPのSYNとSYN-ACKのMSSをmss以下に書き換える。0の場合は書き換えない（既定）
+// 転送先のリンクのMTUから40（IPv4とTCPのヘッダ）を引いた値を設定する
+func (t *NetDevice) SetMSSClamp(mss uint16) {
+	t.mssClamp.Store(uint32(mss))
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"testing"
+)
+
+// 転送した後のTCPセグメントのMSSオプションを読み取る。チェックサムの検証も兼ねる
+func forwardedMSS(t *testing.T, b []byte) uint16 {
+	t.Helper()
+	ip, payload, err := ParseIPv4(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := ParseTCP(payload, ip)
+	if err != nil {
+		t.Fatalf("tcp: %s", err)
+	}
+	return h.Options.MSS
+}
+
+// Forwardで転送するSYNとSYN-ACKのMSSが上限を超える場合だけ書き換え、
+// 上限以下のSYNやSYNを含まないセグメントはそのまま転送すること
+func TestForwardMSSClamp(t *testing.T) {
+	in, _ := forwardPair(t)
+	in.SetMSSClamp(1360)
+	for _, tc := range []struct {
+		name  string
+		flags uint8
+		mss   uint16
+		want  uint16
+	}{
+		{"syn", TCP_FLAG_SYN, 1460, 1360},
+		{"syn-ack", TCP_FLAG_SYN | TCP_FLAG_ACK, 1460, 1360},
+		{"syn below limit", TCP_FLAG_SYN, 1200, 1200},
+		{"syn at limit", TCP_FLAG_SYN, 1360, 1360},
+		{"ack", TCP_FLAG_ACK, 1460, 1460},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tcpPacket(t, testLocal, testRemote, TCPHeader{
+				SrcPort: 40000, DstPort: 80, Seq: 1, Flags: tc.flags, Window: 0xffff,
+				Options: TCPOptions{MSS: tc.mss},
+			}, nil)
+			out := &recordDevice{}
+			if err := in.Forward(bytesPacket(b), out); err != nil {
+				t.Fatal(err)
+			}
+			if len(out.written) != 1 {
+				t.Fatalf("forwarded %d packets, want 1", len(out.written))
+			}
+			if got := forwardedMSS(t, out.written[0]); got != tc.want {
+				t.Fatalf("mss %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	// 0に戻すと書き換えない
+	in.SetMSSClamp(0)
+	out := &recordDevice{}
+	b := tcpPacket(t, testLocal, testRemote, TCPHeader{
+		SrcPort: 40000, DstPort: 80, Seq: 1, Flags: TCP_FLAG_SYN, Window: 0xffff,
+		Options: TCPOptions{MSS: 1460},
+	}, nil)
+	if err := in.Forward(bytesPacket(b), out); err != nil {
+		t.Fatal(err)
+	}
+	if got := forwardedMSS(t, out.written[0]); got != 1460 {
+		t.Fatalf("mss %d with clamp disabled, want 1460", got)
+	}
+}
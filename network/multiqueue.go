@@ -0,0 +1,272 @@
+package network
+
+import (
+	"context"         // 読み込みのキャンセル
+	"encoding/binary" // ヘッダの読み取り
+	"fmt"             // 文字列の生成や出力、スキャン
+	"sync"            // ゴルーチンの待ち合わせ
+)
+
+// 1つのインターフェースに作れるキューの上限（カーネルのMAX_TAP_QUEUES）
+const TUN_MAX_QUEUES = 256
+
+// IFF_MULTI_QUEUEで開いた複数のキューを1つのデバイスとして扱う
+// キューごとに読み書きのゴルーチンを持ち、受信したパケットは1つの受信キューにまとめる。
+// 送信するパケットはフローのハッシュでキューを選ぶため、同じフローの順序は保たれる
+type MultiQueueDevice struct {
+	queues   []*NetDevice
+	mode     Mode
+	incoming chan Packet
+	ctx      context.Context
+	cancel   context.CancelFunc
+	readers  sync.WaitGroup
+	bindOnce sync.Once
+}
+
+var _ Device = (*MultiQueueDevice)(nil)
+
+// n個のキューを持つTUNデバイスを作成する
+// オプションは全てのキューに適用し、WithQueueSizeはキューごとの大きさになる
+func NewTunMultiQueue(n int, opts ...Option) (*MultiQueueDevice, error) {
+	return newMultiQueueDevice(ModeTUN, n, opts)
+}
+
+// n個のキューを持つTAPデバイスを作成する
+func NewTapMultiQueue(n int, opts ...Option) (*MultiQueueDevice, error) {
+	return newMultiQueueDevice(ModeTAP, n, opts)
+}
+
+func newMultiQueueDevice(mode Mode, n int, opts []Option) (*MultiQueueDevice, error) {
+	if n < 1 || n > TUN_MAX_QUEUES {
+		return nil, fmt.Errorf("invalid queue count: %d (must be 1-%d)", n, TUN_MAX_QUEUES)
+	}
+	queues, err := openMultiQueue(mode, n, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MultiQueueDevice{
+		queues:   queues,
+		mode:     mode,
+		incoming: make(chan Packet, cap(queues[0].queues.incoming)),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// インターフェース名を返す
+func (m *MultiQueueDevice) Name() string {
+	return m.queues[0].Name()
+}
+
+// デバイスの動作モードを返す
+func (m *MultiQueueDevice) Mode() Mode {
+	return m.mode
+}
+
+// キューごとのデバイスを返す
+// 統計やフックはキューごとに扱う。キューのデバイスから直接読み込むと受信キューと奪い合う
+func (m *MultiQueueDevice) Queues() []*NetDevice {
+	return append([]*NetDevice(nil), m.queues...)
+}
+
+// 全てのキューの統計を合計して返す
+func (m *MultiQueueDevice) Stats() Stats {
+	var total Stats
+	for _, q := range m.queues {
+		s := q.Stats()
+		total.RxPackets += s.RxPackets
+		total.TxPackets += s.TxPackets
+		total.RxBytes += s.RxBytes
+		total.TxBytes += s.TxBytes
+		total.RxDrops += s.RxDrops
+		total.TxDrops += s.TxDrops
+		total.RxFiltered += s.RxFiltered
+		total.TxFiltered += s.TxFiltered
+		total.RxTruncated += s.RxTruncated
+		total.RxRunt += s.RxRunt
+		total.RxProtocols.add(s.RxProtocols)
+		total.TxProtocols.add(s.TxProtocols)
+	}
+	return total
+}
+
+func (p *ProtocolStats) add(o ProtocolStats) {
+	p.ICMP += o.ICMP
+	p.TCP += o.TCP
+	p.UDP += o.UDP
+	p.Other += o.Other
+}
+
+// 全てのキューの読み書きのゴルーチンを開始する
+// 2回目以降の呼び出しは何もしない
+func (m *MultiQueueDevice) Bind() {
+	m.bindOnce.Do(func() {
+		for _, q := range m.queues {
+			q.Bind()
+			m.readers.Add(1)
+			go m.forward(q)
+		}
+		// 全てのキューの読み込みが終了してから受信キューを閉じる
+		go func() {
+			m.readers.Wait()
+			close(m.incoming)
+		}()
+	})
+}
+
+// キューが受信したパケットを受信キューに移す
+func (m *MultiQueueDevice) forward(q *NetDevice) {
+	defer m.readers.Done()
+	for {
+		pkt, err := q.ReadContext(m.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case m.incoming <- pkt:
+		case <-m.ctx.Done():
+			pkt.Release()
+			return
+		}
+	}
+}
+
+// 全てのキューを閉じる
+// 最初に失敗したキューのエラーを返す
+func (m *MultiQueueDevice) Close() error {
+	m.cancel()
+	var first error
+	for _, q := range m.queues {
+		if err := q.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// パケットを読み込む
+func (m *MultiQueueDevice) ReadPacket() (Packet, error) {
+	return m.ReadContext(context.Background())
+}
+
+// パケットを読み込む
+// ctxがキャンセルされた場合はctx.Err()を、デバイスが閉じられた場合はErrDeviceClosedを返す
+func (m *MultiQueueDevice) ReadContext(ctx context.Context) (Packet, error) {
+	select {
+	case pkt, ok := <-m.incoming:
+		if !ok {
+			return Packet{}, ErrDeviceClosed
+		}
+		return pkt, nil
+	case <-ctx.Done():
+		return Packet{}, ctx.Err()
+	case <-m.ctx.Done():
+		return Packet{}, ErrDeviceClosed
+	}
+}
+
+// パケットをフローのハッシュで選んだキューに書き込む
+func (m *MultiQueueDevice) WritePacket(pkt Packet) error {
+	return m.writePacket(pkt, nil)
+}
+
+// 組み立てたパケットのバイト列をフローのハッシュで選んだキューに書き込む。bの所有権はデバイスに移る
+func (m *MultiQueueDevice) WriteBytes(b []byte) error {
+	return m.writePacket(bytesPacket(b), nil)
+}
+
+func (m *MultiQueueDevice) writePacket(pkt Packet, cancel <-chan struct{}) error {
+	q := m.queues[0]
+	if len(m.queues) > 1 {
+		q = m.queues[flowHash(pkt.Buf[:pkt.Len()], m.mode)%uint32(len(m.queues))]
+	}
+	return q.writePacket(pkt, cancel)
+}
+
+// MTUはインターフェースに対する設定のため、どのキューから扱っても同じになる
+func (m *MultiQueueDevice) GetMTU() (int, error) {
+	return m.queues[0].GetMTU()
+}
+
+func (m *MultiQueueDevice) SetMTU(mtu int) error {
+	return m.queues[0].SetMTU(mtu)
+}
+
+func (m *MultiQueueDevice) deviceLogger() Logger {
+	return m.queues[0].logger
+}
+
+// TUNから読み込んだパケットのフローのハッシュを返す
+// 独自にワーカーへ振り分ける場合に、同じフローを同じワーカーで処理して順序を保つために使う
+// MultiQueueDeviceがキューの選択に使うものと同じで、同じフローのパケットは常に同じ値になる
+// IPでないパケットは0を、フラグメントはアドレスとプロトコルだけのハッシュを返す
+func FlowHash(pkt Packet) uint32 {
+	return flowHash(pkt.Buf[:pkt.Len()], ModeTUN)
+}
+
+// TAPから読み込んだEthernetフレームのフローのハッシュを返す。扱いはFlowHashと同じ
+func FlowHashEthernet(pkt Packet) uint32 {
+	return flowHash(pkt.Buf[:pkt.Len()], ModeTAP)
+}
+
+// パケットのフロー（アドレス、プロトコル、ポート）のハッシュを返す（FNV-1a）
+// Linuxはconnectに偶数のポートを優先して割り当てるため、最後に撹拌して偏りを無くす
+// フラグメントはポートを持たないものがあるため、同じデータグラムが同じキューに入るようアドレスとプロトコルだけを使う
+// 解析できないパケットは0を返す
+func flowHash(b []byte, mode Mode) uint32 {
+	if mode == ModeTAP {
+		if len(b) < ETHERNET_HEADER_LEN {
+			return 0
+		}
+		b = b[ETHERNET_HEADER_LEN:]
+	}
+	if len(b) < 1 {
+		return 0
+	}
+	var addrs []byte
+	var proto uint8
+	var transport []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < IPV4_MIN_HEADER_LEN {
+			return 0
+		}
+		hlen := int(b[0]&0x0f) * 4
+		addrs = b[12:20]
+		proto = b[9]
+		// MFフラグとフラグメントオフセット
+		if binary.BigEndian.Uint16(b[6:8])&0x3fff == 0 && hlen <= len(b) {
+			transport = b[hlen:]
+		}
+	case IPV6_VERSION:
+		if len(b) < IPV6_HEADER_LEN {
+			return 0
+		}
+		addrs = b[8:40]
+		proto = b[6]
+		transport = b[IPV6_HEADER_LEN:]
+	default:
+		return 0
+	}
+	h := uint32(2166136261)
+	mix := func(p []byte) {
+		for _, c := range p {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+	}
+	mix(addrs)
+	h ^= uint32(proto)
+	h *= 16777619
+	if (proto == PROTOCOL_TCP || proto == PROTOCOL_UDP) && len(transport) >= 4 {
+		mix(transport[:4])
+	}
+	// MurmurHash3のfmix32
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,69 @@
+package network
+
+import "testing"
+
+// 同じフローのパケットは内容が違っても同じハッシュになり、異なるフローはほぼ異なる値になること
+func TestFlowHash(t *testing.T) {
+	flow := func(sport uint16, seq uint32, payload string) uint32 {
+		return FlowHash(bytesPacket(tcpPacket(t, testLocal, testRemote, TCPHeader{SrcPort: sport, DstPort: 80, Seq: seq, Flags: TCP_FLAG_ACK, Window: 1024}, []byte(payload))))
+	}
+	if a, b := flow(40000, 1, "first"), flow(40000, 1000, "a second segment"); a != b || a == 0 {
+		t.Fatalf("same flow hashed to %#x and %#x", a, b)
+	}
+	// 向きが逆のパケットは別のフロー
+	reply := FlowHash(bytesPacket(tcpPacket(t, testRemote, testLocal, TCPHeader{SrcPort: 80, DstPort: 40000, Flags: TCP_FLAG_ACK}, nil)))
+	if reply == flow(40000, 1, "") {
+		t.Fatal("reverse direction hashed like the forward flow")
+	}
+
+	// 偶数のポートだけでもキューに偏らない
+	seen := map[uint32]bool{}
+	buckets := make([]int, 4)
+	for i := 0; i < 64; i++ {
+		h := flow(uint16(40000+2*i), 1, "")
+		seen[h] = true
+		buckets[h%4]++
+	}
+	if len(seen) < 60 {
+		t.Fatalf("%d distinct hashes for 64 flows", len(seen))
+	}
+	for i, n := range buckets {
+		if n < 4 {
+			t.Fatalf("bucket %d got %d of 64 flows: %v", i, n, buckets)
+		}
+	}
+}
+
+// フラグメントは同じデータグラムで同じハッシュになり、IPでないパケットは0になること
+func TestFlowHashFragmentsAndNonIP(t *testing.T) {
+	ip := &IPv4Header{ID: 9, TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote}
+	frags, err := FragmentIPv4(ip, make([]byte, 100), 68)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frags) < 2 {
+		t.Fatalf("%d fragments", len(frags))
+	}
+	first := FlowHash(bytesPacket(frags[0]))
+	for i, f := range frags[1:] {
+		if h := FlowHash(bytesPacket(f)); h != first || h == 0 {
+			t.Fatalf("fragment %d hashed to %#x, first %#x", i+1, h, first)
+		}
+	}
+
+	if h := FlowHash(bytesPacket(decodeHex(t, ipv6EchoRequest))); h == 0 {
+		t.Fatal("ipv6 packet hashed to 0")
+	}
+	for _, b := range [][]byte{nil, {0x00, 0x01}, {0x45, 0x00}, arpFrame(t)} {
+		if h := FlowHash(bytesPacket(b)); h != 0 {
+			t.Fatalf("%x hashed to %#x, want 0", b, h)
+		}
+	}
+
+	// TAPではEthernetヘッダを除いたTUNと同じ値
+	pkt := natUDP(t, testLocal, testRemote, 5353, 5353, "x")
+	frame := append([]byte{0x01, 0, 0x5e, 0, 0, 0xfb, 0x02, 0, 0x5e, 0x10, 0, 1, 0x08, 0x00}, pkt...)
+	if a, b := FlowHashEthernet(bytesPacket(frame)), FlowHash(bytesPacket(pkt)); a != b {
+		t.Fatalf("tap hash %#x, tun hash %#x", a, b)
+	}
+}
@@ -0,0 +1,257 @@
+package network
+
+import (
+	"encoding/binary" // ヘッダの書き換え
+	"errors"          // エラーの生成
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net/netip"       // IPアドレスとポートの型
+	"sync"            // 排他制御
+	"time"            // 変換の有効期限
+)
+
+// 変換を使われないまま残す時間
+// UDPはRFC 4787 REQ-5の下限の2分、TCPはRFC 5382 REQ-5の確立済みコネクションの下限の2時間4分
+const (
+	NAT_UDP_TIMEOUT = 2 * time.Minute
+	NAT_TCP_TIMEOUT = 2*time.Hour + 4*time.Minute
+)
+
+var ErrNATUnsupported = errors.New("nat: packet cannot be translated")
+
+// 変換を引くキー
+type natKey struct {
+	proto  uint8
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+// 1つのフローの変換
+type natMapping struct {
+	proto    uint8
+	orig     netip.AddrPort // 内側の送信元
+	ext      netip.AddrPort // 書き換えた送信元（ゲートウェイのアドレスとポート）
+	remote   netip.AddrPort // 外側の宛先
+	timeout  time.Duration
+	lastUsed time.Time
+	timer    *time.Timer
+}
+
+// 送信元NAT（NAPT）
+// 外側へのTCP/UDPパケットの送信元をゲートウェイのアドレスと割り当てたポートに書き換え、
+// 戻りのパケットの宛先を元に戻す。チェックサムはUpdateChecksumで差分を更新する。
+// フラグメントやTCP/UDP以外のパケットは変換できない
+type NAT struct {
+	addr    netip.Addr
+	timeout time.Duration
+	ports   *PortAllocator
+	mu      sync.Mutex
+	out     map[natKey]*natMapping // 内側の(送信元, 宛先)から引く
+	in      map[natKey]*natMapping // 書き換えた(宛先, 送信元)から引く
+}
+
+// addrを外側のアドレスとするNATを作成する
+// timeoutの間使われなかった変換は破棄する。0の場合はプロトコルごとの既定値を使う
+func NewNAT(addr netip.Addr, timeout time.Duration) (*NAT, error) {
+	if !addr.Is4() {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", addr)
+	}
+	ports, err := NewPortAllocator(EPHEMERAL_PORT_MIN, EPHEMERAL_PORT_MAX)
+	if err != nil {
+		return nil, err
+	}
+	return &NAT{
+		addr:    addr,
+		timeout: timeout,
+		ports:   ports,
+		out:     make(map[natKey]*natMapping),
+		in:      make(map[natKey]*natMapping),
+	}, nil
+}
+
+// 外側へ送るIPv4パケットbの送信元をその場で書き換える
+// ゲートウェイ自身が送信元のパケットは書き換えない。変換できない場合はErrNATUnsupportedを返す
+func (n *NAT) Egress(b []byte) error {
+	hlen, proto, err := natHeader(b)
+	if err != nil {
+		return err
+	}
+	src := natAddrPort(b[12:16], b[hlen:])
+	dst := natAddrPort(b[16:20], b[hlen+2:])
+	if src.Addr() == n.addr {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := natKey{proto: proto, local: src, remote: dst}
+	m, ok := n.out[key]
+	if !ok {
+		port, err := n.ports.Allocate(proto)
+		if err != nil {
+			return fmt.Errorf("nat error: %w", err)
+		}
+		m = &natMapping{
+			proto:   proto,
+			orig:    src,
+			ext:     netip.AddrPortFrom(n.addr, port),
+			remote:  dst,
+			timeout: n.mappingTimeout(proto),
+		}
+		m.timer = time.AfterFunc(m.timeout, func() { n.expire(m) })
+		n.out[key] = m
+		n.in[natKey{proto: proto, local: m.ext, remote: dst}] = m
+	}
+	m.lastUsed = time.Now()
+	natRewrite(b, hlen, proto, 12, m.ext)
+	return nil
+}
+
+// 外側から届いたIPv4パケットbの宛先をその場で元に戻す
+// 変換に一致しないパケット（ゲートウェイ自身宛てなど）は書き換えずにfalseを返す
+func (n *NAT) Ingress(b []byte) (bool, error) {
+	hlen, proto, err := natHeader(b)
+	if err != nil {
+		return false, err
+	}
+	src := natAddrPort(b[12:16], b[hlen:])
+	dst := natAddrPort(b[16:20], b[hlen+2:])
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	m, ok := n.in[natKey{proto: proto, local: dst, remote: src}]
+	if !ok {
+		return false, nil
+	}
+	m.lastUsed = time.Now()
+	natRewrite(b, hlen, proto, 16, m.orig)
+	return true, nil
+}
+
+// 外側のデバイスのSetEgressHookに渡すフック
+// 変換できないパケットは破棄する
+func (n *NAT) EgressHook() Hook {
+	return func(pkt Packet) (HookAction, Packet) {
+		if err := n.Egress(pkt.Buf[:pkt.Len()]); err != nil {
+			return HookDrop, pkt
+		}
+		return HookAccept, pkt
+	}
+}
+
+// 外側のデバイスのSetIngressHookに渡すフック
+// 変換に一致したパケットの宛先を元に戻し、それ以外はそのまま通す
+func (n *NAT) IngressHook() Hook {
+	return func(pkt Packet) (HookAction, Packet) {
+		n.Ingress(pkt.Buf[:pkt.Len()])
+		return HookAccept, pkt
+	}
+}
+
+// 現在の変換の数を返す
+func (n *NAT) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.out)
+}
+
+// すべての変換を破棄する
+func (n *NAT) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, m := range n.out {
+		m.timer.Stop()
+		n.remove(key, m)
+	}
+}
+
+func (n *NAT) mappingTimeout(proto uint8) time.Duration {
+	if n.timeout > 0 {
+		return n.timeout
+	}
+	if proto == PROTOCOL_TCP {
+		return NAT_TCP_TIMEOUT
+	}
+	return NAT_UDP_TIMEOUT
+}
+
+// 使われないままtimeoutが過ぎた変換を破棄する
+// 途中で使われていた場合は最後に使われた時刻からtimeout後に確かめ直す
+func (n *NAT) expire(m *natMapping) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := natKey{proto: m.proto, local: m.orig, remote: m.remote}
+	if n.out[key] != m {
+		return
+	}
+	if idle := time.Since(m.lastUsed); idle < m.timeout {
+		m.timer.Reset(m.timeout - idle)
+		return
+	}
+	n.remove(key, m)
+}
+
+func (n *NAT) remove(key natKey, m *natMapping) {
+	delete(n.out, key)
+	delete(n.in, natKey{proto: m.proto, local: m.ext, remote: m.remote})
+	n.ports.Release(m.proto, m.ext.Port())
+}
+
+// 変換できるパケットか確かめ、IPヘッダ長とプロトコル番号を返す
+// ポートを持たない2番目以降のフラグメントは変換できないため、フラグメントはすべて断る
+func natHeader(b []byte) (int, uint8, error) {
+	ip, payload, err := ParseIPv4(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	if ip.Flags&IPV4_FLAG_MF != 0 || ip.FragOffset != 0 {
+		return 0, 0, fmt.Errorf("%w: fragment", ErrNATUnsupported)
+	}
+	switch {
+	case ip.Protocol == PROTOCOL_UDP && len(payload) >= UDP_HEADER_LEN:
+	case ip.Protocol == PROTOCOL_TCP && len(payload) >= TCP_MIN_HEADER_LEN:
+	default:
+		return 0, 0, fmt.Errorf("%w: protocol %d", ErrNATUnsupported, ip.Protocol)
+	}
+	return ip.HeaderLen(), ip.Protocol, nil
+}
+
+func natAddrPort(addr, port []byte) netip.AddrPort {
+	a, _ := netip.AddrFromSlice(addr)
+	return netip.AddrPortFrom(a, binary.BigEndian.Uint16(port))
+}
+
+// IPヘッダのoff（12なら送信元、16なら宛先）のアドレスと対応するポートをapに書き換える
+// IPヘッダのチェックサムとトランスポートのチェックサム（疑似ヘッダを含む）を差分で更新する
+func natRewrite(b []byte, hlen int, proto uint8, off int, ap netip.AddrPort) {
+	seg := b[hlen:]
+	csum := 16
+	if proto == PROTOCOL_UDP {
+		csum = 6
+	}
+	portOff := 0
+	if off == 16 {
+		portOff = 2
+	}
+	// UDPのチェックサム0は計算していないことを表すため、そのまま残す
+	fixTransport := proto == PROTOCOL_TCP || binary.BigEndian.Uint16(seg[csum:]) != 0
+
+	// アドレスはIPヘッダと疑似ヘッダの両方に、ポートはトランスポートのヘッダにだけ含まれる
+	replace := func(field []byte, v uint16, inIPHeader bool) {
+		old := binary.BigEndian.Uint16(field)
+		binary.BigEndian.PutUint16(field, v)
+		if inIPHeader {
+			binary.BigEndian.PutUint16(b[10:12], UpdateChecksum(binary.BigEndian.Uint16(b[10:12]), old, v))
+		}
+		if fixTransport {
+			sum := UpdateChecksum(binary.BigEndian.Uint16(seg[csum:]), old, v)
+			if sum == 0 && proto == PROTOCOL_UDP {
+				sum = 0xffff
+			}
+			binary.BigEndian.PutUint16(seg[csum:], sum)
+		}
+	}
+	addr := ap.Addr().As4()
+	replace(b[off:off+2], binary.BigEndian.Uint16(addr[0:2]), true)
+	replace(b[off+2:off+4], binary.BigEndian.Uint16(addr[2:4]), true)
+	replace(seg[portOff:portOff+2], ap.Port(), false)
+}
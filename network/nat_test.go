@@ -0,0 +1,120 @@
+package network
+
+import (
+	"context"   // 読み込みの期限
+	"net"       // IPアドレスの表現
+	"net/netip" // アドレスとポートの型
+	"testing"
+	"time" // 変換の有効期限
+)
+
+// UDPのIPv4パケットを組み立てる
+func natUDP(t *testing.T, src, dst net.IP, sport, dport uint16, payload string) []byte {
+	t.Helper()
+	h := UDPHeader{SrcPort: sport, DstPort: dport}
+	seg, err := h.MarshalWithPayload([]byte(payload), src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_UDP, Src: src, Dst: dst}
+	b, err := ip.MarshalWithPayload(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// ゲートウェイの外側のデバイスにNATのフックを付け、内側からのUDPのフローを外側へ送って戻りを受け取ること
+// 戻りのパケットは宛先が元の送信元に戻り、変換の期限が切れた後は書き換えない
+func TestNATRoundTripThroughHooks(t *testing.T) {
+	ext := netip.MustParseAddr("203.0.113.1")
+	extIP := net.IP(ext.AsSlice())
+	nat, err := NewNAT(ext, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nat.Close()
+	gw, remote := forwardPair(t)
+	gw.SetEgressHook(nat.EgressHook())
+	gw.SetIngressHook(nat.IngressHook())
+
+	// 内側から転送されてきたパケット
+	if err := gw.WriteBytes(natUDP(t, testLocal, testRemote, 40000, 53, "query")); err != nil {
+		t.Fatal(err)
+	}
+	pkt := readPacket(t, remote)
+	ip, extPort, dport := verifyPacket(t, pkt.Buf[:pkt.Len()])
+	pkt.Release()
+	if !ip.Src.Equal(extIP) || dport != 53 {
+		t.Fatalf("outbound %s:%d -> :%d, want from %s", ip.Src, extPort, dport, ext)
+	}
+	if nat.Len() != 1 {
+		t.Fatalf("%d mappings, want 1", nat.Len())
+	}
+	// 同じフローは同じポートを使う
+	if err := gw.WriteBytes(natUDP(t, testLocal, testRemote, 40000, 53, "again")); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, remote)
+	if _, port, _ := verifyPacket(t, pkt.Buf[:pkt.Len()]); port != extPort {
+		t.Fatalf("second packet from port %d, want %d", port, extPort)
+	}
+	pkt.Release()
+
+	if err := remote.WriteBytes(natUDP(t, testRemote, extIP, 53, extPort, "answer")); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, gw)
+	ip, sport, dport := verifyPacket(t, pkt.Buf[:pkt.Len()])
+	if !ip.Dst.Equal(testLocal) || dport != 40000 || !ip.Src.Equal(testRemote) || sport != 53 {
+		t.Fatalf("reply %s:%d -> %s:%d, want %s:53 -> %s:40000", ip.Src, sport, ip.Dst, dport, testRemote, testLocal)
+	}
+	pkt.Release()
+
+	// 変換に一致しないパケットはそのまま通す
+	if err := remote.WriteBytes(natUDP(t, testRemote, extIP, 53, extPort+1, "stray")); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, gw)
+	if ip, _, dport := verifyPacket(t, pkt.Buf[:pkt.Len()]); !ip.Dst.Equal(extIP) || dport != extPort+1 {
+		t.Fatalf("unmatched packet rewritten to %s:%d", ip.Dst, dport)
+	}
+	pkt.Release()
+
+	waitFor(t, "mapping expiry", func() bool { return nat.Len() == 0 })
+	if err := remote.WriteBytes(natUDP(t, testRemote, extIP, 53, extPort, "late")); err != nil {
+		t.Fatal(err)
+	}
+	pkt = readPacket(t, gw)
+	if ip, _, _ := verifyPacket(t, pkt.Buf[:pkt.Len()]); !ip.Dst.Equal(extIP) {
+		t.Fatalf("reply after expiry rewritten to %s", ip.Dst)
+	}
+	pkt.Release()
+}
+
+// 変換できないパケット（フラグメント）は外側へ送らずに破棄すること
+func TestNATEgressHookDropsFragments(t *testing.T) {
+	nat, err := NewNAT(netip.MustParseAddr("203.0.113.1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nat.Close()
+	gw, remote := forwardPair(t)
+	gw.SetEgressHook(nat.EgressHook())
+	ip := IPv4Header{ID: 9, Flags: IPV4_FLAG_MF, TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote}
+	b, err := ip.MarshalWithPayload(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.WriteBytes(b); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := remote.ReadContext(ctx); err == nil {
+		t.Fatal("fragment passed the nat")
+	}
+	if got := gw.Stats().TxFiltered; got != 1 {
+		t.Fatalf("tx filtered %d, want 1", got)
+	}
+}
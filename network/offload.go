@@ -0,0 +1,41 @@
+package network
+
+import (
+	"fmt"     // 文字列の生成や出力、スキャン
+	"strings" // フラグの文字列表現
+)
+
+// TUNSETOFFLOADでカーネルに通知するオフロード
+type OffloadFlags uint32
+
+// linux/if_tun.hのTUN_F_*
+const (
+	TUN_F_CSUM    OffloadFlags = 0x01 // チェックサムを計算しないまま受け渡す
+	TUN_F_TSO4    OffloadFlags = 0x02
+	TUN_F_TSO6    OffloadFlags = 0x04
+	TUN_F_TSO_ECN OffloadFlags = 0x08
+	TUN_F_UFO     OffloadFlags = 0x10
+)
+
+func (f OffloadFlags) String() string {
+	names := []string{"CSUM", "TSO4", "TSO6", "TSO_ECN", "UFO"}
+	var s []string
+	for i, name := range names {
+		if f&(1<<i) != 0 {
+			s = append(s, name)
+			f &^= 1 << i
+		}
+	}
+	if f != 0 {
+		s = append(s, fmt.Sprintf("0x%x", uint32(f)))
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, "|")
+}
+
+// EnableOffloadで有効にしたオフロードを返す
+func (t *NetDevice) Offloads() OffloadFlags {
+	return OffloadFlags(t.offloads.Load())
+}
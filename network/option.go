@@ -0,0 +1,158 @@
+package network
+
+import (
+	"fmt" // 文字列の生成や出力、スキャン
+)
+
+// NewTun/NewTapに渡すオプション
+type Option func(*config) error
+
+type config struct {
+	name       string
+	mtu        int
+	queueSize  int
+	packetSize int
+	// 1回のシステムコールで読み込むパケット数の上限
+	readBatch int
+	// 0の場合は読み込みに失敗し続けてもデバイスを閉じない
+	maxReadErrors int
+	logger        Logger
+	packetInfo    bool
+	overflow      OverflowPolicy
+	// デバイスを開くシステムコール。nilの場合は実際のものを使う
+	sys *deviceSys
+}
+
+func defaultConfig() config {
+	return config{
+		name:          "tun0",
+		queueSize:     QUEUE_SIZE,
+		packetSize:    PACKET_SIZE,
+		readBatch:     READ_BATCH_SIZE,
+		maxReadErrors: MAX_READ_ERRORS,
+		logger:        nopLogger{},
+		overflow:      Block,
+	}
+}
+
+func newConfig(opts []Option) (config, error) {
+	c := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return config{}, fmt.Errorf("option error: %s", err.Error())
+		}
+	}
+	if c.mtu > c.packetSize {
+		c.packetSize = c.mtu
+	}
+	return c, nil
+}
+
+// インターフェース名を指定する（NULを含めて16バイトまで）
+func WithName(name string) Option {
+	return func(c *config) error {
+		if name == "" {
+			return fmt.Errorf("invalid name: empty")
+		}
+		if len(name) > IFNAMSIZ-1 {
+			return fmt.Errorf("invalid name: %q exceeds %d bytes", name, IFNAMSIZ-1)
+		}
+		c.name = name
+		return nil
+	}
+}
+
+// インターフェースのMTUを指定する
+// 読み込みバッファはMTUを収められる大きさに広げられる
+func WithMTU(mtu int) Option {
+	return func(c *config) error {
+		if mtu < MIN_MTU || mtu > MAX_MTU {
+			return fmt.Errorf("invalid mtu: %d", mtu)
+		}
+		c.mtu = mtu
+		return nil
+	}
+}
+
+// 送受信キューのバッファ数を指定する
+func WithQueueSize(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("invalid queue size: %d", size)
+		}
+		c.queueSize = size
+		return nil
+	}
+}
+
+// 読み込みバッファのサイズを指定する
+func WithPacketSize(size int) Option {
+	return func(c *config) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid packet size: %d", size)
+		}
+		c.packetSize = size
+		return nil
+	}
+}
+
+// 1回のrecvmmsgで読み込むパケット数の上限を指定する
+// 1を指定するとパケットごとにreadを呼び出す
+func WithReadBatchSize(n int) Option {
+	return func(c *config) error {
+		if n < 1 || n > MAX_BATCH_SIZE {
+			return fmt.Errorf("invalid read batch size: %d", n)
+		}
+		c.readBatch = n
+		return nil
+	}
+}
+
+// 連続した読み込みエラーの上限を指定する
+// 上限に達するとデバイスは閉じられる。0を指定すると上限を設けない
+func WithMaxReadErrors(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("invalid max read errors: %d", n)
+		}
+		c.maxReadErrors = n
+		return nil
+	}
+}
+
+// 送受信のエラーなどを出力するロガーを指定する
+// 既定では何も出力しない。nilを指定すると既定に戻る
+func WithLogger(l Logger) Option {
+	return func(c *config) error {
+		if l == nil {
+			l = nopLogger{}
+		}
+		c.logger = l
+		return nil
+	}
+}
+
+// IFF_NO_PIを付けずにデバイスを作成し、各パケットのtun_pi（flags, proto）を扱う
+// 読み込んだパケットはtun_piを取り除いてEtherTypeにprotoを設定し、書き込むパケットには付け直す
+// 1つのfdでIPv4とIPv6を混在させる場合などに使う
+func WithPacketInfo() Option {
+	return func(c *config) error {
+		c.packetInfo = true
+		return nil
+	}
+}
+
+// 受信キューが一杯のときの扱いを指定する。既定はBlock
+// Blockでは読み込みのゴルーチンが止まり、カーネルがパケットを破棄する。
+// DropNewest/DropOldestで破棄したパケットはRxDropsに数える
+func WithOverflowPolicy(p OverflowPolicy) Option {
+	return func(c *config) error {
+		switch p {
+		case DropNewest, DropOldest, Block:
+		default:
+			return fmt.Errorf("invalid overflow policy: %s", p)
+		}
+		c.overflow = p
+		return nil
+	}
+}
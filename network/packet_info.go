@@ -0,0 +1,62 @@
+package network
+
+import (
+	"encoding/binary" // struct tun_piの読み書き
+	"fmt"             // 文字列の生成や出力、スキャン
+	"time"            // 受信時刻
+)
+
+const (
+	// struct tun_pi（flags uint16, proto uint16）の長さ
+	TUN_PI_LEN = 4
+	// 読み込みバッファに収まらずパケットが切り詰められたことを示すtun_piのフラグ
+	TUN_PKT_STRIP = 0x0001
+)
+
+// 読み込んだバッファからパケットを作る
+// バッファは1バイト余分に確保しており、それが埋まった（あるいはカーネルがバッファより長い
+// パケット長を返した）場合は切り詰められたとしてTruncatedを立てる
+// WithPacketInfoの場合は先頭のtun_piを取り除き、protoをEtherTypeに設定する
+func (t *NetDevice) makePacket(ref *poolBuf, n uintptr) (Packet, error) {
+	truncated := false
+	if limit := uintptr(len(ref.b) - 1); n > limit {
+		n = limit
+		truncated = true
+	}
+	buf := ref.b[:n]
+	pkt := Packet{Buf: buf, N: n, Truncated: truncated, Timestamp: time.Now(), pool: t.buffers, ref: ref, gen: ref.gen.Load()}
+	if !t.packetInfo {
+		return pkt, nil
+	}
+	if n < TUN_PI_LEN {
+		return Packet{}, fmt.Errorf("read error: packet info too short (%d bytes)", n)
+	}
+	if binary.BigEndian.Uint16(buf[0:2])&TUN_PKT_STRIP != 0 {
+		pkt.Truncated = true
+	}
+	pkt.EtherType = binary.BigEndian.Uint16(buf[2:4])
+	pkt.Buf = buf[TUN_PI_LEN:]
+	pkt.N = n - TUN_PI_LEN
+	return pkt, nil
+}
+
+// デバイスに書き込むバイト列を作る
+// WithPacketInfoの場合は先頭にtun_piを付ける。EtherTypeが0の場合はIPのバージョンから決める
+func (t *NetDevice) frame(pkt Packet) []byte {
+	if !t.packetInfo {
+		return pkt.Buf[:pkt.Len()]
+	}
+	b := make([]byte, TUN_PI_LEN+pkt.Len())
+	proto := pkt.EtherType
+	if proto == 0 && pkt.Len() > 0 && t.mode == ModeTUN {
+		switch pkt.Buf[0] >> 4 {
+		case IPV4_VERSION:
+			proto = ETHERTYPE_IPV4
+		case IPV6_VERSION:
+			proto = ETHERTYPE_IPV6
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:4], proto)
+	copy(b[TUN_PI_LEN:], pkt.Buf[:pkt.Len()])
+	return b
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"bytes"  // データの比較
+	"errors" // エラーの判定
+	"testing"
+	"time" // 書き込みの期限
+)
+
+// デバイスがconnに書き込んだバイト列を1つ受け取る
+func readWritten(t *testing.T, conn *scriptConn) []byte {
+	t.Helper()
+	select {
+	case b := <-conn.written:
+		return b
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing written")
+	}
+	return nil
+}
+
+// tun_piの有無のどちらでも、読み込んだIPv4パケットを書き込むと同じフレームになること
+func TestPacketInfoRoundTrip(t *testing.T) {
+	ip := natUDP(t, testRemote, testLocal, 53, 1, "answer")
+	pi := append([]byte{0, 0, 0x08, 0x00}, ip...)
+	for _, tc := range []struct {
+		name      string
+		opts      []Option
+		frame     []byte
+		etherType uint16
+	}{
+		{"no packet info", nil, ip, 0},
+		{"packet info", []Option{WithPacketInfo()}, pi, ETHERTYPE_IPV4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newScriptConn(1)
+			dev := scriptDevice(t, conn, tc.opts...)
+			conn.reads <- scriptRead{b: tc.frame}
+			dev.Bind()
+			pkt := readPacket(t, dev)
+			if !bytes.Equal(pkt.Buf[:pkt.Len()], ip) || pkt.EtherType != tc.etherType || pkt.Truncated {
+				t.Fatalf("read %x ethertype %#04x truncated %v, want %x %#04x", pkt.Buf[:pkt.Len()], pkt.EtherType, pkt.Truncated, ip, tc.etherType)
+			}
+			if err := dev.WritePacket(pkt); err != nil {
+				t.Fatal(err)
+			}
+			if got := readWritten(t, conn); !bytes.Equal(got, tc.frame) {
+				t.Fatalf("wrote %x, want %x", got, tc.frame)
+			}
+		})
+	}
+}
+
+// EtherTypeを指定せずに書き込んだ場合はIPのバージョンからprotoを決めること
+func TestPacketInfoWriteProto(t *testing.T) {
+	conn := newScriptConn(2)
+	dev := scriptDevice(t, conn, WithPacketInfo())
+	dev.Bind()
+	v4 := natUDP(t, testLocal, testRemote, 1, 53, "x")
+	v6 := decodeHex(t, ipv6EchoRequest)
+	for _, tc := range []struct {
+		b     []byte
+		proto []byte
+	}{{v4, []byte{0x08, 0x00}}, {v6, []byte{0x86, 0xdd}}} {
+		if err := dev.WriteBytes(tc.b); err != nil {
+			t.Fatal(err)
+		}
+		got := readWritten(t, conn)
+		if !bytes.Equal(got[:TUN_PI_LEN], append([]byte{0, 0}, tc.proto...)) || !bytes.Equal(got[TUN_PI_LEN:], tc.b) {
+			t.Fatalf("wrote %x", got)
+		}
+	}
+}
+
+// TUN_PKT_STRIPが立ったパケットは切り詰められたとし、tun_piより短い読み込みはエラーにすること
+func TestPacketInfoStripAndShort(t *testing.T) {
+	conn := newScriptConn(0)
+	dev := scriptDevice(t, conn, WithPacketInfo())
+	ip := natUDP(t, testRemote, testLocal, 53, 1, "x")
+	conn.reads <- scriptRead{b: []byte{0, 0}}
+	conn.reads <- scriptRead{b: append([]byte{0, TUN_PKT_STRIP, 0x08, 0x00}, ip...)}
+	dev.Bind()
+	pkt := readPacket(t, dev)
+	if !pkt.Truncated || !bytes.Equal(pkt.Buf[:pkt.Len()], ip) {
+		t.Fatalf("truncated %v, read %x", pkt.Truncated, pkt.Buf[:pkt.Len()])
+	}
+	pkt.Release()
+	if s := dev.Stats(); s.RxDrops != 1 || s.RxTruncated != 1 {
+		t.Fatalf("rx drops %d truncated %d, want 1 1", s.RxDrops, s.RxTruncated)
+	}
+	if err := dev.Err(); err != nil && !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("device stopped: %s", err)
+	}
+}
+
+// パケットの最大長を超えるフレームはTruncatedを立てて数え、最大長ちょうどのフレームは立てないこと
+func TestTruncatedRead(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"no packet info", []Option{WithPacketSize(256)}},
+		{"packet info", []Option{WithPacketSize(256), WithPacketInfo()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := newScriptConn(0)
+			dev := scriptDevice(t, conn, tc.opts...)
+			prefix := []byte(nil)
+			if dev.packetInfo {
+				prefix = []byte{0, 0, 0x08, 0x00}
+			}
+			fit := natUDP(t, testRemote, testLocal, 53, 1, string(make([]byte, 256-IPV4_MIN_HEADER_LEN-UDP_HEADER_LEN)))
+			big := natUDP(t, testRemote, testLocal, 53, 1, string(make([]byte, 1000)))
+			conn.reads <- scriptRead{b: append(prefix, big...)}
+			conn.reads <- scriptRead{b: append(prefix, fit...)}
+			dev.Bind()
+
+			pkt := readPacket(t, dev)
+			if !pkt.Truncated || pkt.Len() != 256 || !bytes.Equal(pkt.Buf[:pkt.Len()], big[:256]) {
+				t.Fatalf("oversized frame: truncated %v, %d bytes", pkt.Truncated, pkt.Len())
+			}
+			pkt.Release()
+			pkt = readPacket(t, dev)
+			if pkt.Truncated || !bytes.Equal(pkt.Buf[:pkt.Len()], fit) {
+				t.Fatalf("frame of the packet size: truncated %v, %d bytes", pkt.Truncated, pkt.Len())
+			}
+			pkt.Release()
+			if got := dev.Stats().RxTruncated; got != 1 {
+				t.Fatalf("rx truncated %d, want 1", got)
+			}
+		})
+	}
+}
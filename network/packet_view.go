@@ -0,0 +1,268 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // チェックサムの疑似ヘッダ
+	"net/netip"       // アドレスの表現
+	"sync"            // PacketViewの再利用
+	"sync/atomic"     // 参照カウント
+)
+
+// パケットのバッファを指したまま各層のヘッダの位置を保持するビュー
+// ParseIPv4などと違い、ヘッダを構造体にコピーせずバッファの部分スライスとアクセサで読み取るため、
+// 解析のたびの割り当てが起きない。PacketView自体もプールから再利用する
+//
+// 参照カウントで寿命を管理する。NewPacketViewの時点で1つの参照を持ち、別の層やゴルーチンに
+// 渡す場合はRetainで参照を増やし、それぞれが使い終わったらReleaseを呼ぶ。最後のReleaseで
+// 元のパケットのバッファがデバイスのプールに、PacketViewがビューのプールに返却される。
+// Releaseを呼んだ後はPacketViewと、Bytes/Payloadなどが返したスライスを参照してはならない。
+// 返却されたバッファとビューは別のパケットに再利用されるため、解放後の参照は別のパケットを
+// 読み書きすることになり、検出できない。保持したいデータはReleaseの前にコピーする
+//
+// IPv6の拡張ヘッダはたどらず、次ヘッダがTCP/UDP/ICMPv6でない場合はトランスポートを解析しない
+type PacketView struct {
+	pkt  Packet
+	refs atomic.Int32
+	// 各層の先頭のオフセット。transportが-1の場合はトランスポートのヘッダを解析していない
+	network   int
+	transport int
+	payload   int
+	end       int
+	version   uint8
+	proto     uint8
+}
+
+var viewPool = sync.Pool{New: func() any { return new(PacketView) }}
+
+// pktのビューを作成する。pktの所有権はビューに移り、最後のReleaseで返却される
+// modeがModeTAPの場合はEthernetヘッダを読み飛ばす。解析できない場合はpktを返却してエラーを返す
+func NewPacketView(pkt Packet, mode Mode) (*PacketView, error) {
+	v := viewPool.Get().(*PacketView)
+	v.pkt = pkt
+	v.refs.Store(1)
+	off := 0
+	if mode == ModeTAP {
+		off = ETHERNET_HEADER_LEN
+	}
+	if err := v.parse(off); err != nil {
+		v.Release()
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *PacketView) parse(off int) error {
+	b := v.pkt.Buf[:v.pkt.Len()]
+	if len(b) <= off {
+		return fmt.Errorf("invalid packet: too short (%d bytes)", len(b))
+	}
+	v.network = off
+	v.transport = -1
+	v.version = b[off] >> 4
+	ip := b[off:]
+	switch v.version {
+	case IPV4_VERSION:
+		if len(ip) < IPV4_MIN_HEADER_LEN {
+			return fmt.Errorf("invalid ipv4 header: too short (%d bytes)", len(ip))
+		}
+		hlen := int(ip[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if hlen < IPV4_MIN_HEADER_LEN || total < hlen || total > len(ip) {
+			return fmt.Errorf("invalid ipv4 header: ihl %d, total length %d (packet %d bytes)", hlen/4, total, len(ip))
+		}
+		if InternetChecksum(ip[:hlen]) != 0 {
+			return fmt.Errorf("invalid ipv4 header: %w", ErrBadChecksum)
+		}
+		v.proto = ip[9]
+		v.end = off + total
+		v.payload = off + hlen
+		// 2番目以降のフラグメントはトランスポートのヘッダを持たず、最初のフラグメントも途中で切れている
+		if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+			return nil
+		}
+	case IPV6_VERSION:
+		if len(ip) < IPV6_HEADER_LEN {
+			return fmt.Errorf("invalid ipv6 header: too short (%d bytes)", len(ip))
+		}
+		total := IPV6_HEADER_LEN + int(binary.BigEndian.Uint16(ip[4:6]))
+		if total > len(ip) {
+			return fmt.Errorf("invalid ipv6 header: payload length %d (packet %d bytes)", total-IPV6_HEADER_LEN, len(ip))
+		}
+		v.proto = ip[6]
+		v.end = off + total
+		v.payload = off + IPV6_HEADER_LEN
+	default:
+		return fmt.Errorf("invalid ip header: version %d", v.version)
+	}
+
+	seg := b[v.payload:v.end]
+	switch v.proto {
+	case PROTOCOL_TCP:
+		if len(seg) < TCP_MIN_HEADER_LEN {
+			return fmt.Errorf("invalid tcp header: too short (%d bytes)", len(seg))
+		}
+		hlen := int(seg[12]>>4) * 4
+		if hlen < TCP_MIN_HEADER_LEN || hlen > len(seg) {
+			return fmt.Errorf("invalid tcp header: data offset %d (segment %d bytes)", hlen/4, len(seg))
+		}
+		v.transport = v.payload
+		v.payload += hlen
+	case PROTOCOL_UDP:
+		if len(seg) < UDP_HEADER_LEN {
+			return fmt.Errorf("invalid udp header: too short (%d bytes)", len(seg))
+		}
+		length := int(binary.BigEndian.Uint16(seg[4:6]))
+		if length < UDP_HEADER_LEN || length > len(seg) {
+			return fmt.Errorf("invalid udp header: length %d (packet %d bytes)", length, len(seg))
+		}
+		v.transport = v.payload
+		v.payload += UDP_HEADER_LEN
+		v.end = v.transport + length
+	case PROTOCOL_ICMP, PROTOCOL_ICMPV6:
+		if len(seg) < 4 {
+			return fmt.Errorf("invalid icmp header: too short (%d bytes)", len(seg))
+		}
+		v.transport = v.payload
+	}
+	return nil
+}
+
+// 参照を1つ増やす。増やした参照もReleaseで手放す
+func (v *PacketView) Retain() *PacketView {
+	if v.refs.Add(1) <= 1 {
+		panic("network: PacketView retained after release")
+	}
+	return v
+}
+
+// 参照を1つ手放す。最後の参照であればバッファとビューを返却する
+func (v *PacketView) Release() {
+	switch n := v.refs.Add(-1); {
+	case n > 0:
+		return
+	case n < 0:
+		panic("network: PacketView released too many times")
+	}
+	v.pkt.Release()
+	*v = PacketView{}
+	viewPool.Put(v)
+}
+
+// IPヘッダから末尾（IPのペイロード長まで）のバイト列を返す
+func (v *PacketView) Bytes() []byte {
+	return v.pkt.Buf[v.network:v.end]
+}
+
+// IPのバージョン（4または6）を返す
+func (v *PacketView) Version() uint8 {
+	return v.version
+}
+
+// IPv4のプロトコル番号、IPv6の次ヘッダを返す
+func (v *PacketView) Protocol() uint8 {
+	return v.proto
+}
+
+// IPヘッダ（IPv4のオプションを含む）を返す
+func (v *PacketView) NetworkHeader() []byte {
+	if v.transport >= 0 {
+		return v.pkt.Buf[v.network:v.transport]
+	}
+	return v.pkt.Buf[v.network:v.payload]
+}
+
+// トランスポートのヘッダ（TCPのオプションを含む）を返す。解析していない場合はnilを返す
+func (v *PacketView) TransportHeader() []byte {
+	if v.transport < 0 {
+		return nil
+	}
+	if v.proto == PROTOCOL_ICMP || v.proto == PROTOCOL_ICMPV6 {
+		return v.pkt.Buf[v.transport : v.transport+4]
+	}
+	return v.pkt.Buf[v.transport:v.payload]
+}
+
+// トランスポートのペイロードを返す
+// トランスポートを解析していない場合はIPのペイロードを、ICMPの場合はタイプ・コード・チェックサムの後ろを返す
+func (v *PacketView) Payload() []byte {
+	if v.proto == PROTOCOL_ICMP || v.proto == PROTOCOL_ICMPV6 {
+		if v.transport >= 0 {
+			return v.pkt.Buf[v.transport+4 : v.end]
+		}
+	}
+	return v.pkt.Buf[v.payload:v.end]
+}
+
+// 送信元アドレスを返す
+func (v *PacketView) Src() netip.Addr {
+	b := v.pkt.Buf[v.network:]
+	if v.version == IPV4_VERSION {
+		return netip.AddrFrom4([4]byte(b[12:16]))
+	}
+	return netip.AddrFrom16([16]byte(b[8:24]))
+}
+
+// 宛先アドレスを返す
+func (v *PacketView) Dst() netip.Addr {
+	b := v.pkt.Buf[v.network:]
+	if v.version == IPV4_VERSION {
+		return netip.AddrFrom4([4]byte(b[16:20]))
+	}
+	return netip.AddrFrom16([16]byte(b[24:40]))
+}
+
+// TCP/UDPの送信元ポートを返す。それ以外では0を返す
+func (v *PacketView) SrcPort() uint16 {
+	if !v.hasPorts() {
+		return 0
+	}
+	return binary.BigEndian.Uint16(v.pkt.Buf[v.transport:])
+}
+
+// TCP/UDPの宛先ポートを返す。それ以外では0を返す
+func (v *PacketView) DstPort() uint16 {
+	if !v.hasPorts() {
+		return 0
+	}
+	return binary.BigEndian.Uint16(v.pkt.Buf[v.transport+2:])
+}
+
+func (v *PacketView) hasPorts() bool {
+	return v.transport >= 0 && (v.proto == PROTOCOL_TCP || v.proto == PROTOCOL_UDP)
+}
+
+// TCPのシーケンス番号、確認応答番号、フラグを返す。TCPでない場合はokがfalseになる
+func (v *PacketView) TCP() (seq, ack uint32, flags uint8, ok bool) {
+	if v.transport < 0 || v.proto != PROTOCOL_TCP {
+		return 0, 0, 0, false
+	}
+	h := v.pkt.Buf[v.transport:]
+	return binary.BigEndian.Uint32(h[4:8]), binary.BigEndian.Uint32(h[8:12]), h[13], true
+}
+
+// トランスポートのチェックサムを疑似ヘッダを含めて検証する
+// ICMPv4は疑似ヘッダを使わない。UDPのチェックサム0（計算していない）は正しいものとする
+// トランスポートを解析していないパケットやフラグメントではfalseを返す
+func (v *PacketView) VerifyChecksum() bool {
+	if v.transport < 0 {
+		return false
+	}
+	ip := v.pkt.Buf[v.network:]
+	seg := v.pkt.Buf[v.transport:v.end]
+	if v.version == IPV4_VERSION {
+		switch v.proto {
+		case PROTOCOL_ICMP:
+			return InternetChecksum(seg) == 0
+		case PROTOCOL_UDP:
+			if binary.BigEndian.Uint16(seg[6:8]) == 0 {
+				return true
+			}
+		}
+		return transportChecksum(net.IP(ip[12:16]), net.IP(ip[16:20]), v.proto, seg) == 0
+	}
+	if v.proto == PROTOCOL_ICMP {
+		return false
+	}
+	return transportChecksum6(net.IP(ip[8:24]), net.IP(ip[24:40]), v.proto, seg) == 0
+}
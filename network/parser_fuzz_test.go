@@ -0,0 +1,226 @@
+package network
+
+import (
+	"bytes"   // バイト列の比較
+	"reflect" // オプションの比較
+	"testing"
+)
+
+// 入力の末尾を切り詰めたものと、チェックサムを壊したものをシードに加える
+// csumはチェックサムのフィールドの位置
+func addVariants(f *testing.F, b []byte, csum int) {
+	f.Add(b)
+	for _, n := range []int{0, 1, 7, 8, 19, 20, len(b) / 2, len(b) - 1} {
+		if n >= 0 && n < len(b) {
+			f.Add(b[:n])
+		}
+	}
+	if csum+1 < len(b) {
+		bad := append([]byte(nil), b...)
+		bad[csum] ^= 0xff
+		f.Add(bad)
+	}
+}
+
+// Record Route、Timestamp、Router Alertのオプションを含むIPv4ヘッダのシード
+func ipv4OptionSeeds() [][]byte {
+	return [][]byte{
+		// Record Route：1つ記録済み、残り1つ
+		{IPV4_OPT_RECORD_ROUTE, 11, 8, 10, 0, 0, 1, 0, 0, 0, 0, IPV4_OPT_EOL},
+		// Timestamp：アドレスとタイムスタンプを1組記録済み、オーバーフロー1
+		{IPV4_OPT_NOP, IPV4_OPT_TIMESTAMP, 12, 13, 0x10 | IPV4_TS_ADDR, 10, 0, 0, 1, 0, 0, 0x10, 0},
+		// Router Alert
+		{IPV4_OPT_ROUTER_ALERT, 4, 0, 0},
+		// ポインタが内容を超えたRecord Route
+		{IPV4_OPT_RECORD_ROUTE, 7, 0xff, 10, 0, 0, 1, IPV4_OPT_EOL},
+		// 長さが内容を超えたオプション
+		{IPV4_OPT_TIMESTAMP, 40, 5, 0},
+	}
+}
+
+// MSS、ウィンドウスケール、SACK、タイムスタンプを含むTCPヘッダのシード
+func tcpSeedHeaders() []TCPHeader {
+	return []TCPHeader{
+		{SrcPort: 40000, DstPort: 80, Seq: 1, Flags: TCP_FLAG_SYN, Window: 0xffff,
+			Options: TCPOptions{MSS: 1460, HasWindowScale: true, WindowScale: 7, SACKPermitted: true, HasTimestamps: true, TSVal: 1}},
+		{SrcPort: 80, DstPort: 40000, Seq: 100, Ack: 2, Flags: TCP_FLAG_ACK, Window: 512,
+			Options: TCPOptions{SACKBlocks: []SACKBlock{{10, 20}, {30, 40}, {50, 60}}, HasTimestamps: true, TSVal: 2, TSEcr: 1}},
+		{SrcPort: 1, DstPort: 0xffff, Seq: 0xffffffff, Flags: TCP_FLAG_FIN | TCP_FLAG_PSH | TCP_FLAG_ACK | TCP_FLAG_URG, Urgent: 3},
+	}
+}
+
+// ParseIPv4が受け付けた入力は、ヘッダとペイロードが入力の範囲に収まり、Marshalで元に戻ること
+func FuzzParseIPv4(f *testing.F) {
+	addVariants(f, udpPacket(f, 1000, 64), 10)
+	for _, h := range tcpSeedHeaders() {
+		addVariants(f, tcpPacket(f, testLocal, testRemote, h, []byte("data")), 10)
+	}
+	for _, opts := range ipv4OptionSeeds() {
+		for len(opts)%4 != 0 {
+			opts = append(opts, IPV4_OPT_EOL)
+		}
+		ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_UDP, Src: testLocal, Dst: testRemote, Options: opts}
+		b, err := ip.MarshalWithPayload([]byte("payload"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		addVariants(f, b, 10)
+	}
+	// フラグメント
+	frag := IPv4Header{ID: 7, Flags: IPV4_FLAG_MF, FragOffset: 185, TTL: 1, Protocol: PROTOCOL_TCP, Src: testLocal, Dst: testRemote}
+	b, err := frag.MarshalWithPayload(make([]byte, 16))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, payload, err := ParseIPv4(b)
+		if err != nil {
+			return
+		}
+		hlen := h.HeaderLen()
+		if hlen < IPV4_MIN_HEADER_LEN || hlen > int(h.TotalLength) || int(h.TotalLength) > len(b) {
+			t.Fatalf("header %d, total length %d, input %d bytes", hlen, h.TotalLength, len(b))
+		}
+		if !bytes.Equal(payload, b[hlen:h.TotalLength]) || cap(payload) != cap(b)-hlen {
+			t.Fatalf("payload is not b[%d:%d]", hlen, h.TotalLength)
+		}
+		if !bytes.Equal(h.Options, b[IPV4_MIN_HEADER_LEN:hlen]) {
+			t.Fatalf("options %x, header %x", h.Options, b[:hlen])
+		}
+		if h.OptionsErr != nil && h.ParsedOptions != nil {
+			t.Fatalf("parsed options with error %s", h.OptionsErr)
+		}
+		for _, o := range h.ParsedOptions {
+			if len(o.Data) > len(h.Options) {
+				t.Fatalf("option %d data %d bytes exceeds options %d bytes", o.Type, len(o.Data), len(h.Options))
+			}
+		}
+		out, err := h.MarshalWithPayload(payload)
+		if err != nil {
+			t.Fatalf("marshal of parsed header: %s", err)
+		}
+		if !bytes.Equal(out, b[:h.TotalLength]) {
+			t.Fatalf("marshal of parsed header:\n got %x\nwant %x", out, b[:h.TotalLength])
+		}
+	})
+}
+
+// ParseTCPが受け付けた入力は、ペイロードがヘッダの直後から入力の末尾までであること
+// ランダムな入力はチェックサムで弾かれるため、検証しない解析も試す
+func FuzzParseTCP(f *testing.F) {
+	ip := &IPv4Header{Src: testLocal, Dst: testRemote}
+	for _, h := range tcpSeedHeaders() {
+		seg, err := h.MarshalWithPayload([]byte("data"), testLocal, testRemote)
+		if err != nil {
+			f.Fatal(err)
+		}
+		addVariants(f, seg, 16)
+	}
+	// 長さが0のオプションと、ヘッダを超えるDataOffset
+	f.Add([]byte{0, 80, 0, 80, 0, 0, 0, 1, 0, 0, 0, 0, 0x60, TCP_FLAG_SYN, 0, 0, 0, 0, 0, 0, TCP_OPT_MSS, 0, 0, 0})
+	f.Add([]byte{0, 80, 0, 80, 0, 0, 0, 1, 0, 0, 0, 0, 0xf0, TCP_FLAG_SYN, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, verify := range []bool{true, false} {
+			h, payload, err := parseTCP(b, ip, verify)
+			if err != nil {
+				continue
+			}
+			hlen := h.HeaderLen()
+			if hlen < TCP_MIN_HEADER_LEN || hlen > len(b) {
+				t.Fatalf("header %d bytes, input %d bytes", hlen, len(b))
+			}
+			if !bytes.Equal(payload, b[hlen:]) || cap(payload) != cap(b)-hlen {
+				t.Fatalf("payload is not b[%d:]", hlen)
+			}
+			if len(h.Options.SACKBlocks) > (hlen-TCP_MIN_HEADER_LEN)/8 {
+				t.Fatalf("%d sack blocks in %d bytes of options", len(h.Options.SACKBlocks), hlen-TCP_MIN_HEADER_LEN)
+			}
+		}
+	})
+}
+
+// ParseUDPが受け付けた入力は、ペイロードがヘッダの直後からLengthまでであること
+func FuzzParseUDP(f *testing.F) {
+	ip := &IPv4Header{Src: testLocal, Dst: testRemote}
+	for _, n := range []int{0, 1, 64, 1472} {
+		h := UDPHeader{SrcPort: 53, DstPort: 40000}
+		seg, err := h.MarshalWithPayload(make([]byte, n), testLocal, testRemote)
+		if err != nil {
+			f.Fatal(err)
+		}
+		addVariants(f, seg, 6)
+	}
+	// チェックサム無しと、Lengthが入力より短い場合
+	f.Add([]byte{0, 53, 0, 53, 0, 10, 0, 0, 'h', 'i', 'x', 'x'})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, verify := range []bool{true, false} {
+			h, payload, err := parseUDP(b, ip, verify)
+			if err != nil {
+				continue
+			}
+			if int(h.Length) < UDP_HEADER_LEN || int(h.Length) > len(b) {
+				t.Fatalf("length %d, input %d bytes", h.Length, len(b))
+			}
+			if !bytes.Equal(payload, b[UDP_HEADER_LEN:h.Length]) || cap(payload) != cap(b)-UDP_HEADER_LEN {
+				t.Fatalf("payload is not b[%d:%d]", UDP_HEADER_LEN, h.Length)
+			}
+		}
+	})
+}
+
+// TCPヘッダとペイロードをIPv4パケットに組み立て、解析して同じ内容に戻ること
+func FuzzTCPRoundTrip(f *testing.F) {
+	for _, h := range tcpSeedHeaders() {
+		var left uint32
+		if len(h.Options.SACKBlocks) > 0 {
+			left = h.Options.SACKBlocks[0].Left
+		}
+		o := h.Options
+		f.Add(h.SrcPort, h.DstPort, h.Seq, h.Ack, h.Flags, h.Window, h.Urgent, o.MSS, o.HasWindowScale, o.WindowScale, o.SACKPermitted, left, o.HasTimestamps, o.TSVal, o.TSEcr, []byte("data"))
+	}
+
+	f.Fuzz(func(t *testing.T, srcPort, dstPort uint16, seq, ack uint32, flags uint8, window, urgent, mss uint16,
+		hasWS bool, wscale uint8, sackOK bool, sackLeft uint32, hasTS bool, tsval, tsecr uint32, payload []byte) {
+		want := TCPHeader{
+			SrcPort: srcPort, DstPort: dstPort, Seq: seq, Ack: ack, Flags: flags, Window: window, Urgent: urgent,
+			Options: TCPOptions{MSS: mss, HasWindowScale: hasWS, WindowScale: wscale, SACKPermitted: sackOK, HasTimestamps: hasTS, TSVal: tsval, TSEcr: tsecr},
+		}
+		if sackLeft != 0 {
+			want.Options.SACKBlocks = []SACKBlock{{sackLeft, sackLeft + 1000}}
+		}
+		if !hasTS {
+			want.Options.TSVal, want.Options.TSEcr = 0, 0
+		}
+		if !hasWS {
+			want.Options.WindowScale = 0
+		}
+		if len(payload) > DEFAULT_MTU {
+			payload = payload[:DEFAULT_MTU]
+		}
+		b := tcpPacket(t, testLocal, testRemote, want, payload)
+
+		ip, seg, err := ParseIPv4(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Src.Equal(testLocal) || !ip.Dst.Equal(testRemote) || ip.Protocol != PROTOCOL_TCP {
+			t.Fatalf("ipv4 header %+v", ip)
+		}
+		got, data, err := ParseTCP(seg, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, payload) {
+			t.Fatalf("payload %x, want %x", data, payload)
+		}
+		// MarshalWithPayloadはDataOffsetとチェックサムを設定する
+		want.DataOffset, want.Checksum = got.DataOffset, got.Checksum
+		if !reflect.DeepEqual(*got, want) {
+			t.Fatalf("\n got %+v\nwant %+v", *got, want)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package network
+
+import (
+	"context"         // タイムアウトの設定
+	"crypto/rand"     // 識別子の生成
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+	"os"              // タイムアウトのエラー
+	"time"            // 時間の計測
+)
+
+// ICMPエコー要求を送信し、応答を待つ
+// 応答を待つ間に受信キューから読み込んだ他のパケットは破棄される
+type Pinger struct {
+	dev Device
+	src net.IP
+	id  uint16
+	seq uint16
+}
+
+// srcを送信元アドレスとするPingerを作成する
+func NewPinger(dev Device, src net.IP) (*Pinger, error) {
+	if src.To4() == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", src)
+	}
+	// 他のPingerの応答と区別するため、識別子はランダムに決める
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, fmt.Errorf("rand error: %s", err.Error())
+	}
+	return &Pinger{
+		dev: dev,
+		src: src.To4(),
+		id:  binary.BigEndian.Uint16(b[:]),
+	}, nil
+}
+
+// dstにcount回エコー要求を送信し、応答が返ってきたもののRTTを返す
+// 各要求はtimeoutまで応答を待ち、1つも応答が無い場合はエラーを返す
+func (p *Pinger) Ping(dst net.IP, count int, timeout time.Duration) ([]time.Duration, error) {
+	if dst.To4() == nil {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", dst)
+	}
+	rtts := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		p.seq++
+		rtt, err := p.ping(dst.To4(), p.seq, timeout)
+		if err == os.ErrDeadlineExceeded {
+			continue
+		}
+		if err != nil {
+			return rtts, err
+		}
+		rtts = append(rtts, rtt)
+	}
+	if len(rtts) == 0 && count > 0 {
+		return nil, fmt.Errorf("ping %s: no reply: %w", dst, os.ErrDeadlineExceeded)
+	}
+	return rtts, nil
+}
+
+func (p *Pinger) ping(dst net.IP, seq uint16, timeout time.Duration) (time.Duration, error) {
+	req := ICMPMessage{
+		Type: ICMP_TYPE_ECHO_REQUEST,
+		ID:   p.id,
+		Seq:  seq,
+		Data: []byte("tcp-ip-go ping"),
+	}
+	hdr := &IPv4Header{
+		ID:       seq,
+		TTL:      64,
+		Protocol: PROTOCOL_ICMP,
+		Src:      p.src,
+		Dst:      dst,
+	}
+	b, err := hdr.MarshalWithPayload(req.Marshal())
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := writeBytes(p.dev, b, nil); err != nil {
+		return 0, err
+	}
+	for {
+		pkt, err := p.dev.ReadContext(ctx)
+		if err == context.DeadlineExceeded {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			return 0, err
+		}
+		ok := p.isReply(pkt, dst, seq)
+		pkt.Release()
+		if ok {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// 送信したエコー要求に対応する応答かを判定する
+func (p *Pinger) isReply(pkt Packet, dst net.IP, seq uint16) bool {
+	ip, payload, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil || ip.Protocol != PROTOCOL_ICMP || !ip.Src.Equal(dst) {
+		return false
+	}
+	msg, err := ParseICMP(payload)
+	if err != nil {
+		return false
+	}
+	return msg.Type == ICMP_TYPE_ECHO_REPLY && msg.ID == p.id && msg.Seq == seq
+}
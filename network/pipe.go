@@ -0,0 +1,69 @@
+package network
+
+import (
+	"os"   // 閉じたことを示すエラー
+	"sync" // 一度だけ閉じる
+)
+
+// NewPipePairでつないだデバイスの間で送信中にとどめるパケット数
+// Linuxのtxqueuelenの既定値に合わせる
+const PIPE_QUEUE_SIZE = 500
+
+// NewPipePairでつないだデバイスの片側
+// 書き込んだパケットは対向のrxに届き、対向の読み込みのゴルーチンが読み出す
+type pipeEnd struct {
+	rx     chan []byte
+	tx     chan []byte
+	done   chan struct{}
+	peer   *pipeEnd
+	closed sync.Once
+}
+
+// システムコールを使わずに互いにつながった2つのデバイスを作成する
+// 一方に書き込んだパケットはもう一方から読み込め、TUNデバイスと同じくBindしてから使う。
+// 特権が無くても、プロトコルスタック全体をプロセス内で動かして試せる。
+// ConfigureIPv4やSetMTUなどのインターフェースの設定は使えない
+func NewPipePair() (*NetDevice, *NetDevice) {
+	ab := make(chan []byte, PIPE_QUEUE_SIZE)
+	ba := make(chan []byte, PIPE_QUEUE_SIZE)
+	a := &pipeEnd{rx: ba, tx: ab, done: make(chan struct{})}
+	b := &pipeEnd{rx: ab, tx: ba, done: make(chan struct{})}
+	a.peer, b.peer = b, a
+
+	cfg := defaultConfig()
+	return newNetDevice(a, "pipe0", ModeTUN, cfg), newNetDevice(b, "pipe1", ModeTUN, cfg)
+}
+
+// 対向から届いたパケットをbufにコピーする
+// bufに収まらない場合はTUNデバイスと同じく本来の長さを返す
+func (p *pipeEnd) Read(buf []byte) (int, error) {
+	select {
+	case b := <-p.rx:
+		copy(buf, b)
+		return len(b), nil
+	case <-p.done:
+		return 0, os.ErrClosed
+	}
+}
+
+// パケットを対向に渡す
+// TUNデバイスの送信キューと同じく、対向が閉じているかキューが一杯の場合は破棄する。
+// 待つと双方の読み込みと書き込みが互いを待ち合わせて止まってしまう
+func (p *pipeEnd) Write(buf []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, os.ErrClosed
+	default:
+	}
+	select {
+	case p.tx <- append([]byte(nil), buf...):
+	case <-p.peer.done:
+	default:
+	}
+	return len(buf), nil
+}
+
+func (p *pipeEnd) Close() error {
+	p.closed.Do(func() { close(p.done) })
+	return nil
+}
@@ -0,0 +1,206 @@
+package network
+
+import (
+	"bytes"     // データの比較
+	"context"   // 読み込みの期限
+	"errors"    // エラーの判定
+	"io"        // エコーの読み込み
+	"net/netip" // アドレスの表現
+	"testing"
+	"time" // 接続の期限
+)
+
+// パイプでつないだ2つのスタックを作成する
+func stackPair(t *testing.T) (*Stack, *Stack) {
+	t.Helper()
+	a, b := NewPipePair()
+	a.Bind()
+	b.Bind()
+	sa, err := NewStack(a, netip.MustParseAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := NewStack(b, netip.MustParseAddr("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+		a.Close()
+		b.Close()
+	})
+	return sa, sb
+}
+
+// DFを立てて送っている途中で自身のMTUが下がっても、MSSを下げて送り続けること
+// 送信済みで未確認のセグメントは、再送の時にMTUを超えることになる
+func TestTCPLocalMTULowered(t *testing.T) {
+	sa, sb := stackPair(t)
+	sa.SetPMTUD(true)
+	l, err := sb.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	c, err := sa.DialTCPTimeout(netip.MustParseAddrPort("10.0.0.2:80"), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	data := bytes.Repeat([]byte("abcdefgh"), 6000)
+	// 送信したセグメントを破棄して未確認のまま残し、その間にMTUを下げる
+	// パイプのデバイスはSetMTUを使えないため、送信に使うMTUだけを下げる
+	dev := sa.dev.(*NetDevice)
+	dev.SetEgressHook(func(pkt Packet) (HookAction, Packet) { return HookDrop, pkt })
+	go c.Write(data)
+	time.Sleep(50 * time.Millisecond)
+	sa.ip.mtu.Store(600)
+	dev.SetEgressHook(nil)
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed data differs")
+	}
+	c.mu.Lock()
+	mss := c.mss
+	c.mu.Unlock()
+	if mss > mssForMTU(600) {
+		t.Fatalf("mss %d exceeds mtu 600", mss)
+	}
+}
+
+// DFを立てたUDPのデータグラムはMTUを超えても分割しないこと
+func TestUDPDontFragment(t *testing.T) {
+	sa, _ := stackPair(t)
+	c, err := sa.ListenUDP(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dst := netip.MustParseAddrPort("10.0.0.2:5000")
+	big := make([]byte, 2000)
+	if err := c.WriteToAddrPort(big, dst); err != nil {
+		t.Fatalf("fragmented write: %s", err)
+	}
+	c.SetDontFragment(true)
+	if err := c.WriteToAddrPort(big, dst); !errors.Is(err, ErrFragmentationNeeded) {
+		t.Fatalf("got %v, want ErrFragmentationNeeded", err)
+	}
+	if err := c.WriteToAddrPort(big[:100], dst); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// スタックが送ったTCPセグメントをIPヘッダとともに1つ読み込む。TCP以外のパケットは読み飛ばす
+func readTCPPacket(t *testing.T, dev *NetDevice) (*IPv4Header, []byte, *TCPHeader, []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for {
+		pkt, err := dev.ReadContext(ctx)
+		if err != nil {
+			t.Fatalf("no tcp segment: %s", err)
+		}
+		b := append([]byte(nil), pkt.Buf[:pkt.Len()]...)
+		pkt.Release()
+		ip, seg, err := ParseIPv4(b)
+		if err != nil || ip.Protocol != PROTOCOL_TCP {
+			continue
+		}
+		h, payload, err := ParseTCP(seg, ip)
+		if err != nil {
+			t.Fatalf("tcp: %s", err)
+		}
+		return ip, seg, h, payload
+	}
+}
+
+// ICMPのフラグメント化要求を受け取ると、MSSを下げて未確認のセグメントを小さく送り直し、
+// 以降の書き込みも小さいセグメントで送ること。PMTUDが有効な間はDFを立てること
+func TestTCPFragmentationNeeded(t *testing.T) {
+	s, dev := rawPeer(t)
+	s.SetPMTUD(true)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 0xffff, Options: TCPOptions{MSS: 1460}}, nil)
+	if ip, _, h, _ := readTCPPacket(t, dev); h.Flags != TCP_FLAG_SYN|TCP_FLAG_ACK || ip.Flags&IPV4_FLAG_DF == 0 {
+		t.Fatalf("syn-ack %s, ip flags %d", TCPFlagsString(h.Flags), ip.Flags)
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// seqから始まるnバイトを受け取る。どのセグメントもmss以下でDFが立っていること
+	// 最初に受け取ったセグメントのIPヘッダとTCPセグメントを返す
+	receive := func(seq uint32, n int, mss int) (*IPv4Header, []byte) {
+		t.Helper()
+		var firstIP *IPv4Header
+		var firstSeg []byte
+		got := make(map[uint32]bool)
+		for covered := 0; covered < n; {
+			ip, seg, h, payload := readTCPPacket(t, dev)
+			if len(payload) == 0 {
+				continue
+			}
+			if len(payload) > mss || ip.Flags&IPV4_FLAG_DF == 0 {
+				t.Fatalf("segment seq %d of %d bytes, ip flags %d, want at most %d with DF", h.Seq, len(payload), ip.Flags, mss)
+			}
+			if firstIP == nil {
+				firstIP, firstSeg = ip, seg
+			}
+			if !got[h.Seq] && seqGE(h.Seq, seq) {
+				got[h.Seq] = true
+				covered += len(payload)
+			}
+		}
+		return firstIP, firstSeg
+	}
+
+	if _, err := c.Write(make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	ip, seg := receive(1001, 3000, 1460)
+
+	// 次ホップのMTUが1000であることを知らせる
+	icmp, err := BuildFragmentationNeeded(ip, seg, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WritePacket(icmp); err != nil {
+		t.Fatal(err)
+	}
+	mss := int(mssForMTU(1000))
+	receive(1001, 3000, mss)
+	c.mu.Lock()
+	got := c.mss
+	c.mu.Unlock()
+	if int(got) != mss {
+		t.Fatalf("mss %d, want %d", got, mss)
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 4001, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+
+	if _, err := c.Write(make([]byte, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	receive(4001, 2000, mss)
+}
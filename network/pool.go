@@ -0,0 +1,52 @@
+package network
+
+import (
+	"sync"        // バッファの再利用
+	"sync/atomic" // 返却の世代
+)
+
+// 固定長のバッファを再利用するプール
+// sync.Poolにはバッファのポインタを格納し、Putのたびに割り当てが起きないようにする
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// プールのバッファ
+// Packetは値で渡されてコピーされるため、同じ貸し出しを複数のコピーから返却しうる。
+// 貸し出しごとの世代をPacketに持たせ、返却のたびに進めることで、2回目以降の返却と
+// 以前の貸し出しのコピーからの返却を無視する
+type poolBuf struct {
+	b   []byte
+	gen atomic.Uint32
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		return &poolBuf{b: make([]byte, size)}
+	}
+	return p
+}
+
+// バッファを取得する
+func (p *bufferPool) get() *poolBuf {
+	return p.pool.Get().(*poolBuf)
+}
+
+// genの世代で貸し出したバッファを返却する。既に返却済みの場合は何もしない
+func (p *bufferPool) put(b *poolBuf, gen uint32) {
+	if !b.gen.CompareAndSwap(gen, gen+1) {
+		return
+	}
+	if cap(b.b) < p.size {
+		return
+	}
+	b.b = b.b[:p.size]
+	p.pool.Put(b)
+}
+
+// 取得したまま使わなかったバッファを返却する
+func (p *bufferPool) putUnused(b *poolBuf) {
+	p.put(b, b.gen.Load())
+}
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"testing"
+)
+
+// WritePacketに渡したパケットのコピーからReleaseしても、バッファが二重に返却されないこと
+func TestReleaseCopyDoesNotDoublePut(t *testing.T) {
+	p := newBufferPool(64)
+	ref := p.get()
+	pkt := Packet{Buf: ref.b, N: uintptr(len(ref.b)), pool: p, ref: ref, gen: ref.gen.Load()}
+	sent := pkt // WritePacketは値で受け取る
+	sent.Release()
+	pkt.Release()
+	if got := ref.gen.Load(); got != pkt.gen+1 {
+		t.Fatalf("generation advanced %d times, want 1", got-pkt.gen)
+	}
+
+	// 以前の貸し出しのコピーは、同じバッファを借り直したパケットを返却しない
+	stale := Packet{Buf: ref.b, pool: p, ref: ref, gen: ref.gen.Load() - 1}
+	gen := ref.gen.Load()
+	stale.Release()
+	if ref.gen.Load() != gen {
+		t.Fatalf("stale copy released a re-lent buffer")
+	}
+}
+
+// 2つの読み込みが同じバッファを共有しないこと
+func TestDoubleReleaseDoesNotShareBuffer(t *testing.T) {
+	p := newBufferPool(64)
+	ref := p.get()
+	pkt := Packet{Buf: ref.b, pool: p, ref: ref, gen: ref.gen.Load()}
+	cp := pkt
+	pkt.Release()
+	cp.Release()
+	a, b := p.get(), p.get()
+	if a == b {
+		t.Fatalf("pool returned the same buffer twice")
+	}
+}
@@ -0,0 +1,103 @@
+package network
+
+import (
+	"errors" // エラーの生成
+	"fmt"    // 文字列の生成や出力、スキャン
+	"sync"   // 排他制御
+)
+
+// エフェメラルポートの範囲（RFC 6335）
+const (
+	EPHEMERAL_PORT_MIN = 49152
+	EPHEMERAL_PORT_MAX = 65535
+)
+
+var ErrPortExhausted = errors.New("no ephemeral port available")
+
+// 使用中のポートをプロトコルごとに管理し、空いているエフェメラルポートを割り当てる
+// TCPのポートはTIME_WAITが終わりコネクションが解放されるまで使用中のまま残る
+type PortAllocator struct {
+	mu    sync.Mutex
+	min   uint16
+	max   uint16
+	next  map[uint8]uint16
+	inUse map[uint8]map[uint16]struct{}
+}
+
+// min..maxの範囲からポートを割り当てるPortAllocatorを作成する
+func NewPortAllocator(min, max uint16) (*PortAllocator, error) {
+	if min == 0 || min > max {
+		return nil, fmt.Errorf("invalid port range: %d-%d", min, max)
+	}
+	return &PortAllocator{
+		min:   min,
+		max:   max,
+		next:  make(map[uint8]uint16),
+		inUse: make(map[uint8]map[uint16]struct{}),
+	}, nil
+}
+
+func (a *PortAllocator) ports(proto uint8) map[uint16]struct{} {
+	m, ok := a.inUse[proto]
+	if !ok {
+		m = make(map[uint16]struct{})
+		a.inUse[proto] = m
+	}
+	return m
+}
+
+// 空いているエフェメラルポートを割り当てる
+// 前回割り当てたポートの次から順に探し、範囲の終わりまで来たら先頭に戻る
+func (a *PortAllocator) Allocate(proto uint8) (uint16, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	used := a.ports(proto)
+	size := int(a.max) - int(a.min) + 1
+	next, ok := a.next[proto]
+	if !ok {
+		// 推測されにくいよう開始位置はランダムにする
+		next = a.min + uint16(randomUint32()%uint32(size))
+	}
+	for i := 0; i < size; i++ {
+		port := next
+		if next == a.max {
+			next = a.min
+		} else {
+			next++
+		}
+		if _, ok := used[port]; !ok {
+			used[port] = struct{}{}
+			a.next[proto] = next
+			return port, nil
+		}
+	}
+	return 0, ErrPortExhausted
+}
+
+// 指定したポートを使用中にする。既に使用中の場合はエラーを返す
+func (a *PortAllocator) Reserve(proto uint8, port uint16) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	used := a.ports(proto)
+	if _, ok := used[port]; ok {
+		return fmt.Errorf("port %d already in use", port)
+	}
+	used[port] = struct{}{}
+	return nil
+}
+
+// ポートを解放する
+func (a *PortAllocator) Release(proto uint8, port uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.ports(proto), port)
+}
+
+// ポートが使用中かを返す
+func (a *PortAllocator) InUse(proto uint8, port uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.ports(proto)[port]
+	return ok
+}
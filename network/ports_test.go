@@ -0,0 +1,128 @@
+package network
+
+import (
+	"errors" // エラーの判定
+	"sync"   // 並行した割り当て
+	"testing"
+)
+
+// 範囲の終わりまで割り当てたら先頭に戻り、空いたポートを再び使うこと
+func TestPortAllocatorWraparound(t *testing.T) {
+	a, err := NewPortAllocator(65533, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[uint16]bool)
+	for i := 0; i < 3; i++ {
+		p, err := a.Allocate(PROTOCOL_TCP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p < 65533 || seen[p] {
+			t.Fatalf("allocated %d (seen %v)", p, seen)
+		}
+		seen[p] = true
+	}
+	if _, err := a.Allocate(PROTOCOL_TCP); !errors.Is(err, ErrPortExhausted) {
+		t.Fatalf("got %v, want ErrPortExhausted", err)
+	}
+	a.Release(PROTOCOL_TCP, 65534)
+	if a.InUse(PROTOCOL_TCP, 65534) {
+		t.Fatal("released port still in use")
+	}
+	if p, err := a.Allocate(PROTOCOL_TCP); err != nil || p != 65534 {
+		t.Fatalf("got %d %v, want the released 65534", p, err)
+	}
+	// 最大のポートの次は先頭のポート
+	a.Release(PROTOCOL_TCP, 65533)
+	a.Release(PROTOCOL_TCP, 65535)
+	a.next[PROTOCOL_TCP] = 65535
+	for _, want := range []uint16{65535, 65533} {
+		if p, err := a.Allocate(PROTOCOL_TCP); err != nil || p != want {
+			t.Fatalf("got %d %v, want %d", p, err, want)
+		}
+	}
+}
+
+// 使用中のポートはプロトコルごとに管理し、Reserveは使用中のポートを拒否すること
+func TestPortAllocatorReserve(t *testing.T) {
+	a, err := NewPortAllocator(EPHEMERAL_PORT_MIN, EPHEMERAL_PORT_MAX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reserve(PROTOCOL_TCP, 80); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reserve(PROTOCOL_TCP, 80); err == nil {
+		t.Fatal("reserved port 80 twice")
+	}
+	if err := a.Reserve(PROTOCOL_UDP, 80); err != nil {
+		t.Fatalf("udp port 80 conflicts with tcp: %s", err)
+	}
+	// 予約したエフェメラルポートは割り当てない
+	b, err := NewPortAllocator(50000, 50001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Reserve(PROTOCOL_UDP, 50000); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := b.Allocate(PROTOCOL_UDP); err != nil || p != 50001 {
+		t.Fatalf("got %d %v, want 50001", p, err)
+	}
+	if _, err := b.Allocate(PROTOCOL_UDP); !errors.Is(err, ErrPortExhausted) {
+		t.Fatalf("got %v, want ErrPortExhausted", err)
+	}
+	if err := b.Reserve(PROTOCOL_UDP, 50001); err == nil {
+		t.Fatal("reserved an allocated port")
+	}
+}
+
+// 空の範囲や0を含む範囲は作成できないこと
+func TestNewPortAllocatorRange(t *testing.T) {
+	for _, r := range [][2]uint16{{0, 10}, {100, 99}} {
+		if _, err := NewPortAllocator(r[0], r[1]); err == nil {
+			t.Fatalf("accepted range %d-%d", r[0], r[1])
+		}
+	}
+	if _, err := NewPortAllocator(7, 7); err != nil {
+		t.Fatalf("single port range: %s", err)
+	}
+}
+
+// 並行して割り当てても同じポートを二度渡さないこと
+func TestPortAllocatorConcurrent(t *testing.T) {
+	a, err := NewPortAllocator(60000, 60999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	got := make(map[uint16]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				p, err := a.Allocate(PROTOCOL_TCP)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if got[p] {
+					t.Errorf("port %d allocated twice", p)
+				}
+				got[p] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(got) != 1000 {
+		t.Fatalf("%d ports allocated, want 1000", len(got))
+	}
+	if _, err := a.Allocate(PROTOCOL_TCP); !errors.Is(err, ErrPortExhausted) {
+		t.Fatalf("got %v, want ErrPortExhausted", err)
+	}
+}
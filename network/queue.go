@@ -0,0 +1,107 @@
+package network
+
+import (
+	"fmt"  // 文字列の生成や出力、スキャン
+	"sync" // 利用中の操作の待ち合わせ
+)
+
+// 受信キューと送信キュー
+// ResizeQueuesで作り直すため、キューを読み書きする操作はacquireQueuesで取得した世代を使う
+type packetQueues struct {
+	incoming chan Packet
+	outgoing chan Packet
+	// ResizeQueuesで閉じられる。キューを待っている操作はこれで起こされ、新しい世代でやり直す
+	resized chan struct{}
+	users   sync.WaitGroup
+}
+
+func newPacketQueues(incoming, outgoing chan Packet) *packetQueues {
+	return &packetQueues{
+		incoming: incoming,
+		outgoing: outgoing,
+		resized:  make(chan struct{}),
+	}
+}
+
+// 現在のキューを取得する。使い終わったらreleaseを呼ぶ
+func (t *NetDevice) acquireQueues() *packetQueues {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	q := t.queues
+	q.users.Add(1)
+	return q
+}
+
+func (q *packetQueues) release() {
+	q.users.Done()
+}
+
+// 受信キューと送信キューのバッファ数を返す
+func (t *NetDevice) QueueSizes() (incoming, outgoing int) {
+	q := t.acquireQueues()
+	defer q.release()
+	return cap(q.incoming), cap(q.outgoing)
+}
+
+// 受信キューと送信キューに溜まっているパケット数を返す
+// 送信キューが一杯のままであれば、fdへの書き込みが追いついていない（背圧がかかっている）
+func (t *NetDevice) QueueDepths() (incoming, outgoing int) {
+	q := t.acquireQueues()
+	defer q.release()
+	return len(q.incoming), len(q.outgoing)
+}
+
+// 動作中に受信キューと送信キューのバッファ数を変更する
+// キューを待っている読み書きを一度起こし、溜まっているパケットを順番を保ったまま新しいキューに移す。
+// 移す間は読み書きが止まるが、パケットは失われない。溜まっているパケットが新しいバッファ数を
+// 超える場合はキューを変更せずにエラーを返すため、時間をおいてやり直す
+func (t *NetDevice) ResizeQueues(incoming, outgoing int) error {
+	if incoming < 0 || outgoing < 0 {
+		return fmt.Errorf("invalid queue size: incoming=%d outgoing=%d", incoming, outgoing)
+	}
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+	if t.ctx.Err() != nil {
+		return ErrDeviceClosed
+	}
+	old := t.queues
+	if err := checkQueueLen(old, incoming, outgoing); err != nil {
+		return err
+	}
+	// 古い世代を使っている操作が終わるのを待つ。起こされた操作はqueueMuを取れないため、
+	// 待ち終えた後は古いキューに触れるのはここだけになる
+	close(old.resized)
+	old.users.Wait()
+	// 待つ間に増えたパケットが収まらない場合は、同じキューで新しい世代を作る
+	if err := checkQueueLen(old, incoming, outgoing); err != nil {
+		t.queues = newPacketQueues(old.incoming, old.outgoing)
+		return err
+	}
+	next := newPacketQueues(make(chan Packet, incoming), make(chan Packet, outgoing))
+	migrate(old.incoming, next.incoming)
+	migrate(old.outgoing, next.outgoing)
+	t.queues = next
+	return nil
+}
+
+func checkQueueLen(q *packetQueues, incoming, outgoing int) error {
+	if n := len(q.incoming); n > incoming {
+		return fmt.Errorf("resize error: %d packets in incoming queue exceed size %d", n, incoming)
+	}
+	if n := len(q.outgoing); n > outgoing {
+		return fmt.Errorf("resize error: %d packets in outgoing queue exceed size %d", n, outgoing)
+	}
+	return nil
+}
+
+// fromに溜まっているパケットをtoに移す。toには全て収まる
+func migrate(from, to chan Packet) {
+	for {
+		select {
+		case pkt := <-from:
+			to <- pkt
+		default:
+			return
+		}
+	}
+}
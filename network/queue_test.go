@@ -0,0 +1,109 @@
+package network
+
+import (
+	"errors"  // エラーの判定
+	"strings" // エラーの判定
+	"sync"    // ゴルーチンの待ち合わせ
+	"testing"
+)
+
+// 送受信の途中でキューの大きさを何度も変えても、パケットを失わず順番も変わらないこと
+func TestResizeQueuesInFlight(t *testing.T) {
+	a, b := forwardPair(t)
+	// パイプ自体の送信中のキューが溢れない数にする
+	const n = 400
+	pkts := make([][]byte, n)
+	for i := range pkts {
+		pkts[i] = natUDP(t, testLocal, testRemote, 1, uint16(1000+i), "in flight")
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, p := range pkts {
+			if err := a.WriteBytes(p); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		sizes := []int{1, 4, 64, 2, QUEUE_SIZE, 256}
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			size := sizes[i%len(sizes)]
+			for _, dev := range []*NetDevice{a, b} {
+				// 溜まっているパケットより小さくする場合は拒否される
+				if err := dev.ResizeQueues(size, size); err != nil && !strings.Contains(err.Error(), "resize error") {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		pkt := readPacket(t, b)
+		if _, _, dst := verifyPacket(t, pkt.Buf[:pkt.Len()]); dst != uint16(1000+i) {
+			t.Fatalf("packet %d: got port %d", i, dst)
+		}
+		pkt.Release()
+	}
+	close(done)
+	wg.Wait()
+	for _, dev := range []*NetDevice{a, b} {
+		if s := dev.Stats(); s.RxDrops != 0 || s.TxDrops != 0 {
+			t.Fatalf("%s: rx drops %d tx drops %d", dev.name, s.RxDrops, s.TxDrops)
+		}
+	}
+}
+
+// 溜まっているパケットが収まらない大きさや負の大きさは拒否し、キューを変えないこと
+func TestResizeQueuesRejects(t *testing.T) {
+	a, b := forwardPair(t)
+	for i := 0; i < 5; i++ {
+		if err := a.WriteBytes(natUDP(t, testLocal, testRemote, 1, uint16(1000+i), "queued")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "queued packets", func() bool {
+		in, _ := b.QueueDepths()
+		return in == 5
+	})
+
+	if err := b.ResizeQueues(-1, 10); err == nil {
+		t.Fatal("accepted a negative size")
+	}
+	if err := b.ResizeQueues(4, 10); err == nil {
+		t.Fatal("shrank below the queued packets")
+	}
+	if in, out := b.QueueSizes(); in != QUEUE_SIZE || out != QUEUE_SIZE {
+		t.Fatalf("sizes %d %d after a rejected resize", in, out)
+	}
+	// ちょうど収まる大きさには変えられ、溜まっていたパケットも読める
+	if err := b.ResizeQueues(5, 32); err != nil {
+		t.Fatal(err)
+	}
+	if in, out := b.QueueSizes(); in != 5 || out != 32 {
+		t.Fatalf("sizes %d %d, want 5 32", in, out)
+	}
+	for i := 0; i < 5; i++ {
+		pkt := readPacket(t, b)
+		if _, _, dst := verifyPacket(t, pkt.Buf[:pkt.Len()]); dst != uint16(1000+i) {
+			t.Fatalf("packet %d: got port %d", i, dst)
+		}
+		pkt.Release()
+	}
+
+	b.Close()
+	if err := b.ResizeQueues(10, 10); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("closed device: got %v, want ErrDeviceClosed", err)
+	}
+}
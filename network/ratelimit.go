@@ -0,0 +1,67 @@
+package network
+
+import (
+	"sync" // 排他制御
+	"time" // トークンの補充
+)
+
+const (
+	// 送信するICMPエラーの既定の上限（1秒あたり）。Linuxのicmp_msgs_per_secと同じ
+	ICMP_RATE_LIMIT = 1000
+	// 続けて送れるICMPエラーの上限。Linuxのicmp_msgs_burstと同じ
+	ICMP_RATE_BURST = 50
+)
+
+// トークンバケットによる流量制限
+// 1秒あたりrate個のトークンを補充し、最大burst個まで溜める
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 0の場合は制限しない
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perSecond int) *tokenBucket {
+	b := &tokenBucket{}
+	b.setRate(perSecond)
+	return b
+}
+
+// 1秒あたりの上限を変更する。0以下の場合は制限しない
+// burstは上限を超えない範囲でICMP_RATE_BURSTとし、バケットは満たした状態から始める
+func (b *tokenBucket) setRate(perSecond int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if perSecond <= 0 {
+		b.rate = 0
+		return
+	}
+	b.rate = float64(perSecond)
+	b.burst = ICMP_RATE_BURST
+	if b.burst > b.rate {
+		b.burst = b.rate
+	}
+	b.tokens = b.burst
+	b.last = time.Now()
+}
+
+// トークンを1つ使えればtrueを返す
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
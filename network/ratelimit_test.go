@@ -0,0 +1,119 @@
+package network
+
+import (
+	"context" // 読み込みの期限
+	"testing"
+	"time" // トークンの補充
+)
+
+// バーストの分だけ続けて許可し、経過時間に応じてトークンを補充すること
+func TestTokenBucketRefill(t *testing.T) {
+	b := newTokenBucket(10)
+	for i := 0; i < 10; i++ {
+		if !b.allow() {
+			t.Fatalf("denied token %d of the burst", i)
+		}
+	}
+	if b.allow() {
+		t.Fatal("allowed beyond the burst")
+	}
+	// 0.5秒分で5つ補充される
+	b.mu.Lock()
+	b.last = b.last.Add(-500 * time.Millisecond)
+	b.mu.Unlock()
+	allowed := 0
+	for b.allow() {
+		allowed++
+	}
+	if allowed != 5 {
+		t.Fatalf("refilled %d tokens, want 5", allowed)
+	}
+	// どれだけ待ってもバーストを超えては溜まらない
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+	allowed = 0
+	for b.allow() {
+		allowed++
+	}
+	if allowed != 10 {
+		t.Fatalf("refilled %d tokens after an hour, want the burst 10", allowed)
+	}
+
+	// バーストは上限を超えず、0以下は制限しない
+	if b := newTokenBucket(1000); b.burst != ICMP_RATE_BURST {
+		t.Fatalf("burst %v, want %d", b.burst, ICMP_RATE_BURST)
+	}
+	b.setRate(0)
+	for i := 0; i < 1000; i++ {
+		if !b.allow() {
+			t.Fatal("unlimited bucket denied")
+		}
+	}
+}
+
+// peerに届いたICMPを期限まで数える
+func countICMP(t *testing.T, peer *NetDevice, typ uint8) int {
+	t.Helper()
+	n := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		pkt, err := peer.ReadContext(ctx)
+		cancel()
+		if err != nil {
+			return n
+		}
+		_, msg := parseICMPError(t, pkt)
+		if msg.Type == typ {
+			n++
+		}
+		pkt.Release()
+	}
+}
+
+// 到達不能を大量に引き起こしても上限の数しか返さず、エコー応答は制限しないこと
+func TestStackICMPRateLimit(t *testing.T) {
+	s, peer := rawPeer(t)
+	s.SetICMPRateLimit(5)
+	for i := 0; i < 20; i++ {
+		if err := peer.WriteBytes(natUDP(t, rawPeerIP, rawStackIP, 40000, uint16(9+i), "flood")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countICMP(t, peer, ICMP_TYPE_DEST_UNREACHABLE); got != 5 {
+		t.Fatalf("sent %d port unreachable, want 5", got)
+	}
+
+	echo := ICMPMessage{Type: ICMP_TYPE_ECHO_REQUEST, ID: 1, Seq: 1, Data: []byte("ping")}
+	ip := IPv4Header{TTL: 64, Protocol: PROTOCOL_ICMP, Src: rawPeerIP, Dst: rawStackIP}
+	b, err := ip.MarshalWithPayload(echo.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := peer.WriteBytes(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := countICMP(t, peer, ICMP_TYPE_ECHO_REPLY); got != 3 {
+		t.Fatalf("sent %d echo replies, want 3", got)
+	}
+}
+
+// 転送でTTLが尽きたパケットへの時間超過も上限の数しか返さないこと
+func TestForwardICMPRateLimit(t *testing.T) {
+	in, src := forwardPair(t)
+	out, _ := forwardPair(t)
+	in.SetICMPRateLimit(2)
+	for i := 0; i < 10; i++ {
+		ip := IPv4Header{ID: uint16(i), TTL: 1, Protocol: PROTOCOL_UDP, Src: testRemote, Dst: testLocal}
+		b, err := ip.MarshalWithPayload([]byte("expired"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.Forward(bytesPacket(b), out)
+	}
+	if got := countICMP(t, src, ICMP_TYPE_TIME_EXCEEDED); got != 2 {
+		t.Fatalf("sent %d time exceeded, want 2", got)
+	}
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"context" // 読み込みのキャンセル
+)
+
+// IPパケットをそのまま読み書きする（SOCK_RAWに相当する）
+// TCP/UDPの処理を行わず、受信したIPv4パケットをヘッダとペイロードに分けて返す。
+// デバイスのパケットを受信キューから取り出すため、同じデバイスでStackと併用してはならない
+type RawConn struct {
+	dev Device
+	ip  *ipv4Output
+}
+
+// devを読み書きするRawConnを作成する。デバイスはBind済みである必要がある
+func NewRawConn(dev Device) *RawConn {
+	return &RawConn{dev: dev, ip: newIPv4Output(dev)}
+}
+
+// IPv4パケットを1つ読み込む
+// IPv4として解析できないパケットは読み飛ばす。返すヘッダとペイロードはコピーのため保持し続けてよい
+func (c *RawConn) ReadIP() (*IPv4Header, []byte, error) {
+	return c.ReadIPContext(context.Background())
+}
+
+// IPv4パケットを1つ読み込む。ctxがキャンセルされた場合はctx.Err()を返す
+func (c *RawConn) ReadIPContext(ctx context.Context) (*IPv4Header, []byte, error) {
+	for {
+		pkt, err := c.dev.ReadContext(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		b := append([]byte(nil), pkt.Buf[:pkt.Len()]...)
+		pkt.Release()
+		h, payload, err := ParseIPv4(b)
+		if err != nil {
+			continue
+		}
+		return h, payload, nil
+	}
+}
+
+// hdrにpayloadを続けたIPv4パケットを書き込む
+// TotalLengthとチェックサムは計算し直し、IDとTTLが0の場合は補完する。
+// MTUを超える場合はフラグメントに分割する（DFが立っていればErrFragmentationNeededを返す）
+func (c *RawConn) WriteIP(hdr *IPv4Header, payload []byte) error {
+	h := *hdr
+	h.TotalLength = 0
+	h.Checksum = 0
+	return c.ip.send(&h, payload, nil)
+}
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"context"         // 再生の中断
+	"encoding/binary" // pcapのヘッダの読み込み
+	"encoding/hex"    // 16進文字列の解析
+	"fmt"             // 文字列の生成や出力、スキャン
+	"io"              // 入力元
+	"strings"         // 16進文字列の空白の除去
+	"time"            // パケットの間隔
+)
+
+const (
+	PCAP_MAGIC_NSEC = 0xa1b23c4d // ナノ秒精度のマジックナンバー
+	// 読み込む1パケットの長さの上限（tcpdumpのsnaplenの上限）
+	PCAP_MAX_RECORD_LEN = 262144
+)
+
+// ReplaySourceに渡すオプション
+type ReplayOption func(*ReplaySource)
+
+// 記録された時刻の間隔を空けてパケットを再生する
+// 指定しない場合は待たずに続けて再生する。16進文字列から作った場合は時刻が無いため影響しない
+func WithOriginalTiming() ReplayOption {
+	return func(r *ReplaySource) {
+		r.timing = true
+	}
+}
+
+// pcapファイルや16進文字列のパケットを、カーネルから読み込んだものとしてデバイスの受信の経路に入れる
+// StartCaptureで記録した通信を再生し、同じ入力でスタックの動作を繰り返し確かめるために使う
+type ReplaySource struct {
+	records []captureRecord
+	// 0の場合はリンク層を確かめない
+	linktype uint32
+	timing   bool
+}
+
+// rからpcap形式のパケットを読み込む
+// リトルエンディアンとビッグエンディアン、マイクロ秒精度とナノ秒精度のファイルを読める
+// リンク層はLINKTYPE_RAW（TUN）かLINKTYPE_ETHERNET（TAP）だけを扱う
+func ReadPcap(r io.Reader, opts ...ReplayOption) (*ReplaySource, error) {
+	hdr := make([]byte, PCAP_HEADER_LEN)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("pcap error: %s", err.Error())
+	}
+	var order binary.ByteOrder
+	var nsec bool
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == PCAP_MAGIC:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == PCAP_MAGIC:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:4]) == PCAP_MAGIC_NSEC:
+		order, nsec = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:4]) == PCAP_MAGIC_NSEC:
+		order, nsec = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("pcap error: invalid magic %#08x", binary.LittleEndian.Uint32(hdr[0:4]))
+	}
+	linktype := order.Uint32(hdr[20:24])
+	if linktype != LINKTYPE_RAW && linktype != LINKTYPE_ETHERNET {
+		return nil, fmt.Errorf("pcap error: unsupported link type %d", linktype)
+	}
+
+	s := &ReplaySource{linktype: linktype}
+	rec := make([]byte, PCAP_RECORD_LEN)
+	for {
+		if _, err := io.ReadFull(r, rec); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("pcap error: record %d: %s", len(s.records), err.Error())
+		}
+		frac := time.Duration(order.Uint32(rec[4:8]))
+		if !nsec {
+			frac *= time.Microsecond
+		}
+		caplen := order.Uint32(rec[8:12])
+		if caplen > PCAP_MAX_RECORD_LEN {
+			return nil, fmt.Errorf("pcap error: record %d: invalid length %d", len(s.records), caplen)
+		}
+		data := make([]byte, caplen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("pcap error: record %d: %s", len(s.records), err.Error())
+		}
+		s.records = append(s.records, captureRecord{
+			at:   time.Unix(int64(order.Uint32(rec[0:4])), int64(frac)),
+			data: data,
+			size: int(order.Uint32(rec[12:16])),
+		})
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// 16進文字列のパケットを再生するReplaySourceを作成する
+// 各文字列が1つのパケットで、空白と改行は無視する。リンク層は再生するデバイスに合わせる
+func NewHexReplaySource(packets []string, opts ...ReplayOption) (*ReplaySource, error) {
+	s := &ReplaySource{}
+	for i, p := range packets {
+		data, err := hex.DecodeString(strings.Join(strings.Fields(p), ""))
+		if err != nil {
+			return nil, fmt.Errorf("hex error: packet %d: %s", i, err.Error())
+		}
+		s.records = append(s.records, captureRecord{data: data, size: len(data)})
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// 再生するパケット数を返す
+func (r *ReplaySource) Len() int {
+	return len(r.records)
+}
+
+// パケットを順にdevの受信の経路に入れ、入れたパケット数を返す
+// 受信したパケットと同じく統計とキャプチャに反映し、受信のフックとSubscribeを適用してから受信キューに入れる
+// （フックで破棄したパケットも入れた数に含める）。Timestampは入れた時刻になる
+// Bindしたデバイスではカーネルから読み込んだパケットと混ざる
+// ctxがキャンセルされた場合はctx.Err()を、デバイスが閉じられた場合はErrDeviceClosedを返す
+func (r *ReplaySource) Replay(ctx context.Context, dev *NetDevice) (int, error) {
+	if r.linktype != 0 {
+		want := uint32(LINKTYPE_RAW)
+		if dev.mode == ModeTAP {
+			want = LINKTYPE_ETHERNET
+		}
+		if r.linktype != want {
+			return 0, fmt.Errorf("replay error: link type %d does not match %s device", r.linktype, dev.mode)
+		}
+	}
+	for i, rec := range r.records {
+		if r.timing && i > 0 {
+			if err := sleepContext(ctx, rec.at.Sub(r.records[i-1].at)); err != nil {
+				return i, err
+			}
+		} else if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		pkt := bytesPacket(append([]byte(nil), rec.data...))
+		pkt.Timestamp = time.Now()
+		if !dev.inject(pkt) {
+			return i, ErrDeviceClosed
+		}
+	}
+	return len(r.records), nil
+}
+
+// dだけ待つ。ctxがキャンセルされた場合はctx.Err()を返す
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"bytes"           // キャプチャの出力先
+	"context"         // 再生の中断
+	"encoding/binary" // pcapの組み立て
+	"encoding/hex"    // 16進文字列の生成
+	"errors"          // エラーの判定
+	"testing"
+	"time" // パケットの間隔
+)
+
+// pcapに書き込むレコード。fracはマイクロ秒かナノ秒
+type pcapTestRecord struct {
+	sec, frac uint32
+	data      []byte
+}
+
+// orderのバイト順でpcapを組み立てる
+func buildPcap(order binary.ByteOrder, magic, linktype uint32, recs []pcapTestRecord) []byte {
+	b := make([]byte, PCAP_HEADER_LEN)
+	order.PutUint32(b[0:4], magic)
+	order.PutUint16(b[4:6], 2)
+	order.PutUint16(b[6:8], 4)
+	order.PutUint32(b[16:20], PCAP_MAX_RECORD_LEN)
+	order.PutUint32(b[20:24], linktype)
+	for _, r := range recs {
+		h := make([]byte, PCAP_RECORD_LEN)
+		order.PutUint32(h[0:4], r.sec)
+		order.PutUint32(h[4:8], r.frac)
+		order.PutUint32(h[8:12], uint32(len(r.data)))
+		order.PutUint32(h[12:16], uint32(len(r.data)))
+		b = append(append(b, h...), r.data...)
+	}
+	return b
+}
+
+// StartCaptureで記録したpcapを再生すると、記録したパケットが同じ順番で受信されること
+func TestReplayCaptureRoundTrip(t *testing.T) {
+	a, b := forwardPair(t)
+	var out bytes.Buffer
+	if err := a.StartCapture(&out); err != nil {
+		t.Fatal(err)
+	}
+	var sent [][]byte
+	for i := 0; i < 3; i++ {
+		p := natUDP(t, testLocal, testRemote, 1, uint16(1000+i), "recorded")
+		if err := a.WriteBytes(p); err != nil {
+			t.Fatal(err)
+		}
+		pkt := readPacket(t, b)
+		pkt.Release()
+		sent = append(sent, p)
+	}
+	if err := a.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := ReadPcap(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Len() != len(sent) {
+		t.Fatalf("%d packets in the capture, want %d", src.Len(), len(sent))
+	}
+	dev, _ := forwardPair(t)
+	n, err := src.Replay(context.Background(), dev)
+	if err != nil || n != len(sent) {
+		t.Fatalf("replayed %d packets: %v", n, err)
+	}
+	for i, want := range sent {
+		pkt := readPacket(t, dev)
+		if !bytes.Equal(pkt.Buf[:pkt.Len()], want) || pkt.Timestamp.IsZero() {
+			t.Fatalf("packet %d: got %x, want %x", i, pkt.Buf[:pkt.Len()], want)
+		}
+		pkt.Release()
+	}
+	if got := dev.Stats().RxPackets; got != uint64(len(sent)) {
+		t.Fatalf("rx packets %d, want %d", got, len(sent))
+	}
+}
+
+// ビッグエンディアンやナノ秒精度のpcapを読め、WithOriginalTimingでは記録した間隔を空けること
+func TestReadPcapFormats(t *testing.T) {
+	p1 := natUDP(t, testRemote, testLocal, 53, 1, "one")
+	p2 := natUDP(t, testRemote, testLocal, 53, 1, "two")
+	for _, tc := range []struct {
+		name  string
+		order binary.ByteOrder
+		magic uint32
+		frac  uint32 // 2つ目のパケットまでの間隔
+	}{
+		{"little endian usec", binary.LittleEndian, PCAP_MAGIC, 60000},
+		{"big endian usec", binary.BigEndian, PCAP_MAGIC, 60000},
+		{"big endian nsec", binary.BigEndian, PCAP_MAGIC_NSEC, 60000000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pcap := buildPcap(tc.order, tc.magic, LINKTYPE_RAW, []pcapTestRecord{{100, 0, p1}, {100, tc.frac, p2}})
+			src, err := ReadPcap(bytes.NewReader(pcap), WithOriginalTiming())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if src.Len() != 2 {
+				t.Fatalf("%d packets, want 2", src.Len())
+			}
+			dev, _ := forwardPair(t)
+			start := time.Now()
+			if n, err := src.Replay(context.Background(), dev); err != nil || n != 2 {
+				t.Fatalf("replayed %d packets: %v", n, err)
+			}
+			if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+				t.Fatalf("replayed in %s, want at least the recorded 60ms", elapsed)
+			}
+			for _, want := range [][]byte{p1, p2} {
+				pkt := readPacket(t, dev)
+				if !bytes.Equal(pkt.Buf[:pkt.Len()], want) {
+					t.Fatalf("got %x, want %x", pkt.Buf[:pkt.Len()], want)
+				}
+				pkt.Release()
+			}
+		})
+	}
+}
+
+// 壊れたpcapと、再生するデバイスに合わないリンク層は拒否すること
+func TestReadPcapErrors(t *testing.T) {
+	p := natUDP(t, testRemote, testLocal, 53, 1, "x")
+	valid := buildPcap(binary.LittleEndian, PCAP_MAGIC, LINKTYPE_RAW, []pcapTestRecord{{1, 0, p}})
+	for name, b := range map[string][]byte{
+		"short header":   valid[:PCAP_HEADER_LEN-1],
+		"bad magic":      append([]byte{0, 0, 0, 0}, valid[4:]...),
+		"link type":      buildPcap(binary.LittleEndian, PCAP_MAGIC, 105, nil),
+		"short record":   valid[:PCAP_HEADER_LEN+PCAP_RECORD_LEN-1],
+		"short data":     valid[:len(valid)-1],
+		"invalid length": buildPcap(binary.LittleEndian, PCAP_MAGIC, LINKTYPE_RAW, []pcapTestRecord{{1, 0, make([]byte, PCAP_MAX_RECORD_LEN+1)}}),
+	} {
+		if _, err := ReadPcap(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	eth := buildPcap(binary.LittleEndian, PCAP_MAGIC, LINKTYPE_ETHERNET, []pcapTestRecord{{1, 0, arpFrame(t)}})
+	src, err := ReadPcap(bytes.NewReader(eth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, _ := forwardPair(t)
+	if n, err := src.Replay(context.Background(), dev); err == nil || n != 0 {
+		t.Fatalf("replayed an ethernet capture into a tun device: %d %v", n, err)
+	}
+}
+
+// 16進文字列の空白を無視して再生し、キャンセルと閉じたデバイスでは止まること
+func TestHexReplaySource(t *testing.T) {
+	p := natUDP(t, testRemote, testLocal, 53, 1, "hex")
+	h := hex.EncodeToString(p)
+	src, err := NewHexReplaySource([]string{h[:20] + " \n\t" + h[20:], h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHexReplaySource([]string{h, "zz"}); err == nil {
+		t.Fatal("accepted invalid hex")
+	}
+
+	dev, _ := forwardPair(t)
+	if n, err := src.Replay(context.Background(), dev); err != nil || n != 2 {
+		t.Fatalf("replayed %d packets: %v", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		pkt := readPacket(t, dev)
+		if !bytes.Equal(pkt.Buf[:pkt.Len()], p) {
+			t.Fatalf("packet %d: got %x, want %x", i, pkt.Buf[:pkt.Len()], p)
+		}
+		pkt.Release()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := src.Replay(ctx, dev); !errors.Is(err, context.Canceled) || n != 0 {
+		t.Fatalf("cancelled replay: %d %v", n, err)
+	}
+	dev.Close()
+	if n, err := src.Replay(context.Background(), dev); !errors.Is(err, ErrDeviceClosed) || n != 0 {
+		t.Fatalf("replay into a closed device: %d %v", n, err)
+	}
+}
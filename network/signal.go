@@ -0,0 +1,41 @@
+package network
+
+import (
+	"os"        // シグナルの表現
+	"os/signal" // シグナルの受信
+	"sync"      // 解除を1度だけ行う
+	"syscall"   // SIGTERMの表現
+)
+
+// sigのいずれかを受け取った時にCloseを呼ぶ。sigを省略した場合はos.InterruptとSIGTERMを使う
+// 呼ばない限りシグナルのハンドラは登録しない。デバイスを閉じるとシグナルの受信をやめ、
+// 既にCloseが呼ばれていた場合は何もしない
+// シグナルを受け取ってもプロセスは終了しないため、終了する場合は呼び出し側でDoneなどを待つ
+// 返した関数を呼ぶとハンドラを解除する
+func (t *NetDevice) InstallSignalHandler(sig ...os.Signal) (stop func()) {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig...)
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(ch)
+		select {
+		case s := <-ch:
+			if t.ctx.Err() != nil {
+				return
+			}
+			t.logger.Infof("received %s, closing device", s)
+			if err := t.Close(); err != nil {
+				t.logger.Errorf("%s", err.Error())
+			}
+		case <-t.ctx.Done():
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,55 @@
+//go:build linux || darwin
+
+package network
+
+import (
+	"errors"  // エラーの判定
+	"os"      // プロセスID
+	"syscall" // シグナルの送信
+	"testing"
+	"time" // 待ち時間
+)
+
+// SIGINTを受け取るとCloseを呼び、その後のCloseやハンドラの解除が安全であること
+func TestInstallSignalHandler(t *testing.T) {
+	a, b := NewPipePair()
+	defer b.Close()
+	a.Bind()
+	stop := a.InstallSignalHandler()
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-a.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("device not closed after SIGINT")
+	}
+	if err := a.Err(); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("got %v, want ErrDeviceClosed", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("close after signal: %s", err)
+	}
+	stop()
+}
+
+// 手動でCloseした後に再びCloseしても、ハンドラを解除しても問題ないこと
+func TestInstallSignalHandlerManualClose(t *testing.T) {
+	a, b := NewPipePair()
+	defer b.Close()
+	a.Bind()
+	stop := a.InstallSignalHandler(syscall.SIGTERM)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("second close: %s", err)
+	}
+	stop()
+	stop()
+	if err := a.Err(); !errors.Is(err, ErrDeviceClosed) {
+		t.Fatalf("got %v, want ErrDeviceClosed", err)
+	}
+}
@@ -0,0 +1,349 @@
+package network
+
+import (
+	"fmt"         // 文字列の生成や出力、スキャン
+	"net/netip"   // アドレスとポートの表現
+	"sync/atomic" // IPv6アドレスや設定の更新
+	"time"        // タイムアウトの指定
+)
+
+// デバイスを所有し、受信したパケットを各プロトコルに振り分ける
+// IPv4ヘッダとトランスポート層のヘッダを解析し、TCPは4つ組、UDPは宛先ポートで
+// 待ち受け中のコネクションに渡す。ICMPのエコー要求には自動で応答する
+// マルチキャストはJoinGroupで参加したグループ宛てのUDPとIGMPだけを受け取る
+// IPv6はSetIPv6Addrで設定したアドレス宛てのICMPv6エコー要求にのみ応答する
+// 到達不能や時間超過などのICMPエラーはSetICMPRateLimitの上限まで送る
+type Stack struct {
+	dev   Device
+	addr  netip.Addr
+	ip    *ipv4Output
+	frag  *IPv4Reassembler
+	addr6 atomic.Pointer[netip.Addr]
+	udp   *UDP
+	tcp   *TCP
+	// 送信するICMPエラーの流量制限。UDPのポート到達不能と共有する
+	icmpLimit *tokenBucket
+	// 参加しているマルチキャストのグループ
+	igmp *igmpGroups
+	// Router Alertオプション付きのパケットを渡すフック
+	routerAlertHook atomic.Pointer[Hook]
+	// 送信元が自身のアドレスのパケットを破棄するか、と破棄した数
+	antiSpoof  atomic.Bool
+	spoofDrops atomic.Uint64
+}
+
+// addrを自身のアドレスとするStackを作成し、デバイスからの読み込みを開始する
+// デバイスはBind済みである必要がある
+func NewStack(dev Device, addr netip.Addr) (*Stack, error) {
+	if !addr.Is4() {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", addr)
+	}
+	ports, err := NewPortAllocator(EPHEMERAL_PORT_MIN, EPHEMERAL_PORT_MAX)
+	if err != nil {
+		return nil, err
+	}
+	ip := newIPv4Output(dev)
+	icmpLimit := newTokenBucket(ICMP_RATE_LIMIT)
+	igmp := newIGMPGroups()
+	s := &Stack{
+		dev:       dev,
+		addr:      addr,
+		ip:        ip,
+		udp:       newUDP(dev, ip, addr, ports, icmpLimit, igmp),
+		tcp:       newTCP(dev, ip, addr, ports),
+		icmpLimit: icmpLimit,
+		igmp:      igmp,
+	}
+	s.frag = NewIPv4Reassembler(IPV4_REASSEMBLY_TIMEOUT, s.reassemblyTimeout)
+	go s.readLoop()
+	return s, nil
+}
+
+// 自身のアドレスを返す
+func (s *Stack) Addr() netip.Addr {
+	return s.addr
+}
+
+// IPv6アドレスを設定する
+func (s *Stack) SetIPv6Addr(addr netip.Addr) error {
+	if !addr.Is6() || addr.Is4In6() {
+		return fmt.Errorf("invalid ipv6 address: %s", addr)
+	}
+	s.addr6.Store(&addr)
+	return nil
+}
+
+// 送信に用いるMTUを返す
+func (s *Stack) MTU() int {
+	return int(s.ip.mtu.Load())
+}
+
+// デバイスのMTUを変更し、以降の送信でそのMTUを超えるパケットをフラグメントに分割する
+// SetPMTUDでDFを立てているTCPのコネクションは、分割する代わりにMSSを下げて送り直す
+func (s *Stack) SetMTU(mtu int) error {
+	if err := s.dev.SetMTU(mtu); err != nil {
+		return err
+	}
+	s.ip.mtu.Store(int32(mtu))
+	return nil
+}
+
+// 送信するICMPエラー（到達不能、時間超過）の1秒あたりの上限を設定する。既定はICMP_RATE_LIMIT
+// 0以下の場合は制限しない。上限を超えたエラーは送らずに破棄する。エコー応答は制限しない
+func (s *Stack) SetICMPRateLimit(perSecond int) {
+	s.icmpLimit.setRate(perSecond)
+}
+
+// 流量制限の範囲でICMPエラーを送る
+func (s *Stack) sendICMPError(pkt Packet) {
+	if s.icmpLimit.allow() {
+		s.dev.WritePacket(pkt)
+	}
+}
+
+// TCPの層を返す
+func (s *Stack) TCP() *TCP {
+	return s.tcp
+}
+
+// UDPの層を返す
+func (s *Stack) UDP() *UDP {
+	return s.udp
+}
+
+// portでTCPの接続を待ち受ける
+func (s *Stack) ListenTCP(port uint16) (*TCPListener, error) {
+	return s.tcp.Listen(port)
+}
+
+// dstにTCPで接続する
+func (s *Stack) DialTCP(dst netip.AddrPort) (*TCPConn, error) {
+	return s.tcp.Dial(dst)
+}
+
+// dstにTCPで接続する。timeoutまでに確立しなければエラーを返す
+func (s *Stack) DialTCPTimeout(dst netip.AddrPort, timeout time.Duration) (*TCPConn, error) {
+	return s.tcp.DialTimeout(dst, timeout)
+}
+
+// TCPのコネクションの一覧を返す。デバッグや管理用の表示に使う
+func (s *Stack) Connections() []ConnInfo {
+	return s.tcp.Connections()
+}
+
+// portでUDPのデータグラムを待ち受ける
+func (s *Stack) ListenUDP(port uint16) (*UDPConn, error) {
+	return s.udp.Listen(port)
+}
+
+// デバイスを閉じ、読み込みを停止する
+func (s *Stack) Close() error {
+	s.frag.Close()
+	s.igmp.close()
+	return s.dev.Close()
+}
+
+func (s *Stack) readLoop() {
+	for {
+		pkt, err := s.dev.ReadPacket()
+		if err != nil {
+			return
+		}
+		s.input(pkt.Buf[:pkt.Len()])
+		// 各層は保持する必要のあるデータをコピーするため、処理後すぐに返却できる
+		pkt.Release()
+	}
+}
+
+// 受信したIPパケットをバージョンとプロトコル番号で振り分ける
+func (s *Stack) input(b []byte) {
+	if len(b) > 0 && b[0]>>4 == IPV6_VERSION {
+		s.input6(b)
+		return
+	}
+	ip, payload, err := ParseIPv4(b)
+	if err != nil {
+		return
+	}
+	if src, _ := netip.AddrFromSlice(ip.Src.To4()); src == s.addr && s.spoofed() {
+		return
+	}
+	if _, ok := ip.Option(IPV4_OPT_ROUTER_ALERT); ok {
+		if ip, payload, ok = s.routerAlert(b, ip, payload); !ok {
+			return
+		}
+	}
+	dst, _ := netip.AddrFromSlice(ip.Dst.To4())
+	multicast := dst.IsMulticast()
+	if dst != s.addr && !(multicast && s.igmp.isMember(dst)) {
+		return
+	}
+	if ip.Flags&IPV4_FLAG_MF != 0 || ip.FragOffset != 0 {
+		var ok bool
+		ip, payload, ok = s.frag.Add(ip, payload)
+		if !ok {
+			return
+		}
+	}
+	if multicast {
+		// マルチキャストにはICMPエラーを返さない（RFC 1122 3.2.2）
+		switch ip.Protocol {
+		case PROTOCOL_UDP:
+			s.udp.deliver(ip, payload)
+		case PROTOCOL_IGMP:
+			s.handleIGMP(payload)
+		}
+		return
+	}
+	switch ip.Protocol {
+	case PROTOCOL_TCP:
+		s.tcp.deliver(ip, payload)
+	case PROTOCOL_UDP:
+		s.udp.deliver(ip, payload)
+	case PROTOCOL_ICMP:
+		s.handleICMP(ip, payload)
+	case PROTOCOL_IGMP:
+		s.handleIGMP(payload)
+	default:
+		if reply, err := BuildDestUnreachable(ip, payload, ICMP_CODE_PROTOCOL_UNREACHABLE); err == nil {
+			s.sendICMPError(reply)
+		}
+	}
+}
+
+// Router Alertオプション付きのパケットを受け取るフックを設定する。nilで解除する
+// 宛先に関わらず、自身宛ての判定や各プロトコルへの振り分けの前に呼び出す
+// HookDropを返すとそれ以上処理せず、HookModifyを返すと返したパケットを代わりに処理する
+func (s *Stack) SetRouterAlertHook(h Hook) {
+	if h == nil {
+		s.routerAlertHook.Store(nil)
+		return
+	}
+	s.routerAlertHook.Store(&h)
+}
+
+// Router Alertのフックを適用する。破棄する場合はfalseを返す
+func (s *Stack) routerAlert(b []byte, ip *IPv4Header, payload []byte) (*IPv4Header, []byte, bool) {
+	h := s.routerAlertHook.Load()
+	if h == nil {
+		return ip, payload, true
+	}
+	action, pkt := (*h)(Packet{Buf: b, N: uintptr(len(b))})
+	switch action {
+	case HookDrop:
+		return nil, nil, false
+	case HookModify:
+		ip, payload, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+		return ip, payload, err == nil
+	}
+	return ip, payload, true
+}
+
+// 再構築が時間内に終わらなかったデータグラムの送信元にICMP時間超過を返す
+func (s *Stack) reassemblyTimeout(first *IPv4Header, payload []byte) {
+	pkt, err := buildICMPError(ICMPMessage{Type: ICMP_TYPE_TIME_EXCEEDED, Code: ICMP_CODE_REASSEMBLY_EXCEEDED}, first, payload)
+	if err != nil {
+		return
+	}
+	s.sendICMPError(pkt)
+}
+
+// 受信したIPv6パケットを処理する。現状はICMPv6のエコー要求にのみ応答する
+func (s *Stack) input6(b []byte) {
+	addr6 := s.addr6.Load()
+	if addr6 == nil {
+		return
+	}
+	ip, payload, err := ParseIPv6(b)
+	if err != nil {
+		return
+	}
+	if src, _ := netip.AddrFromSlice(ip.Src); src == *addr6 && s.spoofed() {
+		return
+	}
+	dst, _ := netip.AddrFromSlice(ip.Dst)
+	if dst != *addr6 || ip.Protocol != PROTOCOL_ICMPV6 {
+		return
+	}
+	msg, err := ParseICMPv6(payload, ip)
+	if err != nil || msg.Type != ICMPV6_TYPE_ECHO_REQUEST {
+		return
+	}
+	reply, err := BuildEchoReplyV6(*msg, ip)
+	if err != nil {
+		return
+	}
+	s.dev.WritePacket(reply)
+}
+
+// ICMPのフラグメント化要求を送信元のTCPコネクションに伝える（RFC 1191）
+func (s *Stack) handleFragmentationNeeded(msg *ICMPMessage) {
+	orig, transport, err := ParseICMPErrorOrigin(msg.Data)
+	if err != nil || orig.Protocol != PROTOCOL_TCP {
+		return
+	}
+	src, _ := netip.AddrFromSlice(orig.Src.To4())
+	if src != s.addr {
+		return
+	}
+	// 次ホップのMTUはヘッダの残り4バイトの下位16ビット
+	s.tcp.handlePathMTU(orig, transport, int(msg.Seq))
+}
+
+// 送信元が自身のアドレス（IPv4とSetIPv6Addrのアドレス）のパケットを破棄するかを設定する。既定は無効
+// 自身が送ったパケットがデバイスに戻ってきた場合はループ、そうでなければ送信元の詐称であることが多いため、
+// ゲートウェイやNATとして動かす場合に有効にする。自身宛ての送信はデバイスを経由しないため影響しない
+func (s *Stack) SetAntiSpoof(enabled bool) {
+	s.antiSpoof.Store(enabled)
+}
+
+// SetAntiSpoofで破棄したパケット数を返す
+func (s *Stack) SpoofDrops() uint64 {
+	return s.spoofDrops.Load()
+}
+
+// 送信元が自身のアドレスのパケットを破棄する場合は数えてtrueを返す
+func (s *Stack) spoofed() bool {
+	if !s.antiSpoof.Load() {
+		return false
+	}
+	s.spoofDrops.Add(1)
+	return true
+}
+
+// Path MTU Discoveryの有効・無効を切り替える
+// 有効にすると送信するTCPセグメントにDFを立て、ICMPのフラグメント化要求を受けてMSSを下げる
+func (s *Stack) SetPMTUD(enabled bool) {
+	s.tcp.pmtud.Store(enabled)
+}
+
+// 初期シーケンス番号の生成関数を設定する。以降のDialとLISTENで受け付けるコネクションで使う
+// 既定はRFC 6528の方式（4つ組と秘密鍵のハッシュに時刻を加える）で、nilを渡すと既定に戻す
+// テストで固定のISNを使う場合などに設定する
+func (s *Stack) SetISNGenerator(f func() uint32) {
+	if f == nil {
+		s.tcp.isnFunc.Store(nil)
+		return
+	}
+	s.tcp.isnFunc.Store(&f)
+}
+
+// ICMPのエコー要求に応答する
+func (s *Stack) handleICMP(ip *IPv4Header, payload []byte) {
+	msg, err := ParseICMP(payload)
+	if err != nil {
+		return
+	}
+	if msg.Type == ICMP_TYPE_DEST_UNREACHABLE && msg.Code == ICMP_CODE_FRAGMENTATION_NEEDED {
+		s.handleFragmentationNeeded(msg)
+		return
+	}
+	if msg.Type != ICMP_TYPE_ECHO_REQUEST {
+		return
+	}
+	reply, err := BuildEchoReply(*msg, ip)
+	if err != nil {
+		return
+	}
+	s.dev.WritePacket(reply)
+}
@@ -0,0 +1,55 @@
+package network
+
+import (
+	"errors" // エラーの判定
+	"os"     // タイムアウトのエラー
+	"testing"
+	"time" // 読み込みの期限
+)
+
+// 送信元が自身のアドレスのパケットは、SetAntiSpoofを有効にした場合だけ破棄して数えること
+func TestAntiSpoof(t *testing.T) {
+	s, peer := rawPeer(t)
+	c, err := s.ListenUDP(53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	recv := func() (string, error) {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		b, _, err := c.ReadFromAddrPort()
+		return string(b), err
+	}
+	send := func(payload string) {
+		t.Helper()
+		if err := peer.WriteBytes(natUDP(t, rawStackIP, rawStackIP, 40000, 53, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 既定では処理する
+	send("looped")
+	if got, err := recv(); err != nil || got != "looped" {
+		t.Fatalf("got %q %v with anti-spoof disabled", got, err)
+	}
+
+	s.SetAntiSpoof(true)
+	send("spoofed")
+	if got, err := recv(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("received %q with anti-spoof enabled", got)
+	}
+	if got := s.SpoofDrops(); got != 1 {
+		t.Fatalf("spoof drops %d, want 1", got)
+	}
+	// 他の送信元からは今まで通り届く
+	if err := peer.WriteBytes(natUDP(t, rawPeerIP, rawStackIP, 40000, 53, "peer")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := recv(); err != nil || got != "peer" {
+		t.Fatalf("got %q %v from the peer", got, err)
+	}
+	if got := s.SpoofDrops(); got != 1 {
+		t.Fatalf("spoof drops %d after a legitimate packet, want 1", got)
+	}
+}
@@ -0,0 +1,139 @@
+package network
+
+import (
+	"encoding/binary" // EtherTypeの読み取り
+	"sync/atomic"     // カウンタの更新
+)
+
+// プロトコルごとのパケット数
+type ProtocolStats struct {
+	ICMP  uint64 // ICMPとICMPv6
+	TCP   uint64
+	UDP   uint64
+	Other uint64
+}
+
+// デバイスの送受信の統計
+type Stats struct {
+	RxPackets uint64
+	TxPackets uint64
+	RxBytes   uint64
+	TxBytes   uint64
+	// 読み込みに失敗したパケット数
+	RxDrops uint64
+	// 書き込みに失敗したパケット数
+	TxDrops uint64
+	// フックが破棄したパケット数
+	RxFiltered uint64
+	TxFiltered uint64
+	// 読み込みバッファに収まらず切り詰められたパケット数
+	RxTruncated uint64
+	// 最小のヘッダより短く、上位層に渡さずに破棄したパケット数
+	RxRunt      uint64
+	RxProtocols ProtocolStats
+	TxProtocols ProtocolStats
+}
+
+type protocolCounters struct {
+	icmp, tcp, udp, other atomic.Uint64
+}
+
+// 送受信の経路で更新するカウンタ
+type deviceStats struct {
+	rxPackets, txPackets   atomic.Uint64
+	rxBytes, txBytes       atomic.Uint64
+	rxDrops, txDrops       atomic.Uint64
+	rxFiltered, txFiltered atomic.Uint64
+	rxTruncated            atomic.Uint64
+	rxRunt                 atomic.Uint64
+	rx, tx                 protocolCounters
+}
+
+// 統計のスナップショットを返す
+// 各カウンタは個別にアトミックに読み取るため、カウンタ間の厳密な整合性は保証しない
+func (t *NetDevice) Stats() Stats {
+	s := &t.stats
+	return Stats{
+		RxPackets:   s.rxPackets.Load(),
+		TxPackets:   s.txPackets.Load(),
+		RxBytes:     s.rxBytes.Load(),
+		TxBytes:     s.txBytes.Load(),
+		RxDrops:     s.rxDrops.Load(),
+		TxDrops:     s.txDrops.Load(),
+		RxFiltered:  s.rxFiltered.Load(),
+		TxFiltered:  s.txFiltered.Load(),
+		RxTruncated: s.rxTruncated.Load(),
+		RxRunt:      s.rxRunt.Load(),
+		RxProtocols: s.rx.snapshot(),
+		TxProtocols: s.tx.snapshot(),
+	}
+}
+
+func (c *protocolCounters) snapshot() ProtocolStats {
+	return ProtocolStats{
+		ICMP:  c.icmp.Load(),
+		TCP:   c.tcp.Load(),
+		UDP:   c.udp.Load(),
+		Other: c.other.Load(),
+	}
+}
+
+// パケットをプロトコルごとに数える
+func (c *protocolCounters) count(b []byte, mode Mode) {
+	switch packetProtocol(b, mode) {
+	case PROTOCOL_ICMP, PROTOCOL_ICMPV6:
+		c.icmp.Add(1)
+	case PROTOCOL_TCP:
+		c.tcp.Add(1)
+	case PROTOCOL_UDP:
+		c.udp.Add(1)
+	default:
+		c.other.Add(1)
+	}
+}
+
+func (s *deviceStats) received(pkt Packet, mode Mode) {
+	if pkt.Truncated {
+		s.rxTruncated.Add(1)
+	}
+	b := pkt.Buf[:pkt.Len()]
+	s.rxPackets.Add(1)
+	s.rxBytes.Add(uint64(len(b)))
+	s.rx.count(b, mode)
+}
+
+func (s *deviceStats) sent(b []byte, mode Mode) {
+	s.txPackets.Add(1)
+	s.txBytes.Add(uint64(len(b)))
+	s.tx.count(b, mode)
+}
+
+// ヘッダを解析せずにIPのプロトコル番号を取り出す
+// IPv6は固定ヘッダの次ヘッダを返す。IPでなければ0xffを返す
+func packetProtocol(b []byte, mode Mode) uint8 {
+	if mode == ModeTAP {
+		if len(b) < ETHERNET_HEADER_LEN {
+			return 0xff
+		}
+		switch binary.BigEndian.Uint16(b[12:14]) {
+		case ETHERTYPE_IPV4, ETHERTYPE_IPV6:
+		default:
+			return 0xff
+		}
+		b = b[ETHERNET_HEADER_LEN:]
+	}
+	if len(b) == 0 {
+		return 0xff
+	}
+	switch b[0] >> 4 {
+	case IPV4_VERSION:
+		if len(b) >= IPV4_MIN_HEADER_LEN {
+			return b[9]
+		}
+	case IPV6_VERSION:
+		if len(b) >= IPV6_HEADER_LEN {
+			return b[6]
+		}
+	}
+	return 0xff
+}
@@ -0,0 +1,115 @@
+package network
+
+import (
+	"net"  // MACアドレスの表現
+	"sync" // 並行した書き込み
+	"testing"
+)
+
+// 既知のパケットを送受信し、方向ごと・プロトコルごとの数とバイト数が一致すること
+func TestStatsCounts(t *testing.T) {
+	a, b := forwardPair(t)
+	igmp := IPv4Header{TTL: 1, Protocol: PROTOCOL_IGMP, Src: testLocal, Dst: net.IPv4(224, 0, 0, 22)}
+	other, err := igmp.MarshalWithPayload(make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := [][]byte{
+		tcpPacket(t, testLocal, testRemote, TCPHeader{SrcPort: 1, DstPort: 2, Flags: TCP_FLAG_SYN}, nil),
+		tcpPacket(t, testLocal, testRemote, TCPHeader{SrcPort: 1, DstPort: 2, Flags: TCP_FLAG_ACK}, []byte("data")),
+		natUDP(t, testLocal, testRemote, 1, 53, "a"),
+		natUDP(t, testLocal, testRemote, 1, 53, "bb"),
+		natUDP(t, testLocal, testRemote, 1, 53, "ccc"),
+		decodeHex(t, ipv6EchoRequest),
+		other,
+	}
+	var total uint64
+	for _, p := range packets {
+		if err := a.WriteBytes(p); err != nil {
+			t.Fatal(err)
+		}
+		total += uint64(len(p))
+	}
+	for range packets {
+		pkt := readPacket(t, b)
+		pkt.Release()
+	}
+
+	want := ProtocolStats{ICMP: 1, TCP: 2, UDP: 3, Other: 1}
+	tx := a.Stats()
+	if tx.TxPackets != uint64(len(packets)) || tx.TxBytes != total || tx.TxProtocols != want {
+		t.Fatalf("tx %d packets %d bytes %+v, want %d %d %+v", tx.TxPackets, tx.TxBytes, tx.TxProtocols, len(packets), total, want)
+	}
+	if tx.RxPackets != 0 || tx.TxDrops != 0 {
+		t.Fatalf("sender rx %d packets, tx drops %d", tx.RxPackets, tx.TxDrops)
+	}
+	rx := b.Stats()
+	if rx.RxPackets != uint64(len(packets)) || rx.RxBytes != total || rx.RxProtocols != want {
+		t.Fatalf("rx %d packets %d bytes %+v, want %d %d %+v", rx.RxPackets, rx.RxBytes, rx.RxProtocols, len(packets), total, want)
+	}
+	if rx.TxPackets != 0 || rx.RxDrops != 0 {
+		t.Fatalf("receiver tx %d packets, rx drops %d", rx.TxPackets, rx.RxDrops)
+	}
+}
+
+// 並行して書き込んでもカウンタが失われないこと
+func TestStatsConcurrent(t *testing.T) {
+	a, b := forwardPair(t)
+	const writers, each = 8, 50
+	p := natUDP(t, testLocal, testRemote, 1, 53, "x")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < writers*each; i++ {
+			pkt, err := b.ReadPacket()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pkt.Release()
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if err := a.WriteBytes(p); err != nil {
+					t.Error(err)
+					return
+				}
+				a.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+	if s := a.Stats(); s.TxPackets != writers*each || s.TxProtocols.UDP != writers*each || s.TxBytes != uint64(writers*each*len(p)) {
+		t.Fatalf("tx %d packets %d udp %d bytes", s.TxPackets, s.TxProtocols.UDP, s.TxBytes)
+	}
+	if s := b.Stats(); s.RxPackets != writers*each {
+		t.Fatalf("rx %d packets, want %d", s.RxPackets, writers*each)
+	}
+}
+
+// TAPモードではEthernetヘッダの先のプロトコルを数え、ARPはその他として数えること
+func TestPacketProtocolTAP(t *testing.T) {
+	eth := EthernetHeader{Dst: arpPeerMAC, Src: arpLocalMAC, EtherType: ETHERTYPE_IPV4}
+	frame, err := eth.MarshalWithPayload(natUDP(t, testLocal, testRemote, 1, 53, "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := packetProtocol(frame, ModeTAP); got != PROTOCOL_UDP {
+		t.Fatalf("protocol %d, want udp", got)
+	}
+	if got := packetProtocol(arpFrame(t), ModeTAP); got != 0xff {
+		t.Fatalf("arp protocol %d, want 0xff", got)
+	}
+	if got := packetProtocol(frame, ModeTUN); got != 0xff {
+		t.Fatalf("ethernet frame in tun mode: protocol %d, want 0xff", got)
+	}
+	if got := packetProtocol(nil, ModeTUN); got != 0xff {
+		t.Fatalf("empty packet: protocol %d", got)
+	}
+}
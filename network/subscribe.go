@@ -0,0 +1,155 @@
+package network
+
+import (
+	"fmt"  // 文字列の生成や出力、スキャン
+	"sync" // 購読者の管理
+)
+
+// キューが一杯のときの扱い
+type OverflowPolicy int
+
+const (
+	DropNewest OverflowPolicy = iota // 新しく届いたパケットを破棄する
+	DropOldest                       // キューの先頭（最も古い）パケットを破棄して新しいパケットを入れる
+	Block                            // 空きができるまで待つ
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// Subscribeに渡すオプション
+type SubscribeOption func(*subscriber)
+
+// 購読者のキューのバッファ数を指定する。既定はQUEUE_SIZE
+func SubscribeQueueSize(n int) SubscribeOption {
+	return func(s *subscriber) {
+		if n >= 0 {
+			s.size = n
+		}
+	}
+}
+
+// 購読者のキューが一杯のときの扱いを指定する。既定はDropNewest
+// Blockを指定すると、その購読者が受け取るまで読み込みのゴルーチンが止まる
+func SubscribePolicy(p OverflowPolicy) SubscribeOption {
+	return func(s *subscriber) {
+		s.policy = p
+	}
+}
+
+type subscriber struct {
+	ch     chan Packet
+	done   chan struct{}
+	once   sync.Once
+	size   int
+	policy OverflowPolicy
+}
+
+// 受信したすべてのパケットのコピーを受け取るチャネルを登録する
+// 返された関数を呼ぶと登録を解除し、チャネルを閉じる。デバイスが閉じられた場合もチャネルは閉じられる
+// 購読者に渡すパケットはプールを使わないコピーのため、Releaseは不要で保持し続けてもよい
+// ReadPacketなどの通常の読み込みには影響しない
+func (t *NetDevice) Subscribe(opts ...SubscribeOption) (<-chan Packet, func()) {
+	s := &subscriber{
+		done:   make(chan struct{}),
+		size:   QUEUE_SIZE,
+		policy: DropNewest,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.ch = make(chan Packet, s.size)
+
+	t.subsMu.Lock()
+	if t.subsClosed {
+		t.subsMu.Unlock()
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	if t.subs == nil {
+		t.subs = make(map[*subscriber]struct{})
+	}
+	t.subs[s] = struct{}{}
+	t.subsMu.Unlock()
+
+	return s.ch, func() { t.unsubscribe(s) }
+}
+
+func (t *NetDevice) unsubscribe(s *subscriber) {
+	s.once.Do(func() {
+		// Blockで送信を待っている読み込みのゴルーチンを先に解放する
+		close(s.done)
+		t.subsMu.Lock()
+		if _, ok := t.subs[s]; ok {
+			delete(t.subs, s)
+			close(s.ch)
+		}
+		t.subsMu.Unlock()
+	})
+}
+
+// 受信したパケットを購読者に配る
+func (t *NetDevice) fanOut(pkt Packet) {
+	t.subsMu.RLock()
+	defer t.subsMu.RUnlock()
+	if len(t.subs) == 0 {
+		return
+	}
+	for s := range t.subs {
+		buf := append([]byte(nil), pkt.Buf[:pkt.Len()]...)
+		s.send(Packet{Buf: buf, N: uintptr(len(buf))}, t.ctx.Done())
+	}
+}
+
+func (s *subscriber) send(pkt Packet, cancel <-chan struct{}) {
+	switch s.policy {
+	case Block:
+		select {
+		case s.ch <- pkt:
+		case <-s.done:
+		case <-cancel:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- pkt:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+			default:
+				// バッファ数0のキューでは受け取る相手がいなければ破棄する
+				if cap(s.ch) == 0 {
+					return
+				}
+			}
+		}
+	default:
+		select {
+		case s.ch <- pkt:
+		default:
+		}
+	}
+}
+
+// デバイスが閉じられたときにすべての購読者のチャネルを閉じる
+func (t *NetDevice) closeSubscribers() {
+	t.subsMu.Lock()
+	defer t.subsMu.Unlock()
+	t.subsClosed = true
+	for s := range t.subs {
+		delete(t.subs, s)
+		close(s.ch)
+	}
+}
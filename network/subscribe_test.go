@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bytes" // データの比較
+	"testing"
+	"time" // 受信の期限
+)
+
+// 購読者のチャネルから1つ受け取る
+func recvSub(t *testing.T, ch <-chan Packet) Packet {
+	t.Helper()
+	select {
+	case pkt, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return pkt
+	case <-time.After(2 * time.Second):
+		t.Fatal("no packet for subscriber")
+	}
+	return Packet{}
+}
+
+// 2つの購読者と通常の読み込みが同じパケットを受け取り、それぞれが独立したコピーであること
+func TestSubscribeFanOut(t *testing.T) {
+	a, b := forwardPair(t)
+	s1, stop1 := b.Subscribe()
+	defer stop1()
+	s2, stop2 := b.Subscribe()
+	defer stop2()
+
+	var sent [][]byte
+	for _, p := range []string{"one", "two", "three"} {
+		pkt := natUDP(t, testLocal, testRemote, 1, 53, p)
+		if err := a.WriteBytes(pkt); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, pkt)
+	}
+	for i, want := range sent {
+		p1, p2 := recvSub(t, s1), recvSub(t, s2)
+		r := readPacket(t, b)
+		for name, got := range map[string][]byte{"sub1": p1.Buf[:p1.Len()], "sub2": p2.Buf[:p2.Len()], "read": r.Buf[:r.Len()]} {
+			if !bytes.Equal(got, want) {
+				t.Fatalf("packet %d %s: got %x, want %x", i, name, got, want)
+			}
+		}
+		// 1つを書き換えても他には影響しない
+		p1.Buf[0] = 0
+		if p2.Buf[0] != want[0] || r.Buf[0] != want[0] {
+			t.Fatal("subscribers share a buffer")
+		}
+		r.Release()
+	}
+
+	// 解除したチャネルは閉じられ、残りの購読者は受け取り続ける
+	stop1()
+	stop1()
+	if _, ok := <-s1; ok {
+		t.Fatal("channel open after unsubscribe")
+	}
+	if err := a.WriteBytes(sent[0]); err != nil {
+		t.Fatal(err)
+	}
+	recvSub(t, s2)
+	pkt := readPacket(t, b)
+	pkt.Release()
+}
+
+// 遅い購読者は方針に従って破棄し、他の購読者や通常の読み込みを止めないこと
+func TestSubscribeSlowConsumer(t *testing.T) {
+	a, b := forwardPair(t)
+	newest, stopNewest := b.Subscribe(SubscribeQueueSize(1))
+	defer stopNewest()
+	oldest, stopOldest := b.Subscribe(SubscribeQueueSize(1), SubscribePolicy(DropOldest))
+	defer stopOldest()
+	fast, stopFast := b.Subscribe()
+	defer stopFast()
+
+	var sent [][]byte
+	for i := 0; i < 5; i++ {
+		p := natUDP(t, testLocal, testRemote, 1, uint16(100+i), "x")
+		if err := a.WriteBytes(p); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, p)
+	}
+	for i := range sent {
+		pkt := readPacket(t, b)
+		pkt.Release()
+		if got := recvSub(t, fast); !bytes.Equal(got.Buf, sent[i]) {
+			t.Fatalf("fast subscriber packet %d differs", i)
+		}
+	}
+	if got := recvSub(t, newest); !bytes.Equal(got.Buf, sent[0]) {
+		t.Fatalf("drop-newest kept %x, want the first packet", got.Buf)
+	}
+	if got := recvSub(t, oldest); !bytes.Equal(got.Buf, sent[len(sent)-1]) {
+		t.Fatalf("drop-oldest kept %x, want the last packet", got.Buf)
+	}
+}
+
+// Blockの購読者を解除すると読み込みのゴルーチンが再開すること
+func TestSubscribeBlockUnsubscribe(t *testing.T) {
+	a, b := forwardPair(t)
+	_, stop := b.Subscribe(SubscribeQueueSize(0), SubscribePolicy(Block))
+	if err := a.WriteBytes(natUDP(t, testLocal, testRemote, 1, 53, "blocked")); err != nil {
+		t.Fatal(err)
+	}
+	expectNoPacket(t, b)
+	stop()
+	pkt := readPacket(t, b)
+	pkt.Release()
+}
+
+// デバイスを閉じると購読者のチャネルも閉じ、閉じた後の購読は閉じたチャネルを返すこと
+func TestSubscribeClose(t *testing.T) {
+	a, b := NewPipePair()
+	defer b.Close()
+	a.Bind()
+	ch, stop := a.Subscribe()
+	a.Close()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("received a packet after close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel not closed by Close")
+	}
+	stop()
+	ch, stop = a.Subscribe()
+	if _, ok := <-ch; ok {
+		t.Fatal("subscription after close is open")
+	}
+	stop()
+}
@@ -0,0 +1,233 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+	"strings"         // フラグの文字列表現
+)
+
+const (
+	TCP_MIN_HEADER_LEN = 20
+	TCP_MAX_HEADER_LEN = 60
+)
+
+// TCPのフラグ
+const (
+	TCP_FLAG_FIN = 0x01
+	TCP_FLAG_SYN = 0x02
+	TCP_FLAG_RST = 0x04
+	TCP_FLAG_PSH = 0x08
+	TCP_FLAG_ACK = 0x10
+	TCP_FLAG_URG = 0x20
+)
+
+// TCPオプションの種類
+const (
+	TCP_OPT_EOL            = 0
+	TCP_OPT_NOP            = 1
+	TCP_OPT_MSS            = 2
+	TCP_OPT_WINDOW_SCALE   = 3
+	TCP_OPT_SACK_PERMITTED = 4
+	TCP_OPT_SACK           = 5
+	TCP_OPT_TIMESTAMPS     = 8
+)
+
+// 1つのSACKオプションに入るブロックの最大数（40バイトのオプション領域に収まる数）
+const TCP_MAX_SACK_BLOCKS = 4
+
+// SACKのブロック。受信済みの範囲[Left, Right)を表す（RFC 2018）
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// TCPオプション
+// 認識しないオプションは解析時に読み飛ばす
+type TCPOptions struct {
+	MSS            uint16 // 0の場合はオプション無し
+	HasWindowScale bool
+	WindowScale    uint8
+	SACKPermitted  bool
+	SACKBlocks     []SACKBlock
+	HasTimestamps  bool
+	TSVal          uint32
+	TSEcr          uint32
+}
+
+// TCPヘッダ
+type TCPHeader struct {
+	SrcPort    uint16
+	DstPort    uint16
+	Seq        uint32
+	Ack        uint32
+	DataOffset uint8 // ヘッダ長（4バイト単位）
+	Flags      uint8
+	Window     uint16
+	Checksum   uint16
+	Urgent     uint16
+	Options    TCPOptions
+}
+
+// TCPヘッダを解析し、ヘッダとペイロードを返す
+// チェックサムはipの送信元・宛先を使った疑似ヘッダで検証する
+func ParseTCP(b []byte, ip *IPv4Header) (*TCPHeader, []byte, error) {
+	return parseTCP(b, ip, true)
+}
+
+// verifyがfalseの場合はチェックサムを検証しない（チェックサムオフロードで未計算のまま届いた場合）
+func parseTCP(b []byte, ip *IPv4Header, verify bool) (*TCPHeader, []byte, error) {
+	if len(b) < TCP_MIN_HEADER_LEN {
+		return nil, nil, fmt.Errorf("invalid tcp header: too short (%d bytes)", len(b))
+	}
+	h := &TCPHeader{
+		SrcPort:    binary.BigEndian.Uint16(b[0:2]),
+		DstPort:    binary.BigEndian.Uint16(b[2:4]),
+		Seq:        binary.BigEndian.Uint32(b[4:8]),
+		Ack:        binary.BigEndian.Uint32(b[8:12]),
+		DataOffset: b[12] >> 4,
+		Flags:      b[13],
+		Window:     binary.BigEndian.Uint16(b[14:16]),
+		Checksum:   binary.BigEndian.Uint16(b[16:18]),
+		Urgent:     binary.BigEndian.Uint16(b[18:20]),
+	}
+	hlen := h.HeaderLen()
+	if hlen < TCP_MIN_HEADER_LEN || hlen > len(b) {
+		return nil, nil, fmt.Errorf("invalid tcp header: data offset %d (segment %d bytes)", h.DataOffset, len(b))
+	}
+	if verify && transportChecksum(ip.Src, ip.Dst, PROTOCOL_TCP, b) != 0 {
+		return nil, nil, fmt.Errorf("invalid tcp header: %w", ErrBadChecksum)
+	}
+	opts, err := parseTCPOptions(b[TCP_MIN_HEADER_LEN:hlen])
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Options = opts
+	return h, b[hlen:], nil
+}
+
+func parseTCPOptions(b []byte) (TCPOptions, error) {
+	var opts TCPOptions
+	for i := 0; i < len(b); {
+		kind := b[i]
+		switch kind {
+		case TCP_OPT_EOL:
+			return opts, nil
+		case TCP_OPT_NOP:
+			i++
+			continue
+		}
+		if i+1 >= len(b) || b[i+1] < 2 || i+int(b[i+1]) > len(b) {
+			return opts, fmt.Errorf("invalid tcp option: kind %d at offset %d", kind, i)
+		}
+		length := int(b[i+1])
+		data := b[i+2 : i+length]
+		switch {
+		case kind == TCP_OPT_MSS && length == 4:
+			opts.MSS = binary.BigEndian.Uint16(data)
+		case kind == TCP_OPT_WINDOW_SCALE && length == 3:
+			opts.HasWindowScale = true
+			opts.WindowScale = data[0]
+		case kind == TCP_OPT_SACK_PERMITTED && length == 2:
+			opts.SACKPermitted = true
+		case kind == TCP_OPT_SACK && length > 2 && (length-2)%8 == 0:
+			for j := 0; j < len(data); j += 8 {
+				opts.SACKBlocks = append(opts.SACKBlocks, SACKBlock{
+					Left:  binary.BigEndian.Uint32(data[j : j+4]),
+					Right: binary.BigEndian.Uint32(data[j+4 : j+8]),
+				})
+			}
+		case kind == TCP_OPT_TIMESTAMPS && length == 10:
+			opts.HasTimestamps = true
+			opts.TSVal = binary.BigEndian.Uint32(data[0:4])
+			opts.TSEcr = binary.BigEndian.Uint32(data[4:8])
+		}
+		i += length
+	}
+	return opts, nil
+}
+
+// オプションをバイト列に変換する。長さが4の倍数になるようNOPとEOLで埋める
+func (o *TCPOptions) marshal() []byte {
+	var b []byte
+	if o.MSS != 0 {
+		b = append(b, TCP_OPT_MSS, 4, byte(o.MSS>>8), byte(o.MSS))
+	}
+	if o.HasWindowScale {
+		b = append(b, TCP_OPT_NOP, TCP_OPT_WINDOW_SCALE, 3, o.WindowScale)
+	}
+	if o.SACKPermitted {
+		b = append(b, TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_SACK_PERMITTED, 2)
+	}
+	if n := len(o.SACKBlocks); n > 0 {
+		if n > TCP_MAX_SACK_BLOCKS {
+			n = TCP_MAX_SACK_BLOCKS
+		}
+		b = append(b, TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_SACK, byte(2+8*n))
+		for _, blk := range o.SACKBlocks[:n] {
+			b = binary.BigEndian.AppendUint32(b, blk.Left)
+			b = binary.BigEndian.AppendUint32(b, blk.Right)
+		}
+	}
+	if o.HasTimestamps {
+		b = append(b, TCP_OPT_NOP, TCP_OPT_NOP, TCP_OPT_TIMESTAMPS, 10)
+		b = binary.BigEndian.AppendUint32(b, o.TSVal)
+		b = binary.BigEndian.AppendUint32(b, o.TSEcr)
+	}
+	for len(b)%4 != 0 {
+		b = append(b, TCP_OPT_EOL)
+	}
+	return b
+}
+
+// ヘッダ長をバイト単位で返す
+func (h *TCPHeader) HeaderLen() int {
+	return int(h.DataOffset) * 4
+}
+
+// TCPヘッダにペイロードを続けたバイト列を返す
+// DataOffsetとチェックサムはsrc/dstを使って再計算する
+func (h *TCPHeader) MarshalWithPayload(payload []byte, src, dst net.IP) ([]byte, error) {
+	opts := h.Options.marshal()
+	hlen := TCP_MIN_HEADER_LEN + len(opts)
+	if hlen > TCP_MAX_HEADER_LEN {
+		return nil, fmt.Errorf("invalid tcp header: options too long (%d bytes)", len(opts))
+	}
+	h.DataOffset = uint8(hlen / 4)
+
+	b := make([]byte, hlen, hlen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], h.SrcPort)
+	binary.BigEndian.PutUint16(b[2:4], h.DstPort)
+	binary.BigEndian.PutUint32(b[4:8], h.Seq)
+	binary.BigEndian.PutUint32(b[8:12], h.Ack)
+	b[12] = h.DataOffset << 4
+	b[13] = h.Flags
+	binary.BigEndian.PutUint16(b[14:16], h.Window)
+	binary.BigEndian.PutUint16(b[18:20], h.Urgent)
+	copy(b[TCP_MIN_HEADER_LEN:], opts)
+	b = append(b, payload...)
+
+	h.Checksum = transportChecksum(src, dst, PROTOCOL_TCP, b)
+	binary.BigEndian.PutUint16(b[16:18], h.Checksum)
+	return b, nil
+}
+
+// フラグが全て立っているかを判定する
+func (h *TCPHeader) Has(flags uint8) bool {
+	return h.Flags&flags == flags
+}
+
+// フラグを文字列で表す（例: SYN|ACK）
+func TCPFlagsString(flags uint8) string {
+	names := []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG"}
+	var s []string
+	for i, name := range names {
+		if flags&(1<<i) != 0 {
+			s = append(s, name)
+		}
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, "|")
+}
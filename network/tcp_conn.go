@@ -0,0 +1,1654 @@
+package network
+
+import (
+	"errors"    // エラーの生成
+	"fmt"       // 文字列の生成や出力、スキャン
+	"io"        // io.EOF
+	"net/netip" // アドレスとポートの表現
+	"os"        // タイムアウトのエラー
+	"sort"      // SACKブロックの整列
+	"sync"      // 排他制御
+	"time"      // 再送タイマーとRTTの計測
+)
+
+const (
+	TCP_DEFAULT_MSS = 1460 // MTU 1500からIPv4とTCPのヘッダを引いた値
+	TCP_MIN_MSS     = 536  // MSSオプションが無い場合に仮定する値（RFC 1122）
+	// 受信バッファと送信バッファの大きさの既定値
+	TCP_RECV_BUFFER_SIZE = 256 * 1024
+	TCP_SEND_BUFFER_SIZE = 256 * 1024
+	// 自身が通知するウィンドウスケール（RFC 7323）。受信バッファ全体を16ビットのウィンドウで表せる値
+	TCP_WINDOW_SCALE = 3
+	// ウィンドウスケールの上限。これを超える値を受け取った場合は14とみなす
+	TCP_MAX_WINDOW_SCALE = 14
+	// スケールする前のウィンドウの最大値
+	TCP_MAX_WINDOW = 65535
+	// 再送タイムアウト（RFC 6298）
+	TCP_INITIAL_RTO = time.Second
+	TCP_MIN_RTO     = 200 * time.Millisecond
+	TCP_MAX_RTO     = 60 * time.Second
+	// この回数再送しても確認応答が無い場合はコネクションを終了する
+	TCP_MAX_RETRIES = 8
+	// 遅延ACKでACKを保留する最大の時間
+	TCP_DELAYED_ACK_TIMEOUT = 40 * time.Millisecond
+	// SACKで後続のセグメントがこの数だけ受信済みと通知された未確認のセグメントは失われたとみなす（RFC 6675）
+	// 重複ACKの数でも同じ閾値を使う（RFC 5681）
+	TCP_DUP_THRESH = 3
+	// スロースタートの閾値の初期値。十分に大きな値として、ウィンドウスケールを含めた最大のウィンドウを使う
+	TCP_INITIAL_SSTHRESH = TCP_MAX_WINDOW << TCP_MAX_WINDOW_SCALE
+)
+
+var (
+	ErrRetransmitTimeout = errors.New("retransmission timeout")
+	ErrKeepAliveTimeout  = errors.New("keepalive timeout")
+	// 送信バッファに空きが無いまま書き込みの期限を過ぎた。os.ErrDeadlineExceededとしても判定できる
+	ErrWouldBlock = errors.New("operation would block")
+	// ReadOOBで読み込む緊急データが無い
+	ErrNoUrgentData = errors.New("no urgent data")
+)
+
+// TCPの状態（RFC 793）
+type TCPState int
+
+const (
+	TCPClosed TCPState = iota
+	TCPListen
+	TCPSynSent
+	TCPSynRcvd
+	TCPEstablished
+	TCPFinWait1
+	TCPFinWait2
+	TCPCloseWait
+	TCPClosing
+	TCPLastAck
+	TCPTimeWait
+)
+
+func (s TCPState) String() string {
+	switch s {
+	case TCPClosed:
+		return "CLOSED"
+	case TCPListen:
+		return "LISTEN"
+	case TCPSynSent:
+		return "SYN_SENT"
+	case TCPSynRcvd:
+		return "SYN_RCVD"
+	case TCPEstablished:
+		return "ESTABLISHED"
+	case TCPFinWait1:
+		return "FIN_WAIT_1"
+	case TCPFinWait2:
+		return "FIN_WAIT_2"
+	case TCPCloseWait:
+		return "CLOSE_WAIT"
+	case TCPClosing:
+		return "CLOSING"
+	case TCPLastAck:
+		return "LAST_ACK"
+	case TCPTimeWait:
+		return "TIME_WAIT"
+	default:
+		return fmt.Sprintf("TCPState(%d)", int(s))
+	}
+}
+
+// シーケンス番号の比較（2^32で一周することを考慮する）
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+func seqLE(a, b uint32) bool { return int32(a-b) <= 0 }
+func seqGT(a, b uint32) bool { return int32(a-b) > 0 }
+func seqGE(a, b uint32) bool { return int32(a-b) >= 0 }
+
+// 再送キューの要素。送信済みで確認応答を待っているセグメント
+type tcpSegment struct {
+	seq           uint32
+	length        uint32 // シーケンス空間での長さ（データ長、SYN/FINは1）
+	flags         uint8
+	sentAt        time.Time
+	retransmitted bool
+	sacked        bool // SACKで相手が受信済みと通知した
+}
+
+// TCPのコネクション
+type TCPConn struct {
+	tcp    *TCP
+	local  netip.AddrPort
+	remote netip.AddrPort
+
+	mu    sync.Mutex
+	state TCPState
+	// 状態が変化するたびに閉じて作り直す。待機中のゴルーチンはこれで起こされる
+	changed chan struct{}
+	err     error
+
+	// 送信側のシーケンス変数
+	iss    uint32 // 初期送信シーケンス番号
+	sndUna uint32 // 確認応答されていない最古のシーケンス番号
+	sndNxt uint32 // 次に送信するシーケンス番号
+	// 送信した最大のシーケンス番号の次。再送タイムアウトでsndNxtを戻しても、ここまでの確認応答は受け付ける
+	sndMax uint32
+	sndWnd uint32 // 相手の受信ウィンドウ（スケール済み）
+	// sndWndを最後に更新したセグメントのシーケンス番号と確認応答番号（RFC 793のSND.WL1/SND.WL2）
+	sndWl1 uint32
+	sndWl2 uint32
+	mss    uint16 // 相手が受け取れる最大セグメントサイズ
+
+	// 輻輳制御（RFC 5681のReno。部分ACKの扱いはRFC 6582のNewReno）
+	cwnd       uint32 // 輻輳ウィンドウ
+	ssthresh   uint32 // スロースタートの閾値
+	dupAcks    int    // 連続した重複ACKの数
+	inRecovery bool   // 高速リカバリ中
+	recover    uint32 // 高速リカバリに入った時のsndMax。ここまで確認応答されるとリカバリを終える
+
+	// 送信したデータと、順序通りに受信したデータのバイト数（再送は含めない）
+	bytesSent     uint64
+	bytesReceived uint64
+
+	// 送信バッファ。先頭はsndUnaに対応し、sndNxtまでは送信済みで未確認のデータ
+	sndBuf     []byte
+	sndBufSize int // 送信バッファの上限
+
+	// 送信する緊急データ。sndUpの手前のバイトまでが緊急データ（BSDの解釈）
+	sndUp   uint32
+	urgSend bool // sndUpが確認応答されるまでURGを立てる
+
+	// ゼロウィンドウのプローブ（RFC 1122 4.2.2.17）
+	persistTimer   *time.Timer
+	persistBackoff time.Duration
+
+	// 再送キュー（シーケンス番号順）と再送タイマー
+	rtxQueue []tcpSegment
+	rtxTimer *time.Timer
+	retries  int
+	// RTTの推定値（Jacobson/Karelsのアルゴリズム）
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	// 受信側のシーケンス変数
+	irs    uint32 // 初期受信シーケンス番号
+	rcvNxt uint32 // 次に受信を期待するシーケンス番号
+
+	// アプリケーションがまだ読んでいない受信済みデータ
+	rcvBuf     []byte
+	rcvBufSize int // 受信バッファの上限。順序が入れ替わったデータも受信ウィンドウでこの範囲に収まる
+	// 順序が入れ替わって届いたデータ（シーケンス番号がキー）
+	ooo map[uint32][]byte
+	// 最後に通知した受信ウィンドウ（スケール済み）
+	rcvWndAdvertised uint32
+
+	// 受信した緊急データ（帯域外データ）
+	// 緊急ポインタはBSDと同じく緊急データの次のバイトを指すと解釈する（RFC 6093）。
+	// rcvUp-1のバイトを通常のデータから取り除き、ReadOOBで読めるように保持する
+	rcvUp      uint32
+	urgPending bool // rcvUp-1のバイトをまだ受け取っていない
+	oob        byte
+	hasOOB     bool
+
+	// ウィンドウスケール。双方のSYNにオプションがあった場合のみ有効になる（RFC 7323）
+	wscaleOK bool
+	sndShift uint8 // 相手のウィンドウに掛けるシフト量
+	rcvShift uint8 // 自身のウィンドウから割るシフト量
+
+	// SACK。双方のSYNにSACK許可のオプションがあった場合のみ有効になる（RFC 2018）
+	sackOK  bool
+	lastOOO uint32 // 最後に受け取った順序外データの先頭。SACKの最初のブロックにする
+
+	// 終了処理
+	finPending bool        // Closeが呼ばれ、送信バッファが空になり次第FINを送る
+	finSent    bool        // FINを送信した
+	finRcvd    bool        // 相手のFINを受け取った（以降のReadはio.EOFを返す）
+	finRcvSeq  *uint32     // 順序が入れ替わって届いたFINのシーケンス番号
+	timeWait   *time.Timer // TIME_WAITの終了タイマー
+
+	// パッシブオープンの場合、確立時に通知するリスナー
+	listener *TCPListener
+
+	// Nagleのアルゴリズム（RFC 896）を使わない場合はtrue。既定はnet.TCPConnと同じくtrue
+	noDelay bool
+	// 遅延ACK（RFC 1122 4.2.3.2）
+	delayedAck bool
+	ackPending bool // ACKを保留している
+	dackTimer  *time.Timer
+
+	// キープアライブ（RFC 1122 4.2.3.6）
+	keepAlive  bool
+	kaIdle     time.Duration
+	kaInterval time.Duration
+	kaCount    int
+	kaProbes   int // 応答の無いまま送ったプローブの数
+	kaTimer    *time.Timer
+	lastRecv   time.Time // 最後にセグメントを受け取った時刻
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func newTCPConn(t *TCP, local, remote netip.AddrPort) *TCPConn {
+	return &TCPConn{
+		tcp:      t,
+		local:    local,
+		remote:   remote,
+		changed:  make(chan struct{}),
+		mss:      TCP_MIN_MSS,
+		cwnd:     initialCwnd(TCP_MIN_MSS),
+		ssthresh: TCP_INITIAL_SSTHRESH,
+		ooo:      make(map[uint32][]byte),
+		rto:      TCP_INITIAL_RTO,
+		noDelay:  true,
+
+		sndBufSize: TCP_SEND_BUFFER_SIZE,
+		rcvBufSize: TCP_RECV_BUFFER_SIZE,
+
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+}
+
+// 現在の状態を返す
+func (c *TCPConn) State() TCPState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// 自身のアドレスとポートを返す
+func (c *TCPConn) LocalAddrPort() netip.AddrPort {
+	return c.local
+}
+
+// 相手のアドレスとポートを返す
+func (c *TCPConn) RemoteAddrPort() netip.AddrPort {
+	return c.remote
+}
+
+// 状態を変更し、待機中のゴルーチンを起こす（c.muを保持して呼ぶ）
+func (c *TCPConn) setState(s TCPState) {
+	c.state = s
+	c.wakeup()
+}
+
+// 待機中のゴルーチンを起こす（c.muを保持して呼ぶ）
+func (c *TCPConn) wakeup() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// コネクションを終了させ、コネクション表から取り除く（c.muを保持して呼ぶ）
+func (c *TCPConn) terminate(err error) {
+	if c.state == TCPClosed {
+		return
+	}
+	if c.err == nil {
+		c.err = err
+	}
+	c.stopRetransmitTimer()
+	c.stopPersistTimer()
+	c.stopKeepAliveTimer()
+	c.stopDelayedAck()
+	if c.timeWait != nil {
+		c.timeWait.Stop()
+	}
+	c.setState(TCPClosed)
+	c.tcp.removeConn(c)
+}
+
+// セグメントを送信する（c.muを保持して呼ぶ）
+// ACKフラグがある場合は確認応答番号にrcvNxtを設定する
+func (c *TCPConn) sendSegment(flags uint8, seq uint32, payload []byte) error {
+	h := &TCPHeader{
+		SrcPort: c.local.Port(),
+		DstPort: c.remote.Port(),
+		Seq:     seq,
+		Flags:   flags,
+	}
+	if flags&TCP_FLAG_ACK != 0 {
+		h.Ack = c.rcvNxt
+		// 保留していたACKはこのセグメントで送られる
+		c.stopDelayedAck()
+	}
+	// SYNのウィンドウはスケールしない
+	wnd := c.rcvWindow()
+	if flags&TCP_FLAG_SYN != 0 {
+		h.Options.MSS = TCP_DEFAULT_MSS
+		// 能動的に開く側は常に、受動的に開く側は相手がオプションを付けていた場合のみ送る
+		if flags&TCP_FLAG_ACK == 0 || c.wscaleOK {
+			h.Options.HasWindowScale = true
+			h.Options.WindowScale = TCP_WINDOW_SCALE
+		}
+		if flags&TCP_FLAG_ACK == 0 || c.sackOK {
+			h.Options.SACKPermitted = true
+		}
+		if wnd > TCP_MAX_WINDOW {
+			wnd = TCP_MAX_WINDOW
+		}
+		h.Window = uint16(wnd)
+		c.rcvWndAdvertised = wnd
+	} else {
+		h.Window = uint16(wnd >> c.rcvShift)
+		c.rcvWndAdvertised = uint32(h.Window) << c.rcvShift
+		// 緊急データが確認応答されるまでの全てのセグメントで緊急ポインタを通知する
+		if c.urgSend && flags&TCP_FLAG_ACK != 0 && flags&TCP_FLAG_RST == 0 && seqLT(seq, c.sndUp) {
+			h.Flags |= TCP_FLAG_URG
+			h.Urgent = TCP_MAX_WINDOW
+			if up := c.sndUp - seq; up < TCP_MAX_WINDOW {
+				h.Urgent = uint16(up)
+			}
+		}
+		if flags&TCP_FLAG_ACK != 0 && c.sackOK && len(c.ooo) > 0 {
+			h.Options.SACKBlocks = c.sackBlocks()
+			// MSSの大きさのデータにSACKのオプションを加えるとMTUを超えるため、収まる数のブロックだけを送る
+			room := int(c.tcp.ip.mtu.Load()) - IPV4_MIN_HEADER_LEN - TCP_MIN_HEADER_LEN - len(payload)
+			for n := len(h.Options.SACKBlocks); n > 0 && room < 4+8*n; n-- {
+				h.Options.SACKBlocks = h.Options.SACKBlocks[:n-1]
+			}
+		}
+	}
+	return c.tcp.output(c.local, c.remote, h, payload)
+}
+
+// DFを立てたセグメントが自身のMTUを超えた場合は、MSSを下げて送信済みのセグメントを送り直す（c.muを保持して呼ぶ）
+// 下げた場合はtrueを返す
+func (c *TCPConn) fitMTU(err error) bool {
+	mtu := int(c.tcp.ip.mtu.Load())
+	if !errors.Is(err, ErrFragmentationNeeded) || mssForMTU(mtu) >= c.mss {
+		return false
+	}
+	c.lowerMSS(mtu)
+	return true
+}
+
+// SYNに含まれる相手のオプションを取り込む（c.muを保持して呼ぶ）
+// MSSは自身の送信に使うMTUにも収まるようにする。ウィンドウスケールは相手が付けていた場合のみ有効にする
+func (c *TCPConn) applySynOptions(h *TCPHeader) {
+	if h.Options.MSS != 0 {
+		c.mss = h.Options.MSS
+	}
+	if h.Options.HasWindowScale {
+		c.wscaleOK = true
+		c.sndShift = h.Options.WindowScale
+		if c.sndShift > TCP_MAX_WINDOW_SCALE {
+			c.sndShift = TCP_MAX_WINDOW_SCALE
+		}
+		c.rcvShift = TCP_WINDOW_SCALE
+	}
+	if h.Options.SACKPermitted {
+		c.sackOK = true
+	}
+	if c.mss > TCP_DEFAULT_MSS {
+		c.mss = TCP_DEFAULT_MSS
+	}
+	if limit := mssForMTU(int(c.tcp.ip.mtu.Load())); c.mss > limit {
+		c.mss = limit
+	}
+	c.cwnd = initialCwnd(c.mss)
+}
+
+// 輻輳ウィンドウの初期値を返す（RFC 5681 3.1）
+func initialCwnd(mss uint16) uint32 {
+	switch {
+	case mss > 2190:
+		return 2 * uint32(mss)
+	case mss > 1095:
+		return 3 * uint32(mss)
+	default:
+		return 4 * uint32(mss)
+	}
+}
+
+// MTUに収まるMSSを返す
+func mssForMTU(mtu int) uint16 {
+	if mtu < MIN_MTU {
+		mtu = MIN_MTU
+	}
+	return uint16(mtu - IPV4_MIN_HEADER_LEN - TCP_MIN_HEADER_LEN)
+}
+
+// ICMPのフラグメント化要求を受けてMSSを下げる
+// seqが未確認の範囲に無いものは偽装の可能性があるため無視する（RFC 5927）
+func (c *TCPConn) handlePathMTU(seq uint32, mtu int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == TCPClosed || seqLT(seq, c.sndUna) || seqGE(seq, c.sndMax) {
+		return
+	}
+	c.lowerMSS(mtu)
+}
+
+// MTUに合わせてMSSを下げ、送信済みで未確認のセグメントを新しいMSSで送り直す（c.muを保持して呼ぶ）
+func (c *TCPConn) lowerMSS(mtu int) {
+	mss := mssForMTU(mtu)
+	if mss >= c.mss {
+		return
+	}
+	c.mss = mss
+	var queue []tcpSegment
+	for _, seg := range c.rtxQueue {
+		if seg.sacked {
+			// 相手が受信済みのため送り直さない
+			queue = append(queue, seg)
+			continue
+		}
+		if seg.flags&(TCP_FLAG_SYN|TCP_FLAG_FIN) != 0 || seg.length <= uint32(mss) {
+			seg.retransmitted = true
+			c.retransmit(&seg)
+			queue = append(queue, seg)
+			continue
+		}
+		for off := uint32(0); off < seg.length; off += uint32(mss) {
+			n := seg.length - off
+			if n > uint32(mss) {
+				n = uint32(mss)
+			}
+			part := tcpSegment{seq: seg.seq + off, length: n, flags: seg.flags, sentAt: seg.sentAt, retransmitted: true}
+			// 確認応答済みの部分は送らない
+			if seqLE(part.seq+part.length, c.sndUna) {
+				continue
+			}
+			c.retransmit(&part)
+			queue = append(queue, part)
+		}
+	}
+	c.rtxQueue = queue
+	c.stopRetransmitTimer()
+	if len(c.rtxQueue) > 0 {
+		c.startRetransmitTimer()
+	}
+}
+
+// 受信したセグメントを状態に応じて処理する
+func (c *TCPConn) handle(h *TCPHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRecv = time.Now()
+	c.kaProbes = 0
+	switch c.state {
+	case TCPClosed:
+		return
+	case TCPSynSent:
+		c.handleSynSent(h, payload)
+	case TCPSynRcvd:
+		c.handleSynRcvd(h, payload)
+	default:
+		c.handleSynchronized(h, payload)
+	}
+}
+
+// SYN_SENT：SYN-ACKを受け取るとACKを返してESTABLISHEDに遷移する
+// SYNだけを受け取った場合は同時オープンとしてSYN_RCVDに遷移する
+func (c *TCPConn) handleSynSent(h *TCPHeader, payload []byte) {
+	if h.Has(TCP_FLAG_ACK) && h.Ack != c.sndNxt {
+		// 受け入れられないACK
+		if !h.Has(TCP_FLAG_RST) {
+			c.sendSegment(TCP_FLAG_RST, h.Ack, nil)
+		}
+		return
+	}
+	if h.Has(TCP_FLAG_RST) {
+		if h.Has(TCP_FLAG_ACK) {
+			c.terminate(ErrConnRefused)
+		}
+		return
+	}
+	if !h.Has(TCP_FLAG_SYN) {
+		return
+	}
+	if !h.Has(TCP_FLAG_ACK) {
+		// 同時オープン：相手も同時にSYNを送ってきた。SYN-ACKを返してSYN_RCVDに遷移する（RFC 793 図8）
+		c.irs = h.Seq
+		c.rcvNxt = h.Seq + 1
+		c.setSndWnd(h, uint32(h.Window))
+		c.applySynOptions(h)
+		c.setState(TCPSynRcvd)
+		c.sendSegment(TCP_FLAG_SYN|TCP_FLAG_ACK, c.iss, nil)
+		return
+	}
+	c.irs = h.Seq
+	c.rcvNxt = h.Seq + 1
+	c.sndUna = h.Ack
+	c.setSndWnd(h, uint32(h.Window))
+	c.applySynOptions(h)
+	c.setState(TCPEstablished)
+	c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+}
+
+// SYN_RCVD：最後のACKを受け取るとESTABLISHEDに遷移する
+func (c *TCPConn) handleSynRcvd(h *TCPHeader, payload []byte) {
+	if h.Has(TCP_FLAG_RST) {
+		// 受信ウィンドウの外のRSTは偽装の可能性があるため無視する
+		if c.acceptable(h.Seq, 0) {
+			c.terminate(ErrConnReset)
+		}
+		return
+	}
+	if h.Has(TCP_FLAG_SYN) {
+		if h.Seq != c.irs {
+			return
+		}
+		if h.Has(TCP_FLAG_ACK) && h.Ack == c.sndNxt {
+			// 同時オープンで相手もSYN_RCVDからSYN-ACKを送ってきた。SYNは受信済みのためACKとして扱う
+			c.sndUna = h.Ack
+			c.setSndWnd(h, uint32(h.Window))
+			c.setState(TCPEstablished)
+			c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+			return
+		}
+		// SYN-ACKが失われたと考えて再送する
+		c.sendSegment(TCP_FLAG_SYN|TCP_FLAG_ACK, c.iss, nil)
+		return
+	}
+	if !h.Has(TCP_FLAG_ACK) {
+		return
+	}
+	if h.Ack != c.sndNxt {
+		// 受け入れられないACKにはRSTを返す。コネクションはそのまま残す
+		c.sendSegment(TCP_FLAG_RST, h.Ack, nil)
+		return
+	}
+	c.sndUna = h.Ack
+	c.setSndWnd(h, uint32(h.Window)<<c.sndShift)
+	c.setState(TCPEstablished)
+	if c.listener != nil {
+		c.listener.enqueue(c)
+	}
+	// 最後のACKにデータやFINが載っていれば、確立したコネクションとして処理する
+	if len(payload) > 0 || h.Has(TCP_FLAG_FIN) {
+		c.handleSynchronized(h, payload)
+	}
+}
+
+// ESTABLISHED以降：確認応答、データ、FINを処理する
+// 受信ウィンドウに入らないセグメントは、確認応答やデータを取り込む前に破棄する（RFC 793 p.69）
+func (c *TCPConn) handleSynchronized(h *TCPHeader, payload []byte) {
+	segLen := uint32(len(payload))
+	if h.Has(TCP_FLAG_SYN) {
+		segLen++
+	}
+	if h.Has(TCP_FLAG_FIN) {
+		segLen++
+	}
+	if !c.acceptable(h.Seq, segLen) {
+		if h.Has(TCP_FLAG_RST) {
+			return
+		}
+		// ウィンドウが0の間も、相手の確認応答とウィンドウの更新は受け付ける
+		if c.acceptWindow() == 0 && h.Has(TCP_FLAG_ACK) {
+			c.processAck(h, nil)
+			if c.state == TCPClosed {
+				return
+			}
+		}
+		// 受信済みのシーケンス番号を持つセグメント（キープアライブのプローブや再送されたFINなど）にもACKを返す
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		if h.Has(TCP_FLAG_FIN) && c.state == TCPTimeWait {
+			c.enterTimeWait()
+		}
+		return
+	}
+	if h.Has(TCP_FLAG_RST) {
+		// シーケンス番号がrcvNxtと一致するRSTだけでリセットし、ウィンドウ内の他のRSTには
+		// チャレンジACKを返す。正規の相手であれば正しい番号でRSTを送り直す（RFC 5961 3.2）
+		if h.Seq == c.rcvNxt {
+			c.terminate(ErrConnReset)
+		} else {
+			c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		}
+		return
+	}
+	if h.Has(TCP_FLAG_SYN) {
+		// 確立後のSYNにもチャレンジACKを返し、コネクションはそのまま残す（RFC 5961 4.2）
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		return
+	}
+	if !h.Has(TCP_FLAG_ACK) {
+		return
+	}
+	c.processAck(h, payload)
+	if c.state == TCPClosed {
+		return
+	}
+	if h.Has(TCP_FLAG_URG) && h.Urgent > 0 {
+		c.processUrgent(h.Seq + uint32(h.Urgent))
+	}
+	if len(payload) > 0 {
+		switch c.state {
+		case TCPEstablished, TCPFinWait1, TCPFinWait2:
+			c.processData(h.Seq, payload)
+		}
+	}
+	if h.Has(TCP_FLAG_FIN) {
+		c.processFin(h.Seq + uint32(len(payload)))
+	}
+}
+
+// セグメントが受信ウィンドウに入るかを返す（RFC 793 p.69の受け入れ判定）
+// segLenはデータとSYN、FINの長さ
+func (c *TCPConn) acceptable(seq, segLen uint32) bool {
+	wnd := c.acceptWindow()
+	inWindow := func(s uint32) bool {
+		return seqLE(c.rcvNxt, s) && seqLT(s, c.rcvNxt+wnd)
+	}
+	switch {
+	case segLen == 0 && wnd == 0:
+		return seq == c.rcvNxt
+	case segLen == 0:
+		return inWindow(seq)
+	case wnd == 0:
+		return false
+	default:
+		return inWindow(seq) || inWindow(seq+segLen-1)
+	}
+}
+
+// 受け入れ判定に使う受信ウィンドウを返す
+// 現在の空きと最後に通知したものの大きい方で、通知した後に受信バッファが埋まっても相手の送ったセグメントを捨てない
+func (c *TCPConn) acceptWindow() uint32 {
+	if wnd := c.rcvWindow(); wnd > c.rcvWndAdvertised {
+		return wnd
+	}
+	return c.rcvWndAdvertised
+}
+
+// 確認応答番号と相手のウィンドウを取り込み、送信できるデータがあれば送る
+func (c *TCPConn) processAck(h *TCPHeader, payload []byte) {
+	if seqGT(h.Ack, c.sndMax) {
+		// まだ送っていないデータへのACKにはACKを返して無視する
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		return
+	}
+	if seqGT(h.Ack, c.sndNxt) {
+		// 再送タイムアウトでsndNxtを戻す前に送ったデータが届いていた。FINまで確認応答されていれば送信済みとする
+		if c.finPending && !c.finSent && h.Ack-c.sndUna > uint32(len(c.sndBuf)) {
+			c.finSent = true
+		}
+		c.sndNxt = h.Ack
+	}
+	if seqGT(h.Ack, c.sndUna) {
+		acked := h.Ack - c.sndUna
+		n := acked
+		if n > uint32(len(c.sndBuf)) {
+			n = uint32(len(c.sndBuf))
+		}
+		c.sndBuf = c.sndBuf[n:]
+		c.sndUna = h.Ack
+		if c.urgSend && seqGE(c.sndUna, c.sndUp) {
+			c.urgSend = false
+		}
+		c.ackRetransmitQueue(h.Ack)
+		c.onNewAck(h.Ack, acked)
+		c.wakeup()
+	} else if h.Ack == c.sndUna && c.sndNxt != c.sndUna && len(payload) == 0 &&
+		!h.Has(TCP_FLAG_SYN|TCP_FLAG_FIN) && uint32(h.Window)<<c.sndShift == c.sndWnd {
+		// 重複ACK（RFC 5681 2）
+		c.onDupAck()
+	}
+	// 送信したFINへの確認応答
+	if c.finSent && c.sndUna == c.sndNxt {
+		switch c.state {
+		case TCPFinWait1:
+			c.setState(TCPFinWait2)
+		case TCPClosing:
+			c.enterTimeWait()
+		case TCPLastAck:
+			c.terminate(ErrConnClosed)
+			return
+		}
+	}
+	// 順序が入れ替わって届いた古いセグメントのウィンドウでは更新しない（RFC 793 p.72）
+	if seqGE(h.Ack, c.sndUna) && (seqLT(c.sndWl1, h.Seq) || c.sndWl1 == h.Seq && seqLE(c.sndWl2, h.Ack)) {
+		c.setSndWnd(h, uint32(h.Window)<<c.sndShift)
+	}
+	if c.sackOK && len(h.Options.SACKBlocks) > 0 {
+		c.processSACK(h.Options.SACKBlocks)
+	}
+	c.output()
+}
+
+// 相手のウィンドウをwndにし、更新したセグメントを記録する（c.muを保持して呼ぶ）
+func (c *TCPConn) setSndWnd(h *TCPHeader, wnd uint32) {
+	c.sndWnd = wnd
+	c.sndWl1 = h.Seq
+	c.sndWl2 = h.Ack
+}
+
+// 新しいデータへのACKで輻輳ウィンドウを広げる（c.muを保持して呼ぶ）
+// 高速リカバリ中は、recoverまでのACKでリカバリを終え、それより手前の部分ACKでは次の欠落を再送する
+func (c *TCPConn) onNewAck(ack, acked uint32) {
+	c.dupAcks = 0
+	mss := uint32(c.mss)
+	if c.inRecovery {
+		if seqGE(ack, c.recover) {
+			c.inRecovery = false
+			c.cwnd = c.ssthresh
+			return
+		}
+		// 部分ACK：確認された分だけ縮め、1セグメント分広げる（RFC 6582 3.2）
+		if acked < c.cwnd {
+			c.cwnd -= acked
+		} else {
+			c.cwnd = 0
+		}
+		c.cwnd += mss
+		for i := range c.rtxQueue {
+			if seg := &c.rtxQueue[i]; seqGT(seg.seq+seg.length, ack) {
+				if !seg.retransmitted && !seg.sacked {
+					seg.retransmitted = true
+					c.retransmit(seg)
+				}
+				break
+			}
+		}
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		// スロースタート：ACKごとに確認された分（最大MSS）だけ広げる
+		if acked > mss {
+			acked = mss
+		}
+		c.cwnd += acked
+		return
+	}
+	// 輻輳回避：RTTごとにおよそ1セグメント広げる
+	inc := mss * mss / c.cwnd
+	if inc == 0 {
+		inc = 1
+	}
+	c.cwnd += inc
+}
+
+// 重複ACKを数え、TCP_DUP_THRESHに達したら最古の未確認のセグメントを再送して高速リカバリに入る（c.muを保持して呼ぶ）
+// 高速リカバリ中は重複ACKごとに1セグメント分広げる
+func (c *TCPConn) onDupAck() {
+	c.dupAcks++
+	if c.inRecovery {
+		c.cwnd += uint32(c.mss)
+		return
+	}
+	if c.dupAcks < TCP_DUP_THRESH || len(c.rtxQueue) == 0 {
+		return
+	}
+	c.enterRecovery()
+	c.cwnd += TCP_DUP_THRESH * uint32(c.mss)
+	if seg := &c.rtxQueue[0]; !seg.retransmitted {
+		seg.retransmitted = true
+		c.retransmit(seg)
+	}
+}
+
+// 損失を検出して高速リカバリに入り、輻輳ウィンドウを半分にする（c.muを保持して呼ぶ）
+func (c *TCPConn) enterRecovery() {
+	c.ssthresh = c.lossThreshold()
+	c.cwnd = c.ssthresh
+	c.inRecovery = true
+	c.recover = c.sndMax
+}
+
+// 損失時のスロースタートの閾値として、送信中のデータの半分（最低2セグメント）を返す
+func (c *TCPConn) lossThreshold() uint32 {
+	half := (c.sndNxt - c.sndUna) / 2
+	if floor := 2 * uint32(c.mss); half < floor {
+		half = floor
+	}
+	return half
+}
+
+// SACKのブロックで受信済みと通知されたセグメントに印を付け、
+// 後続のセグメントがTCP_DUP_THRESH以上受信済みになった欠落だけを再送する
+// 再送したセグメントが再び失われた場合は再送タイマーに任せる
+func (c *TCPConn) processSACK(blocks []SACKBlock) {
+	for _, blk := range blocks {
+		// 未確認の範囲に無いブロックは古いか不正なため無視する
+		if !seqLT(blk.Left, blk.Right) || seqLT(blk.Left, c.sndUna) || seqGT(blk.Right, c.sndMax) {
+			continue
+		}
+		for i := range c.rtxQueue {
+			seg := &c.rtxQueue[i]
+			if seqGE(seg.seq, blk.Left) && seqLE(seg.seq+seg.length, blk.Right) {
+				seg.sacked = true
+			}
+		}
+	}
+	sacked := 0
+	for i := len(c.rtxQueue) - 1; i >= 0; i-- {
+		seg := &c.rtxQueue[i]
+		if seg.sacked {
+			sacked++
+			continue
+		}
+		if sacked >= TCP_DUP_THRESH && !seg.retransmitted {
+			if !c.inRecovery {
+				c.enterRecovery()
+			}
+			seg.retransmitted = true
+			c.retransmit(seg)
+		}
+	}
+}
+
+// 受信したデータを受信バッファに入れ、ACKを返す
+// 順序が入れ替わったデータは保持しておき、欠けている部分が埋まった時点で受信バッファに移す
+func (c *TCPConn) processData(seq uint32, data []byte) {
+	// 既に受信した部分を取り除く
+	if seqLT(seq, c.rcvNxt) {
+		dup := c.rcvNxt - seq
+		if dup >= uint32(len(data)) {
+			c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+			return
+		}
+		data = data[dup:]
+		seq = c.rcvNxt
+	}
+	// 受信ウィンドウを超える部分を取り除く
+	wnd := c.rcvWindow()
+	if seqGE(seq, c.rcvNxt+wnd) {
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		return
+	}
+	if end := c.rcvNxt + wnd; seqGT(seq+uint32(len(data)), end) {
+		data = data[:end-seq]
+	}
+
+	if seq != c.rcvNxt {
+		if prev, ok := c.ooo[seq]; !ok || len(prev) < len(data) {
+			c.ooo[seq] = append([]byte(nil), data...)
+		}
+		c.lastOOO = seq
+		// 順序が入れ替わったデータには重複ACKを即座に返す
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		return
+	}
+	// 欠けていた部分を埋めたデータ
+	filled := len(c.ooo) > 0
+	c.appendRcv(seq, data)
+	c.rcvNxt += uint32(len(data))
+	c.drainOutOfOrder()
+	c.wakeup()
+	if c.finRcvSeq != nil && *c.finRcvSeq == c.rcvNxt {
+		// 保留していたFINは呼び出し元でACKする
+		defer c.processFin(c.rcvNxt)
+	}
+	c.ackData(filled || len(data) >= int(c.mss))
+}
+
+// 受信した緊急ポインタを取り込む（c.muを保持して呼ぶ）
+// upは緊急データの次のシーケンス番号。まだ受け取っていないバイトを指し、
+// 保留している緊急ポインタより先にある場合のみ更新する（RFC 793のRCV.UP）
+func (c *TCPConn) processUrgent(up uint32) {
+	if !seqGT(up, c.rcvNxt) || c.urgPending && !seqGT(up, c.rcvUp) {
+		return
+	}
+	c.rcvUp = up
+	c.urgPending = true
+}
+
+// 順序通りに揃ったデータを受信バッファに入れる（c.muを保持して呼ぶ）
+// 緊急データのバイトが含まれる場合は取り除いてReadOOBで読めるようにする
+// BSDと同じく保持するのは最後の1バイトだけで、読まれる前に次の緊急データが届くと上書きする
+func (c *TCPConn) appendRcv(seq uint32, data []byte) {
+	c.bytesReceived += uint64(len(data))
+	if c.urgPending {
+		if off := c.rcvUp - 1 - seq; off < uint32(len(data)) {
+			c.oob = data[off]
+			c.hasOOB = true
+			c.urgPending = false
+			c.rcvBuf = append(c.rcvBuf, data[:off]...)
+			c.rcvBuf = append(c.rcvBuf, data[off+1:]...)
+			return
+		}
+	}
+	c.rcvBuf = append(c.rcvBuf, data...)
+}
+
+// 受信したデータにACKを返す（c.muを保持して呼ぶ）
+// 遅延ACKが有効な場合、immediateでなければ2つ目のセグメントを受け取るか
+// TCP_DELAYED_ACK_TIMEOUTが過ぎるまでACKを保留する
+func (c *TCPConn) ackData(immediate bool) {
+	if !c.delayedAck || immediate || c.ackPending {
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+		return
+	}
+	c.ackPending = true
+	var timer *time.Timer
+	timer = time.AfterFunc(TCP_DELAYED_ACK_TIMEOUT, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// 停止や再設定の後に発火したタイマーは無視する
+		if c.dackTimer != timer || c.state == TCPClosed {
+			return
+		}
+		c.dackTimer = nil
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+	})
+	c.dackTimer = timer
+}
+
+// 保留しているACKを取り消す（c.muを保持して呼ぶ）
+func (c *TCPConn) stopDelayedAck() {
+	c.ackPending = false
+	if c.dackTimer != nil {
+		c.dackTimer.Stop()
+		c.dackTimer = nil
+	}
+}
+
+// 相手のFINを処理する。seqはFINのシーケンス番号
+func (c *TCPConn) processFin(seq uint32) {
+	if seq != c.rcvNxt {
+		// 欠けているデータがあればFINは後で処理する
+		if seqGT(seq, c.rcvNxt) {
+			c.finRcvSeq = &seq
+		} else {
+			// 再送されてきたFINにはACKを返す。TIME_WAITの場合はやり直す
+			c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+			if c.state == TCPTimeWait {
+				c.enterTimeWait()
+			}
+		}
+		return
+	}
+	c.finRcvSeq = nil
+	c.finRcvd = true
+	c.rcvNxt++
+	c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+
+	switch c.state {
+	case TCPSynRcvd, TCPEstablished:
+		c.setState(TCPCloseWait)
+	case TCPFinWait1:
+		if c.finSent && c.sndUna == c.sndNxt {
+			c.enterTimeWait()
+		} else {
+			// 同時クローズ
+			c.setState(TCPClosing)
+		}
+	case TCPFinWait2:
+		c.enterTimeWait()
+	default:
+		c.wakeup()
+	}
+}
+
+// TIME_WAITに遷移し、2*MSL後にコネクションを解放する
+func (c *TCPConn) enterTimeWait() {
+	c.stopRetransmitTimer()
+	c.setState(TCPTimeWait)
+	if c.timeWait != nil {
+		c.timeWait.Stop()
+	}
+	c.timeWait = time.AfterFunc(c.tcp.timeWaitDuration(), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.state == TCPTimeWait {
+			c.terminate(ErrConnClosed)
+		}
+	})
+}
+
+// 欠けていた部分が埋まった保持データを受信バッファに移す
+func (c *TCPConn) drainOutOfOrder() {
+	for moved := true; moved; {
+		moved = false
+		for seq, data := range c.ooo {
+			if seqGT(seq, c.rcvNxt) {
+				continue
+			}
+			delete(c.ooo, seq)
+			if end := seq + uint32(len(data)); seqGT(end, c.rcvNxt) {
+				c.appendRcv(c.rcvNxt, data[c.rcvNxt-seq:])
+				c.rcvNxt = end
+			}
+			moved = true
+		}
+	}
+}
+
+// 順序が入れ替わって保持しているデータの範囲をSACKのブロックにして返す
+// 最後に受け取ったデータを含むブロックを先頭にし、残りは古い順に並べる（RFC 2018 4）
+func (c *TCPConn) sackBlocks() []SACKBlock {
+	blocks := make([]SACKBlock, 0, len(c.ooo))
+	for seq, data := range c.ooo {
+		blocks = append(blocks, SACKBlock{Left: seq, Right: seq + uint32(len(data))})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return seqLT(blocks[i].Left, blocks[j].Left) })
+	// 重なるか隣接する範囲をまとめる
+	merged := blocks[:1]
+	for _, blk := range blocks[1:] {
+		last := &merged[len(merged)-1]
+		if seqLE(blk.Left, last.Right) {
+			if seqGT(blk.Right, last.Right) {
+				last.Right = blk.Right
+			}
+			continue
+		}
+		merged = append(merged, blk)
+	}
+	for i, blk := range merged {
+		if seqGE(c.lastOOO, blk.Left) && seqLT(c.lastOOO, blk.Right) {
+			copy(merged[1:i+1], merged[:i])
+			merged[0] = blk
+			break
+		}
+	}
+	if len(merged) > TCP_MAX_SACK_BLOCKS {
+		merged = merged[:TCP_MAX_SACK_BLOCKS]
+	}
+	return merged
+}
+
+// 受信ウィンドウ（受信バッファの空き）を返す
+// 受信バッファが一杯の場合は0（ゼロウィンドウ）になる
+// ウィンドウスケールが無効の場合は16ビットで表せる範囲に収める
+func (c *TCPConn) rcvWindow() uint32 {
+	if len(c.rcvBuf) >= c.rcvBufSize {
+		return 0
+	}
+	wnd := uint32(c.rcvBufSize - len(c.rcvBuf))
+	if limit := uint32(TCP_MAX_WINDOW) << c.rcvShift; wnd > limit {
+		wnd = limit
+	}
+	return wnd
+}
+
+// 受信バッファに空きができた場合、閉じかけていたウィンドウが開いたことを相手に通知する（c.muを保持して呼ぶ）
+// 小さな空きを通知しないように、MSSか受信バッファの半分のどちらか小さい方まで空くのを待つ（RFC 1122 4.2.3.3）
+func (c *TCPConn) updateWindow() {
+	threshold := uint32(c.mss)
+	if half := uint32(c.rcvBufSize / 2); half < threshold {
+		threshold = half
+	}
+	if c.rcvWndAdvertised < threshold && c.rcvWindow() >= threshold {
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+	}
+}
+
+// 送信ウィンドウの範囲で未送信のデータをMSSごとに送る（c.muを保持して呼ぶ）
+// Closeの後、全てのデータを送り終えたらFINを送る
+// 相手のウィンドウが0のまま送るデータが残っている場合はプローブのタイマーを開始する
+func (c *TCPConn) output() {
+	if c.sndWnd > 0 {
+		c.stopPersistTimer()
+	}
+	for {
+		inFlight := c.sndNxt - c.sndUna
+		if inFlight >= uint32(len(c.sndBuf)) {
+			c.outputFin()
+			return
+		}
+		// 相手の受信ウィンドウと輻輳ウィンドウの小さい方まで送る
+		wnd := c.sndWnd
+		if c.cwnd < wnd {
+			wnd = c.cwnd
+		}
+		if inFlight >= wnd {
+			// 未確認のデータがあれば再送タイマーに任せる
+			if c.sndWnd == 0 && inFlight == 0 && c.persistTimer == nil {
+				c.persistBackoff = c.rto
+				c.startPersistTimer()
+			}
+			return
+		}
+		n := uint32(len(c.sndBuf)) - inFlight
+		if avail := wnd - inFlight; n > avail {
+			n = avail
+		}
+		if n > uint32(c.mss) {
+			n = uint32(c.mss)
+		}
+		// Nagleのアルゴリズム：未確認のデータがある間はMSSに満たないセグメントを送らずにまとめる
+		// Closeの後と緊急データはすぐに送る
+		if !c.noDelay && n < uint32(c.mss) && c.sndNxt != c.sndUna && !c.finPending && !c.urgSend {
+			return
+		}
+		seg := c.sndBuf[inFlight : inFlight+n]
+		if err := c.sendSegment(TCP_FLAG_PSH|TCP_FLAG_ACK, c.sndNxt, seg); err != nil {
+			// DFを立てていて自身のMTUを超えた場合はMSSを下げて送り直す
+			if c.fitMTU(err) {
+				continue
+			}
+			return
+		}
+		// sndMaxより手前は再送タイムアウトで送り直している範囲
+		c.queueRetransmit(tcpSegment{seq: c.sndNxt, length: n, flags: TCP_FLAG_PSH | TCP_FLAG_ACK, retransmitted: seqLT(c.sndNxt, c.sndMax)})
+		if !seqLT(c.sndNxt, c.sndMax) {
+			c.bytesSent += uint64(n)
+		}
+		c.advanceSndNxt(n)
+	}
+}
+
+// 保留しているFINを送る
+func (c *TCPConn) outputFin() {
+	if !c.finPending || c.finSent {
+		return
+	}
+	if err := c.sendSegment(TCP_FLAG_FIN|TCP_FLAG_ACK, c.sndNxt, nil); err != nil {
+		return
+	}
+	c.finSent = true
+	c.queueRetransmit(tcpSegment{seq: c.sndNxt, length: 1, flags: TCP_FLAG_FIN | TCP_FLAG_ACK, retransmitted: seqLT(c.sndNxt, c.sndMax)})
+	c.advanceSndNxt(1)
+}
+
+// sndNxtをnだけ進め、sndMaxを更新する（c.muを保持して呼ぶ）
+func (c *TCPConn) advanceSndNxt(n uint32) {
+	c.sndNxt += n
+	if seqGT(c.sndNxt, c.sndMax) {
+		c.sndMax = c.sndNxt
+	}
+}
+
+// 送信したセグメントを再送キューに入れ、再送タイマーを開始する
+func (c *TCPConn) queueRetransmit(seg tcpSegment) {
+	seg.sentAt = time.Now()
+	c.rtxQueue = append(c.rtxQueue, seg)
+	if c.rtxTimer == nil {
+		c.startRetransmitTimer()
+	}
+}
+
+// ackまでに確認応答されたセグメントを再送キューから取り除き、RTTを更新する
+func (c *TCPConn) ackRetransmitQueue(ack uint32) {
+	var sample time.Duration
+	i := 0
+	for ; i < len(c.rtxQueue); i++ {
+		seg := c.rtxQueue[i]
+		if seqGT(seg.seq+seg.length, ack) {
+			break
+		}
+		// 再送したセグメントはどちらへのACKか区別できないためRTTの計測に使わない（Karnのアルゴリズム）
+		if !seg.retransmitted {
+			sample = time.Since(seg.sentAt)
+		}
+	}
+	if i == 0 {
+		return
+	}
+	c.rtxQueue = c.rtxQueue[i:]
+	c.retries = 0
+	if sample > 0 {
+		c.updateRTT(sample)
+	}
+	c.stopRetransmitTimer()
+	if len(c.rtxQueue) > 0 {
+		c.startRetransmitTimer()
+	}
+}
+
+// RTTの計測値からSRTT/RTTVAR/RTOを更新する（RFC 6298）
+func (c *TCPConn) updateRTT(r time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = r
+		c.rttvar = r / 2
+	} else {
+		diff := c.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + r) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < TCP_MIN_RTO {
+		c.rto = TCP_MIN_RTO
+	}
+	if c.rto > TCP_MAX_RTO {
+		c.rto = TCP_MAX_RTO
+	}
+}
+
+func (c *TCPConn) startRetransmitTimer() {
+	var timer *time.Timer
+	timer = time.AfterFunc(c.rto, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// 停止や再設定の後に発火したタイマーは無視する
+		if c.rtxTimer != timer {
+			return
+		}
+		c.rtxTimer = nil
+		c.onRetransmitTimeout()
+	})
+	c.rtxTimer = timer
+}
+
+func (c *TCPConn) stopRetransmitTimer() {
+	if c.rtxTimer != nil {
+		c.rtxTimer.Stop()
+		c.rtxTimer = nil
+	}
+}
+
+// 再送タイムアウト：最も古い未確認のセグメントを再送し、RTOを2倍にする
+// 残りの未確認のセグメントも失われている可能性が高いため、sndNxtをその直後に戻し、
+// 1セグメントに戻した輻輳ウィンドウの範囲でACKごとに送り直す（RFC 5681 3.1、RFC 6298 5）
+func (c *TCPConn) onRetransmitTimeout() {
+	if c.state == TCPClosed || len(c.rtxQueue) == 0 {
+		return
+	}
+	c.retries++
+	if c.retries > TCP_MAX_RETRIES {
+		c.sendSegment(TCP_FLAG_RST, c.sndNxt, nil)
+		c.terminate(ErrRetransmitTimeout)
+		return
+	}
+	c.rto *= 2
+	if c.rto > TCP_MAX_RTO {
+		c.rto = TCP_MAX_RTO
+	}
+	// 輻輳ウィンドウを1セグメントに戻してスロースタートからやり直す（RFC 5681 3.1）
+	c.ssthresh = c.lossThreshold()
+	c.cwnd = uint32(c.mss)
+	c.inRecovery = false
+	c.dupAcks = 0
+	// 相手が受信済みのデータを破棄している可能性があるため、SACKの印を消す（RFC 2018 8）
+	for i := range c.rtxQueue {
+		c.rtxQueue[i].sacked = false
+	}
+	if len(c.rtxQueue) > 1 {
+		c.rtxQueue = c.rtxQueue[:1]
+		c.sndNxt = c.rtxQueue[0].seq + c.rtxQueue[0].length
+		// 送り直すデータの後にFINも送り直す
+		c.finSent = false
+	}
+	seg := &c.rtxQueue[0]
+	seg.retransmitted = true
+	c.retransmit(seg)
+	c.startRetransmitTimer()
+}
+
+func (c *TCPConn) startPersistTimer() {
+	var timer *time.Timer
+	timer = time.AfterFunc(c.persistBackoff, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// 停止や再設定の後に発火したタイマーは無視する
+		if c.persistTimer != timer {
+			return
+		}
+		c.persistTimer = nil
+		c.onPersistTimeout()
+	})
+	c.persistTimer = timer
+}
+
+func (c *TCPConn) stopPersistTimer() {
+	if c.persistTimer != nil {
+		c.persistTimer.Stop()
+		c.persistTimer = nil
+	}
+}
+
+// ゼロウィンドウのプローブ：sndUna-1をシーケンス番号とするセグメントを送り、
+// 相手に現在のウィンドウを載せたACKを返させる。ウィンドウを開くACKが失われても止まらないように、
+// ウィンドウが開くまで間隔を2倍にしながら送り続ける
+func (c *TCPConn) onPersistTimeout() {
+	if c.state == TCPClosed || c.sndWnd > 0 || c.sndNxt-c.sndUna >= uint32(len(c.sndBuf)) {
+		return
+	}
+	c.sendSegment(TCP_FLAG_ACK, c.sndUna-1, nil)
+	c.persistBackoff *= 2
+	if c.persistBackoff > TCP_MAX_RTO {
+		c.persistBackoff = TCP_MAX_RTO
+	}
+	c.startPersistTimer()
+}
+
+// 再送キューのセグメントを送信バッファから作り直して送る
+func (c *TCPConn) retransmit(seg *tcpSegment) {
+	seq, length := seg.seq, seg.length
+	// 一部だけ確認応答されている場合は残りを送る
+	if seqLT(seq, c.sndUna) {
+		length -= c.sndUna - seq
+		seq = c.sndUna
+	}
+	off := seq - c.sndUna
+	end := off + length
+	if end > uint32(len(c.sndBuf)) {
+		end = uint32(len(c.sndBuf))
+	}
+	var data []byte
+	if off < end && seg.flags&TCP_FLAG_FIN == 0 {
+		data = c.sndBuf[off:end]
+	}
+	// 送信した後にMTUが下がった場合は、新しいMSSに分けて送り直す
+	c.fitMTU(c.sendSegment(seg.flags, seq, data))
+}
+
+// Nagleのアルゴリズムを使わない場合はtrueを設定する。既定はtrue
+// falseにすると、未確認のデータがある間の小さな書き込みをMSSまでまとめて送る
+func (c *TCPConn) SetNoDelay(noDelay bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.noDelay = noDelay
+	if noDelay && c.state != TCPClosed {
+		// まとめるために保留していたデータを送る
+		c.output()
+	}
+	return nil
+}
+
+// 遅延ACKの有効・無効を切り替える。既定は無効
+// 有効にすると、順序通りに届いたMSS未満のセグメントへのACKを最大TCP_DELAYED_ACK_TIMEOUT保留し、
+// 送信するデータに載せるか2つ目のセグメントでまとめて返す
+func (c *TCPConn) SetDelayedAck(enabled bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delayedAck = enabled
+	if !enabled && c.ackPending && c.state != TCPClosed {
+		c.sendSegment(TCP_FLAG_ACK, c.sndNxt, nil)
+	}
+	return nil
+}
+
+// キープアライブを設定する
+// 有効にすると、idleの間セグメントを受け取らなかった場合にsndNxt-1をシーケンス番号とする
+// プローブを送り、応答が無ければintervalごとに送り直す。count回応答が無ければRSTを送って
+// コネクションを終了し、以降の読み書きはErrKeepAliveTimeoutを返す
+func (c *TCPConn) SetKeepAlive(enabled bool, idle, interval time.Duration, count int) error {
+	if enabled && (idle <= 0 || interval <= 0 || count <= 0) {
+		return fmt.Errorf("invalid keepalive: idle=%s interval=%s count=%d", idle, interval, count)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopKeepAliveTimer()
+	c.keepAlive = enabled
+	if !enabled || c.state == TCPClosed {
+		return nil
+	}
+	c.kaIdle = idle
+	c.kaInterval = interval
+	c.kaCount = count
+	c.kaProbes = 0
+	if c.lastRecv.IsZero() {
+		c.lastRecv = time.Now()
+	}
+	c.startKeepAliveTimer(idle)
+	return nil
+}
+
+func (c *TCPConn) startKeepAliveTimer(d time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// 停止や再設定の後に発火したタイマーは無視する
+		if c.kaTimer != timer {
+			return
+		}
+		c.kaTimer = nil
+		c.onKeepAliveTimeout()
+	})
+	c.kaTimer = timer
+}
+
+func (c *TCPConn) stopKeepAliveTimer() {
+	if c.kaTimer != nil {
+		c.kaTimer.Stop()
+		c.kaTimer = nil
+	}
+}
+
+// キープアライブのタイマー：idleの間受信が無ければプローブを送る
+// 未確認のデータがある間は再送タイマーに任せる
+func (c *TCPConn) onKeepAliveTimeout() {
+	if c.state == TCPClosed || !c.keepAlive {
+		return
+	}
+	if c.kaProbes == 0 {
+		if idle := time.Since(c.lastRecv); idle < c.kaIdle {
+			c.startKeepAliveTimer(c.kaIdle - idle)
+			return
+		}
+	}
+	if len(c.rtxQueue) > 0 || c.state != TCPEstablished && c.state != TCPCloseWait {
+		c.kaProbes = 0
+		c.startKeepAliveTimer(c.kaIdle)
+		return
+	}
+	if c.kaProbes >= c.kaCount {
+		c.sendSegment(TCP_FLAG_RST, c.sndNxt, nil)
+		c.terminate(ErrKeepAliveTimeout)
+		return
+	}
+	c.kaProbes++
+	c.sendSegment(TCP_FLAG_ACK, c.sndNxt-1, nil)
+	c.startKeepAliveTimer(c.kaInterval)
+}
+
+// 受信バッファの上限をバイト単位で設定する。既定はTCP_RECV_BUFFER_SIZE
+// 受信バッファが一杯になるとゼロウィンドウを通知し、Readで空きができるまで相手の送信を止める
+func (c *TCPConn) SetReadBufferSize(bytes int) error {
+	if bytes <= 0 {
+		return fmt.Errorf("invalid buffer size: %d", bytes)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rcvBufSize = bytes
+	if c.state != TCPClosed && c.state != TCPSynSent {
+		c.updateWindow()
+	}
+	return nil
+}
+
+// 送信バッファの上限をバイト単位で設定する。既定はTCP_SEND_BUFFER_SIZE
+// 送信済みで未確認のデータもこの上限に含まれ、空きが無い間Writeはブロックする
+func (c *TCPConn) SetWriteBufferSize(bytes int) error {
+	if bytes <= 0 {
+		return fmt.Errorf("invalid buffer size: %d", bytes)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sndBufSize = bytes
+	c.wakeup()
+	return nil
+}
+
+// コネクションの状態のスナップショット
+type ConnInfo struct {
+	Protocol uint8 // 常にPROTOCOL_TCP
+	Local    netip.AddrPort
+	Remote   netip.AddrPort
+	State    TCPState
+	// 送受信のシーケンス変数
+	SndUna uint32
+	SndNxt uint32
+	RcvNxt uint32
+	// 相手の受信ウィンドウ、最後に通知した自身の受信ウィンドウと輻輳ウィンドウ（いずれもバイト単位）
+	SndWnd uint32
+	RcvWnd uint32
+	Cwnd   uint32
+	// 送信したデータと、順序通りに受信したデータのバイト数（再送は含めない）
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// 現在の状態のスナップショットを返す
+func (c *TCPConn) Info() ConnInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConnInfo{
+		Protocol:      PROTOCOL_TCP,
+		Local:         c.local,
+		Remote:        c.remote,
+		State:         c.state,
+		SndUna:        c.sndUna,
+		SndNxt:        c.sndNxt,
+		RcvNxt:        c.rcvNxt,
+		SndWnd:        c.sndWnd,
+		RcvWnd:        c.rcvWndAdvertised,
+		Cwnd:          c.cwnd,
+		BytesSent:     c.bytesSent,
+		BytesReceived: c.bytesReceived,
+	}
+}
+
+// 現在の輻輳ウィンドウをバイト単位で返す
+func (c *TCPConn) CongestionWindow() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.cwnd)
+}
+
+// 現在のスロースタートの閾値をバイト単位で返す
+func (c *TCPConn) SlowStartThreshold() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.ssthresh)
+}
+
+// 現在の再送タイムアウトを返す
+func (c *TCPConn) RTO() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rto
+}
+
+// 状態が変化するまで待つ（c.muを保持して呼ぶ）
+// cancelが閉じられた場合はos.ErrDeadlineExceededを返す
+func (c *TCPConn) wait(cancel <-chan struct{}) error {
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-cancel:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// 受信したデータを読み込む
+// データが届くまでブロックし、コネクションが終了している場合はエラーを返す
+func (c *TCPConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.rcvBuf) == 0 {
+		if c.finRcvd {
+			return 0, io.EOF
+		}
+		if c.state == TCPClosed {
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline.wait()); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rcvBuf)
+	c.rcvBuf = c.rcvBuf[n:]
+
+	c.updateWindow()
+	return n, nil
+}
+
+// 緊急データ（帯域外データ）の1バイトを読み込む
+// 緊急ポインタを受け取っていてそのバイトがまだ届いていない場合は、届くまでブロックする
+// 読み込める緊急データが無い場合はErrNoUrgentDataを返す
+func (c *TCPConn) ReadOOB() (byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.hasOOB {
+		if !c.urgPending || c.finRcvd {
+			return 0, ErrNoUrgentData
+		}
+		if c.state == TCPClosed {
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline.wait()); err != nil {
+			return 0, err
+		}
+	}
+	c.hasOOB = false
+	return c.oob, nil
+}
+
+// データを送信する
+// 送信バッファに空きができるまでブロックする。相手の確認応答は待たない
+// 空きが無いまま書き込みの期限を過ぎた場合は、書き込めた分とErrWouldBlockを返す
+func (c *TCPConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(p)
+}
+
+// pを緊急データとして送信する
+// BSDと同じく、pの最後のバイトの次を緊急ポインタとし、相手のReadOOBではそのバイトだけを読める
+// 残りのバイトは通常のデータとして届く。送信バッファについてはWriteと同じ
+func (c *TCPConn) WriteUrgent(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finPending || c.state != TCPEstablished && c.state != TCPCloseWait {
+		return c.write(p)
+	}
+	c.sndUp = c.sndUna + uint32(len(c.sndBuf)) + uint32(len(p))
+	c.urgSend = true
+	return c.write(p)
+}
+
+// pを送信バッファに入れて送る（c.muを保持して呼ぶ）
+func (c *TCPConn) write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if c.finPending || c.state != TCPEstablished && c.state != TCPCloseWait {
+			if c.err != nil {
+				return written, c.err
+			}
+			return written, ErrConnClosed
+		}
+		space := c.sndBufSize - len(c.sndBuf)
+		if space <= 0 {
+			if err := c.wait(c.writeDeadline.wait()); err != nil {
+				return written, fmt.Errorf("%w: %w", ErrWouldBlock, err)
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > space {
+			n = space
+		}
+		c.sndBuf = append(c.sndBuf, p[written:written+n]...)
+		written += n
+		c.output()
+	}
+	return written, nil
+}
+
+// コネクションを閉じる
+// 送信バッファに残ったデータを送り終えた後にFINを送り、相手の確認応答とFINを待つ処理は
+// バックグラウンドで進む。能動的に閉じた側はTIME_WAITを経てポートを解放する
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case TCPClosed:
+		return ErrConnClosed
+	case TCPSynSent:
+		c.terminate(ErrConnClosed)
+		return nil
+	case TCPSynRcvd, TCPEstablished:
+		c.setState(TCPFinWait1)
+	case TCPCloseWait:
+		c.setState(TCPLastAck)
+	default:
+		// 既に終了処理中
+		return nil
+	}
+	c.finPending = true
+	c.output()
+	return nil
+}
+
+// コネクションを強制的に終了し、相手にRSTを送る
+func (c *TCPConn) Abort() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == TCPClosed {
+		return ErrConnClosed
+	}
+	c.sendSegment(TCP_FLAG_RST|TCP_FLAG_ACK, c.sndNxt, nil)
+	c.terminate(ErrConnClosed)
+	return nil
+}
@@ -0,0 +1,1232 @@
+package network
+
+import (
+	"bytes"     // データの比較
+	"context"   // 読み込みの期限
+	"errors"    // エラーの判定
+	"fmt"       // 違反の記録
+	"io"        // データの読み込み
+	"net"       // IPアドレスの表現
+	"net/netip" // アドレスの表現
+	"os"        // 期限切れのエラー
+	"sync"      // フックとテストの間の排他制御
+	"testing"
+	"time" // 待ち時間
+)
+
+var (
+	rawPeerIP  = net.IPv4(10, 0, 0, 1).To4()
+	rawStackIP = net.IPv4(10, 0, 0, 2).To4()
+)
+
+// 10.0.0.2のスタックと、その対向で生のパケットを読み書きするデバイスを作成する
+func rawPeer(t *testing.T) (*Stack, *NetDevice) {
+	t.Helper()
+	a, b := NewPipePair()
+	a.Bind()
+	b.Bind()
+	s, err := NewStack(a, netip.MustParseAddr("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		a.Close()
+		b.Close()
+	})
+	return s, b
+}
+
+// 10.0.0.1からスタックへTCPセグメントを送る
+func sendTCP(t *testing.T, dev *NetDevice, h TCPHeader, payload []byte) {
+	t.Helper()
+	if err := dev.WriteBytes(tcpPacket(t, rawPeerIP, rawStackIP, h, payload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// スタックが送ったTCPセグメントを1つ読み込む。TCP以外のパケットは読み飛ばす
+func readTCP(t *testing.T, dev *NetDevice) (*TCPHeader, []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for {
+		pkt, err := dev.ReadContext(ctx)
+		if err != nil {
+			t.Fatalf("no tcp segment: %s", err)
+		}
+		ip, seg, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+		if err != nil || ip.Protocol != PROTOCOL_TCP {
+			pkt.Release()
+			continue
+		}
+		h, payload, err := ParseTCP(seg, ip)
+		if err != nil {
+			t.Fatalf("tcp: %s", err)
+		}
+		payload = append([]byte(nil), payload...)
+		pkt.Release()
+		return h, payload
+	}
+}
+
+// 期限までにcondが成り立つのを待つ
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 生のSYNに対するSYN-ACKの各フィールドと、最後のACKで確立したコネクションを受け付けられること
+func TestTCPHandshakeSynAck(t *testing.T) {
+	s, dev := rawPeer(t)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 4096,
+		Options: TCPOptions{MSS: 1400, HasWindowScale: true, WindowScale: 2, SACKPermitted: true}}, nil)
+	h, _ := readTCP(t, dev)
+	if h.Flags != TCP_FLAG_SYN|TCP_FLAG_ACK {
+		t.Fatalf("flags %s, want SYN|ACK", TCPFlagsString(h.Flags))
+	}
+	if h.SrcPort != 80 || h.DstPort != 40000 {
+		t.Fatalf("ports %d -> %d", h.SrcPort, h.DstPort)
+	}
+	if h.Seq != 1000 || h.Ack != 5001 {
+		t.Fatalf("seq %d ack %d, want 1000 5001", h.Seq, h.Ack)
+	}
+	// SYN-ACKのウィンドウはスケールせず、受信バッファを16ビットに収めた値になる
+	if h.Window != TCP_MAX_WINDOW {
+		t.Fatalf("window %d, want %d", h.Window, TCP_MAX_WINDOW)
+	}
+	if h.Options.MSS != TCP_DEFAULT_MSS || !h.Options.HasWindowScale || h.Options.WindowScale != TCP_WINDOW_SCALE || !h.Options.SACKPermitted {
+		t.Fatalf("options %+v", h.Options)
+	}
+
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 1024}, nil)
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != TCPEstablished {
+		t.Fatalf("state %s", c.State())
+	}
+	if got := c.RemoteAddrPort(); got != netip.MustParseAddrPort("10.0.0.1:40000") {
+		t.Fatalf("remote %s", got)
+	}
+	c.mu.Lock()
+	sndWnd, mss := c.sndWnd, c.mss
+	c.mu.Unlock()
+	if sndWnd != 1024<<2 || mss != 1400 {
+		t.Fatalf("send window %d mss %d, want %d 1400", sndWnd, mss, 1024<<2)
+	}
+}
+
+// 生のピアと確立したコネクションを返す。ピアの次のシーケンス番号は5001、スタックの次は1001
+func rawEstablished(t *testing.T) (*TCPConn, *NetDevice) {
+	t.Helper()
+	s, dev := rawPeer(t)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 0xffff}, nil)
+	readTCP(t, dev)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, dev
+}
+
+// 受信ウィンドウの外のセグメントやウィンドウ内の不正確なRST、SYNには、現在の番号でACKを返してコネクションを残すこと
+func TestTCPUnacceptableSegments(t *testing.T) {
+	c, dev := rawEstablished(t)
+	for _, tc := range []struct {
+		name    string
+		h       TCPHeader
+		payload []byte
+	}{
+		{"beyond window", TCPHeader{Seq: 5001 + 1<<20, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH}, []byte("x")},
+		{"old data", TCPHeader{Seq: 4000, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH}, []byte("x")},
+		{"rst in window", TCPHeader{Seq: 5001 + 100, Flags: TCP_FLAG_RST}, nil},
+		{"syn in window", TCPHeader{Seq: 5001 + 100, Flags: TCP_FLAG_SYN}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := tc.h
+			h.SrcPort, h.DstPort, h.Window = 40000, 80, 0xffff
+			sendTCP(t, dev, h, tc.payload)
+			ack, _ := readTCP(t, dev)
+			if ack.Flags != TCP_FLAG_ACK || ack.Seq != 1001 || ack.Ack != 5001 {
+				t.Fatalf("got %s seq %d ack %d, want ACK seq 1001 ack 5001", TCPFlagsString(ack.Flags), ack.Seq, ack.Ack)
+			}
+			if c.State() != TCPEstablished {
+				t.Fatalf("state %s", c.State())
+			}
+		})
+	}
+
+	// ウィンドウの外のRSTは応答せずに無視する
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001 + 1<<20, Flags: TCP_FLAG_RST}, nil)
+	// rcvNxtと一致するRSTでリセットする
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Flags: TCP_FLAG_RST}, nil)
+	waitFor(t, "reset", func() bool { return c.State() == TCPClosed })
+}
+
+// 最後のACKにFINが載っている場合も、FINを取り込んで確認応答すること
+func TestTCPHandshakeAckWithFin(t *testing.T) {
+	s, dev := rawPeer(t)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 0xffff}, nil)
+	readTCP(t, dev)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_FIN, Window: 0xffff}, nil)
+	h, _ := readTCP(t, dev)
+	if !h.Has(TCP_FLAG_ACK) || h.Ack != 5002 {
+		t.Fatalf("got %s ack %d, want ACK of the FIN (5002)", TCPFlagsString(h.Flags), h.Ack)
+	}
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.State() != TCPCloseWait {
+		t.Fatalf("state %s, want CLOSE_WAIT", c.State())
+	}
+}
+
+// sbの80番で受け付けたコネクションと、saから接続したコネクションを返す
+func tcpPair(t *testing.T, sa, sb *Stack) (*TCPConn, *TCPConn) {
+	t.Helper()
+	l, err := sb.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan *TCPConn, 1)
+	go func() {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	client, err := sa.DialTCPTimeout(netip.MustParseAddrPort("10.0.0.2:80"), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Abort()
+		server.Abort()
+	})
+	return client, server
+}
+
+// sの送信するTCPセグメントをfに渡す。fがtrueを返したセグメントは破棄する
+// fはデバイスの送信の経路から呼ばれるため、コネクションのメソッドを呼んではならない
+func tcpEgressHook(s *Stack, f func(h *TCPHeader, payload []byte) bool) {
+	s.dev.(*NetDevice).SetEgressHook(func(pkt Packet) (HookAction, Packet) {
+		ip, seg, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+		if err != nil || ip.Protocol != PROTOCOL_TCP {
+			return HookAccept, pkt
+		}
+		h, payload, err := parseTCP(seg, ip, false)
+		if err != nil {
+			return HookAccept, pkt
+		}
+		if f(h, payload) {
+			return HookDrop, pkt
+		}
+		return HookAccept, pkt
+	})
+}
+
+// connからn バイトを読み込む
+func readN(t *testing.T, c *TCPConn, n int) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, n)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("read %d bytes: %s", n, err)
+	}
+	return got
+}
+
+// 確認応答が失われた場合、RTOの後に未確認のセグメントを再送し、RTOを2倍にすること
+func TestTCPRetransmitAfterDroppedAck(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+
+	var mu sync.Mutex
+	dropped, sent := 0, map[uint32]int{}
+	tcpEgressHook(sb, func(h *TCPHeader, payload []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if dropped < 1 && h.Has(TCP_FLAG_ACK) && len(payload) == 0 {
+			dropped++
+			return true
+		}
+		return false
+	})
+	tcpEgressHook(sa, func(h *TCPHeader, payload []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(payload) > 0 {
+			sent[h.Seq]++
+		}
+		return false
+	})
+	rto := client.RTO()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, server, 5); string(got) != "hello" {
+		t.Fatalf("got %q", got)
+	}
+	waitFor(t, "retransmission", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, n := range sent {
+			if n >= 2 {
+				return true
+			}
+		}
+		return false
+	})
+	if got := client.RTO(); got != 2*rto {
+		t.Fatalf("rto %s after a timeout, want %s", got, 2*rto)
+	}
+	waitFor(t, "acknowledgement", func() bool { return client.Info().SndUna == client.Info().SndNxt })
+}
+
+// 1つのウィンドウのセグメントが全て失われても、1回の再送タイムアウトの後はACKごとに残りを送り直すこと
+// 先頭だけを再送する場合は、失われたセグメントごとに2倍に伸びたRTOを待つことになる
+func TestTCPRetransmitTimeoutGoBack(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+
+	var mu sync.Mutex
+	drop := true
+	tcpEgressHook(sa, func(h *TCPHeader, payload []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return drop && len(payload) > 0
+	})
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "window in flight", func() bool {
+		info := client.Info()
+		return info.SndNxt-info.SndUna >= 3*TCP_DEFAULT_MSS
+	})
+	mu.Lock()
+	drop = false
+	mu.Unlock()
+
+	rto := client.RTO()
+	start := time.Now()
+	if got := readN(t, server, len(data)); !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+	// 初回の再送タイムアウトと、その後のスロースタートの往復だけで届く
+	if elapsed := time.Since(start); elapsed > 2*rto {
+		t.Fatalf("recovered in %s, want within %s", elapsed, 2*rto)
+	}
+}
+
+// 複数のセグメントに分かれるデータを両方向に送り、1バイトも違わずに届くこと
+func TestTCPStreamIntegrity(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+	up := make([]byte, 20*TCP_DEFAULT_MSS+123)
+	down := make([]byte, 7*TCP_DEFAULT_MSS+1)
+	for i := range up {
+		up[i] = byte(i * 7)
+	}
+	for i := range down {
+		down[i] = byte(i*13 + 1)
+	}
+	go client.Write(up)
+	go server.Write(down)
+	if got := readN(t, server, len(up)); !bytes.Equal(got, up) {
+		t.Fatal("client to server data differs")
+	}
+	if got := readN(t, client, len(down)); !bytes.Equal(got, down) {
+		t.Fatal("server to client data differs")
+	}
+	waitFor(t, "acknowledgement", func() bool {
+		info := client.Info()
+		return info.SndUna == info.SndNxt
+	})
+	if got := server.Info().BytesReceived; got != uint64(len(up)) {
+		t.Fatalf("server received %d bytes, want %d", got, len(up))
+	}
+}
+
+// 順序が入れ替わったセグメントは保持して重複ACKを返し、欠けた部分が届いた時にまとめて渡すこと
+// 読まれていないデータの分だけ広告するウィンドウが狭まること
+func TestTCPOutOfOrderSegments(t *testing.T) {
+	c, dev := rawEstablished(t)
+	// ウィンドウスケールが無いため、16ビットに収まる大きさにする
+	c.SetReadBufferSize(1000)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5004, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, []byte("def"))
+	dup, _ := readTCP(t, dev)
+	if dup.Ack != 5001 {
+		t.Fatalf("ack %d for an out-of-order segment, want 5001", dup.Ack)
+	}
+	if c.Info().RcvNxt != 5001 {
+		t.Fatalf("rcv.nxt %d advanced past the gap", c.Info().RcvNxt)
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, []byte("abc"))
+	ack, _ := readTCP(t, dev)
+	if ack.Ack != 5007 {
+		t.Fatalf("ack %d after filling the gap, want 5007", ack.Ack)
+	}
+	if dup.Window != 1000 || ack.Window != 1000-6 {
+		t.Fatalf("windows %d and %d, want 1000 and %d with 6 unread bytes", dup.Window, ack.Window, 1000-6)
+	}
+	if got := readN(t, c, 6); string(got) != "abcdef" {
+		t.Fatalf("got %q, want abcdef", got)
+	}
+}
+
+// 相手のウィンドウが0の間はデータを送らずにプローブを送り、ウィンドウが開いたらデータを送ること
+func TestTCPZeroWindowProbe(t *testing.T) {
+	c, dev := rawEstablished(t)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0}, nil)
+	waitFor(t, "zero window", func() bool { return c.Info().SndWnd == 0 })
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	probe, payload := readTCP(t, dev)
+	// sndUna-1を使い、相手にウィンドウを載せたACKを返させる
+	if probe.Seq != 1000 || len(payload) != 0 {
+		t.Fatalf("probe seq %d with %d bytes, want seq 1000 without data", probe.Seq, len(payload))
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 4096}, nil)
+	h, data := readTCP(t, dev)
+	if h.Seq != 1001 || string(data) != "hello" {
+		t.Fatalf("seq %d data %q after the window opened, want 1001 hello", h.Seq, data)
+	}
+}
+
+// スタックが送ったセグメントのフラグと番号を確かめる
+func expectTCP(t *testing.T, dev *NetDevice, flags uint8, seq, ack uint32) {
+	t.Helper()
+	h, _ := readTCP(t, dev)
+	if h.Flags != flags || h.Seq != seq || h.Ack != ack {
+		t.Fatalf("got %s seq %d ack %d, want %s seq %d ack %d", TCPFlagsString(h.Flags), h.Seq, h.Ack, TCPFlagsString(flags), seq, ack)
+	}
+}
+
+// 状態がwantであることを確かめる
+func expectState(t *testing.T, c *TCPConn, want TCPState) {
+	t.Helper()
+	waitFor(t, want.String(), func() bool { return c.State() == want })
+}
+
+// 能動的に閉じた側はFIN_WAIT_1、FIN_WAIT_2、TIME_WAITを経て、2*MSLの後にコネクションを解放すること
+func TestTCPActiveClose(t *testing.T) {
+	c, dev := rawEstablished(t)
+	c.tcp.SetTimeWaitDuration(100 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectTCP(t, dev, TCP_FLAG_FIN|TCP_FLAG_ACK, 1001, 5001)
+	expectState(t, c, TCPFinWait1)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1002, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectState(t, c, TCPFinWait2)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1002, Flags: TCP_FLAG_FIN | TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_ACK, 1002, 5002)
+	expectState(t, c, TCPTimeWait)
+	// 再送されてきたFINにもACKを返す
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1002, Flags: TCP_FLAG_FIN | TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_ACK, 1002, 5002)
+	expectState(t, c, TCPClosed)
+	if conns := c.tcp.Connections(); len(conns) != 0 {
+		t.Fatalf("%d connections remain after TIME_WAIT", len(conns))
+	}
+}
+
+// 相手から閉じられた場合はCLOSE_WAITでEOFを返し、CloseでLAST_ACKを経て解放すること
+func TestTCPPassiveClose(t *testing.T) {
+	c, dev := rawEstablished(t)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_FIN | TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_ACK, 1001, 5002)
+	expectState(t, c, TCPCloseWait)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("read %d bytes, %v, want EOF", n, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectTCP(t, dev, TCP_FLAG_FIN|TCP_FLAG_ACK, 1001, 5002)
+	expectState(t, c, TCPLastAck)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5002, Ack: 1002, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectState(t, c, TCPClosed)
+}
+
+// 両側が同時にFINを送った場合はCLOSINGを経てTIME_WAITに入ること
+func TestTCPSimultaneousClose(t *testing.T) {
+	c, dev := rawEstablished(t)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectTCP(t, dev, TCP_FLAG_FIN|TCP_FLAG_ACK, 1001, 5001)
+	// こちらのFINを確認しないFIN
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_FIN | TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_ACK, 1002, 5002)
+	expectState(t, c, TCPClosing)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5002, Ack: 1002, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectState(t, c, TCPTimeWait)
+}
+
+// スタック同士で両側から閉じ、双方がデータを受け取り終えてから閉じること
+func TestTCPCloseBetweenStacks(t *testing.T) {
+	sa, sb := stackPair(t)
+	sa.TCP().SetTimeWaitDuration(100 * time.Millisecond)
+	client, server := tcpPair(t, sa, sb)
+	if _, err := client.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if got := readN(t, server, 3); string(got) != "bye" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+	server.Close()
+	expectState(t, server, TCPClosed)
+	expectState(t, client, TCPClosed)
+}
+
+// 応答しない相手には、idleの後にintervalごとに指定した回数のプローブを送り、RSTを送って終了すること
+func TestTCPKeepAliveTimeout(t *testing.T) {
+	c, dev := rawEstablished(t)
+	if err := c.SetKeepAlive(true, 50*time.Millisecond, 30*time.Millisecond, 3); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		// sndNxt-1を使い、相手にACKを返させる
+		expectTCP(t, dev, TCP_FLAG_ACK, 1000, 5001)
+	}
+	expectTCP(t, dev, TCP_FLAG_RST, 1001, 0)
+	expectState(t, c, TCPClosed)
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrKeepAliveTimeout) {
+		t.Fatalf("read got %v, want ErrKeepAliveTimeout", err)
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, ErrKeepAliveTimeout) {
+		t.Fatalf("write got %v, want ErrKeepAliveTimeout", err)
+	}
+}
+
+// プローブに応答する相手とのコネクションは、countを超えてプローブを送っても残ること
+func TestTCPKeepAliveAnswered(t *testing.T) {
+	c, dev := rawEstablished(t)
+	if err := c.SetKeepAlive(true, 30*time.Millisecond, 30*time.Millisecond, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		expectTCP(t, dev, TCP_FLAG_ACK, 1000, 5001)
+		sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	}
+	if c.State() != TCPEstablished {
+		t.Fatalf("state %s after answered probes", c.State())
+	}
+	if err := c.SetKeepAlive(true, 0, time.Second, 1); err == nil {
+		t.Fatal("accepted zero idle")
+	}
+}
+
+// ウィンドウスケールを付けたSYNで確立したコネクションを返す。相手のシフト数は2
+func rawEstablishedScaled(t *testing.T) (*TCPConn, *NetDevice) {
+	t.Helper()
+	s, dev := rawPeer(t)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 0xffff,
+		Options: TCPOptions{HasWindowScale: true, WindowScale: 2}}, nil)
+	readTCP(t, dev)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0x8000}, nil)
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, dev
+}
+
+// ウィンドウスケールを交渉した後は65535を超えるウィンドウを通知し、
+// スケールしたウィンドウの範囲でセグメントを受け入れること
+func TestTCPWindowScale(t *testing.T) {
+	c, dev := rawEstablishedScaled(t)
+	if got := c.Info().SndWnd; got != 0x8000<<2 {
+		t.Fatalf("send window %d, want %d", got, 0x8000<<2)
+	}
+	// 16ビットのウィンドウを超えるが、スケールしたウィンドウには入る位置
+	far := uint32(5001 + 100000)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: far, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0x8000}, []byte("far"))
+	ack, _ := readTCP(t, dev)
+	if wnd := uint32(ack.Window) << TCP_WINDOW_SCALE; wnd <= TCP_MAX_WINDOW {
+		t.Fatalf("advertised window %d does not exceed %d", wnd, TCP_MAX_WINDOW)
+	}
+	if ack.Ack != 5001 {
+		t.Fatalf("ack %d, want a duplicate ack of 5001", ack.Ack)
+	}
+	c.mu.Lock()
+	_, held := c.ooo[far]
+	c.mu.Unlock()
+	if !held {
+		t.Fatal("segment inside the scaled window was discarded")
+	}
+	// スケールしたウィンドウも超える位置は捨てる
+	beyond := uint32(5001 + TCP_RECV_BUFFER_SIZE + 100)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: beyond, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0x8000}, []byte("beyond"))
+	readTCP(t, dev)
+	c.mu.Lock()
+	_, held = c.ooo[beyond]
+	c.mu.Unlock()
+	if held {
+		t.Fatal("segment beyond the scaled window was kept")
+	}
+}
+
+// 相手がウィンドウスケールを付けなかった場合は、SYN-ACKにも付けずにスケールしないウィンドウを使うこと
+func TestTCPWindowScaleNotOffered(t *testing.T) {
+	s, dev := rawPeer(t)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 0x8000}, nil)
+	synAck, _ := readTCP(t, dev)
+	if synAck.Options.HasWindowScale {
+		t.Fatal("syn-ack offers window scale to a peer without it")
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0x8000}, nil)
+	c, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Info().SndWnd; got != 0x8000 {
+		t.Fatalf("send window %d, want %d unscaled", got, 0x8000)
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0x8000}, []byte("x"))
+	ack, _ := readTCP(t, dev)
+	if ack.Window != TCP_MAX_WINDOW {
+		t.Fatalf("window %d, want %d", ack.Window, TCP_MAX_WINDOW)
+	}
+}
+
+// スタック同士では互いにウィンドウスケールを交渉すること
+func TestTCPWindowScaleBetweenStacks(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	readN(t, server, 1)
+	waitFor(t, "scaled window", func() bool { return client.Info().SndWnd > TCP_MAX_WINDOW })
+}
+
+// dの間スタックがTCPセグメントを送らないことを確かめる
+func expectNoTCP(t *testing.T, dev *NetDevice, d time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	for {
+		pkt, err := dev.ReadContext(ctx)
+		if err != nil {
+			return
+		}
+		ip, seg, err := ParseIPv4(pkt.Buf[:pkt.Len()])
+		if err == nil && ip.Protocol == PROTOCOL_TCP {
+			h, payload, _ := parseTCP(seg, ip, false)
+			pkt.Release()
+			t.Fatalf("unexpected %s seq %d with %d bytes", TCPFlagsString(h.Flags), h.Seq, len(payload))
+		}
+		pkt.Release()
+	}
+}
+
+// Nagleのアルゴリズムでは未確認のデータがある間の小さな書き込みをまとめ、TCP_NODELAYではそれぞれ送ること
+func TestTCPNagle(t *testing.T) {
+	c, dev := rawEstablished(t)
+	c.SetNoDelay(false)
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, data := readTCP(t, dev)
+	if h.Seq != 1001 || string(data) != "a" {
+		t.Fatalf("seq %d data %q, want 1001 a", h.Seq, data)
+	}
+	expectNoTCP(t, dev, 100*time.Millisecond)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1002, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	h, data = readTCP(t, dev)
+	if h.Seq != 1002 || string(data) != "bc" {
+		t.Fatalf("seq %d data %q, want the coalesced 1002 bc", h.Seq, data)
+	}
+
+	// 未確認の"bc"が残っていても書き込みごとに送る
+	c.SetNoDelay(true)
+	for i, s := range []string{"d", "e"} {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		h, data = readTCP(t, dev)
+		if h.Seq != uint32(1004+i) || string(data) != s {
+			t.Fatalf("seq %d data %q, want %d %s", h.Seq, data, 1004+i, s)
+		}
+	}
+}
+
+// 遅延ACKは小さなセグメント1つへのACKを保留し、2つ目のセグメント、順序の入れ替わり、
+// MSSのセグメントにはすぐにACKを返すこと
+func TestTCPDelayedAck(t *testing.T) {
+	c, dev := rawEstablished(t)
+	c.SetDelayedAck(true)
+	c.mu.Lock()
+	mss := int(c.mss)
+	c.mu.Unlock()
+	seq := uint32(5001)
+	send := func(off uint32, n int) {
+		sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: seq + off, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, make([]byte, n))
+	}
+	// 即座に返すACKの期限。保留したACKはTCP_DELAYED_ACK_TIMEOUTの後になる
+	prompt := TCP_DELAYED_ACK_TIMEOUT / 2
+	expectAck := func(what string, ack uint32, immediate bool, start time.Time) {
+		t.Helper()
+		h, _ := readTCP(t, dev)
+		elapsed := time.Since(start)
+		if h.Ack != ack {
+			t.Fatalf("%s: ack %d, want %d", what, h.Ack, ack)
+		}
+		if immediate && elapsed >= prompt {
+			t.Fatalf("%s: ack after %s, want immediately", what, elapsed)
+		}
+		if !immediate && elapsed < prompt {
+			t.Fatalf("%s: ack after %s, want it delayed", what, elapsed)
+		}
+	}
+
+	start := time.Now()
+	send(0, 10)
+	seq += 10
+	expectAck("single segment", seq, false, start)
+
+	start = time.Now()
+	send(0, 10)
+	send(10, 10)
+	seq += 20
+	expectAck("second segment", seq, true, start)
+
+	start = time.Now()
+	send(100, 10)
+	expectAck("out of order", seq, true, start)
+	// 欠けた部分を埋めたセグメントにもすぐに返す
+	start = time.Now()
+	send(0, 100)
+	seq += 110
+	expectAck("gap filled", seq, true, start)
+
+	start = time.Now()
+	send(0, mss)
+	seq += uint32(mss)
+	expectAck("full-sized segment", seq, true, start)
+	readN(t, c, 10+20+110+mss)
+}
+
+// 閉じたポートへのセグメントには、ACKの有無に応じた番号でRSTを返すこと（RFC 793 p.36）
+func TestTCPResetClosedPort(t *testing.T) {
+	_, dev := rawPeer(t)
+	// ACKが無ければSEG.SEQ+SEG.LENを確認応答する
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 81, Seq: 7000, Flags: TCP_FLAG_PSH, Window: 0xffff}, []byte("hello"))
+	expectTCP(t, dev, TCP_FLAG_RST|TCP_FLAG_ACK, 0, 7005)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 81, Seq: 7000, Flags: TCP_FLAG_SYN, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_RST|TCP_FLAG_ACK, 0, 7001)
+	// ACKがあればSEG.ACKをシーケンス番号にする
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 81, Seq: 7000, Ack: 300, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, []byte("hello"))
+	expectTCP(t, dev, TCP_FLAG_RST, 300, 0)
+	// RSTにはRSTを返さない
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 81, Seq: 7000, Flags: TCP_FLAG_RST}, nil)
+	expectNoTCP(t, dev, 100*time.Millisecond)
+}
+
+// LISTENへのACK、SYN_RCVDとSYN_SENTでの受け入れられないACKにはSEG.ACKでRSTを返し、待ち受けや接続は続けること
+func TestTCPResetUnacceptableAck(t *testing.T) {
+	s, dev := rawPeer(t)
+	s.SetISNGenerator(func() uint32 { return 1000 })
+	l, err := s.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5000, Ack: 999, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_RST, 999, 0)
+
+	// 半開きのSYN_RCVD
+	sendTCP(t, dev, TCPHeader{SrcPort: 40001, DstPort: 80, Seq: 5000, Flags: TCP_FLAG_SYN, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_SYN|TCP_FLAG_ACK, 1000, 5001)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40001, DstPort: 80, Seq: 5001, Ack: 4242, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	expectTCP(t, dev, TCP_FLAG_RST, 4242, 0)
+	sendTCP(t, dev, TCPHeader{SrcPort: 40001, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	if _, err := l.AcceptTCP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// SYN_SENTで自身のSYNを確認しないSYN-ACK
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := s.DialTCPTimeout(netip.MustParseAddrPort("10.0.0.1:80"), 3*time.Second)
+		dialed <- err
+	}()
+	syn, _ := readTCP(t, dev)
+	if syn.Flags != TCP_FLAG_SYN {
+		t.Fatalf("got %s, want SYN", TCPFlagsString(syn.Flags))
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 80, DstPort: syn.SrcPort, Seq: 9000, Ack: syn.Seq + 100, Flags: TCP_FLAG_SYN | TCP_FLAG_ACK, Window: 0xffff}, nil)
+	h, _ := readTCP(t, dev)
+	if h.Flags != TCP_FLAG_RST || h.Seq != syn.Seq+100 {
+		t.Fatalf("got %s seq %d, want RST seq %d", TCPFlagsString(h.Flags), h.Seq, syn.Seq+100)
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 80, DstPort: syn.SrcPort, Seq: 9000, Ack: syn.Seq + 1, Flags: TCP_FLAG_SYN | TCP_FLAG_ACK, Window: 0xffff}, nil)
+	if err := <-dialed; err != nil {
+		t.Fatalf("dial after the reset: %s", err)
+	}
+}
+
+// 途中のセグメントが1つ失われた場合、受信側はSACKで後続の受信を通知し、送信側はそのセグメントだけを再送すること
+func TestTCPSACKRetransmitsOnlyHole(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+	lost := client.Info().SndNxt + TCP_DEFAULT_MSS
+
+	var mu sync.Mutex
+	sent := map[uint32]int{}
+	var sacks []SACKBlock
+	tcpEgressHook(sa, func(h *TCPHeader, payload []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(payload) == 0 {
+			return false
+		}
+		sent[h.Seq]++
+		return h.Seq == lost && sent[h.Seq] == 1
+	})
+	tcpEgressHook(sb, func(h *TCPHeader, payload []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		sacks = append(sacks, h.Options.SACKBlocks...)
+		return false
+	})
+
+	data := make([]byte, 10*TCP_DEFAULT_MSS)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go client.Write(data)
+	if got := readN(t, server, len(data)); !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for seq, n := range sent {
+		if seq == lost && n != 2 {
+			t.Fatalf("lost segment %d sent %d times, want 2", seq, n)
+		}
+		if seq != lost && n != 1 {
+			t.Fatalf("segment %d sent %d times, want 1", seq, n)
+		}
+	}
+	if len(sacks) == 0 || sacks[0].Left != lost+TCP_DEFAULT_MSS {
+		t.Fatalf("sack blocks %v, want the first to start at %d", sacks, lost+TCP_DEFAULT_MSS)
+	}
+}
+
+// 損失を検出すると輻輳ウィンドウを送信中のデータの半分にし、その後の確認応答で再び広げること
+// 新しいデータを送る時の送信中のバイト数は、常に輻輳ウィンドウと相手のウィンドウの小さい方に収まること
+func TestTCPCongestionWindowOnLoss(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+	mss := uint32(TCP_DEFAULT_MSS)
+	lost := client.Info().SndNxt + 30*mss
+
+	var mu sync.Mutex
+	var violation string
+	var lastCwnd, cwndAtLoss, ssthreshAtLoss uint32
+	resent := false
+	tcpEgressHook(sa, func(h *TCPHeader, payload []byte) bool {
+		if len(payload) == 0 {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// 送信の経路ではclientのc.muを保持している
+		c := client
+		if seqGE(h.Seq, c.sndMax) {
+			wnd := c.cwnd
+			if c.sndWnd < wnd {
+				wnd = c.sndWnd
+			}
+			if flight := h.Seq + uint32(len(payload)) - c.sndUna; flight > wnd && violation == "" {
+				violation = fmt.Sprintf("%d bytes in flight with cwnd %d and rwnd %d", flight, c.cwnd, c.sndWnd)
+			}
+			if !resent {
+				lastCwnd = c.cwnd
+			}
+			return h.Seq == lost
+		}
+		if h.Seq == lost && !resent {
+			resent = true
+			cwndAtLoss, ssthreshAtLoss = c.cwnd, c.ssthresh
+		}
+		return false
+	})
+
+	data := make([]byte, 120*mss)
+	go client.Write(data)
+	readN(t, server, len(data))
+	waitFor(t, "acknowledgement", func() bool {
+		info := client.Info()
+		return info.SndUna == info.SndNxt
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if violation != "" {
+		t.Fatal(violation)
+	}
+	if !resent {
+		t.Fatal("lost segment was not retransmitted")
+	}
+	if ssthreshAtLoss > lastCwnd/2+mss || ssthreshAtLoss < 2*mss {
+		t.Fatalf("ssthresh %d after loss with cwnd %d, want about half", ssthreshAtLoss, lastCwnd)
+	}
+	if cwndAtLoss >= lastCwnd {
+		t.Fatalf("cwnd %d on loss did not shrink from %d", cwndAtLoss, lastCwnd)
+	}
+	if got := uint32(client.SlowStartThreshold()); got != ssthreshAtLoss {
+		t.Fatalf("ssthresh %d after recovery, want %d", got, ssthreshAtLoss)
+	}
+	if got := uint32(client.CongestionWindow()); got <= ssthreshAtLoss {
+		t.Fatalf("cwnd %d did not grow past ssthresh %d after recovery", got, ssthreshAtLoss)
+	}
+}
+
+// 同時オープン：SYN_SENTでACKの無いSYNを受け取るとSYN-ACKを返してSYN_RCVDに移り、
+// 相手のSYN-ACKかACKでESTABLISHEDになること
+func TestTCPSimultaneousOpen(t *testing.T) {
+	for _, final := range []uint8{TCP_FLAG_SYN | TCP_FLAG_ACK, TCP_FLAG_ACK} {
+		t.Run(TCPFlagsString(final), func(t *testing.T) {
+			s, dev := rawPeer(t)
+			s.SetISNGenerator(func() uint32 { return 1000 })
+			dialed := make(chan *TCPConn, 1)
+			go func() {
+				c, err := s.DialTCPTimeout(netip.MustParseAddrPort("10.0.0.1:80"), 3*time.Second)
+				if err != nil {
+					t.Error(err)
+				}
+				dialed <- c
+			}()
+			syn, _ := readTCP(t, dev)
+			if syn.Flags != TCP_FLAG_SYN || syn.Seq != 1000 {
+				t.Fatalf("got %s seq %d, want SYN seq 1000", TCPFlagsString(syn.Flags), syn.Seq)
+			}
+			port := syn.SrcPort
+			// 相手も同時に送ったSYN
+			sendTCP(t, dev, TCPHeader{SrcPort: 80, DstPort: port, Seq: 7000, Flags: TCP_FLAG_SYN, Window: 0xffff}, nil)
+			h, _ := readTCP(t, dev)
+			if h.Flags != TCP_FLAG_SYN|TCP_FLAG_ACK || h.Seq != 1000 || h.Ack != 7001 {
+				t.Fatalf("got %s seq %d ack %d, want SYN|ACK seq 1000 ack 7001", TCPFlagsString(h.Flags), h.Seq, h.Ack)
+			}
+			conns := s.Connections()
+			if len(conns) != 1 || conns[0].State != TCPSynRcvd {
+				t.Fatalf("connections %+v, want one in SYN_RCVD", conns)
+			}
+
+			seq := uint32(7000)
+			if final == TCP_FLAG_ACK {
+				seq = 7001
+			}
+			sendTCP(t, dev, TCPHeader{SrcPort: 80, DstPort: port, Seq: seq, Ack: 1001, Flags: final, Window: 0xffff}, nil)
+			c := <-dialed
+			if c == nil {
+				t.FailNow()
+			}
+			defer c.Abort()
+			info := c.Info()
+			if info.State != TCPEstablished || info.SndUna != 1001 || info.SndNxt != 1001 || info.RcvNxt != 7001 {
+				t.Fatalf("%s snd.una %d snd.nxt %d rcv.nxt %d, want ESTABLISHED 1001 1001 7001", info.State, info.SndUna, info.SndNxt, info.RcvNxt)
+			}
+			if _, err := c.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				h, data := readTCP(t, dev)
+				if len(data) == 0 {
+					continue
+				}
+				if h.Seq != 1001 || h.Ack != 7001 {
+					t.Fatalf("data seq %d ack %d, want 1001 7001", h.Seq, h.Ack)
+				}
+				break
+			}
+		})
+	}
+}
+
+// 受信バッファが一杯になるとゼロウィンドウを通知してそれ以上のデータを受け取らず、
+// 読み込んで空きができるとウィンドウの更新を通知すること
+func TestTCPReadBufferLimit(t *testing.T) {
+	c, dev := rawEstablished(t)
+	if err := c.SetReadBufferSize(3000); err != nil {
+		t.Fatal(err)
+	}
+	seq := uint32(5001)
+	for i, want := range []uint16{2000, 1000, 0} {
+		sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: seq, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, make([]byte, 1000))
+		seq += 1000
+		h, _ := readTCP(t, dev)
+		if h.Ack != seq || h.Window != want {
+			t.Fatalf("segment %d: ack %d window %d, want %d %d", i, h.Ack, h.Window, seq, want)
+		}
+	}
+	// ウィンドウを超えたデータは捨て、ゼロウィンドウのまま確認応答する
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: seq, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, []byte("x"))
+	expectTCP(t, dev, TCP_FLAG_ACK, 1001, seq)
+	if got := c.Info().BytesReceived; got != 3000 {
+		t.Fatalf("received %d bytes, want 3000", got)
+	}
+	// 相手からのゼロウィンドウのプローブにも現在のウィンドウで応答する
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: seq - 1, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	h, _ := readTCP(t, dev)
+	if h.Ack != seq || h.Window != 0 {
+		t.Fatalf("probe answered with ack %d window %d, want %d 0", h.Ack, h.Window, seq)
+	}
+
+	readN(t, c, 1500)
+	h, _ = readTCP(t, dev)
+	if h.Ack != seq || h.Window != 1500 {
+		t.Fatalf("window update ack %d window %d, want %d 1500", h.Ack, h.Window, seq)
+	}
+}
+
+// 送信バッファが一杯の間Writeはブロックし、書き込みの期限を過ぎると書き込めた分とErrWouldBlockを返すこと
+func TestTCPWriteBufferLimit(t *testing.T) {
+	c, dev := rawEstablished(t)
+	// 相手のウィンドウを閉じて送信バッファが空かないようにする
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK, Window: 0}, nil)
+	waitFor(t, "zero window", func() bool { return c.Info().SndWnd == 0 })
+	if err := c.SetWriteBufferSize(100); err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	n, err := c.Write(make([]byte, 150))
+	if n != 100 || !errors.Is(err, ErrWouldBlock) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("wrote %d bytes, %v, want 100 and ErrWouldBlock", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("write returned after %s without blocking", elapsed)
+	}
+	if err := c.SetWriteBufferSize(0); err == nil {
+		t.Fatal("accepted a zero buffer size")
+	}
+}
+
+// URGの載ったセグメントでは、緊急ポインタの手前の1バイト（BSDの解釈）をReadOOBで読め、
+// 残りのバイトは通常のデータとしてReadで読めること
+func TestTCPUrgentReceive(t *testing.T) {
+	c, dev := rawEstablished(t)
+	if _, err := c.ReadOOB(); !errors.Is(err, ErrNoUrgentData) {
+		t.Fatalf("got %v, want ErrNoUrgentData", err)
+	}
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH | TCP_FLAG_URG, Urgent: 4, Window: 0xffff}, []byte("abcX"))
+	readTCP(t, dev)
+	b, err := c.ReadOOB()
+	if err != nil || b != 'X' {
+		t.Fatalf("oob %q, %v, want X", b, err)
+	}
+	if got := readN(t, c, 3); string(got) != "abc" {
+		t.Fatalf("inline data %q, want abc", got)
+	}
+
+	// 緊急ポインタが先のセグメントを指している場合は、そのバイトが届くまで待つ
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5005, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH | TCP_FLAG_URG, Urgent: 4, Window: 0xffff}, []byte("de"))
+	readTCP(t, dev)
+	got := make(chan byte, 1)
+	go func() {
+		b, err := c.ReadOOB()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- b
+	}()
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5007, Ack: 1001, Flags: TCP_FLAG_ACK | TCP_FLAG_PSH, Window: 0xffff}, []byte("fYg"))
+	readTCP(t, dev)
+	select {
+	case b := <-got:
+		if b != 'Y' {
+			t.Fatalf("oob %q, want Y", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadOOB did not return after the urgent byte arrived")
+	}
+	if got := readN(t, c, 4); string(got) != "defg" {
+		t.Fatalf("inline data %q, want defg", got)
+	}
+}
+
+// WriteUrgentはURGを立て、最後のバイトの次を緊急ポインタとして送ること
+func TestTCPUrgentSend(t *testing.T) {
+	c, dev := rawEstablished(t)
+	if _, err := c.WriteUrgent([]byte("hi!")); err != nil {
+		t.Fatal(err)
+	}
+	h, data := readTCP(t, dev)
+	if !h.Has(TCP_FLAG_URG) || h.Urgent != 3 || string(data) != "hi!" {
+		t.Fatalf("got %s urgent %d data %q, want URG urgent 3 hi!", TCPFlagsString(h.Flags), h.Urgent, data)
+	}
+	// 緊急ポインタが確認応答された後はURGを立てない
+	sendTCP(t, dev, TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 5001, Ack: 1004, Flags: TCP_FLAG_ACK, Window: 0xffff}, nil)
+	waitFor(t, "acknowledgement", func() bool { return c.Info().SndUna == 1004 })
+	if _, err := c.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	h, _ = readTCP(t, dev)
+	if h.Has(TCP_FLAG_URG) {
+		t.Fatal("URG set after the urgent pointer was acknowledged")
+	}
+}
+
+// スタック同士で、緊急データの最後のバイトだけが帯域外で届くこと
+func TestTCPUrgentBetweenStacks(t *testing.T) {
+	sa, sb := stackPair(t)
+	client, server := tcpPair(t, sa, sb)
+	if _, err := client.WriteUrgent([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, server, 5); string(got) != "abdef" {
+		t.Fatalf("inline data %q, want abdef", got)
+	}
+	if b, err := server.ReadOOB(); err != nil || b != 'c' {
+		t.Fatalf("oob %q, %v, want c", b, err)
+	}
+}
+
+// 確立したコネクションがESTABLISHEDとして一覧に現れ、転送したバイト数とシーケンス変数を返すこと
+// 先に閉じた側にはTIME_WAITのコネクションが残ること
+func TestConnections(t *testing.T) {
+	sa, sb := stackPair(t)
+	l, err := sb.ListenTCP(80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dst := netip.MustParseAddrPort("10.0.0.2:80")
+	var clients []*TCPConn
+	for i := 0; i < 2; i++ {
+		c, err := sa.DialTCP(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.RemoteAddrPort() != clients[0].LocalAddrPort() {
+		server, other = other, server
+	}
+	defer other.Close()
+	if _, err := clients[0].Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "acknowledged data", func() bool {
+		info := clients[0].Info()
+		return info.SndUna == info.SndNxt
+	})
+	infos := sa.Connections()
+	if len(infos) != 2 {
+		t.Fatalf("%d connections, want 2", len(infos))
+	}
+	if infos[0].Local.Port() > infos[1].Local.Port() {
+		t.Fatalf("not sorted by local port: %d, %d", infos[0].Local.Port(), infos[1].Local.Port())
+	}
+	var info ConnInfo
+	for _, i := range infos {
+		if i.Local == clients[0].LocalAddrPort() {
+			info = i
+		}
+	}
+	if info.Protocol != PROTOCOL_TCP || info.Remote != dst || info.State != TCPEstablished {
+		t.Fatalf("connection %+v", info)
+	}
+	if info.BytesSent != 5 || info.BytesReceived != 0 || info.SndWnd == 0 || info.Cwnd == 0 {
+		t.Fatalf("connection %+v", info)
+	}
+	var peer ConnInfo
+	for _, i := range sb.Connections() {
+		if i.Remote == clients[0].LocalAddrPort() {
+			peer = i
+		}
+	}
+	if peer.State != TCPEstablished || peer.BytesReceived != 5 || peer.RcvNxt != info.SndNxt || peer.SndNxt != info.RcvNxt || peer.RcvWnd == 0 {
+		t.Fatalf("peer %+v, client %+v", peer, info)
+	}
+
+	clients[0].Close()
+	server.Close()
+	clients[1].Close()
+	waitFor(t, "time wait", func() bool {
+		for _, i := range sa.Connections() {
+			if i.Local == clients[0].LocalAddrPort() {
+				return i.State == TCPTimeWait
+			}
+		}
+		return false
+	})
+}
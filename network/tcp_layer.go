@@ -0,0 +1,424 @@
+package network
+
+import (
+	"encoding/binary" // ICMPに含まれるTCPヘッダの読み取り
+	"errors"          // エラーの生成
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+	"net/netip"       // アドレスとポートの表現
+	"os"              // タイムアウトのエラー
+	"sort"            // コネクションの一覧の整列
+	"sync"            // 排他制御
+	"sync/atomic"     // PMTUDとISNの生成関数の切り替え
+	"time"            // タイムアウトの管理
+)
+
+const (
+	TCP_DIAL_TIMEOUT = 10 * time.Second
+	// タイムアウトまでにSYNを再送する回数
+	TCP_SYN_RETRIES = 2
+	// セグメントの最大生存時間。TIME_WAITはこの2倍待つ
+	TCP_MSL = 30 * time.Second
+)
+
+var (
+	ErrConnReset   = errors.New("connection reset by peer")
+	ErrConnRefused = errors.New("connection refused")
+)
+
+// コネクション表のキー
+type tcpKey struct {
+	localPort uint16
+	remote    netip.AddrPort
+}
+
+// TCPの送受信を扱う
+// Stackから渡されたセグメントを4つ組（送信元・宛先のアドレスとポート）で振り分ける
+type TCP struct {
+	dev       Device
+	logger    Logger
+	ip        *ipv4Output
+	addr      netip.Addr
+	mu        sync.Mutex
+	listeners map[uint16]*TCPListener
+	conns     map[tcpKey]*TCPConn
+	timeWait  time.Duration
+	ports     *PortAllocator
+	// Path MTU Discoveryが有効ならDFを立てて送信する
+	pmtud atomic.Bool
+	// 初期シーケンス番号の生成。isnFuncが設定されていればそちらを使う
+	isn     *isnGenerator
+	isnFunc atomic.Pointer[func() uint32]
+}
+
+func newTCP(dev Device, ip *ipv4Output, addr netip.Addr, ports *PortAllocator) *TCP {
+	return &TCP{
+		dev:       dev,
+		logger:    loggerOf(dev),
+		ip:        ip,
+		addr:      addr,
+		ports:     ports,
+		listeners: make(map[uint16]*TCPListener),
+		conns:     make(map[tcpKey]*TCPConn),
+		timeWait:  2 * TCP_MSL,
+		isn:       newISNGenerator(),
+	}
+}
+
+// コネクションの初期送信シーケンス番号を返す
+func (t *TCP) newISS(local, remote netip.AddrPort) uint32 {
+	if f := t.isnFunc.Load(); f != nil {
+		return (*f)()
+	}
+	return t.isn.generate(local, remote)
+}
+
+// TIME_WAITの長さを設定する。既定は2*TCP_MSL
+func (t *TCP) SetTimeWaitDuration(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeWait = d
+}
+
+func (t *TCP) timeWaitDuration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timeWait
+}
+
+// コネクション表にある全てのコネクション（確立中やTIME_WAITを含む）の状態を返す
+// 表のロックはコネクションの一覧をコピーする間だけ取り、各コネクションの状態は個別に取得する
+// そのため返す一覧は同じ瞬間のものとは限らない。ローカルのポート、相手のアドレス順に並べる
+func (t *TCP) Connections() []ConnInfo {
+	t.mu.Lock()
+	conns := make([]*TCPConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Local.Port() != infos[j].Local.Port() {
+			return infos[i].Local.Port() < infos[j].Local.Port()
+		}
+		if c := infos[i].Remote.Addr().Compare(infos[j].Remote.Addr()); c != 0 {
+			return c < 0
+		}
+		return infos[i].Remote.Port() < infos[j].Remote.Port()
+	})
+	return infos
+}
+
+// 受信したセグメントをコネクションかリスナーに渡す
+// どちらも無い場合はRSTを返す
+func (t *TCP) deliver(ip *IPv4Header, b []byte) {
+	h, payload, err := parseTCP(b, ip, !checksumOffloaded(t.dev))
+	if err != nil {
+		t.logger.Debugf("tcp error: %s", err.Error())
+		return
+	}
+	src, _ := netip.AddrFromSlice(ip.Src.To4())
+	remote := netip.AddrPortFrom(src, h.SrcPort)
+
+	t.mu.Lock()
+	c := t.conns[tcpKey{h.DstPort, remote}]
+	l := t.listeners[h.DstPort]
+	t.mu.Unlock()
+
+	if c != nil {
+		c.handle(h, payload)
+		return
+	}
+	if l != nil {
+		l.handle(remote, h)
+		return
+	}
+	t.sendReset(netip.AddrPortFrom(t.addr, h.DstPort), remote, h, payload)
+}
+
+// ICMPのフラグメント化要求を該当するコネクションに渡す
+// transportは元のTCPヘッダの先頭8バイト（ポートとシーケンス番号）
+func (t *TCP) handlePathMTU(orig *IPv4Header, transport []byte, mtu int) {
+	if !t.pmtud.Load() || len(transport) < 8 || mtu < MIN_MTU {
+		return
+	}
+	dst, _ := netip.AddrFromSlice(orig.Dst.To4())
+	srcPort := binary.BigEndian.Uint16(transport[0:2])
+	remote := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(transport[2:4]))
+	seq := binary.BigEndian.Uint32(transport[4:8])
+
+	t.mu.Lock()
+	c := t.conns[tcpKey{srcPort, remote}]
+	t.mu.Unlock()
+	if c != nil {
+		c.handlePathMTU(seq, mtu)
+	}
+}
+
+// 受け付けられないセグメントに対してRSTを返す（RFC 793）
+// ACKがあればその確認応答番号を、無ければ0をシーケンス番号とする
+func (t *TCP) sendReset(local, remote netip.AddrPort, h *TCPHeader, payload []byte) {
+	if h.Has(TCP_FLAG_RST) {
+		return
+	}
+	rst := &TCPHeader{
+		SrcPort: local.Port(),
+		DstPort: remote.Port(),
+	}
+	if h.Has(TCP_FLAG_ACK) {
+		rst.Seq = h.Ack
+		rst.Flags = TCP_FLAG_RST
+	} else {
+		length := uint32(len(payload))
+		if h.Has(TCP_FLAG_SYN) {
+			length++
+		}
+		if h.Has(TCP_FLAG_FIN) {
+			length++
+		}
+		rst.Ack = h.Seq + length
+		rst.Flags = TCP_FLAG_RST | TCP_FLAG_ACK
+	}
+	t.output(local, remote, rst, nil)
+}
+
+// セグメントをIPv4パケットに包んでデバイスに書き込む
+func (t *TCP) output(local, remote netip.AddrPort, h *TCPHeader, payload []byte) error {
+	src := net.IP(local.Addr().AsSlice())
+	dst := net.IP(remote.Addr().AsSlice())
+	seg, err := h.MarshalWithPayload(payload, src, dst)
+	if err != nil {
+		return err
+	}
+	ip := IPv4Header{
+		Protocol: PROTOCOL_TCP,
+		Src:      src,
+		Dst:      dst,
+	}
+	if t.pmtud.Load() {
+		ip.Flags = IPV4_FLAG_DF
+	}
+	return t.ip.send(&ip, seg, nil)
+}
+
+func (t *TCP) addConn(c *TCPConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := tcpKey{c.local.Port(), c.remote}
+	if _, ok := t.conns[key]; ok {
+		return false
+	}
+	t.conns[key] = c
+	return true
+}
+
+func (t *TCP) removeConn(c *TCPConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := tcpKey{c.local.Port(), c.remote}
+	if t.conns[key] == c {
+		delete(t.conns, key)
+		// 能動的に開いたコネクションはエフェメラルポートを解放する
+		if c.listener == nil {
+			t.ports.Release(PROTOCOL_TCP, c.local.Port())
+		}
+	}
+}
+
+// dstに接続する。タイムアウトはTCP_DIAL_TIMEOUT
+func (t *TCP) Dial(dst netip.AddrPort) (*TCPConn, error) {
+	return t.DialTimeout(dst, TCP_DIAL_TIMEOUT)
+}
+
+// dstに接続する
+// SYNを送信してSYN-ACKを待ち、timeoutまでにTCP_SYN_RETRIES回SYNを再送する
+// 相手がRSTを返した場合はErrConnRefusedを返す
+// 同時オープンで相手のSYNを受け取った場合は、確立するまでSYNの代わりにSYN-ACKを再送する
+func (t *TCP) DialTimeout(dst netip.AddrPort, timeout time.Duration) (*TCPConn, error) {
+	if !dst.Addr().Is4() {
+		return nil, fmt.Errorf("invalid ipv4 address: %s", dst.Addr())
+	}
+	c, err := t.newActiveConn(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.iss = t.newISS(c.local, c.remote)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.state = TCPSynSent
+	if err := c.sendSegment(TCP_FLAG_SYN, c.iss, nil); err != nil {
+		c.terminate(err)
+		return nil, err
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	interval := timeout / (TCP_SYN_RETRIES + 1)
+	retry := time.NewTicker(interval)
+	defer retry.Stop()
+	for c.state == TCPSynSent || c.state == TCPSynRcvd {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+			c.mu.Lock()
+		case <-retry.C:
+			c.mu.Lock()
+			switch c.state {
+			case TCPSynSent:
+				c.sendSegment(TCP_FLAG_SYN, c.iss, nil)
+			case TCPSynRcvd:
+				c.sendSegment(TCP_FLAG_SYN|TCP_FLAG_ACK, c.iss, nil)
+			}
+		case <-deadline.C:
+			c.mu.Lock()
+			if c.state == TCPSynSent || c.state == TCPSynRcvd {
+				c.terminate(os.ErrDeadlineExceeded)
+			}
+		}
+	}
+	if c.state == TCPClosed {
+		return nil, fmt.Errorf("dial %s: %w", dst, c.err)
+	}
+	return c, nil
+}
+
+// エフェメラルポートを割り当てたコネクションを作成し、コネクション表に登録する
+func (t *TCP) newActiveConn(dst netip.AddrPort) (*TCPConn, error) {
+	port, err := t.ports.Allocate(PROTOCOL_TCP)
+	if err != nil {
+		return nil, err
+	}
+	c := newTCPConn(t, netip.AddrPortFrom(t.addr, port), dst)
+	if !t.addConn(c) {
+		t.ports.Release(PROTOCOL_TCP, port)
+		return nil, fmt.Errorf("connection %s -> %s already exists", c.local, dst)
+	}
+	return c, nil
+}
+
+// portで接続を待ち受ける。0の場合はエフェメラルポートを割り当てる
+func (t *TCP) Listen(port uint16) (*TCPListener, error) {
+	if port == 0 {
+		p, err := t.ports.Allocate(PROTOCOL_TCP)
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	} else if err := t.ports.Reserve(PROTOCOL_TCP, port); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := &TCPListener{
+		tcp:     t,
+		port:    port,
+		backlog: make(chan *TCPConn, QUEUE_SIZE),
+		done:    make(chan struct{}),
+	}
+	t.listeners[port] = l
+	return l, nil
+}
+
+// 接続を待ち受け、3ウェイハンドシェイクが完了したコネクションを受け付ける
+type TCPListener struct {
+	tcp     *TCP
+	port    uint16
+	backlog chan *TCPConn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// 待ち受けているアドレスとポートを返す
+func (l *TCPListener) AddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(l.tcp.addr, l.port)
+}
+
+// LISTEN：SYNを受け取るとSYN_RCVDのコネクションを作り、SYN-ACKを返す
+// ACKを含むセグメントは存在しないコネクションに向けたものとしてRSTを返す（RFC 793）
+func (l *TCPListener) handle(remote netip.AddrPort, h *TCPHeader) {
+	if h.Has(TCP_FLAG_RST) {
+		return
+	}
+	if h.Has(TCP_FLAG_ACK) {
+		l.tcp.sendReset(l.AddrPort(), remote, h, nil)
+		return
+	}
+	if !h.Has(TCP_FLAG_SYN) {
+		return
+	}
+	select {
+	case <-l.done:
+		return
+	default:
+	}
+
+	c := newTCPConn(l.tcp, l.AddrPort(), remote)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listener = l
+	c.irs = h.Seq
+	c.rcvNxt = h.Seq + 1
+	c.iss = l.tcp.newISS(c.local, c.remote)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.setSndWnd(h, uint32(h.Window))
+	c.applySynOptions(h)
+	c.state = TCPSynRcvd
+	if !l.tcp.addConn(c) {
+		return
+	}
+	c.sendSegment(TCP_FLAG_SYN|TCP_FLAG_ACK, c.iss, nil)
+}
+
+// 確立したコネクションを受付キューに入れる
+// キューが一杯の場合はコネクションをリセットする
+func (l *TCPListener) enqueue(c *TCPConn) {
+	select {
+	case l.backlog <- c:
+	default:
+		c.sendSegment(TCP_FLAG_RST, c.sndNxt, nil)
+		c.terminate(ErrConnReset)
+	}
+}
+
+// 確立したコネクションを1つ受け付ける
+func (l *TCPListener) AcceptTCP() (*TCPConn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.done:
+		return nil, ErrConnClosed
+	}
+}
+
+// 待ち受けを終了する。受け付けていないコネクションはリセットされる
+func (l *TCPListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.tcp.mu.Lock()
+		if l.tcp.listeners[l.port] == l {
+			delete(l.tcp.listeners, l.port)
+		}
+		l.tcp.mu.Unlock()
+		l.tcp.ports.Release(PROTOCOL_TCP, l.port)
+		for {
+			select {
+			case c := <-l.backlog:
+				c.Abort()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"net"  // net.Connとnet.Listenerのインターフェース
+	"time" // 期限の表現
+)
+
+// TCPConnとTCPListenerは標準ライブラリのnet.Connとnet.Listenerとして扱える
+// net/httpなどのサーバーをそのまま動かせる
+var (
+	_ net.Conn     = (*TCPConn)(nil)
+	_ net.Listener = (*TCPListener)(nil)
+)
+
+// 自身のアドレスを*net.TCPAddrで返す
+func (c *TCPConn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.local)
+}
+
+// 相手のアドレスを*net.TCPAddrで返す
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.remote)
+}
+
+// 読み込みの期限を設定する。ゼロ値の場合は期限を解除する
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// 書き込みの期限を設定する。ゼロ値の場合は期限を解除する
+// 書き込みは送信バッファに空きがあれば即座に完了するため、期限は送信バッファが一杯の場合にのみ効く
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// 読み書き両方の期限を設定する
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// net.Listenerの実装
+// 確立したコネクションを1つ受け付ける
+func (l *TCPListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 待ち受けているアドレスを*net.TCPAddrで返す
+func (l *TCPListener) Addr() net.Addr {
+	return net.TCPAddrFromAddrPort(l.AddrPort())
+}
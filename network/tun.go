@@ -1,149 +1,789 @@
 package network
 
 import (
-	"context" // リクエストの伝播、タイムアウトの設定、キャンセル通知
-	"fmt"     // 文字列の生成や出力、スキャン
-	"log"     // ログの出力
-	"os"      // ファイルの操作やプロセスの実行、環境変数の取得
-	"syscall" // ファイル操作やプロセス管理、ネットワーク操作
-	"unsafe"  // 低レベルなメモリ操作を行う
+	"context"     // リクエストの伝播、タイムアウトの設定、キャンセル通知
+	"errors"      // エラーの生成
+	"fmt"         // 文字列の生成や出力、スキャン
+	"io"          // 入出力の基本インターフェース
+	"os"          // ファイルの操作やプロセスの実行、環境変数の取得
+	"sync"        // 排他制御やゴルーチンの待ち合わせ
+	"sync/atomic" // フラグの更新
+	"syscall"     // ファイル操作やプロセス管理、ネットワーク操作
+	"time"        // 時刻の表現
 )
 
-type ifreq struct {
-	ifrName  [16]byte
-	ifrFlags int16
-}
-
 const (
-	TUNSETIFF   = 0x400454ca
-	IFF_TUN     = 0x0001
-	IFF_NO_PI   = 0x1000
+	IFNAMSIZ    = 16
 	PACKET_SIZE = 2048
 	QUEUE_SIZE  = 10
+	// 連続してこの回数だけ読み込みに失敗するとデバイスを閉じる
+	MAX_READ_ERRORS = 10
+	// recvmmsg/sendmmsgで一度に扱うパケット数
+	READ_BATCH_SIZE = 8
+	MAX_BATCH_SIZE  = 64
+)
+
+var ErrDeviceClosed = errors.New("device closed")
+
+// TUN/TAPデバイスを作成できないプラットフォームでNewTun/NewTapが返すエラー
+var ErrUnsupportedPlatform = errors.New("tun/tap devices are not supported on this platform")
+
+// デバイスを開けなかった原因。NewTun/NewTapはシステムコールのエラーと合わせて包んで返す
+var (
+	// /dev/net/tunが無いか、tunモジュールが読み込まれていない
+	ErrTunNotAvailable = errors.New("tun device not available")
+	// デバイスの作成に必要な権限（rootかCAP_NET_ADMIN）が無い
+	ErrPermissionDenied = errors.New("insufficient privileges for tun/tap device")
 )
 
+// デバイスの動作モード
+type Mode int
+
+const (
+	ModeTUN Mode = iota // L3：IPパケットを送受信する
+	ModeTAP             // L2：Ethernetフレームを送受信する
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeTUN:
+		return "tun"
+	case ModeTAP:
+		return "tap"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// 送受信するパケット
+//
+// ReadPacket/ReadContextが返すパケットのBufはデバイスのバッファプールから
+// 借りたものである。処理を終えたらReleaseで返却すると、読み込みのたびの割り当てを省ける。
+// Releaseを呼んだ後はBufとそこから切り出したスライスを参照してはならない。
+// 処理後も内容を保持したい場合はReleaseの前にコピーする。
+// Releaseを呼ばなくてもバッファはGCで回収されるため、正しさには影響しない。
+// WritePacketに渡したパケットの所有権はデバイスに移り、書き込み後（フックで破棄・置き換えた場合も）に
+// デバイスが返却する
+//
+// このパッケージが作るパケットは常にlen(Buf) == int(N)を満たす。
+// Bufを作り直した場合はNも合わせるか、Nを0にしてlen(Buf)を使わせる
 type Packet struct {
 	Buf []byte
 	N   uintptr
+	// WithPacketInfoの場合のtun_piのproto（ETHERTYPE_IPV4など）
+	// 書き込み時に0の場合はIPのバージョンから補完する
+	EtherType uint16
+	// パケットが読み込みバッファ（WithPacketSize）より大きく、末尾が切り詰められた
+	Truncated bool
+	// 受信した時刻。fdがソケットでSO_TIMESTAMPNSを使える場合はカーネルが受信した時刻（壁時計）、
+	// 使えない場合（TUN/TAPのfdなど）は読み込みのシステムコールから戻った直後の時刻
+	// 書き込むパケットでは使わない
+	Timestamp time.Time
+
+	pool *bufferPool
+	ref  *poolBuf
+	gen  uint32 // 借りた時のrefの世代
+}
+
+// パケットの長さを返す
+// Nが0の場合はlen(Buf)を、Bufより長い場合もBufの範囲に収まる長さを返す
+func (p Packet) Len() int {
+	if p.N == 0 || p.N > uintptr(len(p.Buf)) {
+		return len(p.Buf)
+	}
+	return int(p.N)
+}
+
+// BufとNをLenの長さに揃える
+// 書き込み前とフックで置き換えた後に呼び、以降はBuf[:N]を安全に使えるようにする
+func (p *Packet) normalize() {
+	n := p.Len()
+	p.Buf = p.Buf[:n]
+	p.N = uintptr(n)
+}
+
+// バッファをデバイスのプールに返却する
+// プールから借りていないパケットや、返却済みのパケットでは何もしない
+// 返却は借りたバッファごとに1度だけ行うため、同じパケットのコピー（WritePacketに渡したものなど）から
+// 呼んでも、バッファが二重に返却されて別のパケットと共有されることは無い
+func (p *Packet) Release() {
+	if p.pool == nil {
+		return
+	}
+	p.pool.put(p.ref, p.gen)
+	p.pool = nil
+	p.ref = nil
+	p.Buf = nil
+	p.N = 0
 }
 
 type NetDevice struct {
-	file          *os.File
-	incomingQueue chan Packet
-	outgoingQueue chan Packet
-	ctx           context.Context
-	cancel        context.CancelFunc
+	// パケットを読み書きする相手。TUN/TAPではfileと同じで、NewPipePairでは対向のデバイスにつながる
+	conn io.ReadWriteCloser
+	file *os.File
+	raw  syscall.RawConn
+	// 受信キューと送信キュー。ResizeQueuesで入れ替えるため、queueMuを取って読み出す
+	queueMu    sync.Mutex
+	queues     *packetQueues
+	ctx        context.Context
+	cancel     context.CancelFunc
+	packetSize int
+	buffers    *bufferPool
+	readBatch  int
+	packetInfo bool
+	// recvmmsgが使えない（fdがソケットでない）と分かった後はreadを使う
+	noRecvmmsg atomic.Bool
+	noSendmmsg atomic.Bool
+	// SO_TIMESTAMPNSを有効にできたか
+	timestampOnce sync.Once
+	timestamps    atomic.Bool
+	offloads      atomic.Uint32
+	icmpLimit     *tokenBucket
+	mssClamp      atomic.Uint32 // Forwardで書き換えるMSSの上限。0は書き換えない
+	stats         deviceStats
+	logger        Logger
+	capture       atomic.Pointer[pcapWriter]
+	captureMu     sync.Mutex
+	ingressHook   atomic.Pointer[Hook]
+	egressHook    atomic.Pointer[Hook]
+	// SetHardwareAddrでアドレスを更新するARPの応答器
+	arpMu         sync.Mutex
+	arpResponders []*ARPResponder
+	subsMu        sync.RWMutex
+	subs          map[*subscriber]struct{}
+	subsClosed    bool
+	maxReadErrors int
+	overflow      OverflowPolicy
+	name          string
+	mode          Mode
+	readDeadline  deadline
+	writeDeadline deadline
+	readers       sync.WaitGroup
+	injectMu      sync.RWMutex // 受信キューを閉じる間、injectを止める
+	bindOnce      sync.Once
+	bound         atomic.Bool // Bindが呼ばれた。ReadIntoは使えない
+	// CloseWithFlushの後は書き込みを受け付けず、送信のゴルーチンは送信キューを書き出してflushedを閉じる
+	closing   atomic.Bool
+	flushOnce sync.Once
+	flushing  chan struct{}
+	flushed   chan struct{}
+	// 送受信のゴルーチンを止めた原因。Closeの場合はErrDeviceClosed
+	errMu sync.Mutex
+	err   error
 }
 
-func NewTun() (*NetDevice, error) {
-	// os.OpenFileはnameに/dev/net/tunを指定して、TUNデバイスを開く
-	// flagにos.O_RDWRを指定して、読み書き権限許可、permに0を指定しファイルの新規作成を許可
-	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
-	if err != nil {
-		return nil, fmt.Errorf("open error: %s", err.Error())
+var _ io.ReadWriteCloser = (*NetDevice)(nil)
+
+// TUNデバイスを作成する
+func NewTun(opts ...Option) (*NetDevice, error) {
+	return newDevice(ModeTUN, opts)
+}
+
+// TAPデバイスを作成する
+func NewTap(opts ...Option) (*NetDevice, error) {
+	return newDevice(ModeTAP, opts)
+}
+
+// connを読み書きするデバイスを作成する
+func newNetDevice(conn io.ReadWriteCloser, name string, mode Mode, cfg config) *NetDevice {
+	// 切り詰めを検出するために1バイト余分に確保する
+	bufSize := cfg.packetSize + 1
+	if cfg.packetInfo {
+		bufSize += TUN_PI_LEN
 	}
-	// ifreq：ネットワークインターフェースの設定を行うための構造体
-	ifr := ifreq{}
-	copy(ifr.ifrName[:], []byte("tun0"))
-	// IFF_TUN：TUNデバイスを作成するフラグ, IFF_NO_PI：パケット情報を含まないフラグ
-	ifr.ifrFlags = IFF_TUN | IFF_NO_PI
-	// syscall.SYS_IOCTLでTUNSETIFFシステムコールを呼び出し、TUNデバイスを作成
-	_, _, sysErr := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
-	if sysErr != 0 {
-		return nil, fmt.Errorf("ioctl error: %s", sysErr.Error())
+	// context.WithCancel を使って新しいコンテキストを作成し、
+	// Bind前のRead/Write/Closeでもキャンセルを扱えるようにする
+	ctx, cancel := context.WithCancel(context.Background())
+	return &NetDevice{
+		conn:          conn,
+		ctx:           ctx,
+		cancel:        cancel,
+		queues:        newPacketQueues(make(chan Packet, cfg.queueSize), make(chan Packet, cfg.queueSize)),
+		packetSize:    cfg.packetSize,
+		buffers:       newBufferPool(bufSize),
+		packetInfo:    cfg.packetInfo,
+		readBatch:     cfg.readBatch,
+		logger:        cfg.logger,
+		maxReadErrors: cfg.maxReadErrors,
+		overflow:      cfg.overflow,
+		icmpLimit:     newTokenBucket(ICMP_RATE_LIMIT),
+		name:          name,
+		mode:          mode,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		flushing:      make(chan struct{}),
+		flushed:       make(chan struct{}),
 	}
+}
 
-	return &NetDevice{
-		file:          file,
-		incomingQueue: make(chan Packet, QUEUE_SIZE),
-		outgoingQueue: make(chan Packet, QUEUE_SIZE),
-	}, nil
+// デバイスの動作モードを返す
+// ModeTAPの場合、パケットはEthernetヘッダから始まる
+func (t *NetDevice) Mode() Mode {
+	return t.mode
+}
+
+// カーネルが割り当てたインターフェース名を返す
+func (t *NetDevice) Name() string {
+	return t.name
+}
+
+// デバイスのファイル記述子を返す。NewPipePairのデバイスでは^uintptr(0)を返す
+// File.Fdと違いfdをブロッキングに戻さないため、Bind後もデバイスの読み書きは止まらない。
+// ただしBindの読み書きのゴルーチンが動いている間にfdを直接読み書きするとパケットを奪い合うため、
+// 独自のepollループなどでfdを扱う場合はBindを呼ばないこと。fdはCloseで閉じられる
+func (t *NetDevice) Fd() uintptr {
+	fd := ^uintptr(0)
+	t.control(func(f uintptr) error {
+		fd = f
+		return nil
+	})
+	return fd
+}
+
+// デバイスの*os.Fileを返す。NewPipePairのデバイスではnilを返す
+// Fdと同じく、Bindしている間に読み書きしてはならない。
+// File.Fdを呼ぶとfdがブロッキングに戻り、Closeで読み込みのゴルーチンを止められなくなるため、
+// fdが必要な場合はFdを使う
+func (t *NetDevice) File() *os.File {
+	return t.file
 }
 
+// fdに対する操作を行う
+// File.Fdはfdをブロッキングに戻してしまうため、fdが必要な場合はこれを使う
+func (t *NetDevice) control(f func(fd uintptr) error) error {
+	if t.raw == nil {
+		return fmt.Errorf("control error: not supported on %s", t.name)
+	}
+	var opErr error
+	if err := t.raw.Control(func(fd uintptr) { opErr = f(fd) }); err != nil {
+		return fmt.Errorf("control error: %s", err.Error())
+	}
+	return opErr
+}
+
+// ファイルを閉じ、送受信のゴルーチンを停止する
+// SetPersist(true)の場合、インターフェースはカーネル上に残る
+// 受信キューは読み込みのゴルーチンが終了した後に閉じられる
 func (t *NetDevice) Close() error {
-	err := t.file.Close()
+	// 先にキャンセルして、読み込みのゴルーチンが閉じたファイルを読み続けないようにする
+	t.fail(ErrDeviceClosed)
+	t.StopCapture()
+	err := t.conn.Close()
 	if err != nil {
 		return fmt.Errorf("close error: %s", err.Error())
 	}
-	t.cancel()
 
 	return nil
 }
 
+// 送信キューに残るパケットを書き出してから閉じる
+// 呼び出した後の書き込みはErrDeviceClosedを返す。timeoutまでに書き出せなかった
+// パケットは破棄してTxDropsに数え、その数を含むエラーを返す
+func (t *NetDevice) CloseWithFlush(timeout time.Duration) error {
+	t.closing.Store(true)
+	t.flushOnce.Do(func() { close(t.flushing) })
+	// Bindしていなければ送信のゴルーチンが無いため、ここで書き出す（以後のBindは何もしない）
+	t.bindOnce.Do(func() {
+		go func() {
+			t.drainOutgoing()
+			close(t.flushed)
+		}()
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.flushed:
+	case <-t.ctx.Done():
+	case <-timer.C:
+	}
+	// キャンセルした後は送信のゴルーチンがキューを読まないため、残った数をそのまま数えられる
+	t.cancel()
+	q := t.acquireQueues()
+	dropped := len(q.outgoing)
+	q.release()
+	t.stats.txDrops.Add(uint64(dropped))
+	if err := t.Close(); err != nil {
+		return err
+	}
+	if dropped > 0 {
+		return fmt.Errorf("flush error: %d packets dropped: %w", dropped, os.ErrDeadlineExceeded)
+	}
+	return nil
+}
+
+// 送信キューが空になるまでまとめて書き込む
+func (t *NetDevice) drainOutgoing() {
+	for t.ctx.Err() == nil {
+		q := t.acquireQueues()
+		batch := drainBatch(q.outgoing, make([]Packet, 0, MAX_BATCH_SIZE))
+		q.release()
+		if len(batch) == 0 {
+			return
+		}
+		t.writePackets(batch)
+	}
+}
+
+// キューに溜まっている分をbatchに加える（最大MAX_BATCH_SIZE個）
+func drainBatch(queue chan Packet, batch []Packet) []Packet {
+	for len(batch) < MAX_BATCH_SIZE {
+		select {
+		case pkt := <-queue:
+			batch = append(batch, pkt)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// 送受信のゴルーチンが止まると閉じられるチャネルを返す
+// 原因はErrで取得できる。停止した後もCloseを呼んでファイルを閉じる必要がある
+func (t *NetDevice) Done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+// 送受信のゴルーチンを止めた原因を返す。動作中はnilを返す
+// Closeで閉じた場合はErrDeviceClosedを、読み込みに失敗し続けた場合や
+// ファイルが外部で閉じられた場合はその原因のエラーを返す
+func (t *NetDevice) Err() error {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return t.err
+}
+
+// errを原因として送受信のゴルーチンを止める。2回目以降の原因は無視する
+func (t *NetDevice) fail(err error) {
+	t.errMu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.errMu.Unlock()
+	t.cancel()
+}
+
 // パケットの送受信
+// os.Fileの読み書きはランタイムのポーラーでfdが準備できるまで待つ
 func (t *NetDevice) read(buf []byte) (uintptr, error) {
-	n, _, sysErr := syscall.Syscall(syscall.SYS_READ, t.file.Fd(), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
-	if sysErr != 0 {
-		return 0, fmt.Errorf("read error: %s", sysErr.Error())
+	n, err := t.conn.Read(buf)
+	if err != nil {
+		return 0, fmt.Errorf("read error: %w", err)
 	}
-	return n, nil
+	return uintptr(n), nil
 }
 
 func (t *NetDevice) write(buf []byte) (uintptr, error) {
-	n, _, sysErr := syscall.Syscall(syscall.SYS_WRITE, t.file.Fd(), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
-	if sysErr != 0 {
-		return 0, fmt.Errorf("write error: %s", sysErr.Error())
+	n, err := t.conn.Write(buf)
+	if err != nil {
+		return 0, fmt.Errorf("write error: %w", err)
 	}
-	return n, nil
+	return uintptr(n), nil
 }
 
 // パケットのキュースタック
+// 2回目以降の呼び出しは何もしない
+// Bind前に書き込んだパケットは送信キューに溜まり、Bind後に送信される
 func (tun *NetDevice) Bind() {
-	// context.WithCancel を使って新しいコンテキストを作成し、
-	// そのコンテキストとキャンセル関数をフィールドに割り当てる
-	tun.ctx, tun.cancel = context.WithCancel(context.Background())
+	tun.bindOnce.Do(tun.bind)
+}
+
+func (tun *NetDevice) bind() {
+	tun.bound.Store(true)
 	// 別のゴルーチンでパケットの読み込みループを開始
+	tun.readers.Add(1)
 	go func() {
+		defer tun.readers.Done()
+		errCount := 0
 		for {
 			select {
 			case <-tun.ctx.Done():
 				return
 			default:
-				buf := make([]byte, PACKET_SIZE)
-				n, err := tun.read(buf)
+				pkts, err := tun.readPackets()
 				if err != nil {
-					log.Printf("read error: %s", err.Error())
+					if tun.ctx.Err() != nil {
+						return
+					}
+					// Closeを経ずにファイルが閉じられた場合は読み込みを続けられない
+					if errors.Is(err, os.ErrClosed) {
+						tun.logger.Errorf("read error: %s", err.Error())
+						tun.fail(err)
+						return
+					}
+					tun.logger.Errorf("read error: %s", err.Error())
+					// 失敗したパケットはキューに入れない
+					tun.stats.rxDrops.Add(1)
+					errCount++
+					if tun.maxReadErrors > 0 && errCount >= tun.maxReadErrors {
+						tun.logger.Errorf("too many read errors, closing device")
+						tun.fail(fmt.Errorf("too many read errors: %w", err))
+						return
+					}
+					continue
 				}
-				packet := Packet{
-					Buf: buf[:n],
-					N:   n,
+				errCount = 0
+				if !tun.deliver(pkts) {
+					return
 				}
-				tun.incomingQueue <- packet
 			}
 		}
 	}()
 
+	// 読み込みのゴルーチンが終了してから受信キューを閉じる
+	go func() {
+		tun.readers.Wait()
+		// 読み込みはキャンセルの後に終わるため、以降にResizeQueuesがキューを入れ替えることは無い
+		// ReplaySourceが投入している途中のパケットを入れ終えるまで待つ
+		tun.injectMu.Lock()
+		tun.queueMu.Lock()
+		close(tun.queues.incoming)
+		tun.queueMu.Unlock()
+		tun.injectMu.Unlock()
+		tun.closeSubscribers()
+	}()
+
 	go func() {
 		for {
+			q := tun.acquireQueues()
 			select {
 			case <-tun.ctx.Done():
+				q.release()
 				return
 
-			case pkt := <-tun.outgoingQueue:
-				_, err := tun.write(pkt.Buf[:pkt.N])
-				if err != nil {
-					log.Printf("write error: %s", err.Error())
-				}
+			case <-tun.flushing:
+				q.release()
+				tun.drainOutgoing()
+				close(tun.flushed)
+				return
+
+			case <-q.resized:
+				q.release()
+
+			case pkt := <-q.outgoing:
+				// キューに溜まっている分をまとめて1回のシステムコールで書き込む
+				batch := drainBatch(q.outgoing, append(make([]Packet, 0, MAX_BATCH_SIZE), pkt))
+				q.release()
+				tun.writePackets(batch)
 			}
 		}
 	}()
 }
 
+// 読み込んだパケットを統計とキャプチャに反映し、受信のフックを適用して受信キューに入れる
+// デバイスが閉じられた場合は残りのパケットを返却してfalseを返す
+func (t *NetDevice) deliver(pkts []Packet) bool {
+	pkts = t.dropRunts(pkts)
+	for _, packet := range pkts {
+		t.stats.received(packet, t.mode)
+		t.captured(packet.Buf[:packet.Len()])
+	}
+	for i, packet := range pkts {
+		packet, ok := t.ingress(packet)
+		if !ok {
+			continue
+		}
+		t.fanOut(packet)
+		if !t.enqueue(packet) {
+			for j := i + 1; j < len(pkts); j++ {
+				pkts[j].Release()
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// カーネルから読み込んだものとしてパケットを受信の経路に入れる
+// 受信キューを閉じた後（Closeの後）はパケットを返却してfalseを返す
+func (t *NetDevice) inject(pkt Packet) bool {
+	t.injectMu.RLock()
+	defer t.injectMu.RUnlock()
+	if t.ctx.Err() != nil {
+		pkt.Release()
+		return false
+	}
+	return t.deliver([]Packet{pkt})
+}
+
+// 最小のヘッダより短いパケットを取り除き、RxRuntに数える
+// TUNではIPv4ヘッダ、TAPではEthernetヘッダの長さに満たないものは解析できない
+func (t *NetDevice) dropRunts(pkts []Packet) []Packet {
+	min := IPV4_MIN_HEADER_LEN
+	if t.mode == ModeTAP {
+		min = ETHERNET_HEADER_LEN
+	}
+	kept := pkts[:0]
+	for _, pkt := range pkts {
+		if pkt.Len() < min {
+			t.stats.rxRunt.Add(1)
+			pkt.Release()
+			continue
+		}
+		kept = append(kept, pkt)
+	}
+	return kept
+}
+
+// 読み込んだパケットを受信キューに入れる
+// キューが一杯の場合はoverflowに従う。デバイスが閉じられた場合はパケットを返却してfalseを返す
+func (t *NetDevice) enqueue(pkt Packet) bool {
+	for {
+		q := t.acquireQueues()
+		ok, resized := t.enqueueTo(q, pkt)
+		q.release()
+		if !resized {
+			return ok
+		}
+	}
+}
+
+// qの受信キューにパケットを入れる。ResizeQueuesで待機を起こされた場合はresizedがtrueになる
+func (t *NetDevice) enqueueTo(q *packetQueues, pkt Packet) (ok, resized bool) {
+	switch t.overflow {
+	case DropNewest:
+		select {
+		case q.incoming <- pkt:
+		default:
+			pkt.Release()
+			t.stats.rxDrops.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.incoming <- pkt:
+				return true, false
+			default:
+			}
+			select {
+			case old := <-q.incoming:
+				old.Release()
+			default:
+				// バッファ数0のキューでは受け取る相手がいなければ破棄する
+				if cap(q.incoming) == 0 {
+					pkt.Release()
+					t.stats.rxDrops.Add(1)
+					return true, false
+				}
+				continue
+			}
+			t.stats.rxDrops.Add(1)
+		}
+	default:
+		select {
+		case q.incoming <- pkt:
+		case <-q.resized:
+			return false, true
+		case <-t.ctx.Done():
+			pkt.Release()
+			return false, false
+		}
+	}
+	return true, false
+}
+
 // パケットを読み込む
-func (t *NetDevice) Read() (Packet, error) {
-	pkt, ok := <-t.incomingQueue
-	if !ok {
-		return Packet{}, fmt.Errorf("incoming queue is closed")
+// 返されたパケットは処理後にReleaseで返却できる
+func (t *NetDevice) ReadPacket() (Packet, error) {
+	return t.ReadContext(context.Background())
+}
+
+// パケットを読み込む
+// ctxがキャンセルされた場合はctx.Err()を、デバイスが閉じられた場合はErrDeviceClosedを返す
+func (t *NetDevice) ReadContext(ctx context.Context) (Packet, error) {
+	for {
+		q := t.acquireQueues()
+		select {
+		case pkt, ok := <-q.incoming:
+			q.release()
+			if !ok {
+				return Packet{}, ErrDeviceClosed
+			}
+			return pkt, nil
+		case <-q.resized:
+			q.release()
+		case <-ctx.Done():
+			q.release()
+			return Packet{}, ctx.Err()
+		case <-t.ctx.Done():
+			q.release()
+			return Packet{}, ErrDeviceClosed
+		case <-t.readDeadline.wait():
+			q.release()
+			return Packet{}, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// 最大max個のパケットを読み込む
+// 最初の1個が届くまではReadContextと同様に待ち、その後は受信キューに溜まっている分だけを取り出す
+func (t *NetDevice) ReadBatch(max int) ([]Packet, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("invalid batch size: %d", max)
+	}
+	pkt, err := t.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	pkts := make([]Packet, 1, max)
+	pkts[0] = pkt
+	q := t.acquireQueues()
+	defer q.release()
+	for len(pkts) < max {
+		select {
+		case pkt, ok := <-q.incoming:
+			if !ok {
+				return pkts, nil
+			}
+			pkts = append(pkts, pkt)
+		default:
+			return pkts, nil
+		}
 	}
-	return pkt, nil
+	return pkts, nil
 }
 
 // パケットを書き込む
-func (t *NetDevice) Write(pkt Packet) error {
-	select {
-	case t.outgoingQueue <- pkt:
+// プールから借りたパケットの所有権はデバイスに移り、送信後（フックで破棄・置き換えた場合も）にデバイスが返却する。
+// 呼び出し後はBufを参照してはならない。Releaseを呼んでも返却済みであれば何もしない
+func (t *NetDevice) WritePacket(pkt Packet) error {
+	return t.writePacket(pkt, nil)
+}
+
+// 組み立てたパケットのバイト列をPacketに包んで書き込む。WritePacketと同じく閉じた後はErrDeviceClosedを返す
+// Writeと違いコピーしないため、bの所有権はデバイスに移り、呼び出し後に書き換えてはならない
+func (t *NetDevice) WriteBytes(b []byte) error {
+	return t.writePacket(bytesPacket(b), nil)
+}
+
+// パケットを書き込む
+// cancelが閉じられた場合は上位層の書き込み期限切れとしてos.ErrDeadlineExceededを返す
+// Closeと並行に呼ばれても安全なように送信キューは閉じず、閉じたかどうかはctxで判断する
+// selectはキャンセルの後でもキューに空きがあれば送信を選びうるため、先にctxを確認する
+func (t *NetDevice) writePacket(pkt Packet, cancel <-chan struct{}) error {
+	if t.closing.Load() || t.ctx.Err() != nil {
+		return ErrDeviceClosed
+	}
+	pkt, ok := t.egress(pkt)
+	if !ok {
 		return nil
-	case <-t.ctx.Done():
-		return fmt.Errorf("device closed")
 	}
+	pkt.normalize()
+	for {
+		q := t.acquireQueues()
+		select {
+		case q.outgoing <- pkt:
+			q.release()
+			return nil
+		case <-q.resized:
+			q.release()
+		case <-t.ctx.Done():
+			q.release()
+			return ErrDeviceClosed
+		case <-t.writeDeadline.wait():
+			q.release()
+			return os.ErrDeadlineExceeded
+		case <-cancel:
+			q.release()
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// 複数のパケットを順番に書き込む
+// 送信のゴルーチンはキューに溜まったパケットをsendmmsgでまとめて書き込む
+func (t *NetDevice) WriteBatch(pkts []Packet) error {
+	for _, pkt := range pkts {
+		if err := t.writePacket(pkt, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// io.Readerの実装
+// パケットを1つ取り出してpにコピーする。pに収まらない場合はio.ErrShortBufferを返す
+func (t *NetDevice) Read(p []byte) (int, error) {
+	pkt, err := t.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+	defer pkt.Release()
+	n := copy(p, pkt.Buf[:pkt.Len()])
+	if n < pkt.Len() {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// fdからpに直接パケットを1つ読み込み、バイト数を返す
+// 受信キューと読み込みのゴルーチンを経由しないため、自身でバッファを管理する単一のゴルーチンから
+// 低い遅延で読み込む場合に使う。Bindとは併用できず、Bindした後はエラーを返す
+// （Bindする前に呼んだ後でBindした場合、両者がパケットを奪い合う）
+// 統計とキャプチャには反映するが、受信のフックとSubscribeは適用しない。読み込みの期限も使わない
+// pはパケットの最大長（WithPacketInfoの場合はtun_piの4バイトを加えた長さ）以上にする。
+// 短い場合、カーネルは収まらない部分を捨てて切り詰めたパケットを返す
+// 最小のヘッダ長に満たないパケットは読み飛ばす。Closeで読み込みは中断され、ErrDeviceClosedを返す
+func (t *NetDevice) ReadInto(p []byte) (int, error) {
+	if t.bound.Load() {
+		return 0, fmt.Errorf("read error: ReadInto cannot be used after Bind")
+	}
+	for {
+		if t.ctx.Err() != nil {
+			return 0, ErrDeviceClosed
+		}
+		n, err := t.read(p)
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return 0, ErrDeviceClosed
+			}
+			return 0, err
+		}
+		pkt := Packet{Buf: p, N: n}
+		if t.packetInfo {
+			if n < TUN_PI_LEN {
+				return 0, fmt.Errorf("read error: packet info too short (%d bytes)", n)
+			}
+			// tun_piを取り除いて先頭に詰める
+			pkt.N = uintptr(copy(p, p[TUN_PI_LEN:n]))
+		}
+		if len(t.dropRunts([]Packet{pkt})) == 0 {
+			continue
+		}
+		t.stats.received(pkt, t.mode)
+		t.captured(p[:pkt.Len()])
+		return pkt.Len(), nil
+	}
+}
+
+// io.Writerの実装
+// pを1つのパケットとして書き込む。pは呼び出し後に再利用できるようコピーされる
+func (t *NetDevice) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	if err := t.WriteBytes(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 読み込みの期限を設定する。ゼロ値の場合は期限を解除する
+// 期限を過ぎるとRead/ReadPacket/ReadContextはTimeout()がtrueのnet.Errorを返す
+func (t *NetDevice) SetReadDeadline(tm time.Time) error {
+	t.readDeadline.set(tm)
+	return nil
+}
+
+// 書き込みの期限を設定する。ゼロ値の場合は期限を解除する
+// 期限を過ぎるとWrite/WritePacketはTimeout()がtrueのnet.Errorを返す
+func (t *NetDevice) SetWriteDeadline(tm time.Time) error {
+	t.writeDeadline.set(tm)
+	return nil
+}
+
+// 読み書き両方の期限を設定する
+func (t *NetDevice) SetDeadline(tm time.Time) error {
+	t.readDeadline.set(tm)
+	t.writeDeadline.set(tm)
+	return nil
 }
@@ -0,0 +1,227 @@
+package network
+
+import (
+	"bytes"           // バイトスライスの操作
+	"encoding/binary" // アドレスファミリの変換
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // MACアドレスの表現
+	"os"              // ファイルの操作やプロセスの実行、環境変数の取得
+	"strconv"         // インターフェース番号の解析
+	"strings"         // インターフェース名の解析
+	"syscall"         // ファイル操作やプロセス管理、ネットワーク操作
+	"unsafe"          // 低レベルなメモリ操作を行う
+)
+
+// macOSのutunはカーネル制御ソケットとして作成する
+const (
+	AF_SYSTEM         = 32
+	AF_SYS_CONTROL    = 2
+	SYSPROTO_CONTROL  = 2
+	CTLIOCGINFO       = 0xc0644e03
+	UTUN_OPT_IFNAME   = 2
+	UTUN_CONTROL_NAME = "com.apple.net.utun_control"
+	// utunが各パケットの先頭に付けるアドレスファミリ（ネットワークバイトオーダー）の長さ
+	UTUN_AF_LEN = 4
+)
+
+// デバイスを開くのに使うシステムコール。config.sysで差し替えられる
+type deviceSys struct {
+	socket func(domain, typ, proto int) (int, error)
+	ioctl  func(fd, req, arg uintptr) error
+}
+
+var defaultDeviceSys = deviceSys{socket: syscall.Socket, ioctl: ioctl}
+
+// デバイスを開けなかった場合のヒント
+const (
+	permissionHint  = "run as root"
+	unavailableHint = "utun requires macOS 10.6 or later"
+)
+
+// カーネルのstruct ifreqと同じ32バイトになるようにパディングする
+type ifreq struct {
+	ifrName  [IFNAMSIZ]byte
+	ifrFlags int16
+	_        [14]byte
+}
+
+// カーネルのstruct ctl_info
+type ctlInfo struct {
+	ctlID   uint32
+	ctlName [96]byte
+}
+
+// カーネルのstruct sockaddr_ctl
+type sockaddrCtl struct {
+	scLen      uint8
+	scFamily   uint8
+	ssSysaddr  uint16
+	scID       uint32
+	scUnit     uint32
+	scReserved [5]uint32
+}
+
+func newDevice(mode Mode, opts []Option) (*NetDevice, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	// utunはL3のデバイスのみで、tun_piの代わりに常にアドレスファミリが付く
+	if mode != ModeTUN {
+		return nil, fmt.Errorf("invalid mode: %s (utun supports only tun)", mode)
+	}
+	if cfg.packetInfo {
+		return nil, fmt.Errorf("invalid option: packet info is not supported on utun")
+	}
+
+	sys := defaultDeviceSys
+	if cfg.sys != nil {
+		sys = *cfg.sys
+	}
+	fd, err := sys.socket(AF_SYSTEM, syscall.SOCK_DGRAM, SYSPROTO_CONTROL)
+	if err != nil {
+		return nil, openError(err)
+	}
+	syscall.CloseOnExec(fd)
+	// utunの制御IDを調べて接続すると、インターフェースが作成される
+	info := ctlInfo{}
+	copy(info.ctlName[:], UTUN_CONTROL_NAME)
+	if err := sys.ioctl(uintptr(fd), CTLIOCGINFO, uintptr(unsafe.Pointer(&info))); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	addr := sockaddrCtl{
+		scFamily:  AF_SYSTEM,
+		ssSysaddr: AF_SYS_CONTROL,
+		scID:      info.ctlID,
+		scUnit:    utunUnit(cfg.name),
+	}
+	addr.scLen = uint8(unsafe.Sizeof(addr))
+	if _, _, sysErr := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr)); sysErr != 0 {
+		syscall.Close(fd)
+		// rootでない場合はここでEPERMになる
+		return nil, openError(fmt.Errorf("connect error: %w", sysErr))
+	}
+	name, err := utunName(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Linuxと同じく非ブロッキングにしてランタイムのポーラー（kqueue）で待ち合わせる
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("open error: %s", err.Error())
+	}
+	file := os.NewFile(uintptr(fd), name)
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("open error: %s", err.Error())
+	}
+
+	dev := newNetDevice(&utunConn{file: file}, name, mode, cfg)
+	dev.file = file
+	dev.raw = raw
+	if cfg.mtu > 0 {
+		if err := dev.SetMTU(cfg.mtu); err != nil {
+			dev.cancel()
+			file.Close()
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+// WithNameの名前からutunのユニット番号を求める
+// utunNはN+1を指定する。utunで始まらない名前（既定のtun0など）は0としてカーネルに割り当てさせる
+func utunUnit(name string) uint32 {
+	n, err := strconv.ParseUint(strings.TrimPrefix(name, "utun"), 10, 31)
+	if !strings.HasPrefix(name, "utun") || err != nil {
+		return 0
+	}
+	return uint32(n) + 1
+}
+
+// カーネルが割り当てたインターフェース名を取得する
+func utunName(fd int) (string, error) {
+	var buf [IFNAMSIZ]byte
+	n := uint32(len(buf))
+	_, _, sysErr := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), SYSPROTO_CONTROL, UTUN_OPT_IFNAME,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if sysErr != 0 {
+		return "", fmt.Errorf("getsockopt error: %s", sysErr.Error())
+	}
+	if i := bytes.IndexByte(buf[:n], 0); i >= 0 {
+		n = uint32(i)
+	}
+	return string(buf[:n]), nil
+}
+
+// utunのソケットを読み書きし、先頭のアドレスファミリを取り除く・付け加える
+// 読み込みは読み込みのゴルーチンからのみ呼ばれるため、バッファを使い回す
+type utunConn struct {
+	file *os.File
+	rbuf []byte
+}
+
+func (c *utunConn) Read(buf []byte) (int, error) {
+	if len(c.rbuf) != len(buf)+UTUN_AF_LEN {
+		c.rbuf = make([]byte, len(buf)+UTUN_AF_LEN)
+	}
+	n, err := c.file.Read(c.rbuf)
+	if err != nil {
+		return 0, err
+	}
+	if n < UTUN_AF_LEN {
+		return 0, fmt.Errorf("invalid utun packet: too short (%d bytes)", n)
+	}
+	return copy(buf, c.rbuf[UTUN_AF_LEN:n]), nil
+}
+
+func (c *utunConn) Write(buf []byte) (int, error) {
+	af := uint32(syscall.AF_INET)
+	if len(buf) > 0 && buf[0]>>4 == IPV6_VERSION {
+		af = syscall.AF_INET6
+	}
+	b := make([]byte, UTUN_AF_LEN+len(buf))
+	binary.BigEndian.PutUint32(b, af)
+	copy(b[UTUN_AF_LEN:], buf)
+	n, err := c.file.Write(b)
+	if n >= UTUN_AF_LEN {
+		n -= UTUN_AF_LEN
+	} else {
+		n = 0
+	}
+	return n, err
+}
+
+func (c *utunConn) Close() error {
+	return c.file.Close()
+}
+
+// utunは1つのインターフェースを複数のソケットで共有できない
+func openMultiQueue(mode Mode, n int, opts []Option) ([]*NetDevice, error) {
+	return nil, fmt.Errorf("multi-queue error: not supported on utun")
+}
+
+// utunにはオフロードを通知する仕組みが無い
+func (t *NetDevice) EnableOffload(flags OffloadFlags) error {
+	if flags == 0 {
+		return nil
+	}
+	return fmt.Errorf("offload error: not supported on utun")
+}
+
+// utunはL3のデバイスで、MACアドレスを持たない
+func (t *NetDevice) SetHardwareAddr(mac net.HardwareAddr) error {
+	return fmt.Errorf("hardware address error: not supported on utun")
+}
+
+func (t *NetDevice) HardwareAddr() (net.HardwareAddr, error) {
+	return nil, fmt.Errorf("hardware address error: not supported on utun")
+}
+
+// utunには永続化の仕組みが無く、ソケットを閉じるとインターフェースは削除される
+func (t *NetDevice) SetPersist(persist bool) error {
+	return fmt.Errorf("persist error: not supported on utun")
+}
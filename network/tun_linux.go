@@ -0,0 +1,192 @@
+package network
+
+import (
+	"bytes"   // バイトスライスの操作
+	"fmt"     // 文字列の生成や出力、スキャン
+	"os"      // ファイルの操作やプロセスの実行、環境変数の取得
+	"syscall" // ファイル操作やプロセス管理、ネットワーク操作
+	"unsafe"  // 低レベルなメモリ操作を行う
+)
+
+const (
+	TUNSETIFF     = 0x400454ca
+	TUNSETPERSIST = 0x400454cb
+	TUNSETOFFLOAD = 0x400454d0
+	IFF_TUN       = 0x0001
+	IFF_TAP       = 0x0002
+	IFF_NO_PI     = 0x1000
+	// 同じ名前で開いたfdごとに別のキューを作るフラグ
+	IFF_MULTI_QUEUE = 0x0100
+)
+
+// デバイスを開けなかった場合のヒント
+const (
+	permissionHint  = "run as root or grant CAP_NET_ADMIN"
+	unavailableHint = "load the tun module with modprobe tun"
+)
+
+// デバイスを開くのに使うパスとシステムコール
+// 権限やTUNデバイスの無い環境でもopenDeviceの処理を確かめられるよう、config.sysで差し替えられる
+// （例えばos.Pipeのfdを返すopenと、ifreqに名前を書き込むだけのioctl）
+type deviceSys struct {
+	path  string
+	open  func(path string, mode int, perm uint32) (int, error)
+	ioctl func(fd, req, arg uintptr) error
+}
+
+var defaultDeviceSys = deviceSys{path: "/dev/net/tun", open: syscall.Open, ioctl: ioctl}
+
+// カーネルのstruct ifreqと同じ40バイトになるようにパディングする
+type ifreq struct {
+	ifrName  [IFNAMSIZ]byte
+	ifrFlags int16
+	_        [22]byte
+}
+
+func newDevice(mode Mode, opts []Option) (*NetDevice, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := openDevice(mode, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.mtu > 0 {
+		if err := dev.SetMTU(cfg.mtu); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	return dev, nil
+}
+
+// IFF_MULTI_QUEUEを付けて同じインターフェースをn回開き、キューごとのデバイスを返す
+// 2つ目以降は1つ目にカーネルが割り当てた名前で開く
+func openMultiQueue(mode Mode, n int, opts []Option) ([]*NetDevice, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	queues := make([]*NetDevice, 0, n)
+	closeAll := func() {
+		for _, q := range queues {
+			q.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		q, err := openDevice(mode, cfg, IFF_MULTI_QUEUE)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("queue %d: %w", i, err)
+		}
+		queues = append(queues, q)
+		cfg.name = q.name
+	}
+	if cfg.mtu > 0 {
+		if err := queues[0].SetMTU(cfg.mtu); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	return queues, nil
+}
+
+// /dev/net/tunを開き、cfg.nameのインターフェースにつないだデバイスを作成する
+// flagsはモードのフラグに加えてTUNSETIFFに渡す
+func openDevice(mode Mode, cfg config, flags int16) (*NetDevice, error) {
+	sys := defaultDeviceSys
+	if cfg.sys != nil {
+		sys = *cfg.sys
+	}
+	// /dev/net/tunを読み書き権限で開く
+	// os.Fileにする前にTUNSETIFFを済ませ、非ブロッキングにしてからランタイムのポーラーに登録する
+	fd, err := sys.open(sys.path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		// os.OpenFileと同じく、どのパスを開けなかったかをメッセージに含める
+		return nil, openError(&os.PathError{Op: "open", Path: sys.path, Err: err})
+	}
+	// ifreq：ネットワークインターフェースの設定を行うための構造体
+	ifr := ifreq{}
+	copy(ifr.ifrName[:IFNAMSIZ-1], []byte(cfg.name))
+	// IFF_TUN：TUNデバイスを作成するフラグ, IFF_TAP：TAPデバイスを作成するフラグ
+	// IFF_NO_PI：パケット情報を含まないフラグ
+	switch mode {
+	case ModeTUN:
+		ifr.ifrFlags = IFF_TUN
+	case ModeTAP:
+		ifr.ifrFlags = IFF_TAP
+	default:
+		syscall.Close(fd)
+		return nil, fmt.Errorf("invalid mode: %s", mode)
+	}
+	// WithPacketInfoの場合は各パケットの先頭に4バイトのtun_piが付く
+	if !cfg.packetInfo {
+		ifr.ifrFlags |= IFF_NO_PI
+	}
+	ifr.ifrFlags |= flags
+	// syscall.SYS_IOCTLでTUNSETIFFシステムコールを呼び出し、デバイスを作成
+	// CAP_NET_ADMINが無い場合はここでEPERMになる
+	if err := sys.ioctl(uintptr(fd), TUNSETIFF, uintptr(unsafe.Pointer(&ifr))); err != nil {
+		syscall.Close(fd)
+		return nil, openError(err)
+	}
+	// 非ブロッキングのfdから作ったos.Fileはepollベースのランタイムのポーラーで待ち合わせる
+	// 読み込みはゴルーチンをスレッドに固定せず、Closeで即座に中断される
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("open error: %s", err.Error())
+	}
+	file := os.NewFile(uintptr(fd), sys.path)
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("open error: %s", err.Error())
+	}
+
+	dev := newNetDevice(file, ifr.name(), mode, cfg)
+	dev.file = file
+	dev.raw = raw
+	return dev, nil
+}
+
+// ifrNameを最初のNULバイトまでで切り取る
+func (ifr *ifreq) name() string {
+	n := bytes.IndexByte(ifr.ifrName[:], 0)
+	if n < 0 {
+		n = len(ifr.ifrName)
+	}
+	return string(ifr.ifrName[:n])
+}
+
+// インターフェースの永続化を設定する
+// 有効にするとCloseでファイルを閉じてもカーネル上のインターフェースは削除されず、
+// プロセスの再起動後も同じ名前で開き直せる。削除するにはfalseを設定してからCloseする
+func (t *NetDevice) SetPersist(persist bool) error {
+	var arg uintptr
+	if persist {
+		arg = 1
+	}
+	return t.control(func(fd uintptr) error {
+		return ioctl(fd, TUNSETPERSIST, arg)
+	})
+}
+
+// カーネルにオフロードを通知する（TUNSETOFFLOAD）
+// TUN_F_CSUMを有効にするとカーネルはTCP/UDPのチェックサムを計算しないまま渡してくるため、
+// 以降は受信したセグメントのチェックサムを検証しない。書き込むパケットはvirtio_net_hdrが無いと
+// カーネルがチェックサムを検証して破棄するため、引き続き計算する
+// TSOとUFOはvirtio_net_hdrでセグメントの情報を受け渡す必要があり、対応していない
+func (t *NetDevice) EnableOffload(flags OffloadFlags) error {
+	if flags&^TUN_F_CSUM != 0 {
+		return fmt.Errorf("offload error: unsupported flags %s", flags&^TUN_F_CSUM)
+	}
+	err := t.control(func(fd uintptr) error {
+		return ioctl(fd, TUNSETOFFLOAD, uintptr(flags))
+	})
+	if err != nil {
+		return fmt.Errorf("offload error: %w", err)
+	}
+	t.offloads.Store(uint32(flags))
+	return nil
+}
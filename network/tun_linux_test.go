@@ -0,0 +1,119 @@
+package network
+
+import (
+	"bytes"   // MACアドレスの比較
+	"errors"  // エラーの判定
+	"net"     // MACアドレスとIPアドレスの表現
+	"strings" // メッセージの確認
+	"syscall" // 失敗させるエラー
+	"testing"
+)
+
+// openが常にerrで失敗するdeviceSys
+func failingOpenSys(path string, err error) *deviceSys {
+	return &deviceSys{
+		path:  path,
+		open:  func(path string, mode int, perm uint32) (int, error) { return -1, err },
+		ioctl: func(fd, req, arg uintptr) error { return nil },
+	}
+}
+
+// TUNデバイスが無い場合と権限が無い場合に、原因ごとのエラーと開こうとしたパスを返すこと
+func TestNewTunOpenErrors(t *testing.T) {
+	for _, tc := range []struct {
+		errno syscall.Errno
+		want  error
+	}{
+		{syscall.ENOENT, ErrTunNotAvailable},
+		{syscall.ENODEV, ErrTunNotAvailable},
+		{syscall.EPERM, ErrPermissionDenied},
+		{syscall.EACCES, ErrPermissionDenied},
+	} {
+		t.Run(tc.errno.Error(), func(t *testing.T) {
+			path := "/test/dev/net/tun"
+			_, err := NewTun(withSys(failingOpenSys(path, tc.errno)))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+			if !errors.Is(err, tc.errno) {
+				t.Fatalf("%v does not wrap %v", err, tc.errno)
+			}
+			if !strings.Contains(err.Error(), path) {
+				t.Fatalf("%q does not contain the path %s", err, path)
+			}
+		})
+	}
+
+	// どちらでもない原因はそのまま包む
+	_, err := NewTun(withSys(failingOpenSys("/test/tun", syscall.EMFILE)))
+	if !errors.Is(err, syscall.EMFILE) || errors.Is(err, ErrTunNotAvailable) || errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("got %v, want only EMFILE", err)
+	}
+}
+
+// TUNSETIFFが権限不足で失敗した場合はErrPermissionDeniedを返し、開いたfdを閉じること
+func TestNewTunIoctlPermission(t *testing.T) {
+	var peers []int
+	sys := socketPairSys(t, &peers)
+	var opened int
+	open := sys.open
+	sys.open = func(path string, mode int, perm uint32) (int, error) {
+		fd, err := open(path, mode, perm)
+		opened = fd
+		return fd, err
+	}
+	sys.ioctl = func(fd, req, arg uintptr) error { return syscall.EPERM }
+	if _, err := NewTun(withSys(sys)); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("got %v, want ErrPermissionDenied", err)
+	}
+	if _, err := syscall.Write(opened, []byte{0}); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("fd left open after the failed ioctl: %v", err)
+	}
+}
+
+// 設定したMACアドレスを取得でき、先に作ったARPResponderの応答にも使われること
+// TAPデバイスを作れない環境（/dev/net/tunが無い、CAP_NET_ADMINが無い）では飛ばす
+func TestTapHardwareAddrRoundTrip(t *testing.T) {
+	dev, err := NewTap(WithName("tcpiptest0"))
+	if errors.Is(err, ErrTunNotAvailable) || errors.Is(err, ErrPermissionDenied) {
+		t.Skipf("tap device not available: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	r, err := dev.NewARPResponder(net.IPv4(10, 0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.SetHardwareAddr(arpLocalMAC); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dev.HardwareAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, arpLocalMAC) {
+		t.Fatalf("hardware address %s, want %s", got, arpLocalMAC)
+	}
+	if !bytes.Equal(r.HardwareAddr(), arpLocalMAC) {
+		t.Fatalf("responder uses %s, want %s", r.HardwareAddr(), arpLocalMAC)
+	}
+	// 不正なアドレスは設定せず、元のアドレスのまま
+	if err := dev.SetHardwareAddr(net.HardwareAddr{0x01, 0, 0x5e, 0, 0, 1}); err == nil {
+		t.Fatal("set a multicast address")
+	}
+	if got, _ := dev.HardwareAddr(); !bytes.Equal(got, arpLocalMAC) {
+		t.Fatalf("hardware address changed to %s by a rejected set", got)
+	}
+
+	tun, err := NewTun(WithName("tcpiptest1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	if _, err := tun.HardwareAddr(); err == nil {
+		t.Fatal("tun device has a hardware address")
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !linux && !darwin
+
+package network
+
+import (
+	"net" // IPアドレスやネットマスクの表現
+)
+
+// LinuxとmacOS以外ではTUN/TAPデバイスを作成できず、ErrUnsupportedPlatformを返す
+// NewPipePairのデバイスやパケットの解析・組み立ては、どのプラットフォームでも使える
+
+// デバイスを開くシステムコールは無い
+type deviceSys struct{}
+
+func newDevice(mode Mode, opts []Option) (*NetDevice, error) {
+	if _, err := newConfig(opts); err != nil {
+		return nil, err
+	}
+	return nil, ErrUnsupportedPlatform
+}
+
+func openMultiQueue(mode Mode, n int, opts []Option) ([]*NetDevice, error) {
+	if _, err := newConfig(opts); err != nil {
+		return nil, err
+	}
+	return nil, ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) SetPersist(persist bool) error {
+	return ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) EnableOffload(flags OffloadFlags) error {
+	return ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) ConfigureIPv4(addr net.IP, mask net.IPMask) error {
+	return ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) SetMTU(mtu int) error {
+	return ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) GetMTU() (int, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) SetHardwareAddr(mac net.HardwareAddr) error {
+	return ErrUnsupportedPlatform
+}
+
+func (t *NetDevice) HardwareAddr() (net.HardwareAddr, error) {
+	return nil, ErrUnsupportedPlatform
+}
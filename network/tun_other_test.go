@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+
+package network
+
+import (
+	"errors" // エラーの判定
+	"testing"
+)
+
+// LinuxとmacOS以外ではTUN/TAPデバイスを作成できず、ErrUnsupportedPlatformを返すこと
+func TestNewTunUnsupported(t *testing.T) {
+	if _, err := NewTun(); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("NewTun got %v, want ErrUnsupportedPlatform", err)
+	}
+	if _, err := NewTap(); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("NewTap got %v, want ErrUnsupportedPlatform", err)
+	}
+	if _, err := NewTunMultiQueue(2); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("NewTunMultiQueue got %v, want ErrUnsupportedPlatform", err)
+	}
+	// 不正なオプションはプラットフォームより先に検証する
+	if _, err := NewTun(WithMTU(1)); err == nil || errors.Is(err, ErrUnsupportedPlatform) {
+		t.Fatalf("got %v, want the option error", err)
+	}
+}
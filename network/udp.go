@@ -0,0 +1,351 @@
+package network
+
+import (
+	"encoding/binary" // バイト列と数値の変換
+	"errors"          // エラーの生成
+	"fmt"             // 文字列の生成や出力、スキャン
+	"net"             // IPアドレスの表現
+	"net/netip"       // アドレスとポートの表現
+	"os"              // タイムアウトのエラー
+	"sync"            // 排他制御
+	"sync/atomic"     // マルチキャストの設定
+	"time"            // 期限の表現
+)
+
+const (
+	UDP_HEADER_LEN = 8
+	// マルチキャストのTTLの既定値。同じリンクにだけ届ける（RFC 1112）
+	UDP_DEFAULT_MULTICAST_TTL = 1
+)
+
+var ErrConnClosed = errors.New("connection closed")
+
+// UDPヘッダ
+type UDPHeader struct {
+	SrcPort  uint16
+	DstPort  uint16
+	Length   uint16
+	Checksum uint16
+}
+
+// UDPヘッダを解析し、ヘッダとペイロードを返す
+// チェックサムが0でない場合はipの送信元・宛先を使った疑似ヘッダで検証する
+func ParseUDP(b []byte, ip *IPv4Header) (*UDPHeader, []byte, error) {
+	return parseUDP(b, ip, true)
+}
+
+// verifyがfalseの場合はチェックサムを検証しない（チェックサムオフロードで未計算のまま届いた場合）
+func parseUDP(b []byte, ip *IPv4Header, verify bool) (*UDPHeader, []byte, error) {
+	if len(b) < UDP_HEADER_LEN {
+		return nil, nil, fmt.Errorf("invalid udp header: too short (%d bytes)", len(b))
+	}
+	h := &UDPHeader{
+		SrcPort:  binary.BigEndian.Uint16(b[0:2]),
+		DstPort:  binary.BigEndian.Uint16(b[2:4]),
+		Length:   binary.BigEndian.Uint16(b[4:6]),
+		Checksum: binary.BigEndian.Uint16(b[6:8]),
+	}
+	if int(h.Length) < UDP_HEADER_LEN || int(h.Length) > len(b) {
+		return nil, nil, fmt.Errorf("invalid udp header: length %d (packet %d bytes)", h.Length, len(b))
+	}
+	b = b[:h.Length]
+	if verify && h.Checksum != 0 && transportChecksum(ip.Src, ip.Dst, PROTOCOL_UDP, b) != 0 {
+		return nil, nil, fmt.Errorf("invalid udp header: %w", ErrBadChecksum)
+	}
+	return h, b[UDP_HEADER_LEN:], nil
+}
+
+// UDPヘッダにペイロードを続けたバイト列を返す
+// Lengthとチェックサムは再計算する
+func (h *UDPHeader) MarshalWithPayload(payload []byte, src, dst net.IP) ([]byte, error) {
+	length := UDP_HEADER_LEN + len(payload)
+	if length > 0xffff {
+		return nil, fmt.Errorf("invalid udp header: payload too long (%d bytes)", len(payload))
+	}
+	h.Length = uint16(length)
+
+	b := make([]byte, UDP_HEADER_LEN, length)
+	binary.BigEndian.PutUint16(b[0:2], h.SrcPort)
+	binary.BigEndian.PutUint16(b[2:4], h.DstPort)
+	binary.BigEndian.PutUint16(b[4:6], h.Length)
+	b = append(b, payload...)
+
+	h.Checksum = transportChecksum(src, dst, PROTOCOL_UDP, b)
+	// 計算結果が0の場合はチェックサム無しと区別するため0xffffを送る
+	if h.Checksum == 0 {
+		h.Checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:8], h.Checksum)
+	return b, nil
+}
+
+type datagram struct {
+	payload []byte
+	from    netip.AddrPort
+}
+
+// UDPの送受信を扱う
+// Stackから渡されたデータグラムを宛先ポートごとにUDPConnへ振り分ける
+type UDP struct {
+	dev    Device
+	logger Logger
+	ip     *ipv4Output
+	addr   netip.Addr
+	mu     sync.RWMutex
+	conns  map[uint16]*UDPConn
+	ports  *PortAllocator
+	// ポート到達不能の流量制限
+	icmpLimit *tokenBucket
+	// 参加しているマルチキャストのグループ。送信したマルチキャストを自身に折り返すかの判定に使う
+	groups *igmpGroups
+}
+
+func newUDP(dev Device, ip *ipv4Output, addr netip.Addr, ports *PortAllocator, icmpLimit *tokenBucket, groups *igmpGroups) *UDP {
+	return &UDP{
+		dev:       dev,
+		logger:    loggerOf(dev),
+		ip:        ip,
+		addr:      addr,
+		conns:     make(map[uint16]*UDPConn),
+		ports:     ports,
+		icmpLimit: icmpLimit,
+		groups:    groups,
+	}
+}
+
+// 受信したUDPデータグラムを宛先ポートのUDPConnに渡す
+// 待ち受けていないポート宛てにはICMPのポート到達不能を返す
+func (u *UDP) deliver(ip *IPv4Header, b []byte) {
+	h, payload, err := parseUDP(b, ip, !checksumOffloaded(u.dev))
+	if err != nil {
+		u.logger.Debugf("udp error: %s", err.Error())
+		return
+	}
+	u.mu.RLock()
+	c, ok := u.conns[h.DstPort]
+	u.mu.RUnlock()
+	if !ok {
+		// マルチキャスト宛てにはポート到達不能を返さない
+		if ip.Dst.IsMulticast() || !u.icmpLimit.allow() {
+			return
+		}
+		if reply, err := BuildDestUnreachable(ip, b, ICMP_CODE_PORT_UNREACHABLE); err == nil {
+			u.dev.WritePacket(reply)
+		}
+		return
+	}
+	src, _ := netip.AddrFromSlice(ip.Src.To4())
+	c.enqueue(datagram{
+		payload: append([]byte(nil), payload...),
+		from:    netip.AddrPortFrom(src, h.SrcPort),
+	})
+}
+
+// portで待ち受けるUDPConnを作成する。0の場合はエフェメラルポートを割り当てる
+func (u *UDP) Listen(port uint16) (*UDPConn, error) {
+	if port == 0 {
+		p, err := u.ports.Allocate(PROTOCOL_UDP)
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	} else if err := u.ports.Reserve(PROTOCOL_UDP, port); err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := &UDPConn{
+		udp:           u,
+		port:          port,
+		queue:         make(chan datagram, QUEUE_SIZE),
+		done:          make(chan struct{}),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+	c.multicastTTL.Store(UDP_DEFAULT_MULTICAST_TTL)
+	u.conns[port] = c
+	return c, nil
+}
+
+func (u *UDP) release(port uint16) {
+	u.mu.Lock()
+	delete(u.conns, port)
+	u.mu.Unlock()
+	u.ports.Release(PROTOCOL_UDP, port)
+}
+
+// ポートに紐付いたUDPの送受信口
+// net.PacketConnを実装する
+type UDPConn struct {
+	udp           *UDP
+	port          uint16
+	queue         chan datagram
+	done          chan struct{}
+	once          sync.Once
+	readDeadline  deadline
+	writeDeadline deadline
+	// マルチキャストを送信する時のTTLと、自身が参加しているグループ宛てを折り返さない場合はtrue
+	multicastTTL    atomic.Uint32
+	multicastNoLoop atomic.Bool
+	dontFragment    atomic.Bool
+}
+
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// 自身のアドレスとポートを返す
+func (c *UDPConn) LocalAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(c.udp.addr, c.port)
+}
+
+// 自身のアドレスを*net.UDPAddrで返す
+func (c *UDPConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.LocalAddrPort())
+}
+
+// 受信キューが一杯の場合、データグラムは破棄する
+func (c *UDPConn) enqueue(d datagram) {
+	select {
+	case <-c.done:
+	case c.queue <- d:
+	default:
+	}
+}
+
+// payloadをdstに送信する
+func (c *UDPConn) WriteToAddrPort(payload []byte, dst netip.AddrPort) error {
+	if !dst.Addr().Is4() {
+		return fmt.Errorf("invalid ipv4 address: %s", dst.Addr())
+	}
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	src := net.IP(c.udp.addr.AsSlice())
+	dstIP := net.IP(dst.Addr().AsSlice())
+
+	udp := UDPHeader{SrcPort: c.port, DstPort: dst.Port()}
+	seg, err := udp.MarshalWithPayload(payload, src, dstIP)
+	if err != nil {
+		return err
+	}
+	ip := IPv4Header{
+		Protocol: PROTOCOL_UDP,
+		Src:      src,
+		Dst:      dstIP,
+	}
+	if c.dontFragment.Load() {
+		ip.Flags = IPV4_FLAG_DF
+	}
+	// 自身宛てはデバイスを経由せずに受信側へ渡す
+	if dst.Addr() == c.udp.addr {
+		c.udp.deliver(&ip, seg)
+		return nil
+	}
+	if dst.Addr().IsMulticast() {
+		return c.writeMulticast(&ip, seg, dst.Addr())
+	}
+	return c.udp.ip.send(&ip, seg, c.writeDeadline.wait())
+}
+
+// マルチキャストのグループ宛てにSetMulticastTTLのTTLで送る
+// 自身が参加しているグループであれば、SetMulticastLoopbackで無効にしない限り自身の受信側にも渡す
+// TTLが0の場合はデバイスには送らず、自身への折り返しだけを行う
+func (c *UDPConn) writeMulticast(ip *IPv4Header, seg []byte, group netip.Addr) error {
+	ttl := uint8(c.multicastTTL.Load())
+	if !c.multicastNoLoop.Load() && c.udp.groups.isMember(group) {
+		loop := *ip
+		loop.TTL = ttl
+		c.udp.deliver(&loop, seg)
+	}
+	if ttl == 0 {
+		return nil
+	}
+	ip.TTL = ttl
+	return c.udp.ip.send(ip, seg, c.writeDeadline.wait())
+}
+
+// マルチキャストを送信する時のTTLを設定する。既定はUDP_DEFAULT_MULTICAST_TTL
+// 0の場合はデバイスに送らない
+func (c *UDPConn) SetMulticastTTL(ttl uint8) {
+	c.multicastTTL.Store(uint32(ttl))
+}
+
+// 自身が参加しているグループ宛てに送信したデータグラムを、自身にも届けるかを設定する。既定はtrue
+func (c *UDPConn) SetMulticastLoopback(enabled bool) {
+	c.multicastNoLoop.Store(!enabled)
+}
+
+// 送信するデータグラムにDFを立てるかを設定する。既定はfalse
+// 立てた場合、MTUを超えるデータグラムはフラグメントに分割せずにErrFragmentationNeededを返す
+func (c *UDPConn) SetDontFragment(enabled bool) {
+	c.dontFragment.Store(enabled)
+}
+
+// データグラムを1つ受信し、ペイロードと送信元を返す
+func (c *UDPConn) ReadFromAddrPort() ([]byte, netip.AddrPort, error) {
+	select {
+	case d := <-c.queue:
+		return d.payload, d.from, nil
+	case <-c.done:
+		return nil, netip.AddrPort{}, ErrConnClosed
+	case <-c.readDeadline.wait():
+		return nil, netip.AddrPort{}, os.ErrDeadlineExceeded
+	}
+}
+
+// net.PacketConnの実装
+// データグラムを1つ受信してpにコピーする。pに収まらない部分は切り捨てられる
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	payload, from, err := c.ReadFromAddrPort()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, payload), net.UDPAddrFromAddrPort(from), nil
+}
+
+// net.PacketConnの実装
+// addrは*net.UDPAddrである必要がある
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("invalid address type: %T", addr)
+	}
+	ip, ok := netip.AddrFromSlice(udpAddr.IP.To4())
+	if !ok {
+		return 0, fmt.Errorf("invalid ipv4 address: %s", udpAddr.IP)
+	}
+	if err := c.WriteToAddrPort(p, netip.AddrPortFrom(ip, uint16(udpAddr.Port))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 読み込みの期限を設定する。ゼロ値の場合は期限を解除する
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// 書き込みの期限を設定する。ゼロ値の場合は期限を解除する
+// 書き込みは送信キューに空きがあれば即座に完了するため、期限は送信キューが一杯の場合にのみ効く
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// 読み書き両方の期限を設定する
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// ポートを解放する。待機中のReadFromはErrConnClosedを返す
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.udp.release(c.port)
+	})
+	return nil
+}
@@ -0,0 +1,171 @@
+package network
+
+import (
+	"errors"    // エラーの判定
+	"net"       // net.PacketConnの実装
+	"net/netip" // アドレスとポートの表現
+	"os"        // タイムアウトのエラー
+	"testing"
+	"time" // 読み込みの期限
+)
+
+// 疑似ヘッダを使ってチェックサムを検証し、0のチェックサムは検証しないこと
+func TestParseUDP(t *testing.T) {
+	ip := &IPv4Header{Src: testLocal, Dst: testRemote}
+	h := UDPHeader{SrcPort: 40000, DstPort: 53}
+	seg, err := h.MarshalWithPayload([]byte("query"), ip.Src, ip.Dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, payload, err := ParseUDP(seg, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SrcPort != 40000 || got.DstPort != 53 || got.Length != 13 || string(payload) != "query" {
+		t.Fatalf("parsed %+v payload %q", got, payload)
+	}
+	// 宛先が異なれば疑似ヘッダの和も変わる
+	if _, _, err := ParseUDP(seg, &IPv4Header{Src: testLocal, Dst: net.IPv4(198, 51, 100, 2)}); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("wrong pseudo-header: got %v, want ErrBadChecksum", err)
+	}
+	bad := append([]byte(nil), seg...)
+	bad[len(bad)-1] ^= 0xff
+	if _, _, err := ParseUDP(bad, ip); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("corrupted payload: got %v, want ErrBadChecksum", err)
+	}
+	bad[6], bad[7] = 0, 0
+	if _, _, err := ParseUDP(bad, ip); err != nil {
+		t.Fatalf("zero checksum rejected: %s", err)
+	}
+	if _, _, err := ParseUDP(seg[:len(seg)-1], ip); err == nil {
+		t.Fatal("accepted length beyond the packet")
+	}
+}
+
+// 同じスタックの2つのポートの間でデータグラムをやりとりすること
+func TestUDPLoopback(t *testing.T) {
+	sa, _ := stackPair(t)
+	a, err := sa.ListenUDP(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := sa.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.LocalAddrPort().Port() < EPHEMERAL_PORT_MIN {
+		t.Fatalf("ephemeral port %d", b.LocalAddrPort().Port())
+	}
+	a.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if err := b.WriteToAddrPort([]byte("ping"), a.LocalAddrPort()); err != nil {
+		t.Fatal(err)
+	}
+	payload, from, err := a.ReadFromAddrPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "ping" || from != b.LocalAddrPort() {
+		t.Fatalf("got %q from %s, want ping from %s", payload, from, b.LocalAddrPort())
+	}
+	// net.PacketConnとして応答を返す
+	if _, err := a.WriteTo([]byte("pong"), net.UDPAddrFromAddrPort(from)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" || addr.String() != a.LocalAddrPort().String() {
+		t.Fatalf("got %q from %s", buf[:n], addr)
+	}
+}
+
+// 別のスタックのポートへ送ったデータグラムが送信元のアドレスとともに届くこと
+func TestUDPBetweenStacks(t *testing.T) {
+	sa, sb := stackPair(t)
+	a, err := sa.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := sb.ListenUDP(53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := a.WriteToAddrPort([]byte("query"), netip.MustParseAddrPort("10.0.0.2:53")); err != nil {
+		t.Fatal(err)
+	}
+	payload, from, err := b.ReadFromAddrPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), a.LocalAddrPort().Port())
+	if string(payload) != "query" || from != want {
+		t.Fatalf("got %q from %s, want query from %s", payload, from, want)
+	}
+
+	// 同じポートは二重に待ち受けられない
+	if _, err := sb.ListenUDP(53); err == nil {
+		t.Fatal("listened twice on port 53")
+	}
+}
+
+// 待ち受けていないポート宛てにはICMPのポート到達不能を返すこと
+func TestUDPPortUnreachable(t *testing.T) {
+	_, peer := rawPeer(t)
+	b := natUDP(t, rawPeerIP, rawStackIP, 40000, 9, "nobody")
+	if err := peer.WriteBytes(b); err != nil {
+		t.Fatal(err)
+	}
+	ip, msg := readICMP(t, peer)
+	if msg.Type != ICMP_TYPE_DEST_UNREACHABLE || msg.Code != ICMP_CODE_PORT_UNREACHABLE {
+		t.Fatalf("icmp type %d code %d, want 3/3", msg.Type, msg.Code)
+	}
+	if !ip.Dst.Equal(rawPeerIP) {
+		t.Fatalf("reply sent to %s", ip.Dst)
+	}
+	orig, payload, err := ParseICMPErrorOrigin(msg.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig.Protocol != PROTOCOL_UDP || len(payload) < 4 || payload[2] != 0 || payload[3] != 9 {
+		t.Fatalf("icmp quotes %+v %x", orig, payload)
+	}
+}
+
+// 読み込みの期限とCloseでReadFromが戻ること
+func TestUDPReadDeadlineAndClose(t *testing.T) {
+	sa, _ := stackPair(t)
+	c, err := sa.ListenUDP(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, _, err := c.ReadFromAddrPort(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Close()
+	}()
+	if _, _, err := c.ReadFromAddrPort(); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("got %v, want ErrConnClosed", err)
+	}
+	if err := c.WriteToAddrPort([]byte("x"), netip.MustParseAddrPort("10.0.0.2:53")); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("write after close: got %v, want ErrConnClosed", err)
+	}
+	// 閉じたポートは再び使える
+	c, err = sa.ListenUDP(5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// tun0の先にいる10.0.0.2としてHTTPサーバーを動かす
+// make tuntap でtun0を作成した後、make curl でアクセスできる
+func main() {
+	dev, err := network.NewTun(network.WithLogger(network.NewStdLogger(nil)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dev.Bind()
+
+	stack, err := network.NewStack(dev, netip.MustParseAddr("10.0.0.2"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := stack.ListenTCP(80)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello from tcp-ip-go! (%s)\n", r.RemoteAddr)
+	})
+	log.Fatal(http.Serve(l, nil))
+}
@@ -1,19 +1,43 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
 
 	"github.com/kawa1214/tcp-ip-go/network"
 )
 
 func main() {
-	network, _ := network.NewTun()
-	network.Bind()
+	dev, _ := network.NewTun(network.WithLogger(network.NewStdLogger(nil)))
+	dev.Bind()
 
 	for {
-		pkt, _ := network.Read()
-		fmt.Print(hex.Dump(pkt.Buf[:pkt.N]))
-		network.Write(pkt)
+		pkt, _ := dev.ReadPacket()
+		if layers, err := network.Decode(pkt); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(layers)
+		}
+
+		// ICMPエコー要求であれば応答を返す（ping 10.0.0.2）
+		if reply, ok := echoReply(pkt); ok {
+			dev.WritePacket(reply)
+		}
+		pkt.Release()
+	}
+}
+
+func echoReply(pkt network.Packet) (network.Packet, bool) {
+	ip, payload, err := network.ParseIPv4(pkt.Buf[:pkt.Len()])
+	if err != nil || ip.Protocol != network.PROTOCOL_ICMP {
+		return network.Packet{}, false
+	}
+	msg, err := network.ParseICMP(payload)
+	if err != nil || msg.Type != network.ICMP_TYPE_ECHO_REQUEST {
+		return network.Packet{}, false
+	}
+	reply, err := network.BuildEchoReply(*msg, ip)
+	if err != nil {
+		return network.Packet{}, false
 	}
+	return reply, true
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// tun0に届いたIPv4パケットのプロトコル番号を表示する
+// make tuntap でtun0を作成した後、ping 10.0.0.2 などでパケットを送る
+func main() {
+	dev, err := network.NewTun(network.WithLogger(network.NewStdLogger(nil)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dev.Bind()
+
+	conn := network.NewRawConn(dev)
+	for {
+		ip, payload, err := conn.ReadIP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s -> %s protocol %d (%d bytes)\n", ip.Src, ip.Dst, ip.Protocol, len(payload))
+	}
+}